@@ -1,9 +1,14 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"os"
+	"strconv"
+	"time"
+	// Embed the time zone database, the image doesn't include it
+	_ "time/tzdata"
 
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
@@ -14,9 +19,13 @@ import (
 
 	"github.com/labstack/echo/v4"
 	"github.com/xtommas/challenge-hetmo/internal/handlers"
+	"github.com/xtommas/challenge-hetmo/internal/jwtkeys"
+	"github.com/xtommas/challenge-hetmo/internal/mailer"
 	"github.com/xtommas/challenge-hetmo/internal/middleware"
 	"github.com/xtommas/challenge-hetmo/internal/models"
+	"github.com/xtommas/challenge-hetmo/internal/problem"
 	"github.com/xtommas/challenge-hetmo/internal/repositories"
+	"github.com/xtommas/challenge-hetmo/internal/sso"
 	"github.com/xtommas/challenge-hetmo/internal/validator"
 )
 
@@ -37,7 +46,7 @@ func runMigrations(dbUrl string, logger echo.Logger) {
 
 func createInitialAdminUser(db *sql.DB, logger echo.Logger) {
 	var count int
-	err := db.QueryRow("SELECT COUNT(*) FROM users WHERE is_admin = true").Scan(&count)
+	err := db.QueryRow("SELECT COUNT(*) FROM user_roles ur JOIN roles r ON r.id = ur.role_id WHERE r.name = $1", models.RoleAdmin).Scan(&count)
 	if err != nil {
 		logger.Fatal("Failed to check admin user existence:", err)
 	}
@@ -52,7 +61,7 @@ func createInitialAdminUser(db *sql.DB, logger echo.Logger) {
 		// Create the admin user
 		user := &models.User{
 			Username: adminUsername,
-			IsAdmin:  true,
+			Roles:    []string{models.RoleAdmin},
 		}
 
 		// Hash the password
@@ -72,6 +81,84 @@ func createInitialAdminUser(db *sql.DB, logger echo.Logger) {
 	}
 }
 
+// cancellationCutoff reads how many hours before an event users
+// stop being able to cancel their sign ups
+func cancellationCutoff(logger echo.Logger) time.Duration {
+	hoursStr := os.Getenv("SIGNUP_CANCELLATION_CUTOFF_HOURS")
+	if hoursStr == "" {
+		return 0
+	}
+	hours, err := strconv.Atoi(hoursStr)
+	if err != nil || hours < 0 {
+		logger.Fatal("Invalid SIGNUP_CANCELLATION_CUTOFF_HOURS value")
+	}
+	return time.Duration(hours) * time.Hour
+}
+
+// newMailer returns the mailer set up with MAILER, which has to be set
+// so tokens aren't written to the logs by mistake. The "log" mailer
+// writes the emails to MAIL_LOG_FILE, or to the standard output if
+// it's not set, instead of sending them
+func newMailer(logger echo.Logger) mailer.Mailer {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "noreply@localhost"
+	}
+
+	switch os.Getenv("MAILER") {
+	case "smtp":
+		host := os.Getenv("SMTP_HOST")
+		if host == "" {
+			logger.Fatal("SMTP_HOST is required to send emails through SMTP")
+		}
+		port := os.Getenv("SMTP_PORT")
+		if port == "" {
+			port = "587"
+		}
+		return &mailer.SMTPMailer{
+			Host:     host,
+			Port:     port,
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     from,
+		}
+	case "log":
+		path := os.Getenv("MAIL_LOG_FILE")
+		if path == "" {
+			return mailer.NewLogMailer(os.Stdout, from)
+		}
+		file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			logger.Fatal("Failed to open MAIL_LOG_FILE:", err)
+		}
+		return mailer.NewLogMailer(file, from)
+	}
+	logger.Fatal("MAILER must be smtp, or log to write the emails instead of sending them")
+	return nil
+}
+
+// newSSOProvider returns the OpenID Connect provider users can log in
+// with, or nil when OIDC_ISSUER isn't set
+func newSSOProvider(logger echo.Logger) *sso.Provider {
+	issuer := os.Getenv("OIDC_ISSUER")
+	if issuer == "" {
+		return nil
+	}
+
+	provider, err := sso.NewProvider(context.Background(), sso.Config{
+		IssuerURL:    issuer,
+		ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+		GroupsClaim:  os.Getenv("OIDC_GROUPS_CLAIM"),
+		AdminGroup:   os.Getenv("OIDC_ADMIN_GROUP"),
+	})
+	if err != nil {
+		logger.Fatal("Failed to discover the OIDC provider:", err)
+	}
+	return provider
+}
+
 func main() {
 	e := echo.New()
 
@@ -104,27 +191,142 @@ func main() {
 	// Custom validator
 	e.Validator = validator.NewCustomValidator()
 
+	// Errors are written as problem details, with the id of the
+	// request so they can be found in the logs
+	e.HTTPErrorHandler = problem.HTTPErrorHandler
+	e.Use(problem.RequestID())
+
+	// Failed logins are tracked by IP address, so the address is only
+	// taken from the proxy headers when the API runs behind a proxy
+	// that sets them. Otherwise clients could send any address
+	if os.Getenv("TRUST_PROXY_HEADERS") == "true" {
+		e.IPExtractor = echo.ExtractIPFromXFFHeader()
+	} else {
+		e.IPExtractor = echo.ExtractIPDirect()
+	}
+
+	// Access tokens are verified with any of the keys, so new keys can
+	// be added before they start signing and old ones kept until the
+	// tokens they signed expire
+	keysDir := os.Getenv("JWT_KEYS_DIR")
+	if keysDir == "" {
+		e.Logger.Fatal("JWT_KEYS_DIR not provided in .env file")
+	}
+	keys, err := jwtkeys.Load(keysDir)
+	if err != nil {
+		e.Logger.Fatal("Failed to load JWT keys:", err)
+	}
+
 	// Initialize repositories
 	eventRepo := &repositories.EventRepository{DB: db}
 	userRepo := &repositories.UserRepository{DB: db}
 	userEventRepo := &repositories.UserEventRepository{DB: db}
+	seriesRepo := &repositories.SeriesRepository{DB: db}
+	calendarTokenRepo := &repositories.CalendarTokenRepository{DB: db}
+	categoryRepo := &repositories.CategoryRepository{DB: db}
+	venueRepo := &repositories.VenueRepository{DB: db}
+	tokenRepo := &repositories.TokenRepository{DB: db}
+	roleRepo := &repositories.RoleRepository{DB: db}
+	loginAttemptRepo := &repositories.LoginAttemptRepository{DB: db}
+	twoFactorRepo := &repositories.TwoFactorRepository{DB: db}
+	identityRepo := &repositories.IdentityRepository{DB: db}
+	apiKeyRepo := &repositories.APIKeyRepository{DB: db}
+	// Users are checked on every request, changes made through
+	// other instances of the API take up to this long to apply
+	userCache := repositories.NewUserCache(userRepo, 30*time.Second)
 
 	// Public routes
-	e.POST("/register", handlers.Register(userRepo))
-	e.POST("/login", handlers.Login(userRepo))
-
-	// Authenticated routes
-	r := e.Group("/api/v1")
-	r.Use(middleware.JWTMiddleware)
-
-	r.GET("/events", handlers.GetAllEvents(eventRepo))
-	r.GET("/events/:id", handlers.GetEvent(eventRepo))
-	r.POST("/events", middleware.AdminOnly(handlers.CreateEvent(eventRepo)))
-	r.DELETE("/events/:id", middleware.AdminOnly(handlers.DeleteEvent(eventRepo)))
-	r.PATCH("/events/:id", middleware.AdminOnly(handlers.UpdateEvent(eventRepo)))
-	r.POST("/events/:id/signup", handlers.SignUpForEvent(userEventRepo))
-	r.GET("/user/events", handlers.GetUserEvents(userEventRepo))
-	r.PATCH("/users/:username/promote", middleware.AdminOnly(handlers.PromoteUserToAdmin(userRepo)))
+	mail := newMailer(e.Logger)
+
+	e.POST("/register", handlers.Register(userRepo, mail))
+	e.POST("/login", handlers.Login(userRepo, tokenRepo, loginAttemptRepo, twoFactorRepo, keys))
+	e.POST("/login/mfa", handlers.LoginMFA(userRepo, tokenRepo, loginAttemptRepo, twoFactorRepo, keys))
+	e.POST("/token/refresh", handlers.RefreshToken(userRepo, tokenRepo, keys))
+	e.POST("/password/forgot", handlers.ForgotPassword(userRepo, mail))
+	e.POST("/password/reset", handlers.ResetPassword(userRepo, tokenRepo, userCache))
+	e.POST("/email/verify", handlers.VerifyEmail(userRepo, userCache))
+	e.POST("/logout", handlers.Logout(tokenRepo), middleware.JWTMiddleware(tokenRepo, userCache, keys))
+	e.GET("/.well-known/jwks.json", handlers.JWKS(keys))
+	e.GET("/calendar/:token", handlers.GetCalendarFeed(calendarTokenRepo, userEventRepo))
+	ssoProvider := newSSOProvider(e.Logger)
+	if ssoProvider != nil {
+		e.GET("/sso/login", handlers.SSOLogin(identityRepo, ssoProvider))
+		e.GET("/sso/callback", handlers.SSOCallback(userRepo, tokenRepo, twoFactorRepo, roleRepo, identityRepo, userCache, ssoProvider, keys))
+	}
+
+	// Authenticated routes. API keys can only be used on the routes
+	// of k, each of which checks the scopes of the key
+	r := e.Group("/api/v1", middleware.JWTMiddleware(tokenRepo, userCache, keys))
+	k := e.Group("/api/v1", middleware.APIKeyMiddleware(tokenRepo, userCache, keys, apiKeyRepo))
+	if os.Getenv("REQUIRE_ADMIN_2FA") == "true" {
+		// Admins can still see their profile and enable it
+		adminTwoFactor := middleware.RequireAdminTwoFactor(userCache, "GET /api/v1/me", "POST /api/v1/me/2fa/setup", "POST /api/v1/me/2fa/enable")
+		r.Use(adminTwoFactor)
+		k.Use(adminTwoFactor)
+	}
+	signUpPolicy := []echo.MiddlewareFunc{middleware.RequireScope(models.ScopeManageSignUps)}
+	if os.Getenv("REQUIRE_VERIFIED_EMAIL") == "true" {
+		signUpPolicy = append(signUpPolicy, middleware.RequireVerifiedEmail(userCache))
+	}
+
+	k.GET("/events", handlers.GetAllEvents(eventRepo), middleware.RequireScope(models.ScopeReadEvents))
+	k.GET("/events/:id", handlers.ICSVariant(handlers.GetEvent(eventRepo), handlers.GetEventICS(eventRepo)), middleware.RequireScope(models.ScopeReadEvents))
+	k.POST("/events", handlers.CreateEvent(eventRepo), middleware.RequirePermission(models.PermissionCreateEvents))
+	k.DELETE("/events/:id", handlers.DeleteEvent(eventRepo), middleware.RequirePermission(models.PermissionDeleteEvents))
+	k.PATCH("/events/:id", handlers.UpdateEvent(eventRepo), middleware.RequirePermission(models.PermissionUpdateEvents))
+	k.POST("/events/:id/publish", handlers.TransitionEvent(eventRepo, models.EventPublished), middleware.RequirePermission(models.PermissionUpdateEvents))
+	k.POST("/events/:id/unpublish", handlers.TransitionEvent(eventRepo, models.EventDraft), middleware.RequirePermission(models.PermissionUpdateEvents))
+	k.POST("/events/:id/cancel", handlers.TransitionEvent(eventRepo, models.EventCancelled), middleware.RequirePermission(models.PermissionUpdateEvents))
+	k.POST("/events/:id/complete", handlers.TransitionEvent(eventRepo, models.EventCompleted), middleware.RequirePermission(models.PermissionUpdateEvents))
+	k.POST("/events/:id/archive", handlers.TransitionEvent(eventRepo, models.EventArchived), middleware.RequirePermission(models.PermissionUpdateEvents))
+	k.POST("/events/:id/signup", handlers.SignUpForEvent(userEventRepo), signUpPolicy...)
+	k.DELETE("/events/:id/signup", handlers.CancelSignUp(userEventRepo, cancellationCutoff(e.Logger)), middleware.RequireScope(models.ScopeManageSignUps))
+	k.POST("/events/:id/signups/:user_id/check-in", handlers.CheckIn(userEventRepo), middleware.RequirePermission(models.PermissionCheckIn))
+	k.POST("/series", handlers.CreateSeries(seriesRepo), middleware.RequirePermission(models.PermissionCreateEvents))
+	k.GET("/series/:id", handlers.GetSeries(seriesRepo), middleware.RequireScope(models.ScopeReadEvents))
+	k.PATCH("/series/:id/events/:event_id", handlers.UpdateSeriesEvents(seriesRepo), middleware.RequirePermission(models.PermissionUpdateEvents))
+	k.POST("/series/:id/events/:event_id/cancel", handlers.CancelSeriesEvents(seriesRepo), middleware.RequirePermission(models.PermissionUpdateEvents))
+	k.POST("/series/:id/signup", handlers.SignUpForSeries(seriesRepo, userEventRepo), signUpPolicy...)
+	k.GET("/categories", handlers.GetCategories(categoryRepo), middleware.RequireScope(models.ScopeReadEvents))
+	k.POST("/categories", handlers.CreateCategory(categoryRepo), middleware.RequirePermission(models.PermissionManageCategories))
+	k.PATCH("/categories/:id", handlers.UpdateCategory(categoryRepo), middleware.RequirePermission(models.PermissionManageCategories))
+	k.DELETE("/categories/:id", handlers.DeleteCategory(categoryRepo), middleware.RequirePermission(models.PermissionManageCategories))
+	k.GET("/venues", handlers.GetVenues(venueRepo), middleware.RequireScope(models.ScopeReadEvents))
+	k.GET("/venues/:id", handlers.GetVenue(venueRepo), middleware.RequireScope(models.ScopeReadEvents))
+	k.POST("/venues", handlers.CreateVenue(venueRepo), middleware.RequirePermission(models.PermissionManageVenues))
+	k.PATCH("/venues/:id", handlers.UpdateVenue(venueRepo), middleware.RequirePermission(models.PermissionManageVenues))
+	k.DELETE("/venues/:id", handlers.DeleteVenue(venueRepo), middleware.RequirePermission(models.PermissionManageVenues))
+	r.GET("/me", handlers.GetMe(userRepo))
+	r.PATCH("/me", handlers.UpdateMe(userRepo, userCache, mail))
+	r.POST("/me/email/verify", handlers.ResendVerificationEmail(userRepo, mail))
+	r.POST("/me/password", handlers.ChangePassword(userRepo, tokenRepo, twoFactorRepo))
+	r.DELETE("/me", handlers.DeleteMe(userRepo, tokenRepo, twoFactorRepo, userCache))
+	r.POST("/me/2fa/setup", handlers.SetupTwoFactor(userRepo, twoFactorRepo))
+	r.POST("/me/2fa/enable", handlers.EnableTwoFactor(twoFactorRepo, userCache))
+	r.POST("/me/2fa/disable", handlers.DisableTwoFactor(userRepo, twoFactorRepo, userCache))
+	if ssoProvider != nil {
+		r.POST("/me/sso/link", handlers.LinkSSO(identityRepo, ssoProvider))
+	}
+	r.GET("/me/api-keys", handlers.GetAPIKeys(apiKeyRepo, false))
+	r.POST("/me/api-keys", handlers.CreateAPIKey(userRepo, apiKeyRepo))
+	r.DELETE("/me/api-keys/:id", handlers.RevokeAPIKey(apiKeyRepo, false))
+	k.GET("/user/events", handlers.GetUserEvents(userEventRepo), middleware.RequireScope(models.ScopeManageSignUps))
+	r.POST("/user/calendar-token", handlers.CreateCalendarToken(calendarTokenRepo))
+	r.DELETE("/user/calendar-token", handlers.RevokeCalendarToken(calendarTokenRepo))
+	k.GET("/users", handlers.GetUsers(userRepo), middleware.RequirePermission(models.PermissionManageUsers))
+	k.GET("/users/:username", handlers.GetUser(userRepo, userEventRepo), middleware.RequirePermission(models.PermissionManageUsers))
+	k.PATCH("/users/:username/promote", handlers.PromoteUserToAdmin(userRepo, roleRepo, userCache), middleware.RequirePermission(models.PermissionManageUsers))
+	k.PATCH("/users/:username/demote", handlers.DemoteAdmin(userRepo, roleRepo, userCache), middleware.RequirePermission(models.PermissionManageUsers))
+	k.POST("/users/:username/suspend", handlers.SetUserSuspended(userRepo, userCache, true), middleware.RequirePermission(models.PermissionManageUsers))
+	k.POST("/users/:username/unsuspend", handlers.SetUserSuspended(userRepo, userCache, false), middleware.RequirePermission(models.PermissionManageUsers))
+	k.POST("/users/:username/password-reset", handlers.ForcePasswordReset(userRepo, tokenRepo, userCache, mail), middleware.RequirePermission(models.PermissionManageUsers))
+	k.GET("/login-lockouts", handlers.GetLoginLockouts(loginAttemptRepo), middleware.RequirePermission(models.PermissionManageUsers))
+	k.DELETE("/login-lockouts/:username", handlers.ClearLoginLockout(loginAttemptRepo), middleware.RequirePermission(models.PermissionManageUsers))
+	k.GET("/api-keys", handlers.GetAPIKeys(apiKeyRepo, true), middleware.RequirePermission(models.PermissionManageUsers))
+	k.DELETE("/api-keys/:id", handlers.RevokeAPIKey(apiKeyRepo, true), middleware.RequirePermission(models.PermissionManageUsers))
+	k.GET("/roles", handlers.GetRoles(roleRepo), middleware.RequirePermission(models.PermissionManageUsers))
+	k.PUT("/users/:username/roles/:role", handlers.AssignRole(userRepo, roleRepo, userCache), middleware.RequirePermission(models.PermissionManageUsers))
+	k.DELETE("/users/:username/roles/:role", handlers.RemoveRole(userRepo, roleRepo, userCache), middleware.RequirePermission(models.PermissionManageUsers))
 
 	e.Logger.Fatal(e.Start(":8080"))
 }
@@ -0,0 +1,28 @@
+package handlers
+
+import (
+	"github.com/labstack/echo/v4"
+	"github.com/xtommas/challenge-hetmo/internal/models"
+)
+
+// notEventOwnerMessage is the error for users changing events that
+// aren't theirs
+const notEventOwnerMessage = "You can only manage the events you created"
+
+// can tells whether the roles of the user making the request grant
+// the permission
+func can(c echo.Context, permission string) bool {
+	permissions, _ := c.Get("permissions").(models.Permissions)
+	return permissions.Has(permission)
+}
+
+// canManageEvent tells whether the user making the request can change
+// the event. Unless they can manage any event, users can only change
+// the events they created
+func canManageEvent(c echo.Context, event *models.Event) bool {
+	if can(c, models.PermissionManageAnyEvent) {
+		return true
+	}
+	userID, _ := c.Get("user_id").(int64)
+	return event.CreatedBy != nil && *event.CreatedBy == userID
+}
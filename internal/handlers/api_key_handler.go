@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/xtommas/challenge-hetmo/internal/models"
+	"github.com/xtommas/challenge-hetmo/internal/problem"
+	"github.com/xtommas/challenge-hetmo/internal/repositories"
+)
+
+// CreateAPIKey issues an API key for the current user, limited to the
+// scopes sent. Keys can only have the permissions the user has. The
+// key is shown only in this response
+func CreateAPIKey(userRepo *repositories.UserRepository, apiKeyRepo *repositories.APIKeyRepository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var input struct {
+			Name      string     `json:"name" validate:"required,max=100"`
+			Scopes    []string   `json:"scopes" validate:"required,min=1,dive,required"`
+			ExpiresAt *time.Time `json:"expires_at"`
+		}
+		if err := c.Bind(&input); err != nil {
+			return problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid request")
+		}
+
+		if err := c.Validate(input); err != nil {
+			return err
+		}
+
+		if input.ExpiresAt != nil && !input.ExpiresAt.After(time.Now()) {
+			return problem.Invalid("expires_at", "gt", "must be in the future")
+		}
+
+		user, err := getCurrentUser(c, userRepo)
+		if err != nil {
+			return err
+		}
+
+		allowed := models.Permissions(user.AllowedScopes())
+		for _, scope := range input.Scopes {
+			if !allowed.Has(scope) {
+				return problem.New(http.StatusBadRequest, problem.CodeAPIKeyScopeNotAllowed, "Scope not allowed: "+scope)
+			}
+		}
+
+		key := &models.APIKey{
+			UserID:    user.Id,
+			Name:      input.Name,
+			Scopes:    input.Scopes,
+			ExpiresAt: input.ExpiresAt,
+		}
+		token, err := apiKeyRepo.Create(key)
+		if err != nil {
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to create API key")
+		}
+
+		return c.JSON(http.StatusCreated, map[string]interface{}{
+			"api_key": key,
+			"key":     token,
+		})
+	}
+}
+
+// GetAPIKeys lists the API keys of the current user or, with
+// allUsers, of every user
+func GetAPIKeys(apiKeyRepo *repositories.APIKeyRepository, allUsers bool) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var userID int64
+		if !allUsers {
+			userID = c.Get("user_id").(int64)
+		}
+
+		keys, err := apiKeyRepo.GetAll(userID)
+		if err != nil {
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to get API keys")
+		}
+		return c.JSON(http.StatusOK, keys)
+	}
+}
+
+// RevokeAPIKey revokes an API key of the current user or, with
+// allUsers, of any user
+func RevokeAPIKey(apiKeyRepo *repositories.APIKeyRepository, allUsers bool) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid ID")
+		}
+
+		var userID int64
+		if !allUsers {
+			userID = c.Get("user_id").(int64)
+		}
+
+		if err := apiKeyRepo.Revoke(id, userID); err != nil {
+			if err == sql.ErrNoRows {
+				return problem.New(http.StatusNotFound, problem.CodeNotFound, "API key not found")
+			}
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to revoke API key")
+		}
+
+		return c.JSON(http.StatusOK, map[string]string{"message": "API key revoked successfully"})
+	}
+}
@@ -0,0 +1,166 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/xtommas/challenge-hetmo/internal/repositories"
+	"github.com/xtommas/challenge-hetmo/internal/validator"
+)
+
+func TestCreateAPIKey(t *testing.T) {
+	e := echo.New()
+	e.Validator = validator.NewCustomValidator()
+
+	expectUser := func(mock sqlmock.Sqlmock) {
+		mock.ExpectQuery("SELECT (.+) FROM users WHERE id = ?").
+			WithArgs(1).
+			WillReturnRows(newUserRows().AddRow(1, "user", "hashedpassword", nil, false, "", "", nil, "", "", "UTC", nil, false, "{organizer}", "{events:create}"))
+	}
+
+	testCases := []struct {
+		name           string
+		input          string
+		mockBehavior   func(mock sqlmock.Sqlmock)
+		expectedStatus int
+	}{
+		{
+			name:  "Valid scopes",
+			input: `{"name": "sync script", "scopes": ["events:read", "events:create"]}`,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				expectUser(mock)
+				mock.ExpectQuery("INSERT INTO api_keys").
+					WithArgs(1, "sync script", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), nil).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(1, time.Now()))
+			},
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:  "Permission the user doesn't have",
+			input: `{"name": "sync script", "scopes": ["users:manage"]}`,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				expectUser(mock)
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Expiry in the past",
+			input:          `{"name": "sync script", "scopes": ["events:read"], "expires_at": "2020-01-01T00:00:00Z"}`,
+			mockBehavior:   func(mock sqlmock.Sqlmock) {},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "No scopes",
+			input:          `{"name": "sync script", "scopes": []}`,
+			mockBehavior:   func(mock sqlmock.Sqlmock) {},
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/me/api-keys", strings.NewReader(tc.input))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+			c.Set("user_id", int64(1))
+
+			db, mock, err := sqlmock.New()
+			assert.NoError(t, err)
+			defer db.Close()
+
+			tc.mockBehavior(mock)
+
+			err = handle(CreateAPIKey(&repositories.UserRepository{DB: db}, &repositories.APIKeyRepository{DB: db}))(c)
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedStatus, rec.Code)
+			if tc.expectedStatus == http.StatusCreated {
+				var response map[string]interface{}
+				assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+				assert.True(t, strings.HasPrefix(response["key"].(string), "hetmo_"))
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestGetAPIKeys(t *testing.T) {
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/me/api-keys", nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.Set("user_id", int64(1))
+
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	rows := sqlmock.NewRows([]string{"id", "user_id", "name", "prefix", "scopes", "created_at", "expires_at", "last_used_at"}).
+		AddRow(1, 1, "sync script", "hetmo_0123456789ab", "{events:read}", time.Now(), nil, nil)
+	mock.ExpectQuery("SELECT (.+) FROM api_keys").
+		WithArgs(1).
+		WillReturnRows(rows)
+
+	err = handle(GetAPIKeys(&repositories.APIKeyRepository{DB: db}, false))(c)
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "hetmo_0123456789ab")
+	assert.NotContains(t, rec.Body.String(), "key_hash")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRevokeAPIKey(t *testing.T) {
+	e := echo.New()
+
+	testCases := []struct {
+		name           string
+		rowsAffected   int64
+		expectedStatus int
+	}{
+		{
+			name:           "Own key",
+			rowsAffected:   1,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Key of another user",
+			rowsAffected:   0,
+			expectedStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodDelete, "/", nil)
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+			c.SetPath("/api/v1/me/api-keys/:id")
+			c.SetParamNames("id")
+			c.SetParamValues("4")
+			c.Set("user_id", int64(1))
+
+			db, mock, err := sqlmock.New()
+			assert.NoError(t, err)
+			defer db.Close()
+
+			mock.ExpectExec("UPDATE api_keys SET revoked_at = NOW()").
+				WithArgs(4, 1).
+				WillReturnResult(sqlmock.NewResult(0, tc.rowsAffected))
+
+			err = handle(RevokeAPIKey(&repositories.APIKeyRepository{DB: db}, false))(c)
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedStatus, rec.Code)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/xtommas/challenge-hetmo/internal/ical"
+	"github.com/xtommas/challenge-hetmo/internal/models"
+	"github.com/xtommas/challenge-hetmo/internal/problem"
+	"github.com/xtommas/challenge-hetmo/internal/repositories"
+)
+
+// feedLimit caps how many events are included in a calendar feed
+const feedLimit = 500
+
+// ICSVariant routes requests whose id param ends in ".ics" to
+// icsHandler, with the suffix removed. The router can't tell
+// "/events/:id.ics" apart from "/events/:id" by itself
+func ICSVariant(handler, icsHandler echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		values := c.ParamValues()
+		for i, name := range c.ParamNames() {
+			if name == "id" && strings.HasSuffix(values[i], ".ics") {
+				values[i] = strings.TrimSuffix(values[i], ".ics")
+				c.SetParamValues(values...)
+				return icsHandler(c)
+			}
+		}
+		return handler(c)
+	}
+}
+
+// GetEventICS returns a single event as an iCalendar file
+func GetEventICS(eventRepo *repositories.EventRepository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		canViewDrafts := can(c, models.PermissionViewDrafts)
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid ID")
+		}
+		event, err := eventRepo.Get(id)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return problem.New(http.StatusNotFound, problem.CodeNotFound, "Event not found")
+			}
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to get event")
+		}
+
+		if !event.IsPublic() && !canViewDrafts {
+			return problem.New(http.StatusNotFound, problem.CodeNotFound, "Event not found")
+		}
+
+		cal := &ical.Calendar{Events: []models.Event{*event}}
+		c.Response().Header().Set(echo.HeaderContentDisposition, `attachment; filename="event-`+strconv.FormatInt(event.Id, 10)+`.ics"`)
+		return c.Blob(http.StatusOK, ical.ContentType, cal.Bytes())
+	}
+}
+
+// CreateCalendarToken issues the token used to subscribe to the user's
+// calendar feed. Calling it again replaces the previous token
+func CreateCalendarToken(tokenRepo *repositories.CalendarTokenRepository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID := c.Get("user_id").(int64)
+
+		token, err := tokenRepo.Create(userID)
+		if err != nil {
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to create calendar token")
+		}
+
+		// The token can't be recovered later, as only its hash is stored
+		return c.JSON(http.StatusCreated, map[string]string{
+			"token": token,
+			"url":   c.Scheme() + "://" + c.Request().Host + "/calendar/" + token + ".ics",
+		})
+	}
+}
+
+func RevokeCalendarToken(tokenRepo *repositories.CalendarTokenRepository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID := c.Get("user_id").(int64)
+
+		err := tokenRepo.Revoke(userID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return problem.New(http.StatusNotFound, problem.CodeNotFound, "No calendar token to revoke")
+			}
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to revoke calendar token")
+		}
+		return c.JSON(http.StatusOK, map[string]string{"message": "Calendar token revoked successfully"})
+	}
+}
+
+// GetCalendarFeed returns the upcoming events the owner of the feed
+// token signed up to. It's public, as calendar clients can't send the
+// JWT, so the token in the URL is what authenticates the request
+func GetCalendarFeed(tokenRepo *repositories.CalendarTokenRepository, userEventRepo *repositories.UserEventRepository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token := strings.TrimSuffix(c.Param("token"), ".ics")
+
+		userID, err := tokenRepo.GetUserID(token)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return problem.New(http.StatusNotFound, problem.CodeNotFound, "Calendar not found")
+			}
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to get calendar")
+		}
+
+		events, err := userEventRepo.GetAll(userID, "upcoming", repositories.DefaultEventSort, feedLimit, 0)
+		if err != nil {
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to get events")
+		}
+
+		cal := &ical.Calendar{Name: "My events", Events: events}
+		return c.Blob(http.StatusOK, ical.ContentType, cal.Bytes())
+	}
+}
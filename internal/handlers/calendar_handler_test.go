@@ -0,0 +1,234 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/xtommas/challenge-hetmo/internal/models"
+	"github.com/xtommas/challenge-hetmo/internal/problem"
+	"github.com/xtommas/challenge-hetmo/internal/repositories"
+)
+
+func TestGetEventICS(t *testing.T) {
+	eventTime := time.Date(2099, 5, 1, 15, 0, 0, 0, time.UTC)
+
+	// Test cases
+	testCases := []struct {
+		name           string
+		path           string
+		isAdmin        bool
+		event          *models.Event
+		expectedStatus int
+		expectedLines  []string
+	}{
+		{
+			name:           "Cancelled event",
+			path:           "/events/1.ics",
+			event:          &models.Event{Id: 1, Title: "Go meetup, vol. 2", Status: "cancelled", DateAndTime: eventTime, Sequence: 3, UpdatedAt: eventTime},
+			expectedStatus: http.StatusOK,
+			expectedLines: []string{
+				"BEGIN:VCALENDAR",
+				"UID:event-1@challenge-hetmo",
+				"DTSTART:20990501T150000Z",
+				"SEQUENCE:3",
+				"STATUS:CANCELLED",
+				`SUMMARY:Go meetup\, vol. 2`,
+				"END:VCALENDAR",
+			},
+		},
+		{
+			name:           "Non-admin tries to get a draft",
+			path:           "/events/2.ics",
+			event:          &models.Event{Id: 2, Title: "Draft", Status: "draft", DateAndTime: eventTime},
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "Routes without the suffix still return JSON",
+			path:           "/events/3",
+			isAdmin:        true,
+			event:          &models.Event{Id: 3, Title: "Published", Status: "published", DateAndTime: eventTime},
+			expectedStatus: http.StatusOK,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Mock database
+			db, mock, err := sqlmock.New()
+			assert.NoError(t, err)
+			defer db.Close()
+
+			mock.ExpectQuery("SELECT (.+) FROM events e WHERE e.id = ?").
+				WithArgs(tc.event.Id).
+				WillReturnRows(addEventRow(newEventRows(), *tc.event))
+			if !strings.HasSuffix(tc.path, ".ics") {
+				mock.ExpectQuery("SELECT (.+) FROM user_events ue").
+					WillReturnRows(sqlmock.NewRows([]string{"taken", "waitlisted", "status", "position"}).AddRow(0, 0, "", 0))
+			}
+
+			// Create repository with mock db
+			repo := &repositories.EventRepository{DB: db}
+
+			// Route the request, as the router is what
+			// extracts the id from the ".ics" path
+			e := echo.New()
+			e.HTTPErrorHandler = problem.HTTPErrorHandler
+			e.GET("/events/:id", ICSVariant(GetEvent(repo), GetEventICS(repo)), func(next echo.HandlerFunc) echo.HandlerFunc {
+				return func(c echo.Context) error {
+					if tc.isAdmin {
+						c.Set("permissions", adminPermissions)
+					}
+					c.Set("user_id", int64(1))
+					return next(c)
+				}
+			})
+
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			// Assertions
+			assert.Equal(t, tc.expectedStatus, rec.Code)
+
+			if tc.expectedStatus == http.StatusOK && tc.expectedLines != nil {
+				assert.Equal(t, "text/calendar; charset=utf-8", rec.Header().Get(echo.HeaderContentType))
+				lines := strings.Split(rec.Body.String(), "\r\n")
+				for _, line := range tc.expectedLines {
+					assert.Contains(t, lines, line)
+				}
+			}
+
+			// Ensure all expectations were met
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestCreateCalendarToken(t *testing.T) {
+	// Setup
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodPost, "/user/calendar-token", nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.Set("user_id", int64(1))
+
+	// Mock database
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	// The previous token is revoked
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE calendar_feed_tokens SET revoked_at").
+		WithArgs(1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO calendar_feed_tokens").
+		WithArgs(1, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	// Create repository with mock db
+	repo := &repositories.CalendarTokenRepository{DB: db}
+
+	// Call the handler
+	handler := CreateCalendarToken(repo)
+	err = handle(handler)(c)
+
+	// Assertions
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+
+	var response map[string]string
+	err = json.Unmarshal(rec.Body.Bytes(), &response)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, response["token"])
+	assert.Equal(t, "http://example.com/calendar/"+response["token"]+".ics", response["url"])
+
+	// Ensure all expectations were met
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGetCalendarFeed(t *testing.T) {
+	// Setup
+	e := echo.New()
+
+	// Test cases
+	testCases := []struct {
+		name           string
+		expectedStatus int
+		mockBehavior   func(mock sqlmock.Sqlmock)
+	}{
+		{
+			name:           "Valid token",
+			expectedStatus: http.StatusOK,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				// Tokens of suspended or deleted users are left out
+				mock.ExpectQuery("SELECT t.user_id FROM calendar_feed_tokens t (.+) u.suspended_at IS NULL AND u.deleted_at IS NULL").
+					WithArgs(sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+				rows := newEventRows()
+				addEventRow(rows, models.Event{Id: 1, Title: "Event 1", Status: "published", DateAndTime: time.Now().Add(24 * time.Hour)})
+				addEventRow(rows, models.Event{Id: 2, Title: "Event 2", Status: "cancelled", DateAndTime: time.Now().Add(48 * time.Hour)})
+				mock.ExpectQuery("SELECT (.+) FROM events e JOIN user_events ue").
+					WithArgs(1, feedLimit, 0).
+					WillReturnRows(rows)
+			},
+		},
+		{
+			name:           "Revoked token",
+			expectedStatus: http.StatusNotFound,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT t.user_id FROM calendar_feed_tokens").
+					WithArgs(sqlmock.AnyArg()).
+					WillReturnError(sql.ErrNoRows)
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/calendar/secret.ics", nil)
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+			c.SetParamNames("token")
+			c.SetParamValues("secret.ics")
+
+			// Mock database
+			db, mock, err := sqlmock.New()
+			assert.NoError(t, err)
+			defer db.Close()
+
+			tc.mockBehavior(mock)
+
+			// Create repositories with mock db
+			tokenRepo := &repositories.CalendarTokenRepository{DB: db}
+			userEventRepo := &repositories.UserEventRepository{DB: db}
+
+			// Call the handler
+			handler := GetCalendarFeed(tokenRepo, userEventRepo)
+			err = handle(handler)(c)
+
+			// Assertions
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedStatus, rec.Code)
+
+			if tc.expectedStatus == http.StatusOK {
+				body := rec.Body.String()
+				assert.Equal(t, 2, strings.Count(body, "BEGIN:VEVENT"))
+				assert.Contains(t, body, "UID:event-2@challenge-hetmo\r\n")
+				assert.Contains(t, body, "STATUS:CANCELLED\r\n")
+			}
+
+			// Ensure all expectations were met
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"github.com/xtommas/challenge-hetmo/internal/models"
+	"github.com/xtommas/challenge-hetmo/internal/problem"
+	"github.com/xtommas/challenge-hetmo/internal/repositories"
+)
+
+func GetCategories(categoryRepo *repositories.CategoryRepository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		categories, err := categoryRepo.GetAll()
+		if err != nil {
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to get categories")
+		}
+		return c.JSON(http.StatusOK, categories)
+	}
+}
+
+func CreateCategory(categoryRepo *repositories.CategoryRepository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		category := &models.Category{}
+		if err := c.Bind(category); err != nil {
+			return problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid request")
+		}
+
+		if err := checkCategory(c, category); err != nil {
+			return err
+		}
+
+		err := categoryRepo.Create(category)
+		if err != nil {
+			if err == repositories.ErrCategoryExists {
+				return problem.New(http.StatusConflict, problem.CodeCategoryExists, "A category with that name or slug already exists")
+			}
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to create category")
+		}
+		return c.JSON(http.StatusCreated, category)
+	}
+}
+
+func UpdateCategory(categoryRepo *repositories.CategoryRepository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid ID")
+		}
+		category, err := categoryRepo.Get(id)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return problem.New(http.StatusNotFound, problem.CodeNotFound, "Category not found")
+			}
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to get category")
+		}
+
+		var input struct {
+			Name *string `json:"name"`
+			Slug *string `json:"slug"`
+		}
+		if err := c.Bind(&input); err != nil {
+			return problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid request")
+		}
+		if input.Name != nil {
+			category.Name = *input.Name
+		}
+		if input.Slug != nil {
+			category.Slug = *input.Slug
+		}
+
+		if err := checkCategory(c, category); err != nil {
+			return err
+		}
+
+		err = categoryRepo.Update(category)
+		if err != nil {
+			switch err {
+			case sql.ErrNoRows:
+				return problem.New(http.StatusNotFound, problem.CodeNotFound, "Category not found")
+			case repositories.ErrCategoryExists:
+				return problem.New(http.StatusConflict, problem.CodeCategoryExists, "A category with that name or slug already exists")
+			}
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to update category")
+		}
+		return c.JSON(http.StatusOK, category)
+	}
+}
+
+func DeleteCategory(categoryRepo *repositories.CategoryRepository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid ID")
+		}
+		err = categoryRepo.Delete(id)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return problem.New(http.StatusNotFound, problem.CodeNotFound, "Category not found")
+			}
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to delete category")
+		}
+		return c.JSON(http.StatusOK, map[string]string{"message": "Category deleted successfully"})
+	}
+}
+
+// checkCategory returns why the category can't be saved, or nil if it
+// can
+func checkCategory(c echo.Context, category *models.Category) error {
+	if err := c.Validate(category); err != nil {
+		return err
+	}
+	if !models.IsSlug(category.Slug) {
+		return problem.Invalid("slug", "slug", "must use only lowercase letters, digits and hyphens")
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"github.com/xtommas/challenge-hetmo/internal/repositories"
+	"github.com/xtommas/challenge-hetmo/internal/validator"
+)
+
+func TestCreateCategory(t *testing.T) {
+	e := echo.New()
+	e.Validator = validator.NewCustomValidator()
+
+	testCases := []struct {
+		name           string
+		reqBody        string
+		mockBehavior   func(mock sqlmock.Sqlmock)
+		expectedStatus int
+	}{
+		{
+			name:    "Create category",
+			reqBody: `{"name": "Workshops", "slug": "workshops"}`,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("INSERT INTO categories").
+					WithArgs("Workshops", "workshops").
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+			},
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:    "Category already exists",
+			reqBody: `{"name": "Workshops", "slug": "workshops"}`,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("INSERT INTO categories").
+					WithArgs("Workshops", "workshops").
+					WillReturnError(&pq.Error{Code: "23505"})
+			},
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name:           "Invalid slug",
+			reqBody:        `{"name": "Workshops", "slug": "Work Shops"}`,
+			mockBehavior:   func(mock sqlmock.Sqlmock) {},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Missing name",
+			reqBody:        `{"slug": "workshops"}`,
+			mockBehavior:   func(mock sqlmock.Sqlmock) {},
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/categories", strings.NewReader(tc.reqBody))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+
+			db, mock, err := sqlmock.New()
+			assert.NoError(t, err)
+			defer db.Close()
+			tc.mockBehavior(mock)
+
+			repo := &repositories.CategoryRepository{DB: db}
+			err = handle(CreateCategory(repo))(c)
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedStatus, rec.Code)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestUpdateCategory(t *testing.T) {
+	e := echo.New()
+	e.Validator = validator.NewCustomValidator()
+
+	testCases := []struct {
+		name           string
+		categoryID     string
+		reqBody        string
+		mockBehavior   func(mock sqlmock.Sqlmock)
+		expectedStatus int
+		expectedSlug   string
+	}{
+		{
+			name:       "Rename category",
+			categoryID: "1",
+			reqBody:    `{"name": "Hands-on workshops"}`,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT id, name, slug FROM categories WHERE id = ?").
+					WithArgs(1).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "name", "slug"}).AddRow(1, "Workshops", "workshops"))
+				mock.ExpectExec("UPDATE categories SET name = \\$1, slug = \\$2 WHERE id = \\$3").
+					WithArgs("Hands-on workshops", "workshops", 1).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			expectedStatus: http.StatusOK,
+			expectedSlug:   "workshops",
+		},
+		{
+			name:       "Category not found",
+			categoryID: "9",
+			reqBody:    `{"name": "Talks"}`,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT id, name, slug FROM categories WHERE id = ?").
+					WithArgs(9).
+					WillReturnError(sql.ErrNoRows)
+			},
+			expectedStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPatch, "/categories/"+tc.categoryID, strings.NewReader(tc.reqBody))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+			c.SetParamNames("id")
+			c.SetParamValues(tc.categoryID)
+
+			db, mock, err := sqlmock.New()
+			assert.NoError(t, err)
+			defer db.Close()
+			tc.mockBehavior(mock)
+
+			repo := &repositories.CategoryRepository{DB: db}
+			err = handle(UpdateCategory(repo))(c)
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedStatus, rec.Code)
+			if tc.expectedStatus == http.StatusOK {
+				var response map[string]interface{}
+				assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+				assert.Equal(t, tc.expectedSlug, response["slug"])
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestDeleteCategory(t *testing.T) {
+	e := echo.New()
+
+	req := httptest.NewRequest(http.MethodDelete, "/categories/1", nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.SetParamNames("id")
+	c.SetParamValues("1")
+
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	mock.ExpectExec("DELETE FROM categories WHERE id = ?").
+		WithArgs(1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	repo := &repositories.CategoryRepository{DB: db}
+	err = handle(DeleteCategory(repo))(c)
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
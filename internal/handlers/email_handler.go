@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/xtommas/challenge-hetmo/internal/mailer"
+	"github.com/xtommas/challenge-hetmo/internal/models"
+	"github.com/xtommas/challenge-hetmo/internal/problem"
+	"github.com/xtommas/challenge-hetmo/internal/repositories"
+)
+
+// sendVerificationEmail emails the user a token that verifies their
+// email. The email is sent after responding, so a slow mail server
+// doesn't hold up the request
+func sendVerificationEmail(c echo.Context, userRepo *repositories.UserRepository, m mailer.Mailer, user *models.User) error {
+	token, expiresAt, err := userRepo.CreateEmailVerificationToken(user.Id, user.Email)
+	if err != nil {
+		return err
+	}
+
+	msg := mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your email",
+		Body: fmt.Sprintf("This email was added to the account %s.\n\n"+
+			"To verify it, send this token to POST /email/verify before %s:\n\n%s\n\n"+
+			"If it wasn't you, you can ignore this email.\n",
+			user.Username, expiresAt.UTC().Format(time.RFC1123), token),
+	}
+	logger := c.Logger()
+	go func() {
+		if err := m.Send(msg); err != nil {
+			logger.Errorf("Failed to send verification email to user %d: %v", user.Id, err)
+		}
+	}()
+	return nil
+}
+
+// VerifyEmail marks the email a verification token was sent to as
+// verified
+func VerifyEmail(userRepo *repositories.UserRepository, users *repositories.UserCache) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var input struct {
+			Token string `json:"token" validate:"required"`
+		}
+		if err := c.Bind(&input); err != nil {
+			return problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid request")
+		}
+
+		if err := c.Validate(input); err != nil {
+			return err
+		}
+
+		userID, err := userRepo.VerifyEmail(input.Token)
+		if err != nil {
+			if err == repositories.ErrInvalidVerificationToken {
+				return problem.New(http.StatusBadRequest, problem.CodeInvalidVerificationToken, "Invalid or expired verification token")
+			}
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to verify email")
+		}
+		users.Forget(userID)
+
+		return c.JSON(http.StatusOK, map[string]string{"message": "Email verified successfully"})
+	}
+}
+
+// ResendVerificationEmail emails the current user a new token to
+// verify their email, for when the previous one expired or got lost
+func ResendVerificationEmail(userRepo *repositories.UserRepository, m mailer.Mailer) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user, err := getCurrentUser(c, userRepo)
+		if err != nil {
+			return err
+		}
+
+		if user.Email == "" {
+			return problem.New(http.StatusBadRequest, problem.CodeEmailMissing, "Add an email to your profile first")
+		}
+		if user.EmailVerified() {
+			return problem.New(http.StatusConflict, problem.CodeEmailAlreadyVerified, "Email already verified")
+		}
+
+		if err := sendVerificationEmail(c, userRepo, m, user); err != nil {
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to send verification email")
+		}
+
+		return c.JSON(http.StatusOK, map[string]string{"message": "Verification email sent"})
+	}
+}
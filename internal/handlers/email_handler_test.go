@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/xtommas/challenge-hetmo/internal/mailer"
+	"github.com/xtommas/challenge-hetmo/internal/repositories"
+	"github.com/xtommas/challenge-hetmo/internal/validator"
+)
+
+// expectVerificationToken mocks storing a new email verification token
+// of the user
+func expectVerificationToken(mock sqlmock.Sqlmock, userID int64, email string) {
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE email_verification_tokens SET used_at = NOW()").
+		WithArgs(userID).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO email_verification_tokens").
+		WithArgs(userID, email, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+}
+
+func TestVerifyEmail(t *testing.T) {
+	e := echo.New()
+	e.Validator = validator.NewCustomValidator()
+
+	testCases := []struct {
+		name           string
+		reqBody        string
+		expectedStatus int
+		mockBehavior   func(mock sqlmock.Sqlmock)
+	}{
+		{
+			name:           "Valid token",
+			reqBody:        `{"token": "valid-token"}`,
+			expectedStatus: http.StatusOK,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("UPDATE email_verification_tokens SET used_at = NOW()").
+					WithArgs(sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id", "email"}).AddRow(1, "user@example.com"))
+				mock.ExpectExec("UPDATE users SET email_verified_at").
+					WithArgs(1, "user@example.com").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+		},
+		{
+			name:           "Token sent to a previous email",
+			reqBody:        `{"token": "old-token"}`,
+			expectedStatus: http.StatusBadRequest,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("UPDATE email_verification_tokens SET used_at = NOW()").
+					WithArgs(sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id", "email"}).AddRow(1, "old@example.com"))
+				mock.ExpectExec("UPDATE users SET email_verified_at").
+					WithArgs(1, "old@example.com").
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectRollback()
+			},
+		},
+		{
+			name:           "Unknown token",
+			reqBody:        `{"token": "unknown-token"}`,
+			expectedStatus: http.StatusBadRequest,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("UPDATE email_verification_tokens SET used_at = NOW()").
+					WithArgs(sqlmock.AnyArg()).
+					WillReturnError(sql.ErrNoRows)
+				mock.ExpectRollback()
+			},
+		},
+		{
+			name:           "Missing token",
+			reqBody:        `{}`,
+			expectedStatus: http.StatusBadRequest,
+			mockBehavior:   func(mock sqlmock.Sqlmock) {},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/email/verify", strings.NewReader(tc.reqBody))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+
+			db, mock, err := sqlmock.New()
+			assert.NoError(t, err)
+			defer db.Close()
+
+			tc.mockBehavior(mock)
+
+			userRepo := &repositories.UserRepository{DB: db}
+			err = handle(VerifyEmail(userRepo, repositories.NewUserCache(userRepo, time.Minute)))(c)
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedStatus, rec.Code)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestResendVerificationEmail(t *testing.T) {
+	e := echo.New()
+
+	testCases := []struct {
+		name           string
+		email          string
+		verifiedAt     interface{}
+		expectedStatus int
+	}{
+		{
+			name:           "Unverified email",
+			email:          "user@example.com",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Verified email",
+			email:          "user@example.com",
+			verifiedAt:     time.Now(),
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name:           "No email",
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/me/email/verify", nil)
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+			c.Set("user_id", int64(1))
+
+			db, mock, err := sqlmock.New()
+			assert.NoError(t, err)
+			defer db.Close()
+
+			mock.ExpectQuery("SELECT (.+) FROM users WHERE id = ?").
+				WithArgs(1).
+				WillReturnRows(newUserRows().AddRow(1, "user", "hashedpassword", nil, false, "", tc.email, tc.verifiedAt, "", "", "UTC", nil, false, "{}", "{}"))
+			if tc.expectedStatus == http.StatusOK {
+				expectVerificationToken(mock, 1, tc.email)
+			}
+
+			mail := mailer.NewMemoryMailer()
+			err = handle(ResendVerificationEmail(&repositories.UserRepository{DB: db}, mail))(c)
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedStatus, rec.Code)
+			if tc.expectedStatus == http.StatusOK {
+				assert.Eventually(t, func() bool { return len(mail.Sent()) == 1 }, time.Second, 10*time.Millisecond)
+				assert.Contains(t, mail.Sent()[0].Body, "POST /email/verify")
+			} else {
+				assert.Empty(t, mail.Sent())
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"database/sql"
+	"fmt"
 	"math"
 	"net/http"
 	"strconv"
@@ -10,73 +11,159 @@ import (
 
 	"github.com/labstack/echo/v4"
 	"github.com/xtommas/challenge-hetmo/internal/models"
+	"github.com/xtommas/challenge-hetmo/internal/problem"
 	"github.com/xtommas/challenge-hetmo/internal/repositories"
 )
 
 func CreateEvent(eventRepo *repositories.EventRepository) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		event := new(models.Event)
+		// Events have a waitlist and are in UTC unless told otherwise
+		event := &models.Event{WaitlistEnabled: true, Timezone: "UTC"}
 		if err := c.Bind(event); err != nil {
-			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+			return problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid request")
 		}
 
 		if err := c.Validate(event); err != nil {
-			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return err
 		}
+		if err := checkFutureDate(event.DateAndTime); err != nil {
+			return err
+		}
+
+		// The rest of the lifecycle goes through the transition endpoints
+		if event.Status != models.EventDraft && event.Status != models.EventPublished {
+			return problem.Invalid("status", "oneof", "must be draft or published for new events")
+		}
+
+		event.Tags = models.NormalizeTags(event.Tags)
+		// The creator can manage the event without further permissions
+		userID := c.Get("user_id").(int64)
+		event.CreatedBy = &userID
 
 		err := eventRepo.Create(event)
 		if err != nil {
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create event"})
+			switch err {
+			case repositories.ErrUnknownCategory:
+				return problem.New(http.StatusBadRequest, problem.CodeUnknownCategory, "Unknown category")
+			case repositories.ErrUnknownVenue:
+				return problem.New(http.StatusBadRequest, problem.CodeUnknownVenue, "Unknown venue")
+			}
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to create event")
 		}
 		return c.JSON(http.StatusCreated, event)
 	}
 }
 
+// checkFutureDate turns away the dates that already passed, for new
+// events and events that are moved. Events that already happened can
+// still be edited and completed
+func checkFutureDate(date time.Time) error {
+	if !date.After(time.Now()) {
+		return problem.Invalid("date_and_time", "gt", "must be in the future")
+	}
+	return nil
+}
+
+const (
+	// maxSearchLength is the longest accepted value for the q parameter
+	maxSearchLength = 200
+	// maxSuggestions is how many titles are offered when a search
+	// finds no events
+	maxSuggestions = 5
+)
+
 func GetAllEvents(eventRepo *repositories.EventRepository) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		isAdmin := c.Get("is_admin").(bool)
+		canViewDrafts := can(c, models.PermissionViewDrafts)
 
 		dateStartStr := c.QueryParam("date_start")
 		dateEndStr := c.QueryParam("date_end")
 		status := strings.ToLower(c.QueryParam("status"))
-		title := strings.ToLower(c.QueryParam("title"))
+		title := c.QueryParam("title")
+		organizer := c.QueryParam("organizer")
+		location := c.QueryParam("location")
+		category := c.QueryParam("category")
+		var tags []string
+		if tagsParam := c.QueryParam("tags"); tagsParam != "" {
+			tags = models.NormalizeTags(strings.Split(tagsParam, ","))
+		}
+		tagsMatch := c.QueryParam("tags_match")
+		search := strings.TrimSpace(c.QueryParam("q"))
+		sort := c.QueryParam("sort")
+		tz := c.QueryParam("tz")
 		// Pagination
 		pageParam := c.QueryParam("page")
 		limitParam := c.QueryParam("limit")
 
+		// Dates are days in the caller's time zone, UTC by default
+		loc := time.UTC
+		if tz != "" {
+			var err error
+			loc, err = models.LoadTimezone(tz)
+			if err != nil {
+				return problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid tz. Use an IANA time zone such as America/Argentina/Buenos_Aires.")
+			}
+		}
+
 		// Parse the dates into a time.Time
 		var dateStart, dateEnd time.Time
 		var err error
 
 		// Parse date_start if provided
 		if dateStartStr != "" {
-			dateStart, err = time.Parse("2006-01-02", dateStartStr)
+			dateStart, err = time.ParseInLocation("2006-01-02", dateStartStr, loc)
 			if err != nil {
-				return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid date_start format. Use YYYY-MM-DD."})
+				return problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid date_start format. Use YYYY-MM-DD.")
 			}
 		}
 
 		// Parse date_end if provided
 		if dateEndStr != "" {
-			dateEnd, err = time.Parse("2006-01-02", dateEndStr)
+			dateEnd, err = time.ParseInLocation("2006-01-02", dateEndStr, loc)
 			if err != nil {
-				return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid date_end format. Use YYYY-MM-DD."})
+				return problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid date_end format. Use YYYY-MM-DD.")
 			}
-			// Set end time to the end of the date_end day (23:59:59)
-			dateEnd = dateEnd.Add(24 * time.Hour).Add(-time.Second)
+			// Set end time to the end of the date_end day (23:59:59),
+			// which isn't 24 hours later when the clocks change
+			dateEnd = dateEnd.AddDate(0, 0, 1).Add(-time.Second)
 		}
 
-		// Admins can filter by status, but validate the status parameter
-		if isAdmin {
-			if status != "" && status != "draft" && status != "published" {
-				return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid status."})
-			}
-		} else {
-			// Non-admins can only see published events
-			if status != "" && status != "published" {
-				return c.JSON(http.StatusForbidden, map[string]string{"error": "Access denied"})
+		// Users who can see drafts can filter by any status, but validate the status parameter
+		if canViewDrafts {
+			if status != "" && !models.IsEventStatus(status) {
+				return problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid status.")
 			}
-			status = "published"
+		} else if status == "" {
+			// Everyone else gets the published events unless they ask otherwise
+			status = models.EventPublished
+		} else if !(&models.Event{Status: status}).IsPublic() {
+			// and they can't see drafts or archived events
+			return problem.New(http.StatusForbidden, problem.CodeForbidden, "Access denied")
+		}
+
+		if tagsMatch != "" && tagsMatch != "any" && tagsMatch != "all" {
+			return problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid tags_match. Use any or all.")
+		}
+
+		if len(search) > maxSearchLength {
+			return problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, fmt.Sprintf("Search query can't be longer than %d characters", maxSearchLength))
+		}
+
+		near, radiusKm, message := nearParams(c)
+		if message != "" {
+			return problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, message)
+		}
+
+		// Searches are sorted by relevance and searches near a point
+		// by distance unless told otherwise
+		if sort == "" && search != "" {
+			sort = "-" + repositories.RelevanceSort
+		} else if sort == "" && near != nil {
+			sort = repositories.DistanceSort
+		} else if sort == "" {
+			sort = repositories.DefaultEventSort
+		} else if !repositories.IsEventSort(sort, repositories.EventFilter{Query: search, Near: near}) {
+			return problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, invalidSortMessage)
 		}
 
 		// Default page and limit
@@ -94,20 +181,69 @@ func GetAllEvents(eventRepo *repositories.EventRepository) echo.HandlerFunc {
 			limit, err = strconv.Atoi(limitParam)
 			if err != nil || limit < 1 {
 				limit = 10
+			} else if limit > maxLimit {
+				limit = maxLimit
+			}
+		}
+
+		filter := repositories.EventFilter{
+			DateStart: dateStart,
+			DateEnd:   dateEnd,
+			Status:    status,
+			Title:     title,
+			Organizer: organizer,
+			Location:  location,
+			Category:  category,
+			Tags:      tags,
+			AllTags:   tagsMatch == "all",
+			Query:     search,
+			Near:      near,
+			RadiusKm:  radiusKm,
+		}
+
+		cursor, useCursor, err := cursorParam(c, sort)
+		if err != nil {
+			return problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid cursor")
+		}
+		if useCursor {
+			eventPage, err := eventRepo.GetPage(filter, sort, cursor, limit)
+			if err != nil {
+				return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to get events")
+			}
+			response := cursorResponse(eventPage, limit)
+
+			// Counting is slow on large lists, so it's only done on request
+			if includeTotal(c) {
+				total, err := eventRepo.GetTotalCount(filter)
+				if err != nil {
+					return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to get total count")
+				}
+				response["total"] = total
 			}
+
+			// Offer similar titles when the search found nothing at all
+			if search != "" && cursor == nil && len(eventPage.Events) == 0 {
+				suggestions, err := eventRepo.Suggest(filter, maxSuggestions)
+				if err != nil {
+					return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to get suggestions")
+				}
+				response["suggestions"] = suggestions
+			}
+
+			return c.JSON(http.StatusOK, response)
 		}
 
 		// Calculate offset
 		offset := (page - 1) * limit
 
-		events, err := eventRepo.GetAll(dateStart, dateEnd, status, title, limit, offset)
+		events, err := eventRepo.GetAll(filter, sort, limit, offset)
 		if err != nil {
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to get events"})
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to get events")
 		}
 
-		total, err := eventRepo.GetTotalCount(status, title, dateStart, dateEnd)
+		total, err := eventRepo.GetTotalCount(filter)
 		if err != nil {
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to get total count"})
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to get total count")
 		}
 
 		totalPages := int(math.Ceil(float64(total) / float64(limit)))
@@ -120,30 +256,45 @@ func GetAllEvents(eventRepo *repositories.EventRepository) echo.HandlerFunc {
 			"pages":  totalPages,
 		}
 
+		// Offer similar titles when the search found nothing
+		if search != "" && total == 0 {
+			suggestions, err := eventRepo.Suggest(filter, maxSuggestions)
+			if err != nil {
+				return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to get suggestions")
+			}
+			response["suggestions"] = suggestions
+		}
+
 		return c.JSON(http.StatusOK, response)
 	}
 }
 
 func GetEvent(eventRepo *repositories.EventRepository) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		isAdmin := c.Get("is_admin").(bool)
+		canViewDrafts := can(c, models.PermissionViewDrafts)
 		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
 		if err != nil {
-			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid ID"})
+			return problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid ID")
 		}
 		event, err := eventRepo.Get(id)
 		if err != nil {
 			if err == sql.ErrNoRows {
-				return c.JSON(http.StatusNotFound, map[string]string{"error": "Event not found"})
+				return problem.New(http.StatusNotFound, problem.CodeNotFound, "Event not found")
 			}
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to get event"})
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to get event")
 		}
 
-		if event.Status == "draft" && !isAdmin {
-			return c.JSON(http.StatusNotFound, map[string]string{"error": "Event not found"})
+		if !event.IsPublic() && !canViewDrafts {
+			return problem.New(http.StatusNotFound, problem.CodeNotFound, "Event not found")
 		}
 
-		return c.JSON(http.StatusOK, event)
+		userID, _ := c.Get("user_id").(int64)
+		availability, err := eventRepo.GetAvailability(event, userID)
+		if err != nil {
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to get event")
+		}
+
+		return c.JSON(http.StatusOK, models.EventDetails{Event: event, EventAvailability: *availability})
 	}
 }
 
@@ -151,80 +302,227 @@ func DeleteEvent(eventRepo *repositories.EventRepository) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
 		if err != nil {
-			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid ID"})
+			return problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid ID")
+		}
+		event, err := eventRepo.Get(id)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return problem.New(http.StatusNotFound, problem.CodeNotFound, "Event not found")
+			}
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to get event")
 		}
+		if !canManageEvent(c, event) {
+			return problem.New(http.StatusForbidden, problem.CodeNotEventOwner, notEventOwnerMessage)
+		}
+
 		err = eventRepo.Delete(id)
 		if err != nil {
 			if err == sql.ErrNoRows {
-				return c.JSON(http.StatusNotFound, map[string]string{"error": "Event not found"})
+				return problem.New(http.StatusNotFound, problem.CodeNotFound, "Event not found")
 			}
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to delete event"})
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to delete event")
 		}
 		return c.JSON(http.StatusOK, map[string]string{"message": "Event deleted successfully"})
 	}
 }
 
+// eventUpdate holds the fields sent to partially update an event
+type eventUpdate struct {
+	Title            *string    `json:"title"`
+	LongDescription  *string    `json:"long_description"`
+	ShortDescription *string    `json:"short_description"`
+	DateAndTime      *time.Time `json:"date_and_time"`
+	Timezone         *string    `json:"timezone"`
+	Organizer        *string    `json:"organizer"`
+	Location         *string    `json:"location"`
+	Status           *string    `json:"status"`
+	Capacity         *int       `json:"capacity"`
+	WaitlistEnabled  *bool      `json:"waitlist_enabled"`
+	Categories       *[]string  `json:"categories"`
+	Tags             *[]string  `json:"tags"`
+	VenueId          *int64     `json:"venue_id"`
+}
+
+// apply copies the fields that were sent into the event, except for
+// the status, which has to follow the event lifecycle
+func (input *eventUpdate) apply(event *models.Event) {
+	if input.Title != nil {
+		event.Title = *input.Title
+	}
+	if input.LongDescription != nil {
+		event.LongDescription = *input.LongDescription
+	}
+	if input.ShortDescription != nil {
+		event.ShortDescription = *input.ShortDescription
+	}
+	if input.DateAndTime != nil {
+		event.DateAndTime = *input.DateAndTime
+	}
+	if input.Timezone != nil {
+		event.Timezone = *input.Timezone
+	}
+	if input.Organizer != nil {
+		event.Organizer = *input.Organizer
+	}
+	if input.Location != nil {
+		event.Location = *input.Location
+	}
+	if input.Capacity != nil {
+		// A capacity of 0 removes the seat limit
+		if *input.Capacity == 0 {
+			event.Capacity = nil
+		} else {
+			capacity := *input.Capacity
+			event.Capacity = &capacity
+		}
+	}
+	if input.WaitlistEnabled != nil {
+		event.WaitlistEnabled = *input.WaitlistEnabled
+	}
+	if input.Categories != nil {
+		event.Categories = *input.Categories
+	}
+	if input.Tags != nil {
+		event.Tags = models.NormalizeTags(*input.Tags)
+	}
+	if input.VenueId != nil {
+		// A venue id of 0 unlinks the venue
+		if *input.VenueId == 0 {
+			event.VenueId = nil
+		} else {
+			venueId := *input.VenueId
+			event.VenueId = &venueId
+		}
+		// The venue is read again with the event
+		event.Venue = nil
+	}
+}
+
 func UpdateEvent(eventRepo *repositories.EventRepository) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
 		if err != nil {
-			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid ID"})
+			return problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid ID")
 		}
 		event, err := eventRepo.Get(id)
 		if err != nil {
 			if err == sql.ErrNoRows {
-				return c.JSON(http.StatusNotFound, map[string]string{"error": "Event not found"})
+				return problem.New(http.StatusNotFound, problem.CodeNotFound, "Event not found")
 			}
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to get event"})
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to get event")
 		}
-
-		var input struct {
-			Title            *string    `json:"title"`
-			LongDescription  *string    `json:"long_description"`
-			ShortDescription *string    `json:"short_description"`
-			DateAndTime      *time.Time `json:"date_and_time"`
-			Organizer        *string    `json:"organizer"`
-			Location         *string    `json:"location"`
-			Status           *string    `json:"status"`
+		if !canManageEvent(c, event) {
+			return problem.New(http.StatusForbidden, problem.CodeNotEventOwner, notEventOwnerMessage)
 		}
 
+		var input eventUpdate
 		if err := c.Bind(&input); err != nil {
-			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+			return problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid request")
 		}
 
-		if input.Title != nil {
-			event.Title = *input.Title
-		}
-		if input.LongDescription != nil {
-			event.LongDescription = *input.LongDescription
+		input.apply(event)
+		// The status goes last, as completing an event depends on its date
+		if input.Status != nil && *input.Status != event.Status {
+			if !models.IsEventStatus(*input.Status) {
+				return problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid status.")
+			}
+			if err := checkEventTransition(eventRepo, event, *input.Status); err != nil {
+				return eventTransitionError(event, *input.Status, err)
+			}
+			event.Status = *input.Status
 		}
-		if input.ShortDescription != nil {
-			event.ShortDescription = *input.ShortDescription
+
+		if err := c.Validate(event); err != nil {
+			return err
 		}
 		if input.DateAndTime != nil {
-			event.DateAndTime = *input.DateAndTime
+			if err := checkFutureDate(event.DateAndTime); err != nil {
+				return err
+			}
 		}
-		if input.Organizer != nil {
-			event.Organizer = *input.Organizer
+
+		err = eventRepo.Update(event)
+		if err != nil {
+			switch err {
+			case sql.ErrNoRows:
+				return problem.New(http.StatusNotFound, problem.CodeNotFound, "Event not found")
+			case repositories.ErrUnknownCategory:
+				return problem.New(http.StatusBadRequest, problem.CodeUnknownCategory, "Unknown category")
+			case repositories.ErrUnknownVenue:
+				return problem.New(http.StatusBadRequest, problem.CodeUnknownVenue, "Unknown venue")
+			case models.ErrEventHasSignUps:
+				return eventTransitionError(event, models.EventDraft, err)
+			}
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to update event")
+		}
+		return c.JSON(http.StatusOK, event)
+	}
+}
+
+// TransitionEvent moves an event to the given status of its lifecycle
+func TransitionEvent(eventRepo *repositories.EventRepository, status string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid ID")
 		}
-		if input.Location != nil {
-			event.Location = *input.Location
+		event, err := eventRepo.Get(id)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return problem.New(http.StatusNotFound, problem.CodeNotFound, "Event not found")
+			}
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to get event")
 		}
-		if input.Status != nil {
-			event.Status = *input.Status
+		if !canManageEvent(c, event) {
+			return problem.New(http.StatusForbidden, problem.CodeNotEventOwner, notEventOwnerMessage)
 		}
 
-		if err := c.Validate(event); err != nil {
-			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		if err := checkEventTransition(eventRepo, event, status); err != nil {
+			return eventTransitionError(event, status, err)
 		}
 
-		err = eventRepo.Update(event)
+		// The sign ups are checked again along with the update, in case
+		// someone signed up in between
+		err = eventRepo.UpdateStatus(event.Id, event.Status, status)
 		if err != nil {
-			if err == sql.ErrNoRows {
-				return c.JSON(http.StatusNotFound, map[string]string{"error": "Event not found"})
+			switch err {
+			case sql.ErrNoRows:
+				return problem.New(http.StatusConflict, problem.CodeEditConflict, "The event was modified, try again")
+			case models.ErrEventHasSignUps:
+				return eventTransitionError(event, status, err)
 			}
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update event"})
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to update event")
 		}
+
+		event.Status = status
 		return c.JSON(http.StatusOK, event)
 	}
 }
+
+// checkEventTransition checks that the event can move to the given status,
+// looking up its sign ups only when the transition depends on them
+func checkEventTransition(eventRepo *repositories.EventRepository, event *models.Event, status string) error {
+	hasSignUps := false
+	if status == models.EventDraft {
+		var err error
+		hasSignUps, err = eventRepo.HasSignUps(event.Id)
+		if err != nil {
+			return err
+		}
+	}
+	return event.CheckTransition(status, hasSignUps)
+}
+
+// eventTransitionError returns the problem for a failed
+// checkEventTransition
+func eventTransitionError(event *models.Event, status string, err error) error {
+	switch err {
+	case models.ErrInvalidTransition:
+		return problem.New(http.StatusConflict, problem.CodeInvalidStatusTransition, fmt.Sprintf("Can't change the event status from %s to %s", event.Status, status))
+	case models.ErrEventHasSignUps:
+		return problem.New(http.StatusConflict, problem.CodeEventHasSignUps, "Events with sign ups can't go back to draft")
+	case models.ErrEventNotFinished:
+		return problem.New(http.StatusConflict, problem.CodeEventNotHappened, "Events can't be completed before they happen")
+	}
+	return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to update event")
+}
@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"database/sql"
+	"database/sql/driver"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -14,16 +15,82 @@ import (
 	"github.com/labstack/echo/v4"
 	"github.com/stretchr/testify/assert"
 	"github.com/xtommas/challenge-hetmo/internal/models"
+	"github.com/xtommas/challenge-hetmo/internal/problem"
 	"github.com/xtommas/challenge-hetmo/internal/repositories"
 	"github.com/xtommas/challenge-hetmo/internal/validator"
 )
 
+// newEventRows returns the mocked rows for a query that selects events
+// newEventColumns returns the columns selected for an event
+// adminPermissions are the permissions of the admin role
+var adminPermissions = models.Permissions{
+	models.PermissionViewDrafts,
+	models.PermissionCreateEvents,
+	models.PermissionUpdateEvents,
+	models.PermissionDeleteEvents,
+	models.PermissionManageAnyEvent,
+	models.PermissionCheckIn,
+	models.PermissionManageCategories,
+	models.PermissionManageVenues,
+	models.PermissionManageUsers,
+}
+
+func newEventColumns() []string {
+	return []string{"id", "title", "long_description", "short_description", "date_and_time", "timezone", "organizer", "location", "status", "capacity", "waitlist_enabled", "series_id", "sequence", "created_at", "updated_at", "categories", "tags", "venue_id", "venue", "created_by"}
+}
+
+func newEventRows() *sqlmock.Rows {
+	return sqlmock.NewRows(newEventColumns())
+}
+
+// eventValues returns the values of the event columns for the event.
+// Any extra values are appended after them
+func eventValues(event models.Event, extra ...driver.Value) []driver.Value {
+	var capacity interface{}
+	if event.Capacity != nil {
+		capacity = int64(*event.Capacity)
+	}
+	var seriesID interface{}
+	if event.SeriesId != nil {
+		seriesID = *event.SeriesId
+	}
+	categories := "{" + strings.Join(event.Categories, ",") + "}"
+	tags := "{" + strings.Join(event.Tags, ",") + "}"
+	// Events are stored in UTC unless told otherwise
+	timezone := event.Timezone
+	if timezone == "" {
+		timezone = "UTC"
+	}
+	var venueID, venue interface{}
+	if event.VenueId != nil {
+		venueID = *event.VenueId
+	}
+	if event.Venue != nil {
+		venue, _ = json.Marshal(event.Venue)
+	}
+	var createdBy interface{}
+	if event.CreatedBy != nil {
+		createdBy = *event.CreatedBy
+	}
+	values := []driver.Value{event.Id, event.Title, event.LongDescription, event.ShortDescription, event.DateAndTime, timezone, event.Organizer, event.Location, event.Status, capacity, event.WaitlistEnabled, seriesID, event.Sequence, event.CreatedAt, event.UpdatedAt, categories, tags, venueID, venue, createdBy}
+	return append(values, extra...)
+}
+
+// addEventRow appends the event to the mocked rows
+func addEventRow(rows *sqlmock.Rows, event models.Event) *sqlmock.Rows {
+	return rows.AddRow(eventValues(event)...)
+}
+
+func intPtr(i int) *int {
+	return &i
+}
+
 func TestCreateEvent(t *testing.T) {
 	// Setup
 	e := echo.New()
 	e.Validator = validator.NewCustomValidator()
 
-	eventTime, err := time.Parse(time.RFC3339, "2025-05-01T15:00:00Z")
+	eventTime, err := time.Parse(time.RFC3339, "2099-05-01T15:00:00Z")
 	if err != nil {
 		t.Fatalf("an error '%s' was not expected when parsing time", err)
 	}
@@ -33,16 +100,19 @@ func TestCreateEvent(t *testing.T) {
 		"title": "Test Event",
 		"long_description": "This is a test event",
 		"short_description": "Test",
-		"date_and_time": "2025-05-01T15:00:00Z",
+		"date_and_time": "2099-05-01T15:00:00Z",
 		"organizer": "Test Org",
 		"location": "Test Location",
-		"status": "draft"
+		"status": "draft",
+		"categories": ["talks"],
+		"tags": ["Go", " go", "Backend"]
 	}`
 
 	req := httptest.NewRequest(http.MethodPost, "/events", strings.NewReader(reqBody))
 	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
 	rec := httptest.NewRecorder()
 	c := e.NewContext(req, rec)
+	c.Set("user_id", int64(4))
 
 	// Mock database
 	db, mock, err := sqlmock.New()
@@ -51,25 +121,44 @@ func TestCreateEvent(t *testing.T) {
 	}
 	defer db.Close()
 
-	// Set up the expected query with lowercase title, organizer, and location
+	// Set up the expected query, keeping the casing of the fields
+	mock.ExpectBegin()
 	mock.ExpectQuery(`INSERT INTO events`).
 		WithArgs(
-			"test event",
+			"Test Event",
 			"This is a test event",
 			"Test",
 			eventTime,
-			"test org",
-			"test location",
+			"UTC",
+			"Test Org",
+			"Test Location",
 			"draft",
+			nil,
+			true,
+			nil,
+			nil,
+			// The creator is recorded as the owner of the event
+			int64(4),
 		).
-		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow(1, time.Now(), time.Now()))
+	mock.ExpectExec(`INSERT INTO event_categories`).
+		WithArgs(1, `{"talks"}`).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	// Tags are stored lowercased and without repetitions
+	mock.ExpectExec(`INSERT INTO tags`).
+		WithArgs(`{"go","backend"}`).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`INSERT INTO event_tags`).
+		WithArgs(1, `{"go","backend"}`).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
 
 	// Create a repository with the mock db
 	repo := &repositories.EventRepository{DB: db}
 
 	// Call the handler
 	handler := CreateEvent(repo)
-	err = handler(c)
+	err = handle(handler)(c)
 
 	// Assertions
 	if assert.NoError(t, err) {
@@ -82,15 +171,17 @@ func TestCreateEvent(t *testing.T) {
 
 		// Check the response values
 		assert.Equal(t, int64(1), responseEvent.Id)
-		assert.Equal(t, "test event", responseEvent.Title)
+		assert.Equal(t, "Test Event", responseEvent.Title)
 		assert.Equal(t, "This is a test event", responseEvent.LongDescription)
 		assert.Equal(t, "Test", responseEvent.ShortDescription)
-		assert.Equal(t, "test org", responseEvent.Organizer)
-		assert.Equal(t, "test location", responseEvent.Location)
+		assert.Equal(t, "Test Org", responseEvent.Organizer)
+		assert.Equal(t, "Test Location", responseEvent.Location)
 		assert.Equal(t, "draft", responseEvent.Status)
+		assert.Equal(t, []string{"talks"}, responseEvent.Categories)
+		assert.Equal(t, []string{"go", "backend"}, responseEvent.Tags)
 
 		// Parse and check the date
-		expectedTime, _ := time.Parse(time.RFC3339, "2025-05-01T15:00:00Z")
+		expectedTime, _ := time.Parse(time.RFC3339, "2099-05-01T15:00:00Z")
 		assert.Equal(t, expectedTime, responseEvent.DateAndTime)
 	}
 
@@ -116,30 +207,34 @@ func TestCreateEventInvalidInput(t *testing.T) {
 
 	// Call the handler
 	handler := CreateEvent(repo)
-	err := handler(c)
+	err := handle(handler)(c)
 
 	// Assertions
 	assert.NoError(t, err)
 	assert.Equal(t, http.StatusBadRequest, rec.Code)
 
-	var response map[string]string
+	var response problem.Problem
 	err = json.Unmarshal(rec.Body.Bytes(), &response)
 	assert.NoError(t, err)
+	assert.Equal(t, problem.CodeValidationFailed, response.Code)
 
-	// Check that the error message contains validation errors for all required fields
-	assert.Contains(t, response["error"], "Field validation for 'Title' failed")
-	assert.Contains(t, response["error"], "Field validation for 'LongDescription' failed")
-	assert.Contains(t, response["error"], "Field validation for 'ShortDescription' failed")
-	assert.Contains(t, response["error"], "Field validation for 'DateAndTime' failed")
-	assert.Contains(t, response["error"], "Field validation for 'Organizer' failed")
-	assert.Contains(t, response["error"], "Field validation for 'Location' failed")
-	assert.Contains(t, response["error"], "Field validation for 'Status' failed")
+	// Check that there are validation errors for all required fields
+	fields := map[string]problem.FieldError{}
+	for _, fieldError := range response.Errors {
+		fields[fieldError.Field] = fieldError
+	}
+	for _, field := range []string{"title", "long_description", "short_description", "date_and_time", "organizer", "location", "status"} {
+		if assert.Contains(t, fields, field) {
+			assert.Equal(t, "required", fields[field].Code)
+			assert.Equal(t, "is required", fields[field].Message)
+		}
+	}
 }
 
 func TestCreateEventDatabaseError(t *testing.T) {
 	// Set up
 	e := echo.New()
-	eventTime := time.Date(2025, 5, 1, 15, 0, 0, 0, time.UTC)
+	eventTime := time.Date(2099, 5, 1, 15, 0, 0, 0, time.UTC)
 	reqBody := fmt.Sprintf(`{
 		"title": "Test Event",
 		"long_description": "This is a test event",
@@ -153,6 +248,7 @@ func TestCreateEventDatabaseError(t *testing.T) {
 	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
 	rec := httptest.NewRecorder()
 	c := e.NewContext(req, rec)
+	c.Set("user_id", int64(4))
 
 	// Create a mock validator
 	e.Validator = validator.NewCustomValidator()
@@ -162,23 +258,26 @@ func TestCreateEventDatabaseError(t *testing.T) {
 	assert.NoError(t, err)
 	defer db.Close()
 
+	mock.ExpectBegin()
 	mock.ExpectQuery(`INSERT INTO events`).WillReturnError(fmt.Errorf("database error"))
+	mock.ExpectRollback()
 
 	// Create a mock repository
 	repo := &repositories.EventRepository{DB: db}
 
 	// Call the handler
 	handler := CreateEvent(repo)
-	err = handler(c)
+	err = handle(handler)(c)
 
 	// Assertions
 	assert.NoError(t, err)
 	assert.Equal(t, http.StatusInternalServerError, rec.Code)
 
-	var response map[string]string
+	var response map[string]interface{}
 	err = json.Unmarshal(rec.Body.Bytes(), &response)
 	assert.NoError(t, err)
-	assert.Equal(t, "Failed to create event", response["error"])
+	assert.Equal(t, "Failed to create event", response["detail"])
+	assert.Equal(t, problem.CodeInternal, response["code"])
 
 	// Ensure all expectations were met
 	assert.NoError(t, mock.ExpectationsWereMet())
@@ -231,6 +330,26 @@ func TestGetAllEvents(t *testing.T) {
 			expectedEvents: nil,
 			expectError:    true,
 		},
+		{
+			name:           "Non-admin filters by cancelled status",
+			isAdmin:        false,
+			queryParams:    "status=cancelled",
+			expectedStatus: http.StatusOK,
+			expectedEvents: []models.Event{
+				{Id: 3, Title: "event 3", Status: "cancelled", DateAndTime: eventTime},
+			},
+			expectedTotal: 1,
+			expectedPages: 1,
+			expectError:   false,
+		},
+		{
+			name:           "Non-admin tries to filter by archived status",
+			isAdmin:        false,
+			queryParams:    "status=archived",
+			expectedStatus: http.StatusForbidden,
+			expectedEvents: nil,
+			expectError:    true,
+		},
 		{
 			name:           "Pagination test",
 			isAdmin:        true,
@@ -252,7 +371,9 @@ func TestGetAllEvents(t *testing.T) {
 			req := httptest.NewRequest(http.MethodGet, "/events?"+tc.queryParams, nil)
 			rec := httptest.NewRecorder()
 			c := e.NewContext(req, rec)
-			c.Set("is_admin", tc.isAdmin)
+			if tc.isAdmin {
+				c.Set("permissions", adminPermissions)
+			}
 
 			// Mock database
 			db, mock, err := sqlmock.New()
@@ -261,9 +382,9 @@ func TestGetAllEvents(t *testing.T) {
 
 			// Set up mock expectations for successful test cases
 			if tc.expectedStatus == http.StatusOK && !tc.expectError {
-				rows := sqlmock.NewRows([]string{"id", "title", "long_description", "short_description", "date_and_time", "organizer", "location", "status"})
+				rows := newEventRows()
 				for _, event := range tc.expectedEvents {
-					rows.AddRow(event.Id, event.Title, event.LongDescription, event.ShortDescription, event.DateAndTime, event.Organizer, event.Location, event.Status)
+					addEventRow(rows, event)
 				}
 				mock.ExpectQuery("SELECT (.+) FROM events").WillReturnRows(rows)
 
@@ -277,7 +398,7 @@ func TestGetAllEvents(t *testing.T) {
 
 			// Call the handler
 			handler := GetAllEvents(repo)
-			err = handler(c)
+			err = handle(handler)(c)
 
 			// Assertions
 			assert.NoError(t, err)
@@ -306,10 +427,10 @@ func TestGetAllEvents(t *testing.T) {
 				assert.Equal(t, float64(tc.expectedPages), response["pages"])
 			} else if tc.expectError {
 				// For error responses, unmarshal the error message
-				var errorResponse map[string]string
+				var errorResponse map[string]interface{}
 				err = json.Unmarshal(rec.Body.Bytes(), &errorResponse)
 				assert.NoError(t, err)
-				assert.Contains(t, errorResponse, "error")
+				assert.Contains(t, errorResponse, "detail")
 			}
 
 			// Ensure all expectations were met
@@ -318,18 +439,401 @@ func TestGetAllEvents(t *testing.T) {
 	}
 }
 
-func TestGetEvent(t *testing.T) {
+func TestGetAllEventsTextFilters(t *testing.T) {
+	// Setup
+	e := echo.New()
+	e.Validator = validator.NewCustomValidator()
+
+	req := httptest.NewRequest(http.MethodGet, "/events?title=Go+100%25&organizer=GDG&location=buenos_aires", nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.Set("permissions", adminPermissions)
+
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	// The filters ignore case, and their wildcards are matched literally
+	rows := addEventRow(newEventRows(), models.Event{Id: 1, Title: "Go 100% Buenos Aires", Organizer: "GDG Buenos Aires", Location: "Buenos_Aires", Status: "published"})
+	mock.ExpectQuery(`SELECT (.+) FROM events e WHERE 1=1 AND e.title ILIKE \$1 AND e.organizer ILIKE \$2 AND e.location ILIKE \$3`).
+		WithArgs(`%Go 100\%%`, "%GDG%", `%buenos\_aires%`, 10, 0).
+		WillReturnRows(rows)
+	mock.ExpectQuery("SELECT COUNT(.+) FROM events").
+		WithArgs(`%Go 100\%%`, "%GDG%", `%buenos\_aires%`).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+
+	repo := &repositories.EventRepository{DB: db}
+	err = handle(GetAllEvents(repo))(c)
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var response map[string]interface{}
+	err = json.Unmarshal(rec.Body.Bytes(), &response)
+	assert.NoError(t, err)
+	events := response["events"].([]interface{})
+	assert.Equal(t, "Go 100% Buenos Aires", events[0].(map[string]interface{})["title"])
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGetAllEventsTaxonomyFilters(t *testing.T) {
 	// Setup
 	e := echo.New()
 	e.Validator = validator.NewCustomValidator()
 
-	// Test cases
 	testCases := []struct {
 		name           string
-		isAdmin        bool
-		eventID        string
+		queryParams    string
+		expectedQuery  string
+		expectedArgs   []driver.Value
 		expectedStatus int
-		expectedEvent  *models.Event
+	}{
+		{
+			name:          "Filter by category and any tag",
+			queryParams:   "category=workshops&tags=Go,docker",
+			expectedQuery: `AND c.slug = \$2\) AND EXISTS \(SELECT 1 FROM event_tags et JOIN tags t ON t.id = et.tag_id WHERE et.event_id = e.id AND t.name = ANY\(\$3\)\)`,
+			expectedArgs:  []driver.Value{"published", "workshops", `{"go","docker"}`},
+		},
+		{
+			name:          "Filter by all tags",
+			queryParams:   "tags=go,docker,go&tags_match=all",
+			expectedQuery: `WHERE et.event_id = e.id AND t.name = ANY\(\$2\)\) = 2`,
+			expectedArgs:  []driver.Value{"published", `{"go","docker"}`},
+		},
+		{
+			name:           "Invalid tags_match",
+			queryParams:    "tags=go&tags_match=some",
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/events?"+tc.queryParams, nil)
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+
+			db, mock, err := sqlmock.New()
+			assert.NoError(t, err)
+			defer db.Close()
+
+			if tc.expectedQuery != "" {
+				rows := addEventRow(newEventRows(), models.Event{Id: 1, Title: "Docker for gophers", Status: "published", Categories: []string{"workshops"}, Tags: []string{"docker", "go"}})
+				mock.ExpectQuery("SELECT (.+) FROM events e WHERE (.+)" + tc.expectedQuery).
+					WithArgs(append(tc.expectedArgs, 10, 0)...).
+					WillReturnRows(rows)
+				mock.ExpectQuery("SELECT COUNT(.+) FROM events e WHERE (.+)" + tc.expectedQuery).
+					WithArgs(tc.expectedArgs...).
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+			}
+
+			repo := &repositories.EventRepository{DB: db}
+			err = handle(GetAllEvents(repo))(c)
+			assert.NoError(t, err)
+
+			if tc.expectedStatus != 0 {
+				assert.Equal(t, tc.expectedStatus, rec.Code)
+			} else {
+				assert.Equal(t, http.StatusOK, rec.Code)
+				var response map[string]interface{}
+				assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+				event := response["events"].([]interface{})[0].(map[string]interface{})
+				assert.Equal(t, []interface{}{"workshops"}, event["categories"])
+				assert.Equal(t, []interface{}{"docker", "go"}, event["tags"])
+			}
+
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestGetAllEventsCursor(t *testing.T) {
+	// Setup
+	e := echo.New()
+	e.Validator = validator.NewCustomValidator()
+
+	eventTime := time.Date(2099, time.June, 1, 0, 0, 0, 0, time.UTC)
+	sortedRows := func(ids ...int64) *sqlmock.Rows {
+		rows := sqlmock.NewRows(append(newEventColumns(), "sort_value"))
+		for _, id := range ids {
+			event := models.Event{Id: id, Title: fmt.Sprintf("event %d", id), Status: "published", DateAndTime: eventTime}
+			rows.AddRow(eventValues(event, fmt.Sprintf("2099-06-01 00:00:%02d", id))...)
+		}
+		return rows
+	}
+	next := &repositories.Cursor{Sort: "date_and_time", Value: "2099-06-01 00:00:02", Id: 2}
+	prev := &repositories.Cursor{Sort: "date_and_time", Value: "2099-06-01 00:00:03", Id: 3, Before: true}
+
+	testCases := []struct {
+		name           string
+		queryParams    string
+		mockDB         func(mock sqlmock.Sqlmock)
+		expectedStatus int
+		expectedIds    []float64
+		expectedNext   *repositories.Cursor
+		expectedPrev   *repositories.Cursor
+		expectedTotal  interface{}
+	}{
+		{
+			name:        "First page",
+			queryParams: "cursor=&limit=2",
+			mockDB: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT (.+), \(e.date_and_time\)::text FROM events e WHERE 1=1 AND e.status = \$1 ORDER BY e.date_and_time ASC, e.id ASC LIMIT \$2`).
+					WithArgs("published", 3).
+					WillReturnRows(sortedRows(1, 2, 3))
+			},
+			expectedStatus: http.StatusOK,
+			expectedIds:    []float64{1, 2},
+			expectedNext:   next,
+		},
+		{
+			name:        "Next page with total",
+			queryParams: "cursor=" + next.Encode() + "&limit=2&include_total=true",
+			mockDB: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT (.+) WHERE 1=1 AND e.status = \$1 AND \(e.date_and_time, e.id\) > \(CAST\(\$2 AS timestamptz\), \$3\) ORDER BY e.date_and_time ASC, e.id ASC LIMIT \$4`).
+					WithArgs("published", next.Value, next.Id, 3).
+					WillReturnRows(sortedRows(3))
+				mock.ExpectQuery("SELECT COUNT(.+) FROM events").
+					WithArgs("published").
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+			},
+			expectedStatus: http.StatusOK,
+			expectedIds:    []float64{3},
+			expectedPrev:   prev,
+			expectedTotal:  float64(3),
+		},
+		{
+			name:        "Previous page",
+			queryParams: "cursor=" + prev.Encode() + "&limit=2",
+			mockDB: func(mock sqlmock.Sqlmock) {
+				// Read backwards and returned in order
+				mock.ExpectQuery(`SELECT (.+) AND \(e.date_and_time, e.id\) < \(CAST\(\$2 AS timestamptz\), \$3\) ORDER BY e.date_and_time DESC, e.id DESC LIMIT \$4`).
+					WithArgs("published", prev.Value, prev.Id, 3).
+					WillReturnRows(sortedRows(2, 1))
+			},
+			expectedStatus: http.StatusOK,
+			expectedIds:    []float64{1, 2},
+			expectedNext:   next,
+		},
+		{
+			name:        "Limit is capped",
+			queryParams: "cursor=&limit=1000",
+			mockDB: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT (.+) FROM events").
+					WithArgs("published", 101).
+					WillReturnRows(sortedRows(1))
+			},
+			expectedStatus: http.StatusOK,
+			expectedIds:    []float64{1},
+		},
+		{
+			name:           "Invalid cursor",
+			queryParams:    "cursor=not-a-cursor",
+			mockDB:         func(mock sqlmock.Sqlmock) {},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Cursor from another sort",
+			queryParams:    "cursor=" + next.Encode() + "&sort=-date_and_time",
+			mockDB:         func(mock sqlmock.Sqlmock) {},
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/events?"+tc.queryParams, nil)
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+
+			db, mock, err := sqlmock.New()
+			assert.NoError(t, err)
+			defer db.Close()
+			tc.mockDB(mock)
+
+			repo := &repositories.EventRepository{DB: db}
+			err = handle(GetAllEvents(repo))(c)
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedStatus, rec.Code)
+
+			if tc.expectedStatus == http.StatusOK {
+				var response map[string]interface{}
+				err = json.Unmarshal(rec.Body.Bytes(), &response)
+				assert.NoError(t, err)
+
+				ids := []float64{}
+				events, _ := response["events"].([]interface{})
+				for _, event := range events {
+					ids = append(ids, event.(map[string]interface{})["id"].(float64))
+				}
+				assert.Equal(t, tc.expectedIds, ids)
+
+				for key, expected := range map[string]*repositories.Cursor{"next_cursor": tc.expectedNext, "prev_cursor": tc.expectedPrev} {
+					if expected == nil {
+						assert.Nil(t, response[key], key)
+					} else {
+						assert.Equal(t, expected.Encode(), response[key], key)
+					}
+				}
+				assert.Equal(t, tc.expectedTotal, response["total"])
+				assert.NotContains(t, response, "page")
+			}
+
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestGetAllEventsSearch(t *testing.T) {
+	// Setup
+	e := echo.New()
+	e.Validator = validator.NewCustomValidator()
+
+	eventTime := time.Date(2099, time.June, 1, 0, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name                string
+		queryParams         string
+		mockDB              func(mock sqlmock.Sqlmock)
+		expectedStatus      int
+		expectedIds         []float64
+		expectedSnippet     string
+		expectedSuggestions []interface{}
+	}{
+		{
+			name:        "Search returns ranked matches",
+			queryParams: "q=go+meetup",
+			mockDB: func(mock sqlmock.Sqlmock) {
+				columns := append(newEventColumns(), "rank", "title_headline", "snippet")
+				rows := sqlmock.NewRows(columns).
+					AddRow(eventValues(models.Event{Id: 2, Title: "Go Meetup", Status: "published", DateAndTime: eventTime},
+						0.6, "<mark>Go</mark> <mark>Meetup</mark>", "Monthly <mark>Go</mark> talks")...).
+					AddRow(eventValues(models.Event{Id: 1, Title: "Gophers", Status: "published", DateAndTime: eventTime},
+						0.2, "Gophers", "A <mark>meetup</mark> about <mark>Go</mark>")...)
+				mock.ExpectQuery(`SELECT (.+) ts_rank\(e.search_vector, query\),(.+)ts_headline\('simple', replace\((.+)'<', '&lt;'(.+) FROM events e CROSS JOIN websearch_to_tsquery\('simple', \$1\) query WHERE 1=1 AND e.search_vector @@ query AND e.status = \$2 ORDER BY ts_rank\(e.search_vector, query\) DESC, e.id DESC LIMIT`).
+					WithArgs("go meetup", "published", 10, 0).
+					WillReturnRows(rows)
+				mock.ExpectQuery("SELECT COUNT(.+) FROM events e CROSS JOIN websearch_to_tsquery").
+					WithArgs("go meetup", "published").
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+			},
+			expectedStatus:  http.StatusOK,
+			expectedIds:     []float64{2, 1},
+			expectedSnippet: "Monthly <mark>Go</mark> talks",
+		},
+		{
+			name:        "Search without matches suggests titles",
+			queryParams: "q=meetp",
+			mockDB: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT (.+) FROM events e CROSS JOIN websearch_to_tsquery").
+					WithArgs("meetp", "published", 10, 0).
+					WillReturnRows(sqlmock.NewRows(append(newEventColumns(), "rank", "title_headline", "snippet")))
+				mock.ExpectQuery("SELECT COUNT(.+) FROM events e CROSS JOIN websearch_to_tsquery").
+					WithArgs("meetp", "published").
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+				mock.ExpectQuery(`SELECT e.title FROM events e WHERE 1=1 AND e.status = \$1 AND \$2 <% e.title`).
+					WithArgs("published", "meetp", 5).
+					WillReturnRows(sqlmock.NewRows([]string{"title"}).AddRow("Go Meetup"))
+			},
+			expectedStatus:      http.StatusOK,
+			expectedIds:         []float64{},
+			expectedSuggestions: []interface{}{"Go Meetup"},
+		},
+		{
+			name:        "Search sorted by date",
+			queryParams: "q=meetup&sort=-date_and_time",
+			mockDB: func(mock sqlmock.Sqlmock) {
+				columns := append(newEventColumns(), "rank", "title_headline", "snippet")
+				rows := sqlmock.NewRows(columns).
+					AddRow(eventValues(models.Event{Id: 1, Title: "Gophers", Status: "published", DateAndTime: eventTime},
+						0.2, "Gophers", "A <mark>meetup</mark> about Go")...)
+				mock.ExpectQuery(`SELECT (.+) ORDER BY e.date_and_time DESC, e.id DESC LIMIT`).
+					WithArgs("meetup", "published", 10, 0).
+					WillReturnRows(rows)
+				mock.ExpectQuery("SELECT COUNT(.+) FROM events e CROSS JOIN websearch_to_tsquery").
+					WithArgs("meetup", "published").
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+			},
+			expectedStatus:  http.StatusOK,
+			expectedIds:     []float64{1},
+			expectedSnippet: "A <mark>meetup</mark> about Go",
+		},
+		{
+			name:           "Invalid sort",
+			queryParams:    "q=meetup&sort=rank",
+			mockDB:         func(mock sqlmock.Sqlmock) {},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Search query too long",
+			queryParams:    "q=" + strings.Repeat("a", 201),
+			mockDB:         func(mock sqlmock.Sqlmock) {},
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/events?"+tc.queryParams, nil)
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+
+			db, mock, err := sqlmock.New()
+			assert.NoError(t, err)
+			defer db.Close()
+			tc.mockDB(mock)
+
+			repo := &repositories.EventRepository{DB: db}
+			err = handle(GetAllEvents(repo))(c)
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedStatus, rec.Code)
+
+			if tc.expectedStatus == http.StatusOK {
+				var response map[string]interface{}
+				err = json.Unmarshal(rec.Body.Bytes(), &response)
+				assert.NoError(t, err)
+
+				ids := []float64{}
+				events, _ := response["events"].([]interface{})
+				for _, event := range events {
+					ids = append(ids, event.(map[string]interface{})["id"].(float64))
+				}
+				assert.Equal(t, tc.expectedIds, ids)
+
+				if tc.expectedSnippet != "" {
+					search := events[0].(map[string]interface{})["search"].(map[string]interface{})
+					assert.Equal(t, tc.expectedSnippet, search["snippet"])
+				}
+				if tc.expectedSuggestions != nil {
+					assert.Equal(t, tc.expectedSuggestions, response["suggestions"])
+				} else {
+					assert.NotContains(t, response, "suggestions")
+				}
+			}
+
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestGetEvent(t *testing.T) {
+	// Setup
+	e := echo.New()
+	e.Validator = validator.NewCustomValidator()
+
+	// Test cases
+	testCases := []struct {
+		name              string
+		isAdmin           bool
+		userID            int64
+		eventID           string
+		seatsTaken        int
+		expectedStatus    int
+		expectedEvent     *models.Event
+		expectedRemaining *int
 	}{
 		{
 			name:           "Admin gets draft event",
@@ -345,6 +849,16 @@ func TestGetEvent(t *testing.T) {
 			expectedStatus: http.StatusOK,
 			expectedEvent:  &models.Event{Id: 2, Title: "Published Event", Status: "published"},
 		},
+		{
+			name:              "Non-admin gets seats of a limited event",
+			isAdmin:           false,
+			userID:            3,
+			eventID:           "4",
+			seatsTaken:        38,
+			expectedStatus:    http.StatusOK,
+			expectedEvent:     &models.Event{Id: 4, Title: "Limited Event", Status: "published", Capacity: intPtr(40)},
+			expectedRemaining: intPtr(2),
+		},
 		{
 			name:           "Non-admin tries to get draft event",
 			isAdmin:        false,
@@ -376,7 +890,10 @@ func TestGetEvent(t *testing.T) {
 			c := e.NewContext(req, rec)
 			c.SetParamNames("id")
 			c.SetParamValues(tc.eventID)
-			c.Set("is_admin", tc.isAdmin)
+			if tc.isAdmin {
+				c.Set("permissions", adminPermissions)
+			}
+			c.Set("user_id", tc.userID)
 
 			// Mock database
 			db, mock, err := sqlmock.New()
@@ -385,14 +902,19 @@ func TestGetEvent(t *testing.T) {
 
 			// Set up mock expectations
 			if tc.expectedEvent != nil {
-				rows := sqlmock.NewRows([]string{"id", "title", "long_description", "short_description", "date_and_time", "organizer", "location", "status"}).
-					AddRow(tc.expectedEvent.Id, tc.expectedEvent.Title, tc.expectedEvent.LongDescription, tc.expectedEvent.ShortDescription, tc.expectedEvent.DateAndTime, tc.expectedEvent.Organizer, tc.expectedEvent.Location, tc.expectedEvent.Status)
-				mock.ExpectQuery("SELECT (.+) FROM events WHERE id = ?").
+				rows := addEventRow(newEventRows(), *tc.expectedEvent)
+				mock.ExpectQuery("SELECT (.+) FROM events e WHERE e.id = ?").
 					WithArgs(tc.expectedEvent.Id).
 					WillReturnRows(rows)
+				if tc.expectedStatus == http.StatusOK {
+					mock.ExpectQuery("SELECT (.+) FROM user_events ue").
+						WithArgs(tc.expectedEvent.Id, tc.userID).
+						WillReturnRows(sqlmock.NewRows([]string{"taken", "waitlisted", "status", "position"}).
+							AddRow(tc.seatsTaken, 0, "", 0))
+				}
 			} else if tc.expectedStatus == http.StatusNotFound {
-				mock.ExpectQuery("SELECT (.+) FROM events WHERE id = ?").
-					WillReturnRows(sqlmock.NewRows([]string{"id", "title", "long_description", "short_description", "date_and_time", "organizer", "location", "status"}))
+				mock.ExpectQuery("SELECT (.+) FROM events e WHERE e.id = ?").
+					WillReturnRows(newEventRows())
 			}
 
 			// Create repository with mock db
@@ -400,24 +922,29 @@ func TestGetEvent(t *testing.T) {
 
 			// Call the handler
 			handler := GetEvent(repo)
-			err = handler(c)
+			err = handle(handler)(c)
 
 			// Assertions
 			assert.NoError(t, err)
 			assert.Equal(t, tc.expectedStatus, rec.Code)
 
 			if tc.expectedEvent != nil {
-				var responseEvent models.Event
+				var responseEvent struct {
+					models.Event
+					models.EventAvailability
+				}
 				err = json.Unmarshal(rec.Body.Bytes(), &responseEvent)
 				assert.NoError(t, err)
 				assert.Equal(t, tc.expectedEvent.Id, responseEvent.Id)
 				assert.Equal(t, tc.expectedEvent.Title, responseEvent.Title)
 				assert.Equal(t, tc.expectedEvent.Status, responseEvent.Status)
+				assert.Equal(t, tc.seatsTaken, responseEvent.SeatsTaken)
+				assert.Equal(t, tc.expectedRemaining, responseEvent.SeatsRemaining)
 			} else if tc.expectedStatus != http.StatusOK {
-				var errorResponse map[string]string
+				var errorResponse map[string]interface{}
 				err = json.Unmarshal(rec.Body.Bytes(), &errorResponse)
 				assert.NoError(t, err)
-				assert.Contains(t, errorResponse, "error")
+				assert.Contains(t, errorResponse, "detail")
 			}
 
 			// Ensure all expectations were met
@@ -431,6 +958,10 @@ func TestUpdateEvent(t *testing.T) {
 	e := echo.New()
 	e.Validator = validator.NewCustomValidator()
 
+	// Requests are made by an organizer, who can only update their own events
+	owner := int64(4)
+	other := int64(5)
+
 	// Test cases
 	testCases := []struct {
 		name           string
@@ -447,62 +978,123 @@ func TestUpdateEvent(t *testing.T) {
 				"title": "Updated Event",
 				"long_description": "This is an updated event",
 				"short_description": "Updated",
-				"date_and_time": "2025-06-01T15:00:00Z",
+				"date_and_time": "2099-06-01T15:00:00Z",
 				"organizer": "Updated Org",
 				"location": "Updated Location",
-				"status": "published"
+				"status": "published",
+				"venue_id": 3
 			}`,
 			mockSetup: func(mock sqlmock.Sqlmock) {
-				mock.ExpectQuery("SELECT (.+) FROM events WHERE id = ?").
+				mock.ExpectQuery("SELECT (.+) FROM events e WHERE e.id = ?").
 					WithArgs(1).
-					WillReturnRows(sqlmock.NewRows([]string{"id", "title", "long_description", "short_description", "date_and_time", "organizer", "location", "status"}).
-						AddRow(1, "Old Title", "Old Description", "Old Short", time.Now(), "Old Org", "Old Location", "draft"))
-				mock.ExpectExec("UPDATE events SET").
+					WillReturnRows(addEventRow(newEventRows(), models.Event{Id: 1, Title: "Old Title", LongDescription: "Old Description", ShortDescription: "Old Short", DateAndTime: time.Now(), Organizer: "Old Org", Location: "Old Location", Status: "draft", CreatedBy: &owner}))
+				mock.ExpectBegin()
+				mock.ExpectQuery("UPDATE events SET").
 					WithArgs(
-						"updated event",
+						"Updated Event",
 						"This is an updated event",
 						"Updated",
-						time.Date(2025, 6, 1, 15, 0, 0, 0, time.UTC),
-						"updated org",
-						"updated location",
+						time.Date(2099, 6, 1, 15, 0, 0, 0, time.UTC),
+						"UTC",
+						"Updated Org",
+						"Updated Location",
 						"published",
+						nil,
+						false,
+						int64(3),
 						1,
 					).
-					WillReturnResult(sqlmock.NewResult(1, 1))
+					WillReturnRows(sqlmock.NewRows([]string{"sequence", "updated_at"}).AddRow(1, time.Now()))
+				mock.ExpectExec("DELETE FROM event_categories").
+					WithArgs(1).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec("DELETE FROM event_tags").
+					WithArgs(1).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec("UPDATE user_events SET status = 'confirmed'").
+					WithArgs(1).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectCommit()
 			},
 			expectedStatus: http.StatusOK,
 			expectedEvent: &models.Event{
 				Id:               1,
-				Title:            "updated event",
+				Title:            "Updated Event",
 				LongDescription:  "This is an updated event",
 				ShortDescription: "Updated",
-				DateAndTime:      time.Date(2025, 6, 1, 15, 0, 0, 0, time.UTC),
-				Organizer:        "updated org",
-				Location:         "updated location",
+				DateAndTime:      time.Date(2099, 6, 1, 15, 0, 0, 0, time.UTC),
+				Organizer:        "Updated Org",
+				Location:         "Updated Location",
 				Status:           "published",
 			},
 		},
+		{
+			name:    "Event created by someone else",
+			eventID: "1",
+			reqBody: `{"title": "Updated Event"}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT (.+) FROM events e WHERE e.id = ?").
+					WithArgs(1).
+					WillReturnRows(addEventRow(newEventRows(), models.Event{Id: 1, Title: "Old Title", Status: "draft", DateAndTime: time.Now(), CreatedBy: &other}))
+			},
+			expectedStatus: http.StatusForbidden,
+			expectedEvent:  nil,
+		},
 		{
 			name:    "Event not found",
 			eventID: "999",
 			reqBody: `{"title": "Non-existent Event"}`,
 			mockSetup: func(mock sqlmock.Sqlmock) {
-				mock.ExpectQuery("SELECT (.+) FROM events WHERE id = ?").
+				mock.ExpectQuery("SELECT (.+) FROM events e WHERE e.id = ?").
 					WithArgs(999).
 					WillReturnError(sql.ErrNoRows)
 			},
 			expectedStatus: http.StatusNotFound,
 			expectedEvent:  nil,
 		},
+		{
+			name:    "Complete a past event",
+			eventID: "1",
+			reqBody: `{"status": "completed"}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT (.+) FROM events e WHERE e.id = ?").
+					WithArgs(1).
+					WillReturnRows(addEventRow(newEventRows(), models.Event{Id: 1, Title: "Old Title", LongDescription: "Old Description", ShortDescription: "Old Short", DateAndTime: time.Now().Add(-24 * time.Hour), Organizer: "Old Org", Location: "Old Location", Status: "published", CreatedBy: &owner}))
+				mock.ExpectBegin()
+				mock.ExpectQuery("UPDATE events SET").
+					WillReturnRows(sqlmock.NewRows([]string{"sequence", "updated_at"}).AddRow(1, time.Now()))
+				mock.ExpectExec("DELETE FROM event_categories").
+					WithArgs(1).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec("DELETE FROM event_tags").
+					WithArgs(1).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec("UPDATE user_events SET status = 'confirmed'").
+					WithArgs(1).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectCommit()
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:    "Move an event to the past",
+			eventID: "1",
+			reqBody: `{"date_and_time": "2020-06-01T15:00:00Z"}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT (.+) FROM events e WHERE e.id = ?").
+					WithArgs(1).
+					WillReturnRows(addEventRow(newEventRows(), models.Event{Id: 1, Title: "Old Title", LongDescription: "Old Description", ShortDescription: "Old Short", DateAndTime: time.Now().Add(24 * time.Hour), Organizer: "Old Org", Location: "Old Location", Status: "draft", CreatedBy: &owner}))
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
 		{
 			name:    "Invalid request body",
 			eventID: "1",
 			reqBody: `{"title": ""}`,
 			mockSetup: func(mock sqlmock.Sqlmock) {
-				mock.ExpectQuery("SELECT (.+) FROM events WHERE id = ?").
+				mock.ExpectQuery("SELECT (.+) FROM events e WHERE e.id = ?").
 					WithArgs(1).
-					WillReturnRows(sqlmock.NewRows([]string{"id", "title", "long_description", "short_description", "date_and_time", "organizer", "location", "status"}).
-						AddRow(1, "Old Title", "Old Description", "Old Short", time.Now(), "Old Org", "Old Location", "draft"))
+					WillReturnRows(addEventRow(newEventRows(), models.Event{Id: 1, Title: "Old Title", LongDescription: "Old Description", ShortDescription: "Old Short", DateAndTime: time.Now(), Organizer: "Old Org", Location: "Old Location", Status: "draft", CreatedBy: &owner}))
 			},
 			expectedStatus: http.StatusBadRequest,
 			expectedEvent:  nil,
@@ -518,6 +1110,8 @@ func TestUpdateEvent(t *testing.T) {
 			c := e.NewContext(req, rec)
 			c.SetParamNames("id")
 			c.SetParamValues(tc.eventID)
+			c.Set("user_id", owner)
+			c.Set("permissions", models.Permissions{models.PermissionUpdateEvents})
 
 			// Mock database
 			db, mock, err := sqlmock.New()
@@ -532,7 +1126,7 @@ func TestUpdateEvent(t *testing.T) {
 
 			// Call the handler
 			handler := UpdateEvent(repo)
-			err = handler(c)
+			err = handle(handler)(c)
 
 			// Assertions
 			assert.NoError(t, err)
@@ -561,21 +1155,41 @@ func TestUpdateEvent(t *testing.T) {
 func TestDeleteEvent(t *testing.T) {
 	// Setup
 	e := echo.New()
+	owner := int64(4)
+	other := int64(5)
 
 	// Test cases
 	testCases := []struct {
 		name           string
 		eventID        string
+		permissions    models.Permissions
+		createdBy      *int64
 		expectedStatus int
 	}{
 		{
 			name:           "Delete event successfully",
 			eventID:        "1",
+			permissions:    adminPermissions,
 			expectedStatus: http.StatusOK,
 		},
+		{
+			name:           "Organizer deletes their own event",
+			eventID:        "1",
+			permissions:    models.Permissions{models.PermissionDeleteEvents},
+			createdBy:      &owner,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Organizer deletes someone else's event",
+			eventID:        "1",
+			permissions:    models.Permissions{models.PermissionDeleteEvents},
+			createdBy:      &other,
+			expectedStatus: http.StatusForbidden,
+		},
 		{
 			name:           "Event not found",
 			eventID:        "999",
+			permissions:    adminPermissions,
 			expectedStatus: http.StatusNotFound,
 		},
 		{
@@ -593,6 +1207,8 @@ func TestDeleteEvent(t *testing.T) {
 			c := e.NewContext(req, rec)
 			c.SetParamNames("id")
 			c.SetParamValues(tc.eventID)
+			c.Set("user_id", owner)
+			c.Set("permissions", tc.permissions)
 
 			// Mock database
 			db, mock, err := sqlmock.New()
@@ -600,14 +1216,19 @@ func TestDeleteEvent(t *testing.T) {
 			defer db.Close()
 
 			// Set up mock expectations
+			if tc.expectedStatus == http.StatusNotFound {
+				mock.ExpectQuery("SELECT (.+) FROM events e WHERE e.id = ?").
+					WithArgs(999).
+					WillReturnError(sql.ErrNoRows)
+			} else if tc.expectedStatus != http.StatusBadRequest {
+				mock.ExpectQuery("SELECT (.+) FROM events e WHERE e.id = ?").
+					WithArgs(1).
+					WillReturnRows(addEventRow(newEventRows(), models.Event{Id: 1, Title: "Event", Status: "draft", CreatedBy: tc.createdBy}))
+			}
 			if tc.expectedStatus == http.StatusOK {
 				mock.ExpectExec("DELETE FROM events").
 					WithArgs(1).
 					WillReturnResult(sqlmock.NewResult(0, 1))
-			} else if tc.expectedStatus == http.StatusNotFound {
-				mock.ExpectExec("DELETE FROM events").
-					WithArgs(999).
-					WillReturnResult(sqlmock.NewResult(0, 0))
 			}
 
 			// Create repository with mock db
@@ -615,7 +1236,7 @@ func TestDeleteEvent(t *testing.T) {
 
 			// Call the handler
 			handler := DeleteEvent(repo)
-			err = handler(c)
+			err = handle(handler)(c)
 
 			// Assertions
 			assert.NoError(t, err)
@@ -628,3 +1249,352 @@ func TestDeleteEvent(t *testing.T) {
 		})
 	}
 }
+
+func TestTransitionEvent(t *testing.T) {
+	// Setup
+	e := echo.New()
+
+	pastTime := time.Now().Add(-24 * time.Hour)
+	futureTime := time.Now().Add(24 * time.Hour)
+
+	// Test cases
+	testCases := []struct {
+		name           string
+		eventID        string
+		status         string
+		mockSetup      func(mock sqlmock.Sqlmock)
+		expectedStatus int
+	}{
+		{
+			name:    "Publish a draft",
+			eventID: "1",
+			status:  models.EventPublished,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT (.+) FROM events e WHERE e.id = ?").
+					WithArgs(1).
+					WillReturnRows(addEventRow(newEventRows(), models.Event{Id: 1, Title: "Event", Status: "draft", DateAndTime: futureTime}))
+				mock.ExpectBegin()
+				mock.ExpectExec("UPDATE events SET status").
+					WithArgs(1, "draft", "published").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:    "Unpublish an event with sign ups",
+			eventID: "1",
+			status:  models.EventDraft,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT (.+) FROM events e WHERE e.id = ?").
+					WithArgs(1).
+					WillReturnRows(addEventRow(newEventRows(), models.Event{Id: 1, Title: "Event", Status: "published", DateAndTime: futureTime}))
+				mock.ExpectQuery("SELECT EXISTS").
+					WithArgs(1).
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+			},
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name:    "Someone signs up while the event is unpublished",
+			eventID: "1",
+			status:  models.EventDraft,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT (.+) FROM events e WHERE e.id = ?").
+					WithArgs(1).
+					WillReturnRows(addEventRow(newEventRows(), models.Event{Id: 1, Title: "Event", Status: "published", DateAndTime: futureTime}))
+				mock.ExpectQuery("SELECT EXISTS").
+					WithArgs(1).
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+				mock.ExpectBegin()
+				mock.ExpectExec("UPDATE events SET status").
+					WithArgs(1, "published", "draft").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectQuery("SELECT EXISTS").
+					WithArgs(1).
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+				mock.ExpectRollback()
+			},
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name:    "Complete an event that hasn't happened",
+			eventID: "1",
+			status:  models.EventCompleted,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT (.+) FROM events e WHERE e.id = ?").
+					WithArgs(1).
+					WillReturnRows(addEventRow(newEventRows(), models.Event{Id: 1, Title: "Event", Status: "published", DateAndTime: futureTime}))
+			},
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name:    "Complete a past event",
+			eventID: "1",
+			status:  models.EventCompleted,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT (.+) FROM events e WHERE e.id = ?").
+					WithArgs(1).
+					WillReturnRows(addEventRow(newEventRows(), models.Event{Id: 1, Title: "Event", Status: "published", DateAndTime: pastTime}))
+				mock.ExpectBegin()
+				mock.ExpectExec("UPDATE events SET status").
+					WithArgs(1, "published", "completed").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:    "Archived events can't be published",
+			eventID: "1",
+			status:  models.EventPublished,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT (.+) FROM events e WHERE e.id = ?").
+					WithArgs(1).
+					WillReturnRows(addEventRow(newEventRows(), models.Event{Id: 1, Title: "Event", Status: "archived", DateAndTime: pastTime}))
+			},
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name:    "Event not found",
+			eventID: "999",
+			status:  models.EventCancelled,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT (.+) FROM events e WHERE e.id = ?").
+					WithArgs(999).
+					WillReturnError(sql.ErrNoRows)
+			},
+			expectedStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Create request
+			req := httptest.NewRequest(http.MethodPost, "/events/"+tc.eventID+"/"+tc.status, nil)
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+			c.SetParamNames("id")
+			c.SetParamValues(tc.eventID)
+			c.Set("permissions", adminPermissions)
+
+			// Mock database
+			db, mock, err := sqlmock.New()
+			assert.NoError(t, err)
+			defer db.Close()
+
+			// Set up mock expectations
+			tc.mockSetup(mock)
+
+			// Create repository with mock db
+			repo := &repositories.EventRepository{DB: db}
+
+			// Call the handler
+			handler := TransitionEvent(repo, tc.status)
+			err = handle(handler)(c)
+
+			// Assertions
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedStatus, rec.Code)
+
+			if tc.expectedStatus == http.StatusOK {
+				var responseEvent models.Event
+				err = json.Unmarshal(rec.Body.Bytes(), &responseEvent)
+				assert.NoError(t, err)
+				assert.Equal(t, tc.status, responseEvent.Status)
+			}
+
+			// Ensure all expectations were met
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestGetAllEventsNear(t *testing.T) {
+	// Setup
+	e := echo.New()
+	e.Validator = validator.NewCustomValidator()
+
+	testCases := []struct {
+		name           string
+		queryParams    string
+		expectedRadius float64
+		expectedStatus int
+	}{
+		{
+			name:           "Near a point with the default radius",
+			queryParams:    "near=-34.6037,-58.3816",
+			expectedRadius: 10,
+		},
+		{
+			name:           "Near a point with a radius",
+			queryParams:    "near=-34.6037,%20-58.3816&radius_km=2.5",
+			expectedRadius: 2.5,
+		},
+		{
+			name:           "Invalid near",
+			queryParams:    "near=-34.6037",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Latitude out of range",
+			queryParams:    "near=95,-58.3816",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Radius too large",
+			queryParams:    "near=-34.6037,-58.3816&radius_km=1000",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Radius without near",
+			queryParams:    "radius_km=5",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Sort by distance without near",
+			queryParams:    "sort=distance",
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/events?"+tc.queryParams, nil)
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+
+			db, mock, err := sqlmock.New()
+			assert.NoError(t, err)
+			defer db.Close()
+
+			if tc.expectedStatus == 0 {
+				venueID := int64(3)
+				lat, lng := -34.6, -58.38
+				event := models.Event{Id: 1, Title: "Go Meetup", Status: "published", VenueId: &venueID, Venue: &models.Venue{Id: 3, Name: "Centro Cultural", Latitude: &lat, Longitude: &lng, Timezone: "America/Argentina/Buenos_Aires"}}
+				// Events near a point are sorted by distance unless told otherwise
+				mock.ExpectQuery(`SELECT (.+), distance.km FROM events e JOIN venues nv ON nv.id = e.venue_id CROSS JOIN LATERAL \(SELECT (.+) AS km\) distance WHERE 1=1 AND nv.latitude BETWEEN \$3 AND \$4 AND distance.km <= \$5 AND e.status = \$6 ORDER BY distance.km ASC, e.id ASC`).
+					WithArgs(-34.6037, -58.3816, sqlmock.AnyArg(), sqlmock.AnyArg(), tc.expectedRadius, "published", 10, 0).
+					WillReturnRows(sqlmock.NewRows(append(newEventColumns(), "km")).AddRow(eventValues(event, 1.25)...))
+				mock.ExpectQuery("SELECT COUNT(.+) FROM events e JOIN venues nv").
+					WithArgs(-34.6037, -58.3816, sqlmock.AnyArg(), sqlmock.AnyArg(), tc.expectedRadius, "published").
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+			}
+
+			repo := &repositories.EventRepository{DB: db}
+			err = handle(GetAllEvents(repo))(c)
+			assert.NoError(t, err)
+
+			if tc.expectedStatus != 0 {
+				assert.Equal(t, tc.expectedStatus, rec.Code)
+			} else {
+				assert.Equal(t, http.StatusOK, rec.Code)
+				var response struct {
+					Events []models.Event `json:"events"`
+				}
+				assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+				assert.Len(t, response.Events, 1)
+				if assert.NotNil(t, response.Events[0].DistanceKm) {
+					assert.Equal(t, 1.25, *response.Events[0].DistanceKm)
+				}
+				if assert.NotNil(t, response.Events[0].Venue) {
+					assert.Equal(t, "Centro Cultural", response.Events[0].Venue.Name)
+				}
+			}
+
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+// sameInstant matches time arguments that are the same instant as
+// the expected time, whatever their location
+type sameInstant time.Time
+
+func (t sameInstant) Match(v driver.Value) bool {
+	actual, ok := v.(time.Time)
+	return ok && actual.Equal(time.Time(t))
+}
+
+func TestGetAllEventsTimezone(t *testing.T) {
+	// Setup
+	e := echo.New()
+	e.Validator = validator.NewCustomValidator()
+
+	testCases := []struct {
+		name           string
+		queryParams    string
+		expectedStart  time.Time
+		expectedEnd    time.Time
+		expectedStatus int
+	}{
+		{
+			name:          "Dates in UTC by default",
+			queryParams:   "date_start=2024-10-05&date_end=2024-10-05",
+			expectedStart: time.Date(2024, 10, 5, 0, 0, 0, 0, time.UTC),
+			expectedEnd:   time.Date(2024, 10, 5, 23, 59, 59, 0, time.UTC),
+		},
+		{
+			name:          "Dates in the caller's time zone",
+			queryParams:   "date_start=2024-10-05&date_end=2024-10-05&tz=America/Argentina/Buenos_Aires",
+			expectedStart: time.Date(2024, 10, 5, 3, 0, 0, 0, time.UTC),
+			expectedEnd:   time.Date(2024, 10, 6, 2, 59, 59, 0, time.UTC),
+		},
+		{
+			// The clocks go back an hour on 2024-11-03 in New York
+			name:          "Day with a daylight saving change",
+			queryParams:   "date_start=2024-11-03&date_end=2024-11-03&tz=America/New_York",
+			expectedStart: time.Date(2024, 11, 3, 4, 0, 0, 0, time.UTC),
+			expectedEnd:   time.Date(2024, 11, 4, 4, 59, 59, 0, time.UTC),
+		},
+		{
+			name:           "Invalid time zone",
+			queryParams:    "date_start=2024-10-05&tz=Mars/Olympus_Mons",
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/events?"+tc.queryParams, nil)
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+
+			db, mock, err := sqlmock.New()
+			assert.NoError(t, err)
+			defer db.Close()
+
+			if tc.expectedStatus == 0 {
+				event := models.Event{Id: 1, Title: "Go Meetup", Status: "published", DateAndTime: time.Date(2024, 10, 5, 22, 0, 0, 0, time.UTC), Timezone: "America/Argentina/Buenos_Aires"}
+				mock.ExpectQuery(`SELECT (.+) FROM events e WHERE 1=1 AND e.status = \$1 AND e.date_and_time >= \$2 AND e.date_and_time <= \$3`).
+					WithArgs("published", sameInstant(tc.expectedStart), sameInstant(tc.expectedEnd), 10, 0).
+					WillReturnRows(addEventRow(newEventRows(), event))
+				mock.ExpectQuery("SELECT COUNT(.+) FROM events e").
+					WithArgs("published", sameInstant(tc.expectedStart), sameInstant(tc.expectedEnd)).
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+			}
+
+			repo := &repositories.EventRepository{DB: db}
+			err = handle(GetAllEvents(repo))(c)
+			assert.NoError(t, err)
+
+			if tc.expectedStatus != 0 {
+				assert.Equal(t, tc.expectedStatus, rec.Code)
+			} else {
+				assert.Equal(t, http.StatusOK, rec.Code)
+				// Events are shown both in UTC and in their own time zone
+				var response struct {
+					Events []map[string]interface{} `json:"events"`
+				}
+				assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+				if assert.Len(t, response.Events, 1) {
+					assert.Equal(t, "2024-10-05T22:00:00Z", response.Events[0]["date_and_time"])
+					assert.Equal(t, "2024-10-05T19:00:00-03:00", response.Events[0]["local_date_and_time"])
+					assert.Equal(t, "America/Argentina/Buenos_Aires", response.Events[0]["timezone"])
+				}
+			}
+
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
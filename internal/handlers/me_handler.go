@@ -0,0 +1,248 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/xtommas/challenge-hetmo/internal/mailer"
+	"github.com/xtommas/challenge-hetmo/internal/models"
+	"github.com/xtommas/challenge-hetmo/internal/problem"
+	"github.com/xtommas/challenge-hetmo/internal/repositories"
+)
+
+// profileUpdate holds the profile fields sent to partially update the
+// current user
+type profileUpdate struct {
+	DisplayName *string `json:"display_name"`
+	Email       *string `json:"email"`
+	AvatarURL   *string `json:"avatar_url"`
+	Locale      *string `json:"locale"`
+	Timezone    *string `json:"timezone"`
+}
+
+// apply copies the fields that were sent into the user. Empty values
+// clear the field, except for the time zone
+func (input *profileUpdate) apply(user *models.User) {
+	if input.DisplayName != nil {
+		user.DisplayName = *input.DisplayName
+	}
+	if input.Email != nil {
+		user.Email = *input.Email
+	}
+	if input.AvatarURL != nil {
+		user.AvatarURL = *input.AvatarURL
+	}
+	if input.Locale != nil {
+		user.Locale = *input.Locale
+		// Invalid locales are kept as sent for the validation to reject
+		if locale, err := models.CanonicalLocale(user.Locale); err == nil {
+			user.Locale = locale
+		}
+	}
+	if input.Timezone != nil {
+		user.Timezone = *input.Timezone
+	}
+}
+
+// reauthWindow is how recently users without a password must have
+// logged in to confirm a sensitive change without a second factor
+const reauthWindow = 10 * time.Minute
+
+// reauthenticate makes the current user confirm it's them before a
+// sensitive change. Users with a password send it, while users created
+// through SSO send a two-factor or recovery code if they enabled it, or
+// otherwise must have just logged in
+func reauthenticate(c echo.Context, tokenRepo *repositories.TokenRepository, twoFactorRepo *repositories.TwoFactorRepository, user *models.User, password, code string) error {
+	if user.HasPassword() {
+		if !user.CheckPassword(password) {
+			return problem.New(http.StatusBadRequest, problem.CodeIncorrectPassword, "Password is incorrect")
+		}
+		return nil
+	}
+
+	if user.TwoFactorEnabled {
+		valid, err := checkSecondFactor(twoFactorRepo, user.Id, code)
+		if err != nil {
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to check code")
+		}
+		if !valid {
+			return problem.New(http.StatusBadRequest, problem.CodeInvalidMFACode, "Invalid code")
+		}
+		return nil
+	}
+
+	tokenID, _ := c.Get("token_id").(string)
+	loggedInAt, err := tokenRepo.LoggedInAt(tokenID)
+	if err != nil && err != sql.ErrNoRows {
+		return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to check session")
+	}
+	if err == sql.ErrNoRows || time.Since(loggedInAt) > reauthWindow {
+		return problem.New(http.StatusForbidden, problem.CodeReauthenticationRequired, "Log in again to confirm it's you")
+	}
+	return nil
+}
+
+// getCurrentUser loads the user making the request
+func getCurrentUser(c echo.Context, userRepo *repositories.UserRepository) (*models.User, error) {
+	userID, ok := c.Get("user_id").(int64)
+	if !ok {
+		return nil, problem.New(http.StatusUnauthorized, problem.CodeInvalidToken, "Invalid user")
+	}
+
+	user, err := userRepo.GetByID(userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, problem.New(http.StatusNotFound, problem.CodeNotFound, "User not found")
+		}
+		return nil, problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to get user")
+	}
+	return user, nil
+}
+
+func GetMe(userRepo *repositories.UserRepository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user, err := getCurrentUser(c, userRepo)
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, user)
+	}
+}
+
+// UpdateMe updates the profile of the current user with the fields
+// that were sent
+func UpdateMe(userRepo *repositories.UserRepository, users *repositories.UserCache, m mailer.Mailer) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user, err := getCurrentUser(c, userRepo)
+		if err != nil {
+			return err
+		}
+		previousEmail := user.Email
+
+		var input profileUpdate
+		if err := c.Bind(&input); err != nil {
+			return problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid request")
+		}
+
+		input.apply(user)
+		if err := c.Validate(user.Profile()); err != nil {
+			return err
+		}
+
+		if err := userRepo.UpdateProfile(user); err != nil {
+			if err == sql.ErrNoRows {
+				return problem.New(http.StatusNotFound, problem.CodeNotFound, "User not found")
+			}
+			if err == repositories.ErrEmailTaken {
+				return problem.New(http.StatusConflict, problem.CodeEmailTaken, "Email already in use")
+			}
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to update profile")
+		}
+
+		// A new email has to be verified again
+		if !strings.EqualFold(user.Email, previousEmail) {
+			user.EmailVerifiedAt = nil
+			users.Forget(user.Id)
+			if user.Email != "" {
+				if err := sendVerificationEmail(c, userRepo, m, user); err != nil {
+					c.Logger().Errorf("Failed to create email verification token for user %d: %v", user.Id, err)
+				}
+			}
+		}
+		return c.JSON(http.StatusOK, user)
+	}
+}
+
+// ChangePassword sets a new password for the current user, who has to
+// send their current one. Users created through SSO set their first
+// password confirming it's them like for any sensitive change. The
+// user's other sessions are logged out
+func ChangePassword(userRepo *repositories.UserRepository, tokenRepo *repositories.TokenRepository, twoFactorRepo *repositories.TwoFactorRepository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var input struct {
+			CurrentPassword string `json:"current_password"`
+			Code            string `json:"code"`
+			NewPassword     string `json:"new_password" validate:"required,min=5"`
+		}
+		if err := c.Bind(&input); err != nil {
+			return problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid request")
+		}
+
+		if err := c.Validate(input); err != nil {
+			return err
+		}
+
+		user, err := getCurrentUser(c, userRepo)
+		if err != nil {
+			return err
+		}
+
+		if user.HasPassword() {
+			if !user.CheckPassword(input.CurrentPassword) {
+				return problem.New(http.StatusBadRequest, problem.CodeIncorrectPassword, "Current password is incorrect")
+			}
+		} else if err := reauthenticate(c, tokenRepo, twoFactorRepo, user, "", input.Code); err != nil {
+			return err
+		}
+
+		if err := user.SetPassword(input.NewPassword); err != nil {
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to set password")
+		}
+
+		if err := userRepo.SetPassword(user.Id, user.Password); err != nil {
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to change password")
+		}
+
+		tokenID, _ := c.Get("token_id").(string)
+		if err := tokenRepo.RevokeUser(user.Id, tokenID); err != nil {
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to revoke other sessions")
+		}
+
+		return c.JSON(http.StatusOK, map[string]string{"message": "Password changed successfully"})
+	}
+}
+
+// DeleteMe deletes the account of the current user, who has to send
+// their password, or confirm it's them otherwise if they have none. The
+// account is anonymised rather than removed, so the events the user
+// attended keep their attendance counts
+func DeleteMe(userRepo *repositories.UserRepository, tokenRepo *repositories.TokenRepository, twoFactorRepo *repositories.TwoFactorRepository, users *repositories.UserCache) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var input struct {
+			Password string `json:"password"`
+			Code     string `json:"code"`
+		}
+		if err := c.Bind(&input); err != nil {
+			return problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid request")
+		}
+
+		if err := c.Validate(input); err != nil {
+			return err
+		}
+
+		user, err := getCurrentUser(c, userRepo)
+		if err != nil {
+			return err
+		}
+
+		if err := reauthenticate(c, tokenRepo, twoFactorRepo, user, input.Password, input.Code); err != nil {
+			return err
+		}
+
+		if err := userRepo.Anonymise(user.Id); err != nil {
+			switch err {
+			case sql.ErrNoRows:
+				return problem.New(http.StatusNotFound, problem.CodeNotFound, "User not found")
+			case repositories.ErrLastAdmin:
+				return problem.New(http.StatusConflict, problem.CodeLastAdmin, "The last admin can't delete their account")
+			}
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to delete account")
+		}
+		users.Forget(user.Id)
+
+		return c.JSON(http.StatusOK, map[string]string{"message": "Account deleted successfully"})
+	}
+}
@@ -0,0 +1,448 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"github.com/xtommas/challenge-hetmo/internal/mailer"
+	"github.com/xtommas/challenge-hetmo/internal/repositories"
+	"github.com/xtommas/challenge-hetmo/internal/validator"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestUpdateMe(t *testing.T) {
+	// Setup
+	e := echo.New()
+	e.Validator = validator.NewCustomValidator()
+
+	// Test cases
+	testCases := []struct {
+		name           string
+		reqBody        string
+		ssoUser        bool
+		expectedStatus int
+		expectEmail    bool
+		mockBehavior   func(mock sqlmock.Sqlmock)
+	}{
+		{
+			name:           "Update profile",
+			reqBody:        `{"display_name": "Ana", "email": "ana@example.com", "avatar_url": "https://example.com/ana.png", "locale": "es_ar", "timezone": "America/Argentina/Buenos_Aires"}`,
+			expectedStatus: http.StatusOK,
+			// The new email has to be verified
+			expectEmail: true,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec("UPDATE users SET display_name = (.+) WHERE id = ?").
+					WithArgs("Ana", "ana@example.com", "https://example.com/ana.png", "es-AR", "America/Argentina/Buenos_Aires", 1).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				expectVerificationToken(mock, 1, "ana@example.com")
+			},
+		},
+		{
+			name:           "User created through SSO",
+			reqBody:        `{"email": "ana@example.com"}`,
+			ssoUser:        true,
+			expectedStatus: http.StatusOK,
+			expectEmail:    true,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec("UPDATE users SET display_name = (.+) WHERE id = ?").
+					WithArgs("", "ana@example.com", "https://example.com/old.png", "", "UTC", 1).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				expectVerificationToken(mock, 1, "ana@example.com")
+			},
+		},
+		{
+			name:           "Email of another user",
+			reqBody:        `{"email": "ana@example.com"}`,
+			expectedStatus: http.StatusConflict,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec("UPDATE users SET display_name = (.+) WHERE id = ?").
+					WithArgs("", "ana@example.com", "https://example.com/old.png", "", "UTC", 1).
+					WillReturnError(&pq.Error{Code: "23505", Constraint: "users_email_key"})
+			},
+		},
+		{
+			name:           "Clear avatar",
+			reqBody:        `{"avatar_url": ""}`,
+			expectedStatus: http.StatusOK,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec("UPDATE users SET display_name = (.+) WHERE id = ?").
+					WithArgs("", "", "", "", "UTC", 1).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+		},
+		{
+			name:           "Avatar that isn't a web URL",
+			reqBody:        `{"avatar_url": "javascript:alert(1)"}`,
+			expectedStatus: http.StatusBadRequest,
+			mockBehavior:   func(mock sqlmock.Sqlmock) {},
+		},
+		{
+			name:           "Invalid email",
+			reqBody:        `{"email": "ana"}`,
+			expectedStatus: http.StatusBadRequest,
+			mockBehavior:   func(mock sqlmock.Sqlmock) {},
+		},
+		{
+			name:           "Invalid time zone",
+			reqBody:        `{"timezone": "Mars/Olympus_Mons"}`,
+			expectedStatus: http.StatusBadRequest,
+			mockBehavior:   func(mock sqlmock.Sqlmock) {},
+		},
+		{
+			name:           "Empty time zone",
+			reqBody:        `{"timezone": ""}`,
+			expectedStatus: http.StatusBadRequest,
+			mockBehavior:   func(mock sqlmock.Sqlmock) {},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPatch, "/me", strings.NewReader(tc.reqBody))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+			c.Set("user_id", int64(1))
+
+			// Mock database
+			db, mock, err := sqlmock.New()
+			assert.NoError(t, err)
+			defer db.Close()
+
+			// Users created through SSO have no password
+			password := "hashedpassword"
+			if tc.ssoUser {
+				password = ""
+			}
+			mock.ExpectQuery("SELECT (.+) FROM users WHERE id = ?").
+				WithArgs(1).
+				WillReturnRows(newUserRows().AddRow(1, "user", password, nil, false, "", "", nil, "https://example.com/old.png", "", "UTC", nil, false, "{}", "{}"))
+			tc.mockBehavior(mock)
+
+			// Call the handler
+			userRepo := &repositories.UserRepository{DB: db}
+			mail := mailer.NewMemoryMailer()
+			err = handle(UpdateMe(userRepo, repositories.NewUserCache(userRepo, time.Minute), mail))(c)
+
+			// Assertions
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedStatus, rec.Code)
+
+			if tc.expectedStatus == http.StatusOK {
+				var response map[string]interface{}
+				assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+				assert.Equal(t, "user", response["username"])
+				assert.NotContains(t, response, "password")
+			}
+
+			if tc.expectEmail {
+				assert.Eventually(t, func() bool { return len(mail.Sent()) == 1 }, time.Second, 10*time.Millisecond)
+			} else {
+				assert.Empty(t, mail.Sent())
+			}
+
+			// Ensure all expectations were met
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	// Setup
+	e := echo.New()
+	e.Validator = validator.NewCustomValidator()
+	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("oldpassword"), bcrypt.DefaultCost)
+
+	// Test cases
+	testCases := []struct {
+		name           string
+		reqBody        string
+		expectedStatus int
+		mockBehavior   func(mock sqlmock.Sqlmock)
+	}{
+		{
+			name:           "Change password",
+			reqBody:        `{"current_password": "oldpassword", "new_password": "newpassword"}`,
+			expectedStatus: http.StatusOK,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT (.+) FROM users WHERE id = ?").
+					WithArgs(1).
+					WillReturnRows(newUserRows().AddRow(1, "user", string(hashedPassword), nil, false, "", "", nil, "", "", "UTC", nil, false, "{}", "{}"))
+				mock.ExpectExec("UPDATE users SET password = ?").
+					WithArgs(sqlmock.AnyArg(), 1).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				// The session making the request is kept
+				mock.ExpectBegin()
+				mock.ExpectExec("INSERT INTO revoked_access_tokens").
+					WithArgs(1, "token-id").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("UPDATE refresh_tokens SET revoked_at = NOW()").
+					WithArgs(1, "token-id").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("UPDATE api_keys SET revoked_at = NOW\\(\\) WHERE user_id = ?").
+					WithArgs(1).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("UPDATE calendar_feed_tokens SET revoked_at = NOW\\(\\) WHERE user_id = ?").
+					WithArgs(1).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectCommit()
+			},
+		},
+		{
+			name:           "Wrong current password",
+			reqBody:        `{"current_password": "wrongpassword", "new_password": "newpassword"}`,
+			expectedStatus: http.StatusBadRequest,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT (.+) FROM users WHERE id = ?").
+					WithArgs(1).
+					WillReturnRows(newUserRows().AddRow(1, "user", string(hashedPassword), nil, false, "", "", nil, "", "", "UTC", nil, false, "{}", "{}"))
+			},
+		},
+		{
+			name:           "Set a first password after logging in through SSO",
+			reqBody:        `{"new_password": "newpassword"}`,
+			expectedStatus: http.StatusOK,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT (.+) FROM users WHERE id = ?").
+					WithArgs(1).
+					WillReturnRows(newUserRows().AddRow(1, "user", "", nil, false, "", "", nil, "", "", "UTC", nil, false, "{}", "{}"))
+				mock.ExpectQuery("SELECT MIN\\(f.created_at\\) FROM refresh_tokens").
+					WithArgs("token-id").
+					WillReturnRows(sqlmock.NewRows([]string{"min"}).AddRow(time.Now().Add(-time.Minute)))
+				mock.ExpectExec("UPDATE users SET password = ?").
+					WithArgs(sqlmock.AnyArg(), 1).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectBegin()
+				mock.ExpectExec("INSERT INTO revoked_access_tokens").
+					WithArgs(1, "token-id").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("UPDATE refresh_tokens SET revoked_at = NOW()").
+					WithArgs(1, "token-id").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("UPDATE api_keys SET revoked_at = NOW\\(\\) WHERE user_id = ?").
+					WithArgs(1).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("UPDATE calendar_feed_tokens SET revoked_at = NOW\\(\\) WHERE user_id = ?").
+					WithArgs(1).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectCommit()
+			},
+		},
+		{
+			name:           "Set a first password long after logging in through SSO",
+			reqBody:        `{"new_password": "newpassword"}`,
+			expectedStatus: http.StatusForbidden,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT (.+) FROM users WHERE id = ?").
+					WithArgs(1).
+					WillReturnRows(newUserRows().AddRow(1, "user", "", nil, false, "", "", nil, "", "", "UTC", nil, false, "{}", "{}"))
+				mock.ExpectQuery("SELECT MIN\\(f.created_at\\) FROM refresh_tokens").
+					WithArgs("token-id").
+					WillReturnRows(sqlmock.NewRows([]string{"min"}).AddRow(time.Now().Add(-time.Hour)))
+			},
+		},
+		{
+			name:           "New password too short",
+			reqBody:        `{"current_password": "oldpassword", "new_password": "new"}`,
+			expectedStatus: http.StatusBadRequest,
+			mockBehavior:   func(mock sqlmock.Sqlmock) {},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/me/password", strings.NewReader(tc.reqBody))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+			c.Set("user_id", int64(1))
+			c.Set("token_id", "token-id")
+
+			// Mock database
+			db, mock, err := sqlmock.New()
+			assert.NoError(t, err)
+			defer db.Close()
+
+			tc.mockBehavior(mock)
+
+			// Call the handler
+			err = handle(ChangePassword(&repositories.UserRepository{DB: db}, &repositories.TokenRepository{DB: db}, &repositories.TwoFactorRepository{DB: db}))(c)
+
+			// Assertions
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedStatus, rec.Code)
+
+			// Ensure all expectations were met
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestDeleteMe(t *testing.T) {
+	// Setup
+	e := echo.New()
+	e.Validator = validator.NewCustomValidator()
+	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.DefaultCost)
+
+	expectAnonymise := func(mock sqlmock.Sqlmock) {
+		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT COUNT(.+) FROM \\(SELECT id FROM roles WHERE name = (.+) FOR UPDATE\\)").
+			WithArgs("admin", 1).
+			WillReturnRows(sqlmock.NewRows([]string{"is_admin", "others"}).AddRow(false, 1))
+		// The seat at the upcoming event goes to the waitlist
+		mock.ExpectQuery("SELECT e.id FROM events e (.+) FOR UPDATE OF e").
+			WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(7))
+		mock.ExpectExec("UPDATE user_events SET status = 'cancelled'").
+			WithArgs(1, "{7}").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("UPDATE user_events SET status = 'confirmed'").
+			WithArgs(7).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		// The user is logged out in the same transaction
+		mock.ExpectExec("INSERT INTO revoked_access_tokens").
+			WithArgs(1, "").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("UPDATE refresh_tokens SET revoked_at = NOW()").
+			WithArgs(1, "").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("UPDATE api_keys SET revoked_at = NOW\\(\\) WHERE user_id = ?").
+			WithArgs(1).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("UPDATE calendar_feed_tokens SET revoked_at = NOW\\(\\) WHERE user_id = ?").
+			WithArgs(1).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("DELETE FROM user_roles").
+			WithArgs(1).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("DELETE FROM calendar_feed_tokens").
+			WithArgs(1).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("DELETE FROM password_reset_tokens").
+			WithArgs(1).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("DELETE FROM email_verification_tokens").
+			WithArgs(1).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("DELETE FROM user_totp").
+			WithArgs(1).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("DELETE FROM recovery_codes").
+			WithArgs(1).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("DELETE FROM user_identities").
+			WithArgs(1).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("DELETE FROM sso_states").
+			WithArgs(1).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("DELETE FROM api_keys").
+			WithArgs(1).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("UPDATE users SET username = (.+), deleted_at = NOW()").
+			WithArgs(1, sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+	}
+
+	// Test cases
+	testCases := []struct {
+		name           string
+		reqBody        string
+		ssoUser        bool
+		expectedStatus int
+		mockBehavior   func(mock sqlmock.Sqlmock)
+	}{
+		{
+			name:           "Delete account",
+			reqBody:        `{"password": "password"}`,
+			expectedStatus: http.StatusOK,
+			mockBehavior:   expectAnonymise,
+		},
+		{
+			name:           "User created through SSO who just logged in",
+			reqBody:        `{}`,
+			ssoUser:        true,
+			expectedStatus: http.StatusOK,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT MIN\\(f.created_at\\) FROM refresh_tokens").
+					WithArgs("token-id").
+					WillReturnRows(sqlmock.NewRows([]string{"min"}).AddRow(time.Now().Add(-time.Minute)))
+				expectAnonymise(mock)
+			},
+		},
+		{
+			name:           "User created through SSO who logged in long ago",
+			reqBody:        `{}`,
+			ssoUser:        true,
+			expectedStatus: http.StatusForbidden,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT MIN\\(f.created_at\\) FROM refresh_tokens").
+					WithArgs("token-id").
+					WillReturnRows(sqlmock.NewRows([]string{"min"}).AddRow(time.Now().Add(-time.Hour)))
+			},
+		},
+		{
+			name:           "Last admin",
+			reqBody:        `{"password": "password"}`,
+			expectedStatus: http.StatusConflict,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT COUNT(.+) FROM \\(SELECT id FROM roles WHERE name = (.+) FOR UPDATE\\)").
+					WithArgs("admin", 1).
+					WillReturnRows(sqlmock.NewRows([]string{"is_admin", "others"}).AddRow(true, 0))
+				mock.ExpectRollback()
+			},
+		},
+		{
+			name:           "Wrong password",
+			reqBody:        `{"password": "wrongpassword"}`,
+			expectedStatus: http.StatusBadRequest,
+			mockBehavior:   func(mock sqlmock.Sqlmock) {},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodDelete, "/me", strings.NewReader(tc.reqBody))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+			c.Set("user_id", int64(1))
+			c.Set("token_id", "token-id")
+
+			// Mock database
+			db, mock, err := sqlmock.New()
+			assert.NoError(t, err)
+			defer db.Close()
+
+			password := string(hashedPassword)
+			if tc.ssoUser {
+				password = ""
+			}
+			mock.ExpectQuery("SELECT (.+) FROM users WHERE id = ?").
+				WithArgs(1).
+				WillReturnRows(newUserRows().AddRow(1, "user", password, nil, false, "", "", nil, "", "", "UTC", nil, false, "{}", "{}"))
+			tc.mockBehavior(mock)
+
+			// Call the handler
+			userRepo := &repositories.UserRepository{DB: db}
+			err = handle(DeleteMe(userRepo, &repositories.TokenRepository{DB: db}, &repositories.TwoFactorRepository{DB: db}, repositories.NewUserCache(userRepo, time.Minute)))(c)
+
+			// Assertions
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedStatus, rec.Code)
+
+			// Ensure all expectations were met
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"github.com/xtommas/challenge-hetmo/internal/repositories"
+)
+
+// maxLimit is the largest page size the listings accept
+const maxLimit = 100
+
+const invalidSortMessage = "Invalid sort. Use date_and_time, title, created_at or popularity (or relevance when searching, and distance when searching near a point), optionally prefixed with - for descending order."
+
+// cursorParam reads the cursor query parameter. Listings are paginated
+// with cursors when the parameter is present, and an empty cursor asks
+// for the first page. Cursors only work with the sort they were made for
+func cursorParam(c echo.Context, sort string) (*repositories.Cursor, bool, error) {
+	if !c.QueryParams().Has("cursor") {
+		return nil, false, nil
+	}
+	value := c.QueryParam("cursor")
+	if value == "" {
+		return nil, true, nil
+	}
+	cursor, err := repositories.DecodeCursor(value, sort)
+	return cursor, true, err
+}
+
+// includeTotal tells whether the client asked for the total count of
+// a listing paginated with cursors
+func includeTotal(c echo.Context) bool {
+	include, _ := strconv.ParseBool(c.QueryParam("include_total"))
+	return include
+}
+
+// cursorResponse returns the body of a listing paginated with cursors
+func cursorResponse(page *repositories.EventPage, limit int) map[string]interface{} {
+	return pageResponse("events", page.Events, page.Next, page.Prev, limit)
+}
+
+// pageResponse returns the body of a page of items listed under name,
+// read with a cursor
+func pageResponse(name string, items interface{}, next, prev *repositories.Cursor, limit int) map[string]interface{} {
+	response := map[string]interface{}{
+		name:          items,
+		"limit":       limit,
+		"next_cursor": nil,
+		"prev_cursor": nil,
+	}
+	if next != nil {
+		response["next_cursor"] = next.Encode()
+	}
+	if prev != nil {
+		response["prev_cursor"] = prev.Encode()
+	}
+	return response
+}
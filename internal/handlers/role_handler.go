@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/xtommas/challenge-hetmo/internal/models"
+	"github.com/xtommas/challenge-hetmo/internal/problem"
+	"github.com/xtommas/challenge-hetmo/internal/repositories"
+)
+
+func GetRoles(roleRepo *repositories.RoleRepository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		roles, err := roleRepo.GetAll()
+		if err != nil {
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to get roles")
+		}
+		return c.JSON(http.StatusOK, roles)
+	}
+}
+
+// AssignRole gives the role in the role param to the user in the
+// username param
+func AssignRole(userRepo *repositories.UserRepository, roleRepo *repositories.RoleRepository, users *repositories.UserCache) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user, err := getUserParam(c, userRepo)
+		if err != nil {
+			return err
+		}
+
+		err = roleRepo.Assign(user.Id, c.Param("role"))
+		if err != nil {
+			switch err {
+			case repositories.ErrUnknownRole:
+				return problem.New(http.StatusNotFound, problem.CodeNotFound, "Role not found")
+			case repositories.ErrRoleAlreadyAssigned:
+				return problem.New(http.StatusConflict, problem.CodeRoleAlreadyAssigned, "User already has the role")
+			}
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to assign role")
+		}
+		// The new permissions apply to the user's next request
+		users.Forget(user.Id)
+
+		return c.JSON(http.StatusOK, map[string]string{"message": "Role assigned successfully"})
+	}
+}
+
+// RemoveRole takes the role in the role param away from the user in
+// the username param. The last admin keeps the admin role
+func RemoveRole(userRepo *repositories.UserRepository, roleRepo *repositories.RoleRepository, users *repositories.UserCache) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user, err := getUserParam(c, userRepo)
+		if err != nil {
+			return err
+		}
+
+		err = roleRepo.Remove(user.Id, c.Param("role"))
+		if err != nil {
+			switch err {
+			case repositories.ErrUnknownRole:
+				return problem.New(http.StatusNotFound, problem.CodeNotFound, "Role not found")
+			case repositories.ErrRoleNotAssigned:
+				return problem.New(http.StatusNotFound, problem.CodeRoleNotAssigned, "User doesn't have the role")
+			case repositories.ErrLastAdmin:
+				return problem.New(http.StatusConflict, problem.CodeLastAdmin, "The last admin can't lose the admin role")
+			}
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to remove role")
+		}
+		users.Forget(user.Id)
+
+		return c.JSON(http.StatusOK, map[string]string{"message": "Role removed successfully"})
+	}
+}
+
+// getUserParam loads the user in the username param
+func getUserParam(c echo.Context, userRepo *repositories.UserRepository) (*models.User, error) {
+	user, err := userRepo.Get(c.Param("username"))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, problem.New(http.StatusNotFound, problem.CodeNotFound, "User not found")
+		}
+		return nil, problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to get user")
+	}
+	return user, nil
+}
@@ -0,0 +1,175 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/xtommas/challenge-hetmo/internal/repositories"
+)
+
+func TestAssignRole(t *testing.T) {
+	e := echo.New()
+
+	testCases := []struct {
+		name           string
+		role           string
+		mockBehavior   func(mock sqlmock.Sqlmock)
+		expectedStatus int
+	}{
+		{
+			name: "Assign role",
+			role: "organizer",
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT id FROM roles WHERE name = ?").
+					WithArgs("organizer").
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(2))
+				mock.ExpectExec("INSERT INTO user_roles").
+					WithArgs(1, 2).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name: "Role already assigned",
+			role: "organizer",
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT id FROM roles WHERE name = ?").
+					WithArgs("organizer").
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(2))
+				mock.ExpectExec("INSERT INTO user_roles").
+					WithArgs(1, 2).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+			},
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name: "Unknown role",
+			role: "owner",
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT id FROM roles WHERE name = ?").
+					WithArgs("owner").
+					WillReturnRows(sqlmock.NewRows([]string{"id"}))
+			},
+			expectedStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPut, "/users/user/roles/"+tc.role, nil)
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+			c.SetParamNames("username", "role")
+			c.SetParamValues("user", tc.role)
+
+			db, mock, err := sqlmock.New()
+			assert.NoError(t, err)
+			defer db.Close()
+
+			mock.ExpectQuery("SELECT (.+) FROM users WHERE username = ?").
+				WithArgs("user").
+				WillReturnRows(newUserRows().AddRow(1, "user", "hashedpassword", nil, false, "", "", nil, "", "", "UTC", nil, false, "{}", "{}"))
+			tc.mockBehavior(mock)
+
+			userRepo := &repositories.UserRepository{DB: db}
+			roleRepo := &repositories.RoleRepository{DB: db}
+			err = handle(AssignRole(userRepo, roleRepo, repositories.NewUserCache(userRepo, time.Minute)))(c)
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedStatus, rec.Code)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestRemoveRole(t *testing.T) {
+	e := echo.New()
+
+	testCases := []struct {
+		name           string
+		role           string
+		mockBehavior   func(mock sqlmock.Sqlmock)
+		expectedStatus int
+	}{
+		{
+			name: "Remove role",
+			role: "admin",
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT id FROM roles WHERE name = (.+) FOR UPDATE").
+					WithArgs("admin").
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+				mock.ExpectQuery("SELECT COUNT(.+) FROM user_roles").
+					WithArgs(1, 1).
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+				mock.ExpectExec("DELETE FROM user_roles").
+					WithArgs(1, 1).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name: "Last admin",
+			role: "admin",
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT id FROM roles WHERE name = (.+) FOR UPDATE").
+					WithArgs("admin").
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+				mock.ExpectQuery("SELECT COUNT(.+) FROM user_roles").
+					WithArgs(1, 1).
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+				mock.ExpectRollback()
+			},
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name: "Role not assigned",
+			role: "staff",
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT id FROM roles WHERE name = (.+) FOR UPDATE").
+					WithArgs("staff").
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
+				mock.ExpectExec("DELETE FROM user_roles").
+					WithArgs(1, 3).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectRollback()
+			},
+			expectedStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodDelete, "/users/user/roles/"+tc.role, nil)
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+			c.SetParamNames("username", "role")
+			c.SetParamValues("user", tc.role)
+
+			db, mock, err := sqlmock.New()
+			assert.NoError(t, err)
+			defer db.Close()
+
+			mock.ExpectQuery("SELECT (.+) FROM users WHERE username = ?").
+				WithArgs("user").
+				WillReturnRows(newUserRows().AddRow(1, "user", "hashedpassword", nil, false, "", "", nil, "", "", "UTC", nil, false, "{admin}", "{users:manage}"))
+			tc.mockBehavior(mock)
+
+			userRepo := &repositories.UserRepository{DB: db}
+			roleRepo := &repositories.RoleRepository{DB: db}
+			err = handle(RemoveRole(userRepo, roleRepo, repositories.NewUserCache(userRepo, time.Minute)))(c)
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedStatus, rec.Code)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
@@ -0,0 +1,315 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/xtommas/challenge-hetmo/internal/models"
+	"github.com/xtommas/challenge-hetmo/internal/problem"
+	"github.com/xtommas/challenge-hetmo/internal/recurrence"
+	"github.com/xtommas/challenge-hetmo/internal/repositories"
+)
+
+// Scopes of an edit or cancellation of a series occurrence
+const (
+	scopeSingle    = "single"
+	scopeFollowing = "following"
+)
+
+func CreateSeries(seriesRepo *repositories.SeriesRepository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		// The event fields are used for every occurrence, and
+		// date_and_time is the start of the first one
+		var input struct {
+			models.Event
+			RecurrenceRule string `json:"recurrence_rule" validate:"required"`
+		}
+		// Events have a waitlist and are in UTC unless told otherwise
+		input.WaitlistEnabled = true
+		input.Timezone = "UTC"
+		if err := c.Bind(&input); err != nil {
+			return problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid request")
+		}
+
+		if err := c.Validate(input); err != nil {
+			return err
+		}
+		if err := checkFutureDate(input.DateAndTime); err != nil {
+			return err
+		}
+
+		if input.Status != models.EventDraft && input.Status != models.EventPublished {
+			return problem.Invalid("status", "oneof", "must be draft or published for new events")
+		}
+
+		rule, err := recurrence.Parse(input.RecurrenceRule)
+		if err != nil {
+			return problem.New(http.StatusBadRequest, problem.CodeInvalidRecurrenceRule, err.Error())
+		}
+		// Occurrences keep the time of day of the first one in the
+		// event's time zone, even when the clocks change
+		loc, err := models.LoadTimezone(input.Timezone)
+		if err != nil {
+			return problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, err.Error())
+		}
+		starts, err := rule.Occurrences(input.DateAndTime.In(loc))
+		if err != nil {
+			return problem.New(http.StatusBadRequest, problem.CodeInvalidRecurrenceRule, err.Error())
+		}
+
+		series := &models.EventSeries{
+			RecurrenceRule: rule.String(),
+			StartsAt:       input.DateAndTime,
+		}
+		input.Tags = models.NormalizeTags(input.Tags)
+		userID := c.Get("user_id").(int64)
+		input.CreatedBy = &userID
+		if err := seriesRepo.Create(series, input.Event, starts); err != nil {
+			switch err {
+			case repositories.ErrUnknownCategory:
+				return problem.New(http.StatusBadRequest, problem.CodeUnknownCategory, "Unknown category")
+			case repositories.ErrUnknownVenue:
+				return problem.New(http.StatusBadRequest, problem.CodeUnknownVenue, "Unknown venue")
+			}
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to create series")
+		}
+		return c.JSON(http.StatusCreated, series)
+	}
+}
+
+func GetSeries(seriesRepo *repositories.SeriesRepository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		canViewDrafts := can(c, models.PermissionViewDrafts)
+		series, err := getSeries(c, seriesRepo)
+		if err != nil {
+			return err
+		}
+
+		// Users that can't see drafts only get the occurrences they're allowed to see
+		if !canViewDrafts {
+			visible := []models.Event{}
+			for _, event := range series.Occurrences {
+				if event.IsPublic() {
+					visible = append(visible, event)
+				}
+			}
+			if len(visible) == 0 {
+				return problem.New(http.StatusNotFound, problem.CodeNotFound, "Series not found")
+			}
+			series.Occurrences = visible
+		}
+
+		return c.JSON(http.StatusOK, series)
+	}
+}
+
+// UpdateSeriesEvents edits an occurrence of a series or, with
+// scope=following, that occurrence and every one after it. Changing
+// the date moves all of them by the same number of days and the same
+// change in the time of day
+func UpdateSeriesEvents(seriesRepo *repositories.SeriesRepository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		series, err := getSeries(c, seriesRepo)
+		if err != nil {
+			return err
+		}
+		events, err := selectOccurrences(c, series)
+		if err != nil {
+			return err
+		}
+		for i := range events {
+			if !canManageEvent(c, &events[i]) {
+				return problem.New(http.StatusForbidden, problem.CodeNotEventOwner, notEventOwnerMessage)
+			}
+		}
+
+		var input eventUpdate
+		if err := c.Bind(&input); err != nil {
+			return problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid request")
+		}
+		if input.Status != nil {
+			return problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Occurrences are cancelled through the cancel endpoint")
+		}
+
+		moved := input.DateAndTime
+		input.DateAndTime = nil
+		first := events[0].DateAndTime
+
+		for i := range events {
+			input.apply(&events[i])
+			if moved != nil {
+				// An invalid time zone is reported by Validate below
+				loc, err := models.LoadTimezone(events[i].Timezone)
+				if err != nil {
+					loc = time.UTC
+				}
+				events[i].DateAndTime = shiftOccurrence(events[i].DateAndTime, first, *moved, loc)
+			}
+			if err := c.Validate(events[i]); err != nil {
+				return err
+			}
+			if moved != nil {
+				if err := checkFutureDate(events[i].DateAndTime); err != nil {
+					return err
+				}
+			}
+		}
+
+		err = seriesRepo.UpdateOccurrences(events)
+		if err != nil {
+			switch err {
+			case sql.ErrNoRows:
+				return problem.New(http.StatusNotFound, problem.CodeNotFound, "Event not found")
+			case repositories.ErrUnknownCategory:
+				return problem.New(http.StatusBadRequest, problem.CodeUnknownCategory, "Unknown category")
+			case repositories.ErrUnknownVenue:
+				return problem.New(http.StatusBadRequest, problem.CodeUnknownVenue, "Unknown venue")
+			}
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to update events")
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{"events": events})
+	}
+}
+
+// CancelSeriesEvents cancels an occurrence of a series or, with
+// scope=following, that occurrence and every one after it
+func CancelSeriesEvents(seriesRepo *repositories.SeriesRepository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		series, err := getSeries(c, seriesRepo)
+		if err != nil {
+			return err
+		}
+		events, err := selectOccurrences(c, series)
+		if err != nil {
+			return err
+		}
+		for i := range events {
+			if !canManageEvent(c, &events[i]) {
+				return problem.New(http.StatusForbidden, problem.CodeNotEventOwner, notEventOwnerMessage)
+			}
+		}
+
+		ids := make([]int64, len(events))
+		for i, event := range events {
+			ids[i] = event.Id
+		}
+
+		cancelled, err := seriesRepo.CancelOccurrences(series.Id, ids)
+		if err != nil {
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to cancel events")
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"message":   "Events cancelled successfully",
+			"cancelled": cancelled,
+		})
+	}
+}
+
+// SignUpForSeries signs the user up to every upcoming published
+// occurrence of the series
+func SignUpForSeries(seriesRepo *repositories.SeriesRepository, userEventRepo *repositories.UserEventRepository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID := c.Get("user_id").(int64)
+		series, err := getSeries(c, seriesRepo)
+		if err != nil {
+			return err
+		}
+
+		type signUpResult struct {
+			EventID int64  `json:"event_id"`
+			Status  string `json:"status"`
+		}
+		results := []signUpResult{}
+
+		for _, event := range series.Occurrences {
+			if event.Status != models.EventPublished || !event.DateAndTime.After(time.Now()) {
+				continue
+			}
+
+			// Occurrences the user can't get into are reported
+			// instead of failing the whole series
+			status, err := userEventRepo.CreateSignUp(userID, event.Id)
+			switch err {
+			case nil:
+			case repositories.ErrAlreadySignedUp:
+				status = "already_signed_up"
+			case repositories.ErrEventFull:
+				status = "full"
+			case repositories.ErrSignUpNotAllowed:
+				continue
+			default:
+				return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to sign up to the series")
+			}
+			results = append(results, signUpResult{EventID: event.Id, Status: status})
+		}
+
+		if len(results) == 0 {
+			return problem.New(http.StatusBadRequest, problem.CodeNoUpcomingEvents, "The series has no upcoming events to sign up to")
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{"signups": results})
+	}
+}
+
+// getSeries loads the series in the id param
+func getSeries(c echo.Context, seriesRepo *repositories.SeriesRepository) (*models.EventSeries, error) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return nil, problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid ID")
+	}
+	series, err := seriesRepo.Get(id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, problem.New(http.StatusNotFound, problem.CodeNotFound, "Series not found")
+		}
+		return nil, problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to get series")
+	}
+	return series, nil
+}
+
+// selectOccurrences returns the occurrence in the event_id param and,
+// if the scope param is "following", every occurrence after it
+func selectOccurrences(c echo.Context, series *models.EventSeries) ([]models.Event, error) {
+	eventID, err := strconv.ParseInt(c.Param("event_id"), 10, 64)
+	if err != nil {
+		return nil, problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid event ID")
+	}
+
+	scope := c.QueryParam("scope")
+	if scope == "" {
+		scope = scopeSingle
+	}
+	if scope != scopeSingle && scope != scopeFollowing {
+		return nil, problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid scope option")
+	}
+
+	// Occurrences are sorted by date, so the following
+	// ones are the ones after the selected occurrence
+	for i, event := range series.Occurrences {
+		if event.Id != eventID {
+			continue
+		}
+		if scope == scopeSingle {
+			return series.Occurrences[i : i+1], nil
+		}
+		return series.Occurrences[i:], nil
+	}
+
+	return nil, problem.New(http.StatusNotFound, problem.CodeNotFound, "Event not found in series")
+}
+
+// shiftOccurrence moves t by the days and the change in the time of
+// day that took from to to, as seen on the clocks of loc. This way
+// occurrences keep their local time when the clocks change
+func shiftOccurrence(t, from, to time.Time, loc *time.Location) time.Time {
+	t, from, to = t.In(loc), from.In(loc), to.In(loc)
+	days := time.Date(to.Year(), to.Month(), to.Day(), 0, 0, 0, 0, time.UTC).
+		Sub(time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, time.UTC)) / (24 * time.Hour)
+	clock := time.Duration(to.Hour()-from.Hour())*time.Hour +
+		time.Duration(to.Minute()-from.Minute())*time.Minute +
+		time.Duration(to.Second()-from.Second())*time.Second +
+		time.Duration(to.Nanosecond()-from.Nanosecond())
+	return time.Date(t.Year(), t.Month(), t.Day()+int(days), t.Hour(), t.Minute(), t.Second(), t.Nanosecond()+int(clock), loc)
+}
@@ -0,0 +1,427 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/xtommas/challenge-hetmo/internal/models"
+	"github.com/xtommas/challenge-hetmo/internal/repositories"
+	"github.com/xtommas/challenge-hetmo/internal/validator"
+)
+
+// addSeriesRows mocks the queries that load a series
+// with weekly occurrences starting on first
+func addSeriesRows(mock sqlmock.Sqlmock, seriesID int64, first time.Time, statuses ...string) {
+	mock.ExpectQuery("SELECT (.+) FROM event_series WHERE id = ?").
+		WithArgs(seriesID).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "recurrence_rule", "starts_at"}).
+			AddRow(seriesID, "FREQ=WEEKLY;COUNT=3", first))
+	rows := newEventRows()
+	for i, status := range statuses {
+		addEventRow(rows, models.Event{
+			Id:               int64(i + 1),
+			Title:            "Weekly Meetup",
+			LongDescription:  "Our weekly meetup",
+			ShortDescription: "Meetup",
+			DateAndTime:      first.AddDate(0, 0, 7*i),
+			Organizer:        "go community",
+			Location:         "office",
+			Status:           status,
+			SeriesId:         &seriesID,
+		})
+	}
+	mock.ExpectQuery("SELECT (.+) FROM events e WHERE e.series_id = ?").
+		WithArgs(seriesID).
+		WillReturnRows(rows)
+}
+
+func TestCreateSeries(t *testing.T) {
+	// Setup
+	e := echo.New()
+	e.Validator = validator.NewCustomValidator()
+
+	// Test cases
+	testCases := []struct {
+		name                string
+		rule                string
+		expectedStatus      int
+		expectedOccurrences int
+		mockBehavior        func(mock sqlmock.Sqlmock)
+	}{
+		{
+			name:                "Weekly series",
+			rule:                "FREQ=WEEKLY;COUNT=3",
+			expectedStatus:      http.StatusCreated,
+			expectedOccurrences: 3,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("INSERT INTO event_series").
+					WithArgs("FREQ=WEEKLY;COUNT=3", time.Date(2099, 5, 5, 19, 0, 0, 0, time.UTC)).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(7))
+				for i, day := range []int{5, 12, 19} {
+					mock.ExpectQuery("INSERT INTO events").
+						WithArgs("Weekly Meetup", sqlmock.AnyArg(), sqlmock.AnyArg(), time.Date(2099, 5, day, 19, 0, 0, 0, time.UTC), "UTC", sqlmock.AnyArg(), sqlmock.AnyArg(), "published", nil, true, int64(7), nil, int64(4)).
+						WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow(i+1, time.Now(), time.Now()))
+				}
+				mock.ExpectCommit()
+			},
+		},
+		{
+			name:           "Unbounded rule",
+			rule:           "FREQ=WEEKLY",
+			expectedStatus: http.StatusBadRequest,
+			mockBehavior:   func(mock sqlmock.Sqlmock) {},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			reqBody := `{
+				"title": "Weekly Meetup",
+				"long_description": "Our weekly meetup",
+				"short_description": "Meetup",
+				"date_and_time": "2099-05-05T19:00:00Z",
+				"organizer": "Go Community",
+				"location": "Office",
+				"status": "published",
+				"recurrence_rule": "` + tc.rule + `"
+			}`
+			req := httptest.NewRequest(http.MethodPost, "/series", strings.NewReader(reqBody))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+			c.Set("user_id", int64(4))
+
+			// Mock database
+			db, mock, err := sqlmock.New()
+			assert.NoError(t, err)
+			defer db.Close()
+
+			tc.mockBehavior(mock)
+
+			// Create repository with mock db
+			repo := &repositories.SeriesRepository{DB: db}
+
+			// Call the handler
+			handler := CreateSeries(repo)
+			err = handle(handler)(c)
+
+			// Assertions
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedStatus, rec.Code)
+
+			if tc.expectedStatus == http.StatusCreated {
+				var series models.EventSeries
+				err = json.Unmarshal(rec.Body.Bytes(), &series)
+				assert.NoError(t, err)
+				assert.Equal(t, int64(7), series.Id)
+				assert.Len(t, series.Occurrences, tc.expectedOccurrences)
+			}
+
+			// Ensure all expectations were met
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestUpdateSeriesEvents(t *testing.T) {
+	// Setup
+	e := echo.New()
+	e.Validator = validator.NewCustomValidator()
+
+	first := time.Date(2099, 5, 5, 19, 0, 0, 0, time.UTC)
+
+	// Test cases
+	testCases := []struct {
+		name           string
+		eventID        string
+		scope          string
+		reqBody        string
+		expectedStatus int
+		mockBehavior   func(mock sqlmock.Sqlmock)
+	}{
+		{
+			name:           "Move this and following occurrences",
+			eventID:        "2",
+			scope:          "following",
+			reqBody:        `{"date_and_time": "2099-05-12T20:00:00Z", "location": "New Office"}`,
+			expectedStatus: http.StatusOK,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				addSeriesRows(mock, 7, first, "published", "published", "published")
+				mock.ExpectBegin()
+				for _, id := range []int{2, 3} {
+					mock.ExpectQuery("UPDATE events SET").
+						WithArgs("Weekly Meetup", sqlmock.AnyArg(), sqlmock.AnyArg(), first.AddDate(0, 0, 7*(id-1)).Add(time.Hour), "UTC", sqlmock.AnyArg(), "New Office", "published", nil, false, nil, id).
+						WillReturnRows(sqlmock.NewRows([]string{"sequence", "updated_at"}).AddRow(1, time.Now()))
+					mock.ExpectExec("DELETE FROM event_categories").
+						WithArgs(id).
+						WillReturnResult(sqlmock.NewResult(0, 0))
+					mock.ExpectExec("DELETE FROM event_tags").
+						WithArgs(id).
+						WillReturnResult(sqlmock.NewResult(0, 0))
+					mock.ExpectExec("UPDATE user_events SET status = 'confirmed'").
+						WithArgs(id).
+						WillReturnResult(sqlmock.NewResult(0, 0))
+				}
+				mock.ExpectCommit()
+			},
+		},
+		{
+			name:           "Status can't be changed",
+			eventID:        "2",
+			reqBody:        `{"status": "draft"}`,
+			expectedStatus: http.StatusBadRequest,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				addSeriesRows(mock, 7, first, "published", "published", "published")
+			},
+		},
+		{
+			name:           "Occurrence of another series",
+			eventID:        "42",
+			reqBody:        `{"title": "Other title"}`,
+			expectedStatus: http.StatusNotFound,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				addSeriesRows(mock, 7, first, "published", "published", "published")
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPatch, "/series/7/events/"+tc.eventID+"?scope="+tc.scope, strings.NewReader(tc.reqBody))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+			c.SetParamNames("id", "event_id")
+			c.SetParamValues("7", tc.eventID)
+			c.Set("permissions", adminPermissions)
+
+			// Mock database
+			db, mock, err := sqlmock.New()
+			assert.NoError(t, err)
+			defer db.Close()
+
+			tc.mockBehavior(mock)
+
+			// Create repository with mock db
+			repo := &repositories.SeriesRepository{DB: db}
+
+			// Call the handler
+			handler := UpdateSeriesEvents(repo)
+			err = handle(handler)(c)
+
+			// Assertions
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedStatus, rec.Code)
+
+			// Ensure all expectations were met
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestCancelSeriesEvents(t *testing.T) {
+	// Setup
+	e := echo.New()
+
+	req := httptest.NewRequest(http.MethodPost, "/series/7/events/2/cancel?scope=following", nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.SetParamNames("id", "event_id")
+	c.SetParamValues("7", "2")
+	c.Set("permissions", adminPermissions)
+
+	// Mock database
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	addSeriesRows(mock, 7, time.Date(2099, 5, 5, 19, 0, 0, 0, time.UTC), "published", "published", "draft")
+	mock.ExpectExec("UPDATE events SET status = 'cancelled'").
+		WithArgs(7, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+
+	// Create repository with mock db
+	repo := &repositories.SeriesRepository{DB: db}
+
+	// Call the handler
+	handler := CancelSeriesEvents(repo)
+	err = handle(handler)(c)
+
+	// Assertions
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var response map[string]interface{}
+	err = json.Unmarshal(rec.Body.Bytes(), &response)
+	assert.NoError(t, err)
+	assert.Equal(t, float64(2), response["cancelled"])
+
+	// Ensure all expectations were met
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSignUpForSeries(t *testing.T) {
+	// Setup
+	e := echo.New()
+
+	req := httptest.NewRequest(http.MethodPost, "/series/7/signup", nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.SetParamNames("id")
+	c.SetParamValues("7")
+	c.Set("user_id", int64(1))
+
+	// Mock database
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	// The draft occurrence is skipped
+	addSeriesRows(mock, 7, time.Date(2099, 5, 5, 19, 0, 0, 0, time.UTC), "published", "draft", "published")
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT capacity, waitlist_enabled FROM events").
+		WithArgs(1, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"capacity", "waitlist_enabled"}).AddRow(nil, true))
+	mock.ExpectExec("INSERT INTO user_events").
+		WithArgs(1, 1, "confirmed").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT capacity, waitlist_enabled FROM events").
+		WithArgs(3, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"capacity", "waitlist_enabled"}).AddRow(nil, true))
+	mock.ExpectExec("INSERT INTO user_events").
+		WithArgs(1, 3, "confirmed").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	// Create repositories with mock db
+	seriesRepo := &repositories.SeriesRepository{DB: db}
+	userEventRepo := &repositories.UserEventRepository{DB: db}
+
+	// Call the handler
+	handler := SignUpForSeries(seriesRepo, userEventRepo)
+	err = handle(handler)(c)
+
+	// Assertions
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var response struct {
+		SignUps []struct {
+			EventID int64  `json:"event_id"`
+			Status  string `json:"status"`
+		} `json:"signups"`
+	}
+	err = json.Unmarshal(rec.Body.Bytes(), &response)
+	assert.NoError(t, err)
+	if assert.Len(t, response.SignUps, 2) {
+		assert.Equal(t, "confirmed", response.SignUps[0].Status)
+		assert.Equal(t, "already_signed_up", response.SignUps[1].Status)
+	}
+
+	// Ensure all expectations were met
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestCreateSeriesAcrossDaylightSaving(t *testing.T) {
+	// Setup
+	e := echo.New()
+	e.Validator = validator.NewCustomValidator()
+
+	// The clocks go forward an hour on 2099-03-08 in New York, and
+	// the meetup stays at 19:00 local time
+	reqBody := `{
+		"title": "Weekly Meetup",
+		"long_description": "Our weekly meetup",
+		"short_description": "Meetup",
+		"date_and_time": "2099-03-03T19:00:00-05:00",
+		"timezone": "America/New_York",
+		"organizer": "Go Community",
+		"location": "Office",
+		"status": "published",
+		"recurrence_rule": "FREQ=WEEKLY;COUNT=2"
+	}`
+	req := httptest.NewRequest(http.MethodPost, "/series", strings.NewReader(reqBody))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.Set("user_id", int64(4))
+
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO event_series").
+		WithArgs("FREQ=WEEKLY;COUNT=2", sameInstant(time.Date(2099, 3, 4, 0, 0, 0, 0, time.UTC))).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(7))
+	for i, start := range []time.Time{
+		time.Date(2099, 3, 4, 0, 0, 0, 0, time.UTC),
+		time.Date(2099, 3, 10, 23, 0, 0, 0, time.UTC),
+	} {
+		mock.ExpectQuery("INSERT INTO events").
+			WithArgs("Weekly Meetup", sqlmock.AnyArg(), sqlmock.AnyArg(), sameInstant(start), "America/New_York", sqlmock.AnyArg(), sqlmock.AnyArg(), "published", nil, true, int64(7), nil, int64(4)).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow(i+1, time.Now(), time.Now()))
+	}
+	mock.ExpectCommit()
+
+	repo := &repositories.SeriesRepository{DB: db}
+	err = handle(CreateSeries(repo))(c)
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestShiftOccurrence(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	assert.NoError(t, err)
+
+	// The first occurrence moves from 19:00 to 20:00 the next day,
+	// in the week before the clocks go forward
+	from := time.Date(2099, 3, 3, 19, 0, 0, 0, newYork)
+	to := time.Date(2099, 3, 4, 20, 0, 0, 0, newYork)
+
+	testCases := []struct {
+		name       string
+		occurrence time.Time
+		loc        *time.Location
+		expected   time.Time
+	}{
+		{
+			name:       "Same week",
+			occurrence: from,
+			loc:        newYork,
+			expected:   to,
+		},
+		{
+			name:       "After the clocks change",
+			occurrence: time.Date(2099, 3, 10, 19, 0, 0, 0, newYork),
+			loc:        newYork,
+			expected:   time.Date(2099, 3, 11, 20, 0, 0, 0, newYork),
+		},
+		{
+			name:       "In UTC",
+			occurrence: time.Date(2099, 3, 10, 23, 0, 0, 0, time.UTC),
+			loc:        time.UTC,
+			// 25 hours later, as seen in UTC
+			expected: time.Date(2099, 3, 12, 0, 0, 0, 0, time.UTC),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			actual := shiftOccurrence(tc.occurrence, from, to, tc.loc)
+			assert.True(t, actual.Equal(tc.expected), "expected %v, got %v", tc.expected, actual)
+		})
+	}
+}
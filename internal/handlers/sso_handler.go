@@ -0,0 +1,202 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/xtommas/challenge-hetmo/internal/jwtkeys"
+	"github.com/xtommas/challenge-hetmo/internal/models"
+	"github.com/xtommas/challenge-hetmo/internal/problem"
+	"github.com/xtommas/challenge-hetmo/internal/repositories"
+	"github.com/xtommas/challenge-hetmo/internal/sso"
+	"golang.org/x/oauth2"
+)
+
+// ssoStateCookie holds the state of the SSO login started in the
+// browser. Only that browser can complete the login, otherwise someone
+// could send a victim to complete a login or a link they started
+const ssoStateCookie = "sso_state"
+
+// startSSOLogin stores a new SSO login and returns the URL of the
+// provider where the user logs in
+func startSSOLogin(c echo.Context, identityRepo *repositories.IdentityRepository, provider *sso.Provider, userID int64) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	nonce := hex.EncodeToString(b)
+	verifier := oauth2.GenerateVerifier()
+
+	state, err := identityRepo.CreateState(repositories.SSOState{Nonce: nonce, CodeVerifier: verifier, UserID: userID})
+	if err != nil {
+		return "", err
+	}
+	setSSOStateCookie(c, state, 0)
+	return provider.AuthCodeURL(state, nonce, verifier), nil
+}
+
+// setSSOStateCookie sets the state cookie of the SSO login, or clears
+// it if maxAge is negative. The provider sends the user back with a
+// top-level navigation, which lax cookies are sent with
+func setSSOStateCookie(c echo.Context, state string, maxAge int) {
+	c.SetCookie(&http.Cookie{
+		Name:     ssoStateCookie,
+		Value:    state,
+		Path:     "/sso/callback",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   c.Scheme() == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// SSOLogin sends the user to log in at the SSO provider, which sends
+// them back to SSOCallback
+func SSOLogin(identityRepo *repositories.IdentityRepository, provider *sso.Provider) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		authURL, err := startSSOLogin(c, identityRepo, provider, 0)
+		if err != nil {
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to start SSO login")
+		}
+		return c.Redirect(http.StatusFound, authURL)
+	}
+}
+
+// LinkSSO returns the URL where the current user logs in at the SSO
+// provider to link their account there, so they can log in with it.
+// The login has to be completed in the browser that made the request
+func LinkSSO(identityRepo *repositories.IdentityRepository, provider *sso.Provider) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID := c.Get("user_id").(int64)
+
+		authURL, err := startSSOLogin(c, identityRepo, provider, userID)
+		if err != nil {
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to start SSO login")
+		}
+		return c.JSON(http.StatusOK, map[string]string{"authorization_url": authURL})
+	}
+}
+
+// SSOCallback completes the SSO login the provider sent the user back
+// from. The user the account at the provider belongs to is logged in
+// like in Login, and a new user is created for unknown accounts.
+// Logins started by LinkSSO link the account instead
+func SSOCallback(userRepo *repositories.UserRepository, tokenRepo *repositories.TokenRepository, twoFactorRepo *repositories.TwoFactorRepository, roleRepo *repositories.RoleRepository, identityRepo *repositories.IdentityRepository, users *repositories.UserCache, provider *sso.Provider, keys *jwtkeys.KeySet) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if c.QueryParam("error") != "" {
+			return problem.New(http.StatusUnauthorized, problem.CodeSSOLoginFailed, "SSO login was denied")
+		}
+
+		cookie, err := c.Cookie(ssoStateCookie)
+		if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(c.QueryParam("state"))) != 1 {
+			return problem.New(http.StatusBadRequest, problem.CodeInvalidSSOState, "Invalid or expired SSO login, try again")
+		}
+		setSSOStateCookie(c, "", -1)
+
+		state, err := identityRepo.UseState(c.QueryParam("state"))
+		if err != nil {
+			if err == repositories.ErrInvalidSSOState {
+				return problem.New(http.StatusBadRequest, problem.CodeInvalidSSOState, "Invalid or expired SSO login, try again")
+			}
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "An unexpected error occurred")
+		}
+
+		identity, err := provider.Exchange(c.Request().Context(), c.QueryParam("code"), state.CodeVerifier, state.Nonce)
+		if err != nil {
+			c.Logger().Warn("SSO login failed: ", err)
+			return problem.New(http.StatusUnauthorized, problem.CodeSSOLoginFailed, "SSO login failed")
+		}
+
+		if state.UserID != 0 {
+			if err := identityRepo.Link(state.UserID, identity.Issuer, identity.Subject); err != nil {
+				if err == repositories.ErrIdentityLinked {
+					return problem.New(http.StatusConflict, problem.CodeSSOAccountLinked, "The SSO account is linked to another user")
+				}
+				return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to link SSO account")
+			}
+			return c.JSON(http.StatusOK, map[string]string{"message": "SSO account linked successfully"})
+		}
+
+		var user *models.User
+		userID, err := identityRepo.GetUserID(identity.Issuer, identity.Subject)
+		switch err {
+		case nil:
+			user, err = userRepo.GetByID(userID)
+			if err != nil {
+				return problem.New(http.StatusInternalServerError, problem.CodeInternal, "An unexpected error occurred")
+			}
+		case sql.ErrNoRows:
+			user = newSSOUser(identity)
+			if err := identityRepo.Provision(user, identity.Issuer, identity.Subject); err != nil {
+				return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to create user")
+			}
+		default:
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "An unexpected error occurred")
+		}
+
+		if err := checkCanLogIn(user); err != nil {
+			return err
+		}
+
+		if group := provider.AdminGroup(); group != "" {
+			if err := syncAdminRole(roleRepo, users, user, identity.InGroup(group)); err != nil {
+				return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to update roles")
+			}
+		}
+
+		return logIn(c, keys, tokenRepo, twoFactorRepo, user)
+	}
+}
+
+// newSSOUser returns the user to create for an account at the SSO
+// provider, named after its username or email
+func newSSOUser(identity *sso.Identity) *models.User {
+	username := identity.Username
+	if username == "" {
+		username, _, _ = strings.Cut(identity.Email, "@")
+	}
+	if len([]rune(username)) < 3 {
+		username = "user"
+	}
+	if runes := []rune(username); len(runes) > 50 {
+		username = string(runes[:50])
+	}
+
+	user := &models.User{Username: username, DisplayName: identity.Name}
+	if runes := []rune(user.DisplayName); len(runes) > 100 {
+		user.DisplayName = string(runes[:100])
+	}
+	// Unverified emails could belong to someone else
+	if identity.EmailVerified && len(identity.Email) <= 255 {
+		user.Email = identity.Email
+	}
+	return user
+}
+
+// syncAdminRole gives or takes the admin role from the user to match
+// their groups at the SSO provider. The last admin keeps the role
+func syncAdminRole(roleRepo *repositories.RoleRepository, users *repositories.UserCache, user *models.User, admin bool) error {
+	if admin == user.HasRole(models.RoleAdmin) {
+		return nil
+	}
+
+	var err error
+	if admin {
+		err = roleRepo.Assign(user.Id, models.RoleAdmin)
+	} else {
+		err = roleRepo.Remove(user.Id, models.RoleAdmin)
+	}
+	switch err {
+	case nil:
+		users.Forget(user.Id)
+	case repositories.ErrRoleAlreadyAssigned, repositories.ErrRoleNotAssigned, repositories.ErrLastAdmin:
+	default:
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,282 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/xtommas/challenge-hetmo/internal/repositories"
+	"github.com/xtommas/challenge-hetmo/internal/sso"
+	"github.com/xtommas/challenge-hetmo/internal/sso/ssotest"
+	"golang.org/x/oauth2"
+)
+
+// newTestSSOProvider returns a provider that logs in with the stub
+// server, where members of event-admins are admins
+func newTestSSOProvider(t *testing.T, server *ssotest.Server) *sso.Provider {
+	provider, err := sso.NewProvider(context.Background(), sso.Config{
+		IssuerURL:    server.URL,
+		ClientID:     ssotest.ClientID,
+		ClientSecret: ssotest.ClientSecret,
+		RedirectURL:  "http://localhost:8080/sso/callback",
+		AdminGroup:   "event-admins",
+	})
+	assert.NoError(t, err)
+	return provider
+}
+
+func TestSSOLogin(t *testing.T) {
+	e := echo.New()
+	server := ssotest.NewServer()
+	defer server.Close()
+
+	req := httptest.NewRequest(http.MethodGet, "/sso/login", nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	mock.ExpectExec("DELETE FROM sso_states WHERE expires_at <= NOW()").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO sso_states").
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), nil, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	err = handle(SSOLogin(&repositories.IdentityRepository{DB: db}, newTestSSOProvider(t, server)))(c)
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusFound, rec.Code)
+	location := rec.Header().Get("Location")
+	assert.True(t, strings.HasPrefix(location, server.URL+"/authorize?"))
+	assert.Contains(t, location, "code_challenge_method=S256")
+	// The browser gets the state, so only it can complete the login
+	cookies := rec.Result().Cookies()
+	if assert.Len(t, cookies, 1) {
+		assert.Equal(t, ssoStateCookie, cookies[0].Name)
+		assert.True(t, cookies[0].HttpOnly)
+		assert.Contains(t, location, "state="+cookies[0].Value)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSSOCallback(t *testing.T) {
+	e := echo.New()
+	server := ssotest.NewServer()
+	defer server.Close()
+	provider := newTestSSOProvider(t, server)
+
+	// expectState mocks the SSO login the provider sends the user back
+	// from
+	expectState := func(mock sqlmock.Sqlmock, nonce, verifier string, userID interface{}) {
+		mock.ExpectQuery("DELETE FROM sso_states WHERE state_hash = (.+) RETURNING").
+			WithArgs(sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows([]string{"nonce", "code_verifier", "user_id"}).AddRow(nonce, verifier, userID))
+	}
+	expectTokens := func(mock sqlmock.Sqlmock, userID int64) {
+		mock.ExpectExec("INSERT INTO refresh_tokens").
+			WithArgs(userID, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+
+	testCases := []struct {
+		name           string
+		groups         []string
+		mockBehavior   func(mock sqlmock.Sqlmock, nonce, verifier string)
+		expectedStatus int
+		// The login was started in another browser, which has the
+		// state cookie
+		otherBrowser bool
+	}{
+		{
+			name:   "New admin is provisioned",
+			groups: []string{"event-admins"},
+			mockBehavior: func(mock sqlmock.Sqlmock, nonce, verifier string) {
+				expectState(mock, nonce, verifier, nil)
+				mock.ExpectQuery("SELECT user_id FROM user_identities").
+					WithArgs(server.URL, "sso-user").
+					WillReturnError(sql.ErrNoRows)
+				mock.ExpectBegin()
+				// The username is taken, so a suffix is added
+				mock.ExpectQuery("INSERT INTO users (.+) ON CONFLICT \\(username\\) DO NOTHING").
+					WithArgs("jdoe", "Jane Doe", "jdoe@example.com").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "email", "email_verified_at"}))
+				// The provider verified the email
+				mock.ExpectQuery("INSERT INTO users (.+) ON CONFLICT \\(username\\) DO NOTHING").
+					WithArgs(sqlmock.AnyArg(), "Jane Doe", "jdoe@example.com").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "email", "email_verified_at"}).AddRow(5, "jdoe@example.com", time.Now()))
+				mock.ExpectExec("INSERT INTO user_identities").
+					WithArgs(5, server.URL, "sso-user").
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectCommit()
+				mock.ExpectQuery("SELECT id FROM roles WHERE name = ?").
+					WithArgs("admin").
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+				mock.ExpectExec("INSERT INTO user_roles").
+					WithArgs(5, 1).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				expectTokens(mock, 5)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:   "Known user leaves the admin group",
+			groups: []string{"staff"},
+			mockBehavior: func(mock sqlmock.Sqlmock, nonce, verifier string) {
+				expectState(mock, nonce, verifier, nil)
+				mock.ExpectQuery("SELECT user_id FROM user_identities").
+					WithArgs(server.URL, "sso-user").
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+				mock.ExpectQuery("SELECT (.+) FROM users WHERE id = ?").
+					WithArgs(1).
+					WillReturnRows(newUserRows().AddRow(1, "jdoe", "", nil, false, "", "", nil, "", "", "UTC", nil, false, "{admin}", "{users:manage}"))
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT id FROM roles WHERE name = (.+) FOR UPDATE").
+					WithArgs("admin").
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+				mock.ExpectQuery("SELECT COUNT(.+) FROM user_roles").
+					WithArgs(1, 1).
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+				mock.ExpectExec("DELETE FROM user_roles").
+					WithArgs(1, 1).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+				expectTokens(mock, 1)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:   "Suspended user",
+			groups: []string{"event-admins"},
+			mockBehavior: func(mock sqlmock.Sqlmock, nonce, verifier string) {
+				expectState(mock, nonce, verifier, nil)
+				mock.ExpectQuery("SELECT user_id FROM user_identities").
+					WithArgs(server.URL, "sso-user").
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+				mock.ExpectQuery("SELECT (.+) FROM users WHERE id = ?").
+					WithArgs(1).
+					WillReturnRows(newUserRows().AddRow(1, "jdoe", "", time.Now(), false, "", "", nil, "", "", "UTC", nil, false, "{admin}", "{users:manage}"))
+			},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name: "User with two-factor authentication",
+			mockBehavior: func(mock sqlmock.Sqlmock, nonce, verifier string) {
+				expectState(mock, nonce, verifier, nil)
+				mock.ExpectQuery("SELECT user_id FROM user_identities").
+					WithArgs(server.URL, "sso-user").
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+				mock.ExpectQuery("SELECT (.+) FROM users WHERE id = ?").
+					WithArgs(1).
+					WillReturnRows(newUserRows().AddRow(1, "jdoe", "", nil, false, "", "", nil, "", "", "UTC", nil, true, "{}", "{}"))
+				// The user gets a challenge instead of tokens
+				mock.ExpectExec("INSERT INTO mfa_challenges").
+					WithArgs(1, sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name: "User has to reset their password",
+			mockBehavior: func(mock sqlmock.Sqlmock, nonce, verifier string) {
+				expectState(mock, nonce, verifier, nil)
+				mock.ExpectQuery("SELECT user_id FROM user_identities").
+					WithArgs(server.URL, "sso-user").
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+				mock.ExpectQuery("SELECT (.+) FROM users WHERE id = ?").
+					WithArgs(1).
+					WillReturnRows(newUserRows().AddRow(1, "jdoe", "", nil, true, "", "", nil, "", "", "UTC", nil, false, "{}", "{}"))
+			},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name: "Link to the current user",
+			mockBehavior: func(mock sqlmock.Sqlmock, nonce, verifier string) {
+				expectState(mock, nonce, verifier, 3)
+				mock.ExpectExec("INSERT INTO user_identities (.+) ON CONFLICT").
+					WithArgs(3, server.URL, "sso-user").
+					WillReturnResult(sqlmock.NewResult(1, 1))
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name: "Account linked to another user",
+			mockBehavior: func(mock sqlmock.Sqlmock, nonce, verifier string) {
+				expectState(mock, nonce, verifier, 3)
+				mock.ExpectExec("INSERT INTO user_identities (.+) ON CONFLICT").
+					WithArgs(3, server.URL, "sso-user").
+					WillReturnResult(sqlmock.NewResult(0, 0))
+			},
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name: "ID token of another login",
+			mockBehavior: func(mock sqlmock.Sqlmock, nonce, verifier string) {
+				expectState(mock, "other-nonce", verifier, nil)
+			},
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "Unknown state",
+			mockBehavior: func(mock sqlmock.Sqlmock, nonce, verifier string) {
+				mock.ExpectQuery("DELETE FROM sso_states WHERE state_hash = (.+) RETURNING").
+					WithArgs(sqlmock.AnyArg()).
+					WillReturnError(sql.ErrNoRows)
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Login started in another browser",
+			mockBehavior:   func(mock sqlmock.Sqlmock, nonce, verifier string) {},
+			expectedStatus: http.StatusBadRequest,
+			otherBrowser:   true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server.SetClaims(map[string]interface{}{
+				"sub":                "sso-user",
+				"preferred_username": "jdoe",
+				"name":               "Jane Doe",
+				"email":              "jdoe@example.com",
+				"email_verified":     true,
+				"groups":             tc.groups,
+			})
+
+			// Log in at the provider, which sends the user back with a code
+			nonce, verifier := "nonce", oauth2.GenerateVerifier()
+			query, err := server.Authorize(provider.AuthCodeURL("state", nonce, verifier))
+			assert.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodGet, "/sso/callback?"+query.Encode(), nil)
+			if !tc.otherBrowser {
+				req.AddCookie(&http.Cookie{Name: ssoStateCookie, Value: "state"})
+			}
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+
+			db, mock, err := sqlmock.New()
+			assert.NoError(t, err)
+			defer db.Close()
+
+			tc.mockBehavior(mock, nonce, verifier)
+
+			userRepo := &repositories.UserRepository{DB: db}
+			err = handle(SSOCallback(userRepo, &repositories.TokenRepository{DB: db}, &repositories.TwoFactorRepository{DB: db}, &repositories.RoleRepository{DB: db},
+				&repositories.IdentityRepository{DB: db}, repositories.NewUserCache(userRepo, time.Minute), provider, newTestKeys(t)))(c)
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedStatus, rec.Code)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
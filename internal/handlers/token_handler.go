@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+	"github.com/xtommas/challenge-hetmo/internal/jwtkeys"
+	"github.com/xtommas/challenge-hetmo/internal/models"
+	"github.com/xtommas/challenge-hetmo/internal/problem"
+	"github.com/xtommas/challenge-hetmo/internal/repositories"
+)
+
+// accessTokenTTL is how long access tokens last. They are renewed
+// with refresh tokens, so they are kept short
+const accessTokenTTL = 15 * time.Minute
+
+// newAccessToken signs an access token for the user, returning it
+// along with its id and expiration time
+func newAccessToken(keys *jwtkeys.KeySet, user *models.User) (string, string, time.Time, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", "", time.Time{}, err
+	}
+	jti := hex.EncodeToString(id)
+	expiresAt := time.Now().Add(accessTokenTTL)
+
+	// Set claims (the info that the JWT transmits)
+	claims := jwt.MapClaims{
+		"user_id":  user.Id,
+		"username": user.Username,
+		"jti":      jti,
+		"exp":      expiresAt.Unix(),
+	}
+
+	// Generate encoded token
+	t, err := keys.Sign(claims)
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+	return t, jti, expiresAt, nil
+}
+
+// issueTokens responds with a new access token for the user and the
+// refresh token that renews it. The refresh token joins the given
+// family, or starts a new one if it's empty
+func issueTokens(c echo.Context, keys *jwtkeys.KeySet, tokenRepo *repositories.TokenRepository, user *models.User, familyID string) error {
+	accessToken, jti, expiresAt, err := newAccessToken(keys, user)
+	if err != nil {
+		return err
+	}
+
+	refreshToken, err := tokenRepo.Create(user.Id, familyID, jti, expiresAt)
+	if err != nil {
+		if err == repositories.ErrInvalidRefreshToken {
+			return problem.New(http.StatusUnauthorized, problem.CodeInvalidRefreshToken, "Invalid refresh token")
+		}
+		return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to create refresh token")
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"token":         accessToken,
+		"refresh_token": refreshToken,
+		"expires_in":    int(accessTokenTTL.Seconds()),
+	})
+}
+
+// RefreshToken trades a refresh token for a new access token and a
+// new refresh token. Each refresh token works only once
+func RefreshToken(userRepo *repositories.UserRepository, tokenRepo *repositories.TokenRepository, keys *jwtkeys.KeySet) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var input struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+		if err := c.Bind(&input); err != nil || input.RefreshToken == "" {
+			return problem.Invalid("refresh_token", "required", "is required")
+		}
+
+		userID, familyID, err := tokenRepo.Use(input.RefreshToken)
+		if err != nil {
+			switch err {
+			case repositories.ErrInvalidRefreshToken:
+				return problem.New(http.StatusUnauthorized, problem.CodeInvalidRefreshToken, "Invalid refresh token")
+			case repositories.ErrRefreshTokenReused:
+				return problem.New(http.StatusUnauthorized, problem.CodeRefreshTokenReused, "Refresh token already used, log in again")
+			}
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to refresh token")
+		}
+
+		// The new token carries the current rights of the user
+		user, err := userRepo.GetByID(userID)
+		if err != nil {
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to refresh token")
+		}
+		if user.IsDeleted() {
+			return problem.New(http.StatusUnauthorized, problem.CodeInvalidRefreshToken, "Invalid refresh token")
+		}
+		if user.IsSuspended() {
+			return problem.New(http.StatusForbidden, problem.CodeAccountSuspended, "Account suspended")
+		}
+		if user.PasswordResetRequired {
+			return problem.New(http.StatusForbidden, problem.CodePasswordResetRequired, "Password reset required")
+		}
+
+		return issueTokens(c, keys, tokenRepo, user, familyID)
+	}
+}
+
+// Logout revokes the access token of the request and, if it's sent,
+// the refresh token along with every token that replaced it
+func Logout(tokenRepo *repositories.TokenRepository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID := c.Get("user_id").(int64)
+		tokenID := c.Get("token_id").(string)
+		expiresAt := c.Get("token_expires_at").(time.Time)
+
+		var input struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+		if err := c.Bind(&input); err != nil {
+			return problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid request")
+		}
+
+		err := tokenRepo.Logout(userID, tokenID, expiresAt, input.RefreshToken)
+		if err != nil {
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to log out")
+		}
+		return c.JSON(http.StatusOK, map[string]string{"message": "Logged out successfully"})
+	}
+}
+
+// JWKS publishes the public keys that verify the access tokens, for
+// other services to verify them without calling the API
+func JWKS(keys *jwtkeys.KeySet) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		c.Response().Header().Set("Cache-Control", "public, max-age=300")
+		return c.JSON(http.StatusOK, map[string]interface{}{"keys": keys.JWKS()})
+	}
+}
@@ -0,0 +1,256 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/xtommas/challenge-hetmo/internal/jwtkeys"
+	"github.com/xtommas/challenge-hetmo/internal/repositories"
+)
+
+// newTestKeys returns keys to sign the access tokens of the tests
+func newTestKeys(t *testing.T) *jwtkeys.KeySet {
+	keys, err := jwtkeys.Generate()
+	assert.NoError(t, err)
+	return keys
+}
+
+func newRefreshTokenRows() *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"id", "user_id", "family_id", "expires_at", "used_at", "revoked_at"})
+}
+
+func TestRefreshToken(t *testing.T) {
+	// Setup
+	e := echo.New()
+
+	// Test cases
+	testCases := []struct {
+		name           string
+		reqBody        string
+		expectedStatus int
+		mockBehavior   func(mock sqlmock.Sqlmock)
+	}{
+		{
+			name:           "Refresh token rotated",
+			reqBody:        `{"refresh_token": "refresh"}`,
+			expectedStatus: http.StatusOK,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT (.+) FROM refresh_tokens WHERE token_hash = (.+) FOR UPDATE").
+					WithArgs(sqlmock.AnyArg()).
+					WillReturnRows(newRefreshTokenRows().AddRow(5, 1, "family", time.Now().Add(time.Hour), nil, nil))
+				mock.ExpectExec("UPDATE refresh_tokens SET used_at = NOW()").
+					WithArgs(5).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+				// The new tokens carry the current rights of the user
+				mock.ExpectQuery("SELECT (.+) FROM users WHERE id = ?").
+					WithArgs(1).
+					WillReturnRows(newUserRows().AddRow(1, "user", "hashedpassword", nil, false, "", "", nil, "", "", "UTC", nil, false, "{admin}", "{users:manage}"))
+				mock.ExpectExec("INSERT INTO refresh_tokens").
+					WithArgs(1, "family", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(6, 1))
+			},
+		},
+		{
+			name:           "Reused refresh token revokes its family",
+			reqBody:        `{"refresh_token": "refresh"}`,
+			expectedStatus: http.StatusUnauthorized,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT (.+) FROM refresh_tokens WHERE token_hash = (.+) FOR UPDATE").
+					WithArgs(sqlmock.AnyArg()).
+					WillReturnRows(newRefreshTokenRows().AddRow(5, 1, "family", time.Now().Add(time.Hour), time.Now().Add(-time.Minute), nil))
+				mock.ExpectExec("UPDATE refresh_tokens SET revoked_at = NOW\\(\\) WHERE family_id = ?").
+					WithArgs("family").
+					WillReturnResult(sqlmock.NewResult(0, 2))
+				mock.ExpectExec("INSERT INTO revoked_access_tokens (.+) FROM refresh_tokens WHERE family_id = ?").
+					WithArgs("family").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+		},
+		{
+			name:           "Expired refresh token",
+			reqBody:        `{"refresh_token": "refresh"}`,
+			expectedStatus: http.StatusUnauthorized,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT (.+) FROM refresh_tokens WHERE token_hash = (.+) FOR UPDATE").
+					WithArgs(sqlmock.AnyArg()).
+					WillReturnRows(newRefreshTokenRows().AddRow(5, 1, "family", time.Now().Add(-time.Hour), nil, nil))
+				mock.ExpectRollback()
+			},
+		},
+		{
+			name:           "Suspended account",
+			reqBody:        `{"refresh_token": "refresh"}`,
+			expectedStatus: http.StatusForbidden,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT (.+) FROM refresh_tokens WHERE token_hash = (.+) FOR UPDATE").
+					WithArgs(sqlmock.AnyArg()).
+					WillReturnRows(newRefreshTokenRows().AddRow(5, 1, "family", time.Now().Add(time.Hour), nil, nil))
+				mock.ExpectExec("UPDATE refresh_tokens SET used_at = NOW()").
+					WithArgs(5).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+				mock.ExpectQuery("SELECT (.+) FROM users WHERE id = ?").
+					WithArgs(1).
+					WillReturnRows(newUserRows().AddRow(1, "user", "hashedpassword", time.Now().Add(-time.Hour), false, "", "", nil, "", "", "UTC", nil, false, "{}", "{}"))
+			},
+		},
+		{
+			name:           "Deleted account",
+			reqBody:        `{"refresh_token": "refresh"}`,
+			expectedStatus: http.StatusUnauthorized,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT (.+) FROM refresh_tokens WHERE token_hash = (.+) FOR UPDATE").
+					WithArgs(sqlmock.AnyArg()).
+					WillReturnRows(newRefreshTokenRows().AddRow(5, 1, "family", time.Now().Add(time.Hour), nil, nil))
+				mock.ExpectExec("UPDATE refresh_tokens SET used_at = NOW()").
+					WithArgs(5).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+				mock.ExpectQuery("SELECT (.+) FROM users WHERE id = ?").
+					WithArgs(1).
+					WillReturnRows(newUserRows().AddRow(1, "deleted-user", "", nil, false, "", "", nil, "", "", "UTC", time.Now().Add(-time.Hour), false, "{}", "{}"))
+			},
+		},
+		{
+			name:           "Missing refresh token",
+			reqBody:        `{}`,
+			expectedStatus: http.StatusBadRequest,
+			mockBehavior:   func(mock sqlmock.Sqlmock) {},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/token/refresh", strings.NewReader(tc.reqBody))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+
+			// Mock database
+			db, mock, err := sqlmock.New()
+			assert.NoError(t, err)
+			defer db.Close()
+
+			tc.mockBehavior(mock)
+
+			// Create repositories with mock db
+			userRepo := &repositories.UserRepository{DB: db}
+			tokenRepo := &repositories.TokenRepository{DB: db}
+
+			// Call the handler
+			err = handle(RefreshToken(userRepo, tokenRepo, newTestKeys(t)))(c)
+
+			// Assertions
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedStatus, rec.Code)
+
+			if tc.expectedStatus == http.StatusOK {
+				var response map[string]interface{}
+				assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+				assert.Contains(t, response, "token")
+				assert.Contains(t, response, "refresh_token")
+			}
+
+			// Ensure all expectations were met
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestLogout(t *testing.T) {
+	// Setup
+	e := echo.New()
+	expiresAt := time.Now().Add(10 * time.Minute)
+
+	// Test cases
+	testCases := []struct {
+		name           string
+		reqBody        string
+		expectedStatus int
+		mockBehavior   func(mock sqlmock.Sqlmock)
+	}{
+		{
+			name:           "Log out revoking the refresh token",
+			reqBody:        `{"refresh_token": "refresh"}`,
+			expectedStatus: http.StatusOK,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectExec("DELETE FROM revoked_access_tokens WHERE expires_at <= NOW()").
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec("INSERT INTO revoked_access_tokens").
+					WithArgs("token-id", expiresAt).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectQuery("SELECT family_id FROM refresh_tokens WHERE token_hash = (.+) AND user_id = ?").
+					WithArgs(sqlmock.AnyArg(), 1).
+					WillReturnRows(sqlmock.NewRows([]string{"family_id"}).AddRow("family"))
+				mock.ExpectExec("UPDATE refresh_tokens SET revoked_at = NOW\\(\\) WHERE family_id = ?").
+					WithArgs("family").
+					WillReturnResult(sqlmock.NewResult(0, 2))
+				mock.ExpectExec("INSERT INTO revoked_access_tokens (.+) FROM refresh_tokens WHERE family_id = ?").
+					WithArgs("family").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+		},
+		{
+			name:           "Log out without a refresh token",
+			reqBody:        `{}`,
+			expectedStatus: http.StatusOK,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectExec("DELETE FROM revoked_access_tokens WHERE expires_at <= NOW()").
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec("INSERT INTO revoked_access_tokens").
+					WithArgs("token-id", expiresAt).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/logout", strings.NewReader(tc.reqBody))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+			c.Set("user_id", int64(1))
+			c.Set("token_id", "token-id")
+			c.Set("token_expires_at", expiresAt)
+
+			// Mock database
+			db, mock, err := sqlmock.New()
+			assert.NoError(t, err)
+			defer db.Close()
+
+			tc.mockBehavior(mock)
+
+			// Create repository with mock db
+			tokenRepo := &repositories.TokenRepository{DB: db}
+
+			// Call the handler
+			err = handle(Logout(tokenRepo))(c)
+
+			// Assertions
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedStatus, rec.Code)
+
+			// Ensure all expectations were met
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
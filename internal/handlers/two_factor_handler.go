@@ -0,0 +1,240 @@
+package handlers
+
+import (
+	"database/sql"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/xtommas/challenge-hetmo/internal/jwtkeys"
+	"github.com/xtommas/challenge-hetmo/internal/problem"
+	"github.com/xtommas/challenge-hetmo/internal/repositories"
+	"github.com/xtommas/challenge-hetmo/internal/totp"
+)
+
+// totpIssuer names the API in authenticator apps
+const totpIssuer = "Hetmo Events"
+
+// checkSecondFactor tells whether the code is a valid TOTP code or an
+// unused recovery code of the user. Either one works only once
+func checkSecondFactor(twoFactorRepo *repositories.TwoFactorRepository, userID int64, code string) (bool, error) {
+	secret, enabled, err := twoFactorRepo.Get(userID)
+	if err == sql.ErrNoRows || (err == nil && !enabled) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if step, ok := totp.Validate(secret, code, time.Now()); ok {
+		return twoFactorRepo.UseStep(userID, step)
+	}
+	return twoFactorRepo.UseRecoveryCode(userID, code)
+}
+
+// LoginMFA completes the login of a user with two-factor
+// authentication, trading the challenge token returned by Login and a
+// TOTP or recovery code for tokens
+func LoginMFA(userRepo *repositories.UserRepository, tokenRepo *repositories.TokenRepository, attemptRepo *repositories.LoginAttemptRepository, twoFactorRepo *repositories.TwoFactorRepository, keys *jwtkeys.KeySet) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var input struct {
+			MFAToken string `json:"mfa_token" validate:"required"`
+			Code     string `json:"code" validate:"required"`
+		}
+		if err := c.Bind(&input); err != nil {
+			return problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid input")
+		}
+
+		if err := c.Validate(input); err != nil {
+			return err
+		}
+
+		userID, err := twoFactorRepo.CheckChallenge(input.MFAToken)
+		if err != nil {
+			if err == repositories.ErrInvalidChallenge {
+				return problem.New(http.StatusUnauthorized, problem.CodeInvalidMFAToken, "Invalid or expired MFA token, log in again")
+			}
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "An unexpected error occurred")
+		}
+
+		user, err := userRepo.GetByID(userID)
+		if err != nil {
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "An unexpected error occurred")
+		}
+		// The account may have changed since the password was checked
+		if err := checkCanLogIn(user); err != nil {
+			return err
+		}
+
+		// Wrong codes count as failed logins, so guessing codes is
+		// throttled like guessing passwords
+		ip := c.RealIP()
+		blockedUntil, err := attemptRepo.BlockedUntil(user.Username, ip)
+		if err != nil {
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "An unexpected error occurred")
+		}
+		if !blockedUntil.IsZero() {
+			retryAfter := int(math.Ceil(time.Until(blockedUntil).Seconds()))
+			c.Response().Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			return problem.New(http.StatusTooManyRequests, problem.CodeLoginThrottled, "Too many failed login attempts, try again later")
+		}
+
+		valid, err := checkSecondFactor(twoFactorRepo, user.Id, input.Code)
+		if err != nil {
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "An unexpected error occurred")
+		}
+		if !valid {
+			if err := twoFactorRepo.FailChallenge(input.MFAToken); err != nil {
+				return problem.New(http.StatusInternalServerError, problem.CodeInternal, "An unexpected error occurred")
+			}
+			if err := attemptRepo.RecordFailure(user.Username, ip); err != nil {
+				return problem.New(http.StatusInternalServerError, problem.CodeInternal, "An unexpected error occurred")
+			}
+			return problem.New(http.StatusUnauthorized, problem.CodeInvalidMFACode, "Invalid code")
+		}
+
+		if err := twoFactorRepo.UseChallenge(input.MFAToken); err != nil {
+			if err == repositories.ErrInvalidChallenge {
+				return problem.New(http.StatusUnauthorized, problem.CodeInvalidMFAToken, "Invalid or expired MFA token, log in again")
+			}
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "An unexpected error occurred")
+		}
+		if err := attemptRepo.Clear(user.Username); err != nil {
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "An unexpected error occurred")
+		}
+
+		return issueTokens(c, keys, tokenRepo, user, "")
+	}
+}
+
+// SetupTwoFactor generates a TOTP secret for the current user to add
+// to their authenticator app. Two-factor authentication is only
+// enabled once the user sends a code generated with it
+func SetupTwoFactor(userRepo *repositories.UserRepository, twoFactorRepo *repositories.TwoFactorRepository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user, err := getCurrentUser(c, userRepo)
+		if err != nil {
+			return err
+		}
+
+		secret, err := totp.NewSecret()
+		if err != nil {
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to set up two-factor authentication")
+		}
+
+		if err := twoFactorRepo.Setup(user.Id, secret); err != nil {
+			if err == repositories.ErrTwoFactorEnabled {
+				return problem.New(http.StatusConflict, problem.CodeTwoFactorAlreadyEnabled, "Two-factor authentication is already enabled")
+			}
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to set up two-factor authentication")
+		}
+
+		return c.JSON(http.StatusOK, map[string]string{
+			"secret": secret,
+			// Clients show it as a QR code for authenticator apps to scan
+			"provisioning_uri": totp.URI(totpIssuer, user.Username, secret),
+		})
+	}
+}
+
+// EnableTwoFactor turns on two-factor authentication for the current
+// user once they send a code generated with the secret they set up,
+// and returns their recovery codes. They are shown only once
+func EnableTwoFactor(twoFactorRepo *repositories.TwoFactorRepository, users *repositories.UserCache) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID := c.Get("user_id").(int64)
+
+		var input struct {
+			Code string `json:"code" validate:"required"`
+		}
+		if err := c.Bind(&input); err != nil {
+			return problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid request")
+		}
+
+		if err := c.Validate(input); err != nil {
+			return err
+		}
+
+		secret, enabled, err := twoFactorRepo.Get(userID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return problem.New(http.StatusBadRequest, problem.CodeTwoFactorNotSetUp, "Set up two-factor authentication first")
+			}
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to enable two-factor authentication")
+		}
+		if enabled {
+			return problem.New(http.StatusConflict, problem.CodeTwoFactorAlreadyEnabled, "Two-factor authentication is already enabled")
+		}
+
+		step, ok := totp.Validate(secret, input.Code, time.Now())
+		if !ok {
+			return problem.New(http.StatusBadRequest, problem.CodeInvalidMFACode, "Invalid code")
+		}
+
+		codes, err := twoFactorRepo.Enable(userID, step)
+		if err != nil {
+			if err == repositories.ErrTwoFactorEnabled {
+				return problem.New(http.StatusConflict, problem.CodeTwoFactorAlreadyEnabled, "Two-factor authentication is already enabled")
+			}
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to enable two-factor authentication")
+		}
+		// Admins required to enable it can use the API right away
+		users.Forget(userID)
+
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"message":        "Two-factor authentication enabled successfully",
+			"recovery_codes": codes,
+		})
+	}
+}
+
+// DisableTwoFactor turns off two-factor authentication for the
+// current user, who has to send a code again along with their
+// password, if they have one
+func DisableTwoFactor(userRepo *repositories.UserRepository, twoFactorRepo *repositories.TwoFactorRepository, users *repositories.UserCache) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var input struct {
+			Password string `json:"password"`
+			Code     string `json:"code" validate:"required"`
+		}
+		if err := c.Bind(&input); err != nil {
+			return problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid request")
+		}
+
+		if err := c.Validate(input); err != nil {
+			return err
+		}
+
+		user, err := getCurrentUser(c, userRepo)
+		if err != nil {
+			return err
+		}
+
+		if !user.TwoFactorEnabled {
+			return problem.New(http.StatusBadRequest, problem.CodeTwoFactorNotEnabled, "Two-factor authentication is not enabled")
+		}
+
+		// Users created through SSO have no password, so the code
+		// alone confirms it's them
+		if user.HasPassword() && !user.CheckPassword(input.Password) {
+			return problem.New(http.StatusBadRequest, problem.CodeIncorrectPassword, "Password is incorrect")
+		}
+
+		valid, err := checkSecondFactor(twoFactorRepo, user.Id, input.Code)
+		if err != nil {
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to disable two-factor authentication")
+		}
+		if !valid {
+			return problem.New(http.StatusBadRequest, problem.CodeInvalidMFACode, "Invalid code")
+		}
+
+		if err := twoFactorRepo.Disable(user.Id); err != nil {
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to disable two-factor authentication")
+		}
+		users.Forget(user.Id)
+
+		return c.JSON(http.StatusOK, map[string]string{"message": "Two-factor authentication disabled successfully"})
+	}
+}
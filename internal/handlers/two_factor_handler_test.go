@@ -0,0 +1,403 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/xtommas/challenge-hetmo/internal/repositories"
+	"github.com/xtommas/challenge-hetmo/internal/totp"
+	"github.com/xtommas/challenge-hetmo/internal/validator"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const testTOTPSecret = "JBSWY3DPEHPK3PXP"
+
+// currentTOTPCode returns the code the user's app shows right now
+func currentTOTPCode(t *testing.T) string {
+	code, err := totp.Code(testTOTPSecret, totp.Step(time.Now()))
+	assert.NoError(t, err)
+	return code
+}
+
+func TestLoginWithTwoFactor(t *testing.T) {
+	e := echo.New()
+	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("correctpassword"), bcrypt.DefaultCost)
+
+	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(`{"username": "admin", "password": "correctpassword"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	expectLoginNotBlocked(mock, "admin")
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE username = ?").
+		WithArgs("admin").
+		WillReturnRows(newUserRows().AddRow(1, "admin", string(hashedPassword), nil, false, "", "", nil, "", "", "UTC", nil, true, "{admin}", "{users:manage}"))
+	mock.ExpectExec("DELETE FROM login_attempts").
+		WithArgs("username", "admin").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	// No tokens are issued until the second factor is sent
+	mock.ExpectExec("INSERT INTO mfa_challenges").
+		WithArgs(1, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	err = handle(Login(&repositories.UserRepository{DB: db}, &repositories.TokenRepository{DB: db},
+		&repositories.LoginAttemptRepository{DB: db}, &repositories.TwoFactorRepository{DB: db}, newTestKeys(t)))(c)
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var response map[string]interface{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+	assert.Equal(t, true, response["mfa_required"])
+	assert.NotEmpty(t, response["mfa_token"])
+	assert.NotContains(t, response, "token")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestLoginMFA(t *testing.T) {
+	e := echo.New()
+	e.Validator = validator.NewCustomValidator()
+
+	// expectChallenge mocks a valid challenge of an admin that isn't
+	// locked out
+	expectChallenge := func(mock sqlmock.Sqlmock) {
+		mock.ExpectQuery("SELECT user_id FROM mfa_challenges").
+			WithArgs(sqlmock.AnyArg(), 5).
+			WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+		mock.ExpectQuery("SELECT (.+) FROM users WHERE id = ?").
+			WithArgs(1).
+			WillReturnRows(newUserRows().AddRow(1, "admin", "hashedpassword", nil, false, "", "", nil, "", "", "UTC", nil, true, "{admin}", "{users:manage}"))
+		expectLoginNotBlocked(mock, "admin")
+		mock.ExpectQuery("SELECT secret, (.+) FROM user_totp").
+			WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"secret", "enabled"}).AddRow(testTOTPSecret, true))
+	}
+
+	testCases := []struct {
+		name           string
+		code           func(t *testing.T) string
+		mockBehavior   func(mock sqlmock.Sqlmock)
+		expectedStatus int
+	}{
+		{
+			name: "Valid TOTP code",
+			code: currentTOTPCode,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				expectChallenge(mock)
+				mock.ExpectExec("UPDATE user_totp SET last_used_step").
+					WithArgs(1, sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("UPDATE mfa_challenges SET used_at").
+					WithArgs(sqlmock.AnyArg(), 5).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("DELETE FROM login_attempts").
+					WithArgs("username", "admin").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("INSERT INTO refresh_tokens").
+					WithArgs(1, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name: "Reused TOTP code",
+			code: currentTOTPCode,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				expectChallenge(mock)
+				mock.ExpectExec("UPDATE user_totp SET last_used_step").
+					WithArgs(1, sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec("UPDATE mfa_challenges SET attempts").
+					WithArgs(sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectBegin()
+				mock.ExpectQuery("INSERT INTO login_attempts (.+) RETURNING failures").
+					WithArgs("username", "admin", sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"failures"}).AddRow(1))
+				mock.ExpectQuery("INSERT INTO login_attempts (.+) RETURNING failures").
+					WithArgs("ip", "192.0.2.1", sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"failures"}).AddRow(1))
+				mock.ExpectCommit()
+			},
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "Recovery code",
+			code: func(t *testing.T) string { return "abcd-efgh-ijkl-mnop" },
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				expectChallenge(mock)
+				mock.ExpectExec("UPDATE recovery_codes SET used_at").
+					WithArgs(1, sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("UPDATE mfa_challenges SET used_at").
+					WithArgs(sqlmock.AnyArg(), 5).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("DELETE FROM login_attempts").
+					WithArgs("username", "admin").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("INSERT INTO refresh_tokens").
+					WithArgs(1, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name: "Suspended after the password was checked",
+			code: currentTOTPCode,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT user_id FROM mfa_challenges").
+					WithArgs(sqlmock.AnyArg(), 5).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+				mock.ExpectQuery("SELECT (.+) FROM users WHERE id = ?").
+					WithArgs(1).
+					WillReturnRows(newUserRows().AddRow(1, "admin", "hashedpassword", time.Now(), false, "", "", nil, "", "", "UTC", nil, true, "{admin}", "{users:manage}"))
+			},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name: "Password reset required after the password was checked",
+			code: currentTOTPCode,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT user_id FROM mfa_challenges").
+					WithArgs(sqlmock.AnyArg(), 5).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+				mock.ExpectQuery("SELECT (.+) FROM users WHERE id = ?").
+					WithArgs(1).
+					WillReturnRows(newUserRows().AddRow(1, "admin", "hashedpassword", nil, true, "", "", nil, "", "", "UTC", nil, true, "{admin}", "{users:manage}"))
+			},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name: "Expired challenge",
+			code: currentTOTPCode,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT user_id FROM mfa_challenges").
+					WithArgs(sqlmock.AnyArg(), 5).
+					WillReturnError(sql.ErrNoRows)
+			},
+			expectedStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			body := `{"mfa_token": "challenge", "code": "` + tc.code(t) + `"}`
+			req := httptest.NewRequest(http.MethodPost, "/login/mfa", strings.NewReader(body))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+
+			db, mock, err := sqlmock.New()
+			assert.NoError(t, err)
+			defer db.Close()
+
+			tc.mockBehavior(mock)
+
+			err = handle(LoginMFA(&repositories.UserRepository{DB: db}, &repositories.TokenRepository{DB: db},
+				&repositories.LoginAttemptRepository{DB: db}, &repositories.TwoFactorRepository{DB: db}, newTestKeys(t)))(c)
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedStatus, rec.Code)
+			if tc.expectedStatus == http.StatusOK {
+				var response map[string]interface{}
+				assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+				assert.Contains(t, response, "token")
+				assert.Contains(t, response, "refresh_token")
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestEnableTwoFactor(t *testing.T) {
+	e := echo.New()
+	e.Validator = validator.NewCustomValidator()
+
+	testCases := []struct {
+		name           string
+		code           func(t *testing.T) string
+		mockBehavior   func(mock sqlmock.Sqlmock)
+		expectedStatus int
+	}{
+		{
+			name: "Enable with a valid code",
+			code: currentTOTPCode,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT secret, (.+) FROM user_totp").
+					WithArgs(1).
+					WillReturnRows(sqlmock.NewRows([]string{"secret", "enabled"}).AddRow(testTOTPSecret, false))
+				mock.ExpectBegin()
+				mock.ExpectExec("UPDATE user_totp SET enabled_at").
+					WithArgs(1, sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("DELETE FROM recovery_codes").
+					WithArgs(1).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				for i := 0; i < 10; i++ {
+					mock.ExpectExec("INSERT INTO recovery_codes").
+						WithArgs(1, sqlmock.AnyArg()).
+						WillReturnResult(sqlmock.NewResult(int64(i+1), 1))
+				}
+				mock.ExpectCommit()
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name: "Invalid code",
+			code: func(t *testing.T) string { return "000000x" },
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT secret, (.+) FROM user_totp").
+					WithArgs(1).
+					WillReturnRows(sqlmock.NewRows([]string{"secret", "enabled"}).AddRow(testTOTPSecret, false))
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name: "Not set up",
+			code: currentTOTPCode,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT secret, (.+) FROM user_totp").
+					WithArgs(1).
+					WillReturnError(sql.ErrNoRows)
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name: "Already enabled",
+			code: currentTOTPCode,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT secret, (.+) FROM user_totp").
+					WithArgs(1).
+					WillReturnRows(sqlmock.NewRows([]string{"secret", "enabled"}).AddRow(testTOTPSecret, true))
+			},
+			expectedStatus: http.StatusConflict,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			body := `{"code": "` + tc.code(t) + `"}`
+			req := httptest.NewRequest(http.MethodPost, "/me/2fa/enable", strings.NewReader(body))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+			c.Set("user_id", int64(1))
+
+			db, mock, err := sqlmock.New()
+			assert.NoError(t, err)
+			defer db.Close()
+
+			tc.mockBehavior(mock)
+
+			userRepo := &repositories.UserRepository{DB: db}
+			err = handle(EnableTwoFactor(&repositories.TwoFactorRepository{DB: db}, repositories.NewUserCache(userRepo, time.Minute)))(c)
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedStatus, rec.Code)
+			if tc.expectedStatus == http.StatusOK {
+				var response struct {
+					RecoveryCodes []string `json:"recovery_codes"`
+				}
+				assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+				assert.Len(t, response.RecoveryCodes, 10)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestDisableTwoFactor(t *testing.T) {
+	e := echo.New()
+	e.Validator = validator.NewCustomValidator()
+	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("correctpassword"), bcrypt.DefaultCost)
+
+	expectDisable := func(mock sqlmock.Sqlmock) {
+		mock.ExpectQuery("SELECT secret, (.+) FROM user_totp").
+			WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"secret", "enabled"}).AddRow(testTOTPSecret, true))
+		mock.ExpectExec("UPDATE user_totp SET last_used_step").
+			WithArgs(1, sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectBegin()
+		mock.ExpectExec("DELETE FROM user_totp").
+			WithArgs(1).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("DELETE FROM recovery_codes").
+			WithArgs(1).
+			WillReturnResult(sqlmock.NewResult(0, 10))
+		mock.ExpectExec("DELETE FROM mfa_challenges").
+			WithArgs(1).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectCommit()
+	}
+
+	testCases := []struct {
+		name           string
+		password       string
+		ssoUser        bool
+		mockBehavior   func(mock sqlmock.Sqlmock)
+		expectedStatus int
+	}{
+		{
+			name:           "Disable with password and code",
+			password:       "correctpassword",
+			mockBehavior:   expectDisable,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Disable with only a code when the user has no password",
+			ssoUser:        true,
+			mockBehavior:   expectDisable,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Wrong password",
+			password:       "wrongpassword",
+			mockBehavior:   func(mock sqlmock.Sqlmock) {},
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			body := `{"password": "` + tc.password + `", "code": "` + currentTOTPCode(t) + `"}`
+			req := httptest.NewRequest(http.MethodPost, "/me/2fa/disable", strings.NewReader(body))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+			c.Set("user_id", int64(1))
+
+			db, mock, err := sqlmock.New()
+			assert.NoError(t, err)
+			defer db.Close()
+
+			password := string(hashedPassword)
+			if tc.ssoUser {
+				password = ""
+			}
+			mock.ExpectQuery("SELECT (.+) FROM users WHERE id = ?").
+				WithArgs(1).
+				WillReturnRows(newUserRows().AddRow(1, "admin", password, nil, false, "", "", nil, "", "", "UTC", nil, true, "{admin}", "{users:manage}"))
+			tc.mockBehavior(mock)
+
+			userRepo := &repositories.UserRepository{DB: db}
+			err = handle(DisableTwoFactor(userRepo, &repositories.TwoFactorRepository{DB: db}, repositories.NewUserCache(userRepo, time.Minute)))(c)
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedStatus, rec.Code)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
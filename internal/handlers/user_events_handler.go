@@ -4,8 +4,11 @@ import (
 	"math"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/labstack/echo/v4"
+	"github.com/xtommas/challenge-hetmo/internal/models"
+	"github.com/xtommas/challenge-hetmo/internal/problem"
 	"github.com/xtommas/challenge-hetmo/internal/repositories"
 )
 
@@ -14,14 +17,66 @@ func SignUpForEvent(userEventRepo *repositories.UserEventRepository) echo.Handle
 		userID := c.Get("user_id").(int64)
 		eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
 		if err != nil {
-			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid event ID"})
+			return problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid event ID")
 		}
 
-		err = userEventRepo.CreateSignUp(userID, eventID)
+		status, err := userEventRepo.CreateSignUp(userID, eventID)
 		if err != nil {
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			if err == repositories.ErrAlreadySignedUp {
+				return problem.New(http.StatusConflict, problem.CodeAlreadySignedUp, err.Error())
+			}
+			if err == repositories.ErrEventFull {
+				return problem.New(http.StatusConflict, problem.CodeEventFull, err.Error())
+			}
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to sign up")
+		}
+
+		if status == models.SignUpWaitlisted {
+			return c.JSON(http.StatusOK, map[string]string{
+				"message": "The event is full, you have been added to the waitlist",
+				"status":  status,
+			})
+		}
+		return c.JSON(http.StatusOK, map[string]string{
+			"message": "Successfully signed up for the event",
+			"status":  status,
+		})
+	}
+}
+
+// CancelSignUp cancels the user's sign up to an event. Sign ups can't
+// be cancelled once the event is less than cutoff away
+func CancelSignUp(userEventRepo *repositories.UserEventRepository, cutoff time.Duration) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID := c.Get("user_id").(int64)
+		eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid event ID")
+		}
+
+		// The reason is optional, so an empty body is fine
+		var input struct {
+			Reason string `json:"reason" validate:"max=500"`
+		}
+		if err := c.Bind(&input); err != nil {
+			return problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid request")
+		}
+
+		if err := c.Validate(input); err != nil {
+			return err
+		}
+
+		err = userEventRepo.CancelSignUp(userID, eventID, input.Reason, cutoff)
+		if err != nil {
+			if err == repositories.ErrSignUpNotFound {
+				return problem.New(http.StatusNotFound, problem.CodeNotFound, err.Error())
+			}
+			if err == repositories.ErrCancellationClosed {
+				return problem.New(http.StatusConflict, problem.CodeCancellationClosed, err.Error())
+			}
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to cancel sign up")
 		}
-		return c.JSON(http.StatusOK, map[string]string{"message": "Successfully signed up for the event"})
+		return c.JSON(http.StatusOK, map[string]string{"message": "Successfully cancelled the sign up"})
 	}
 }
 
@@ -29,7 +84,7 @@ func GetUserEvents(userEventRepo *repositories.UserEventRepository) echo.Handler
 	return func(c echo.Context) error {
 		userID, ok := c.Get("user_id").(int64)
 		if !ok {
-			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid user"})
+			return problem.New(http.StatusUnauthorized, problem.CodeInvalidToken, "Invalid user")
 		}
 
 		// Pagination
@@ -38,7 +93,14 @@ func GetUserEvents(userEventRepo *repositories.UserEventRepository) echo.Handler
 
 		filter := c.QueryParam("filter")
 		if filter != "upcoming" && filter != "past" && filter != "" {
-			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid filter option"})
+			return problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid filter option")
+		}
+
+		sort := c.QueryParam("sort")
+		if sort == "" {
+			sort = repositories.DefaultEventSort
+		} else if !repositories.IsEventSort(sort, repositories.EventFilter{}) {
+			return problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, invalidSortMessage)
 		}
 
 		// Default page and limit
@@ -58,20 +120,45 @@ func GetUserEvents(userEventRepo *repositories.UserEventRepository) echo.Handler
 			limit, err = strconv.Atoi(limitParam)
 			if err != nil || limit < 1 {
 				limit = 10
+			} else if limit > maxLimit {
+				limit = maxLimit
 			}
 		}
 
+		cursor, useCursor, err := cursorParam(c, sort)
+		if err != nil {
+			return problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid cursor")
+		}
+		if useCursor {
+			eventPage, err := userEventRepo.GetPage(userID, filter, sort, cursor, limit)
+			if err != nil {
+				return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to get events")
+			}
+			response := cursorResponse(eventPage, limit)
+
+			// Counting is slow on large lists, so it's only done on request
+			if includeTotal(c) {
+				total, err := userEventRepo.GetTotalCount(userID, filter)
+				if err != nil {
+					return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to get total count")
+				}
+				response["total"] = total
+			}
+
+			return c.JSON(http.StatusOK, response)
+		}
+
 		// Calculate offset
 		offset := (page - 1) * limit
 
-		events, err := userEventRepo.GetAll(userID, filter, limit, offset)
+		events, err := userEventRepo.GetAll(userID, filter, sort, limit, offset)
 		if err != nil {
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to get events"})
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to get events")
 		}
 
 		total, err := userEventRepo.GetTotalCount(userID, filter)
 		if err != nil {
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to get total count"})
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to get total count")
 		}
 
 		totalPages := int(math.Ceil(float64(total) / float64(limit)))
@@ -87,3 +174,29 @@ func GetUserEvents(userEventRepo *repositories.UserEventRepository) echo.Handler
 		return c.JSON(http.StatusOK, response)
 	}
 }
+
+// CheckIn marks the user in the user_id param as present at the event
+func CheckIn(userEventRepo *repositories.UserEventRepository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid event ID")
+		}
+		userID, err := strconv.ParseInt(c.Param("user_id"), 10, 64)
+		if err != nil {
+			return problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid user ID")
+		}
+
+		checkedInAt, err := userEventRepo.CheckIn(userID, eventID)
+		if err != nil {
+			if err == repositories.ErrSignUpNotFound {
+				return problem.New(http.StatusNotFound, problem.CodeNotFound, "The user has no seat at the event")
+			}
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to check in")
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"message":       "Checked in successfully",
+			"checked_in_at": checkedInAt,
+		})
+	}
+}
@@ -1,9 +1,11 @@
 package handlers
 
 import (
+	"database/sql"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -12,6 +14,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/xtommas/challenge-hetmo/internal/models"
 	"github.com/xtommas/challenge-hetmo/internal/repositories"
+	"github.com/xtommas/challenge-hetmo/internal/validator"
 )
 
 func TestSignUpForEvent(t *testing.T) {
@@ -34,9 +37,68 @@ func TestSignUpForEvent(t *testing.T) {
 			expectedStatus:  http.StatusOK,
 			expectedMessage: "Successfully signed up for the event",
 			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT capacity, waitlist_enabled FROM events").
+					WithArgs(2, sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"capacity", "waitlist_enabled"}).AddRow(nil, true))
 				mock.ExpectExec("INSERT INTO user_events").
-					WithArgs(1, 2, sqlmock.AnyArg()).
+					WithArgs(1, 2, "confirmed").
 					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+		},
+		{
+			name:            "Full event puts user on the waitlist",
+			userID:          1,
+			eventID:         "2",
+			expectedStatus:  http.StatusOK,
+			expectedMessage: "The event is full, you have been added to the waitlist",
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT capacity, waitlist_enabled FROM events").
+					WithArgs(2, sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"capacity", "waitlist_enabled"}).AddRow(40, true))
+				mock.ExpectQuery("SELECT COUNT(.+) FROM user_events").
+					WithArgs(2).
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(40))
+				mock.ExpectExec("INSERT INTO user_events").
+					WithArgs(1, 2, "waitlisted").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+		},
+		{
+			name:            "Full event without waitlist",
+			userID:          1,
+			eventID:         "2",
+			expectedStatus:  http.StatusConflict,
+			expectedMessage: "event is full",
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT capacity, waitlist_enabled FROM events").
+					WithArgs(2, sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"capacity", "waitlist_enabled"}).AddRow(40, false))
+				mock.ExpectQuery("SELECT COUNT(.+) FROM user_events").
+					WithArgs(2).
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(40))
+				mock.ExpectRollback()
+			},
+		},
+		{
+			name:            "Already signed up",
+			userID:          1,
+			eventID:         "2",
+			expectedStatus:  http.StatusConflict,
+			expectedMessage: "already signed up to event",
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT capacity, waitlist_enabled FROM events").
+					WithArgs(2, sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"capacity", "waitlist_enabled"}).AddRow(nil, true))
+				mock.ExpectExec("INSERT INTO user_events").
+					WithArgs(1, 2, "confirmed").
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectRollback()
 			},
 		},
 		{
@@ -52,11 +114,13 @@ func TestSignUpForEvent(t *testing.T) {
 			userID:          1,
 			eventID:         "2",
 			expectedStatus:  http.StatusInternalServerError,
-			expectedMessage: "can't sign up to event",
+			expectedMessage: "Failed to sign up",
 			mockBehavior: func(mock sqlmock.Sqlmock) {
-				mock.ExpectExec("INSERT INTO user_events").
-					WithArgs(1, 2, sqlmock.AnyArg()).
-					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT capacity, waitlist_enabled FROM events").
+					WithArgs(2, sqlmock.AnyArg()).
+					WillReturnError(sql.ErrNoRows)
+				mock.ExpectRollback()
 			},
 		},
 	}
@@ -82,20 +146,20 @@ func TestSignUpForEvent(t *testing.T) {
 
 			// Call the handler
 			handler := SignUpForEvent(repo)
-			err = handler(c)
+			err = handle(handler)(c)
 
 			// Assertions
 			assert.NoError(t, err)
 			assert.Equal(t, tc.expectedStatus, rec.Code)
 
-			var response map[string]string
+			var response map[string]interface{}
 			err = json.Unmarshal(rec.Body.Bytes(), &response)
 			assert.NoError(t, err)
 
 			if tc.expectedStatus == http.StatusOK {
 				assert.Equal(t, tc.expectedMessage, response["message"])
 			} else {
-				assert.Equal(t, tc.expectedMessage, response["error"])
+				assert.Equal(t, tc.expectedMessage, response["detail"])
 			}
 
 			// Ensure all expectations were met
@@ -104,6 +168,197 @@ func TestSignUpForEvent(t *testing.T) {
 	}
 }
 
+func TestCancelSignUp(t *testing.T) {
+	// Setup
+	e := echo.New()
+	e.Validator = validator.NewCustomValidator()
+
+	// Test cases
+	testCases := []struct {
+		name            string
+		eventID         string
+		reqBody         string
+		cutoff          time.Duration
+		expectedStatus  int
+		expectedMessage string
+		mockBehavior    func(mock sqlmock.Sqlmock)
+	}{
+		{
+			name:            "Successful cancellation",
+			eventID:         "2",
+			reqBody:         `{"reason": "I got sick"}`,
+			cutoff:          24 * time.Hour,
+			expectedStatus:  http.StatusOK,
+			expectedMessage: "Successfully cancelled the sign up",
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT date_and_time FROM events").
+					WithArgs(2).
+					WillReturnRows(sqlmock.NewRows([]string{"date_and_time"}).AddRow(time.Now().Add(48 * time.Hour)))
+				mock.ExpectExec("UPDATE user_events SET status = 'cancelled'").
+					WithArgs(1, 2, "I got sick").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("UPDATE user_events SET status = 'confirmed'").
+					WithArgs(2).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+		},
+		{
+			name:            "Too close to the event",
+			eventID:         "2",
+			cutoff:          24 * time.Hour,
+			expectedStatus:  http.StatusConflict,
+			expectedMessage: "cancellations are closed for this event",
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT date_and_time FROM events").
+					WithArgs(2).
+					WillReturnRows(sqlmock.NewRows([]string{"date_and_time"}).AddRow(time.Now().Add(12 * time.Hour)))
+				mock.ExpectRollback()
+			},
+		},
+		{
+			name:            "Not signed up",
+			eventID:         "2",
+			expectedStatus:  http.StatusNotFound,
+			expectedMessage: "not signed up to event",
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT date_and_time FROM events").
+					WithArgs(2).
+					WillReturnRows(sqlmock.NewRows([]string{"date_and_time"}).AddRow(time.Now().Add(48 * time.Hour)))
+				mock.ExpectExec("UPDATE user_events SET status = 'cancelled'").
+					WithArgs(1, 2, nil).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectRollback()
+			},
+		},
+		{
+			name:            "Invalid event ID",
+			eventID:         "invalid",
+			expectedStatus:  http.StatusBadRequest,
+			expectedMessage: "Invalid event ID",
+			mockBehavior:    func(mock sqlmock.Sqlmock) {},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodDelete, "/events/"+tc.eventID+"/signup", strings.NewReader(tc.reqBody))
+			if tc.reqBody != "" {
+				req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			}
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+			c.SetParamNames("id")
+			c.SetParamValues(tc.eventID)
+			c.Set("user_id", int64(1))
+
+			// Mock database
+			db, mock, err := sqlmock.New()
+			assert.NoError(t, err)
+			defer db.Close()
+
+			tc.mockBehavior(mock)
+
+			// Create repository with mock db
+			repo := &repositories.UserEventRepository{DB: db}
+
+			// Call the handler
+			handler := CancelSignUp(repo, tc.cutoff)
+			err = handle(handler)(c)
+
+			// Assertions
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedStatus, rec.Code)
+
+			var response map[string]interface{}
+			err = json.Unmarshal(rec.Body.Bytes(), &response)
+			assert.NoError(t, err)
+
+			if tc.expectedStatus == http.StatusOK {
+				assert.Equal(t, tc.expectedMessage, response["message"])
+			} else {
+				assert.Equal(t, tc.expectedMessage, response["detail"])
+			}
+
+			// Ensure all expectations were met
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestCheckIn(t *testing.T) {
+	// Setup
+	e := echo.New()
+
+	// Test cases
+	testCases := []struct {
+		name           string
+		userID         string
+		mockBehavior   func(mock sqlmock.Sqlmock)
+		expectedStatus int
+	}{
+		{
+			name:   "Check in a user with a seat",
+			userID: "3",
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("UPDATE user_events SET checked_in_at").
+					WithArgs(3, 1).
+					WillReturnRows(sqlmock.NewRows([]string{"checked_in_at"}).AddRow(time.Now()))
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:   "User without a seat",
+			userID: "3",
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("UPDATE user_events SET checked_in_at").
+					WithArgs(3, 1).
+					WillReturnError(sql.ErrNoRows)
+			},
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "Invalid user ID",
+			userID:         "abc",
+			mockBehavior:   func(mock sqlmock.Sqlmock) {},
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/events/1/signups/"+tc.userID+"/check-in", nil)
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+			c.SetParamNames("id", "user_id")
+			c.SetParamValues("1", tc.userID)
+
+			// Mock database
+			db, mock, err := sqlmock.New()
+			assert.NoError(t, err)
+			defer db.Close()
+
+			tc.mockBehavior(mock)
+
+			// Create repository with mock db
+			repo := &repositories.UserEventRepository{DB: db}
+
+			// Call the handler
+			err = handle(CheckIn(repo))(c)
+
+			// Assertions
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedStatus, rec.Code)
+
+			// Ensure all expectations were met
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
 func TestGetUserEvents(t *testing.T) {
 	// Setup
 	e := echo.New()
@@ -113,6 +368,7 @@ func TestGetUserEvents(t *testing.T) {
 		name           string
 		userID         int64
 		filter         string
+		sort           string
 		page           string
 		limit          string
 		expectedStatus int
@@ -135,13 +391,13 @@ func TestGetUserEvents(t *testing.T) {
 			expectedTotal: 2,
 			expectedPages: 1,
 			mockBehavior: func(mock sqlmock.Sqlmock) {
-				rows := sqlmock.NewRows([]string{"id", "title", "long_description", "short_description", "date_and_time", "organizer", "location", "status"}).
-					AddRow(1, "Event 1", "Long desc 1", "Short desc 1", time.Now().Add(24*time.Hour), "Org 1", "Loc 1", "published").
-					AddRow(2, "Event 2", "Long desc 2", "Short desc 2", time.Now().Add(-24*time.Hour), "Org 2", "Loc 2", "published")
-				mock.ExpectQuery("SELECT e.id, e.title, e.long_description, e.short_description, e.date_and_time, e.organizer, e.location, e.status FROM events e JOIN user_events ue ON e.id = ue.event_id WHERE ue.user_id = \\$1 LIMIT \\$2 OFFSET \\$3").
+				rows := newEventRows()
+				addEventRow(rows, models.Event{Id: 1, Title: "Event 1", LongDescription: "Long desc 1", ShortDescription: "Short desc 1", DateAndTime: time.Now().Add(24 * time.Hour), Organizer: "Org 1", Location: "Loc 1", Status: "published"})
+				addEventRow(rows, models.Event{Id: 2, Title: "Event 2", LongDescription: "Long desc 2", ShortDescription: "Short desc 2", DateAndTime: time.Now().Add(-24 * time.Hour), Organizer: "Org 2", Location: "Loc 2", Status: "published"})
+				mock.ExpectQuery("SELECT (.+) FROM events e JOIN user_events ue ON e.id = ue.event_id WHERE ue.user_id = \\$1 AND ue.status <> 'cancelled' ORDER BY e.date_and_time ASC, e.id ASC LIMIT \\$2 OFFSET \\$3").
 					WithArgs(1, 10, 0).
 					WillReturnRows(rows)
-				mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM events e JOIN user_events ue ON e.id = ue.event_id WHERE ue.user_id = \\$1").
+				mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM events e JOIN user_events ue ON e.id = ue.event_id WHERE ue.user_id = \\$1 AND ue.status <> 'cancelled'").
 					WithArgs(1).
 					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
 			},
@@ -159,16 +415,43 @@ func TestGetUserEvents(t *testing.T) {
 			expectedTotal: 6,
 			expectedPages: 2,
 			mockBehavior: func(mock sqlmock.Sqlmock) {
-				rows := sqlmock.NewRows([]string{"id", "title", "long_description", "short_description", "date_and_time", "organizer", "location", "status"}).
-					AddRow(1, "Event 1", "Long desc 1", "Short desc 1", time.Now().Add(24*time.Hour), "Org 1", "Loc 1", "published")
-				mock.ExpectQuery("SELECT e.id, e.title, e.long_description, e.short_description, e.date_and_time, e.organizer, e.location, e.status FROM events e JOIN user_events ue ON e.id = ue.event_id WHERE ue.user_id = \\$1 AND e.date_and_time > NOW\\(\\) LIMIT \\$2 OFFSET \\$3").
+				rows := addEventRow(newEventRows(), models.Event{Id: 1, Title: "Event 1", LongDescription: "Long desc 1", ShortDescription: "Short desc 1", DateAndTime: time.Now().Add(24 * time.Hour), Organizer: "Org 1", Location: "Loc 1", Status: "published"})
+				mock.ExpectQuery("SELECT (.+) FROM events e JOIN user_events ue ON e.id = ue.event_id WHERE ue.user_id = \\$1 AND ue.status <> 'cancelled' AND e.date_and_time > NOW\\(\\) ORDER BY e.date_and_time ASC, e.id ASC LIMIT \\$2 OFFSET \\$3").
 					WithArgs(1, 5, 5).
 					WillReturnRows(rows)
-				mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM events e JOIN user_events ue ON e.id = ue.event_id WHERE ue.user_id = \\$1 AND e.date_and_time > NOW\\(\\)").
+				mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM events e JOIN user_events ue ON e.id = ue.event_id WHERE ue.user_id = \\$1 AND ue.status <> 'cancelled' AND e.date_and_time > NOW\\(\\)").
 					WithArgs(1).
 					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(6))
 			},
 		},
+		{
+			name:           "Get user events sorted by popularity",
+			userID:         1,
+			filter:         "",
+			sort:           "-popularity",
+			expectedStatus: http.StatusOK,
+			expectedEvents: []models.Event{
+				{Id: 2, Title: "Event 2", DateAndTime: time.Now().Add(24 * time.Hour)},
+			},
+			expectedTotal: 1,
+			expectedPages: 1,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				rows := addEventRow(newEventRows(), models.Event{Id: 2, Title: "Event 2", DateAndTime: time.Now().Add(24 * time.Hour), Status: "published"})
+				mock.ExpectQuery("SELECT (.+) ORDER BY \\(SELECT COUNT\\(\\*\\) FROM user_events p WHERE p.event_id = e.id AND p.status <> 'cancelled'\\) DESC, e.id DESC LIMIT \\$2 OFFSET \\$3").
+					WithArgs(1, 10, 0).
+					WillReturnRows(rows)
+				mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM events e").
+					WithArgs(1).
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+			},
+		},
+		{
+			name:           "Invalid sort",
+			userID:         1,
+			sort:           "location",
+			expectedStatus: http.StatusBadRequest,
+			mockBehavior:   func(mock sqlmock.Sqlmock) {},
+		},
 		{
 			name:           "Invalid filter",
 			userID:         1,
@@ -188,7 +471,7 @@ func TestGetUserEvents(t *testing.T) {
 			expectedStatus: http.StatusInternalServerError,
 			expectedEvents: nil,
 			mockBehavior: func(mock sqlmock.Sqlmock) {
-				mock.ExpectQuery("SELECT e.id, e.title, e.long_description, e.short_description, e.date_and_time, e.organizer, e.location, e.status FROM events e JOIN user_events ue ON e.id = ue.event_id WHERE ue.user_id = \\$1 LIMIT \\$2 OFFSET \\$3").
+				mock.ExpectQuery("SELECT (.+) FROM events e JOIN user_events ue ON e.id = ue.event_id WHERE ue.user_id = \\$1 AND ue.status <> 'cancelled' ORDER BY e.date_and_time ASC, e.id ASC LIMIT \\$2 OFFSET \\$3").
 					WithArgs(1, 10, 0).
 					WillReturnError(sqlmock.ErrCancelled)
 			},
@@ -197,7 +480,7 @@ func TestGetUserEvents(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			req := httptest.NewRequest(http.MethodGet, "/user/events?filter="+tc.filter+"&page="+tc.page+"&limit="+tc.limit, nil)
+			req := httptest.NewRequest(http.MethodGet, "/user/events?filter="+tc.filter+"&sort="+tc.sort+"&page="+tc.page+"&limit="+tc.limit, nil)
 			rec := httptest.NewRecorder()
 			c := e.NewContext(req, rec)
 			c.Set("user_id", tc.userID)
@@ -214,7 +497,7 @@ func TestGetUserEvents(t *testing.T) {
 
 			// Call the handler
 			handler := GetUserEvents(repo)
-			err = handler(c)
+			err = handle(handler)(c)
 
 			// Assertions
 			assert.NoError(t, err)
@@ -242,11 +525,11 @@ func TestGetUserEvents(t *testing.T) {
 					assert.WithinDuration(t, event.DateAndTime, parsedTime, time.Second)
 				}
 			} else {
-				var response map[string]string
+				var response map[string]interface{}
 				err = json.Unmarshal(rec.Body.Bytes(), &response)
 				assert.NoError(t, err)
-				assert.Contains(t, response, "error")
-				assert.NotEmpty(t, response["error"])
+				assert.Contains(t, response, "detail")
+				assert.NotEmpty(t, response["detail"])
 			}
 
 			// Ensure all expectations were met
@@ -254,3 +537,43 @@ func TestGetUserEvents(t *testing.T) {
 		})
 	}
 }
+
+func TestGetUserEventsCursor(t *testing.T) {
+	e := echo.New()
+
+	req := httptest.NewRequest(http.MethodGet, "/user/events?filter=upcoming&sort=-title&cursor=&limit=1", nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.Set("user_id", int64(1))
+
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	// The sort value goes after the event columns
+	rows := sqlmock.NewRows(append(newEventColumns(), "sort_value")).
+		AddRow(eventValues(models.Event{Id: 2, Title: "Workshop", Status: "published"}, "workshop")...).
+		AddRow(eventValues(models.Event{Id: 1, Title: "Talk", Status: "published"}, "talk")...)
+	mock.ExpectQuery("SELECT (.+), \\(LOWER\\(e.title\\)\\)::text FROM events e JOIN user_events ue ON e.id = ue.event_id WHERE ue.user_id = \\$1 AND ue.status <> 'cancelled' AND e.date_and_time > NOW\\(\\) ORDER BY LOWER\\(e.title\\) DESC, e.id DESC LIMIT \\$2").
+		WithArgs(1, 2).
+		WillReturnRows(rows)
+
+	repo := &repositories.UserEventRepository{DB: db}
+	err = handle(GetUserEvents(repo))(c)
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var response map[string]interface{}
+	err = json.Unmarshal(rec.Body.Bytes(), &response)
+	assert.NoError(t, err)
+	assert.Len(t, response["events"], 1)
+	assert.Nil(t, response["prev_cursor"])
+	assert.NotContains(t, response, "total")
+
+	// The next page starts after the last event of this one
+	next := &repositories.Cursor{Sort: "-title", Value: "workshop", Id: 2}
+	assert.Equal(t, next.Encode(), response["next_cursor"])
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -2,91 +2,200 @@ package handlers
 
 import (
 	"database/sql"
+	"fmt"
+	"math"
 	"net/http"
-	"os"
+	"strconv"
 	"time"
 
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/labstack/echo/v4"
+	"github.com/xtommas/challenge-hetmo/internal/jwtkeys"
+	"github.com/xtommas/challenge-hetmo/internal/mailer"
 	"github.com/xtommas/challenge-hetmo/internal/models"
+	"github.com/xtommas/challenge-hetmo/internal/problem"
 	"github.com/xtommas/challenge-hetmo/internal/repositories"
 )
 
-func Register(userRepo *repositories.UserRepository) echo.HandlerFunc {
+// Register creates a user and emails them a token to verify their
+// email
+func Register(userRepo *repositories.UserRepository, m mailer.Mailer) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		var input struct {
 			Username string `json:"username" validate:"required,min=3,max=50"`
 			Password string `json:"password" validate:"required,min=5"`
+			Email    string `json:"email" validate:"required,email,max=255"`
 		}
 		if err := c.Bind(&input); err != nil {
-			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+			return problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid request")
 		}
 
 		if err := c.Validate(input); err != nil {
-			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return err
 		}
 
 		user := &models.User{
 			Username: input.Username,
-			IsAdmin:  false,
+			Email:    input.Email,
+			// New users have no roles
+			Roles: []string{},
 		}
 		if err := user.SetPassword(input.Password); err != nil {
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to set password"})
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to set password")
 		}
 
 		err := userRepo.Create(user)
+		if err == repositories.ErrUsernameTaken {
+			// Unlike the email, the username is told apart, as the user
+			// has to choose another one to log in with. It doesn't tell
+			// whether the email has an account
+			return problem.New(http.StatusConflict, problem.CodeConflict, "Username already in use")
+		}
+		if err == repositories.ErrEmailTaken {
+			// The response doesn't tell the email is taken, so it can't
+			// be used to find out who has an account. Its owner is told
+			// instead
+			sendEmailTakenNotice(c, userRepo, m, input.Email)
+			return c.JSON(http.StatusAccepted, map[string]string{"message": registerMessage})
+		}
 		if err != nil {
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to register user"})
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to register user")
 		}
-		return c.JSON(http.StatusCreated, user)
+
+		// The user is registered anyway, and can ask for a new email
+		if err := sendVerificationEmail(c, userRepo, m, user); err != nil {
+			c.Logger().Errorf("Failed to create email verification token for user %d: %v", user.Id, err)
+		}
+		return c.JSON(http.StatusAccepted, map[string]string{"message": registerMessage})
 	}
 }
 
-func Login(userRepo *repositories.UserRepository) echo.HandlerFunc {
+// registerMessage is the response to every registration, so it
+// doesn't tell which emails have an account
+const registerMessage = "Check your email to finish registering"
+
+// sendEmailTakenNotice tells the owner of the email that someone tried
+// to register with it, after responding so the response time doesn't
+// tell either. Emails that weren't verified could belong to someone
+// else, so they aren't told anything
+func sendEmailTakenNotice(c echo.Context, userRepo *repositories.UserRepository, m mailer.Mailer, email string) {
+	logger := c.Logger()
+	go func() {
+		owner, err := userRepo.GetByEmail(email)
+		if err != nil {
+			if err != sql.ErrNoRows {
+				logger.Errorf("Failed to get the owner of a registered email: %v", err)
+			}
+			return
+		}
+		if !owner.EmailVerified() {
+			return
+		}
+		msg := mailer.Message{
+			To:      owner.Email,
+			Subject: "Someone tried to register with your email",
+			Body: fmt.Sprintf("Someone tried to register a new account with this email, which already belongs to the account %s.\n\n"+
+				"If it was you, log in with that account instead, or send your username to POST /password/forgot if you forgot its password.\n"+
+				"If it wasn't you, you can ignore this email.\n",
+				owner.Username),
+		}
+		if err := m.Send(msg); err != nil {
+			logger.Errorf("Failed to send email taken notice to user %d: %v", owner.Id, err)
+		}
+	}()
+}
+
+// Login trades a username and password for tokens. Failed attempts
+// make the next ones for the same username or from the same IP
+// address wait longer and longer, and eventually lock them out
+func Login(userRepo *repositories.UserRepository, tokenRepo *repositories.TokenRepository, attemptRepo *repositories.LoginAttemptRepository, twoFactorRepo *repositories.TwoFactorRepository, keys *jwtkeys.KeySet) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		var input struct {
 			Username string `json:"username"`
 			Password string `json:"password"`
 		}
 		if err := c.Bind(&input); err != nil {
-			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid input"})
+			return problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid input")
 		}
 
-		user, err := userRepo.Get(input.Username)
+		ip := c.RealIP()
+		blockedUntil, err := attemptRepo.BlockedUntil(input.Username, ip)
 		if err != nil {
-			if err == sql.ErrNoRows {
-				return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid credentials"})
-			}
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "An unexpected error occurred"})
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "An unexpected error occurred")
+		}
+		if !blockedUntil.IsZero() {
+			retryAfter := int(math.Ceil(time.Until(blockedUntil).Seconds()))
+			c.Response().Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			return problem.New(http.StatusTooManyRequests, problem.CodeLoginThrottled, "Too many failed login attempts, try again later")
 		}
 
-		if !user.CheckPassword(input.Password) {
-			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid credentials"})
+		user, err := userRepo.Get(input.Username)
+		if err != nil && err != sql.ErrNoRows {
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "An unexpected error occurred")
 		}
 
-		token := jwt.New(jwt.SigningMethodHS256)
+		// Unknown users take as long to fail as wrong passwords, so
+		// the response time doesn't tell which users exist
+		var valid bool
+		if err == sql.ErrNoRows {
+			valid = models.CheckDummyPassword(input.Password)
+		} else {
+			valid = user.CheckPassword(input.Password)
+		}
+		if !valid {
+			if err := attemptRepo.RecordFailure(input.Username, ip); err != nil {
+				return problem.New(http.StatusInternalServerError, problem.CodeInternal, "An unexpected error occurred")
+			}
+			return problem.New(http.StatusUnauthorized, problem.CodeInvalidCredentials, "Invalid credentials")
+		}
 
-		// Set claims (the info that the JWT transmits)
-		claims := token.Claims.(jwt.MapClaims)
-		claims["user_id"] = user.Id
-		claims["username"] = user.Username
-		claims["is_admin"] = user.IsAdmin
-		claims["exp"] = time.Now().Add(time.Hour * 72).Unix()
+		if err := attemptRepo.Clear(user.Username); err != nil {
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "An unexpected error occurred")
+		}
 
-		// Generate encoded token
-		t, err := token.SignedString([]byte(os.Getenv("JWT_SECRET")))
-		if err != nil {
+		if err := checkCanLogIn(user); err != nil {
 			return err
 		}
 
-		return c.JSON(http.StatusOK, map[string]string{
-			"token": t,
-		})
+		return logIn(c, keys, tokenRepo, twoFactorRepo, user)
+	}
+}
 
+// checkCanLogIn turns away the users that can't log in, such as
+// suspended ones and those who have to reset their password
+func checkCanLogIn(user *models.User) error {
+	if user.IsDeleted() {
+		return problem.New(http.StatusUnauthorized, problem.CodeInvalidCredentials, "Invalid credentials")
+	}
+	if user.IsSuspended() {
+		return problem.New(http.StatusForbidden, problem.CodeAccountSuspended, "Account suspended")
 	}
+	if user.PasswordResetRequired {
+		return problem.New(http.StatusForbidden, problem.CodePasswordResetRequired, "Password reset required")
+	}
+	return nil
 }
 
-func PromoteUserToAdmin(userRepo *repositories.UserRepository) echo.HandlerFunc {
+// logIn completes the login of a user who proved who they are. Users
+// with two-factor authentication get their tokens from LoginMFA,
+// trading a challenge and a code
+func logIn(c echo.Context, keys *jwtkeys.KeySet, tokenRepo *repositories.TokenRepository, twoFactorRepo *repositories.TwoFactorRepository, user *models.User) error {
+	if user.TwoFactorEnabled {
+		mfaToken, expiresAt, err := twoFactorRepo.CreateChallenge(user.Id)
+		if err != nil {
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "An unexpected error occurred")
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"mfa_required": true,
+			"mfa_token":    mfaToken,
+			"expires_in":   int(time.Until(expiresAt).Seconds()),
+		})
+	}
+
+	return issueTokens(c, keys, tokenRepo, user, "")
+}
+
+// PromoteUserToAdmin gives the admin role to the user
+func PromoteUserToAdmin(userRepo *repositories.UserRepository, roleRepo *repositories.RoleRepository, users *repositories.UserCache) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		// Get the username from the URL
 		username := c.Param("username")
@@ -95,23 +204,320 @@ func PromoteUserToAdmin(userRepo *repositories.UserRepository) echo.HandlerFunc
 		user, err := userRepo.Get(username)
 		if err != nil {
 			if err == sql.ErrNoRows {
-				return c.JSON(http.StatusNotFound, map[string]string{"error": "User not found"})
+				return problem.New(http.StatusNotFound, problem.CodeNotFound, "User not found")
 			}
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to promote user"})
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to promote user")
 		}
 
 		// Check if the user is already an admin
-		if user.IsAdmin {
-			return c.JSON(http.StatusBadRequest, map[string]string{"error": "User is already an admin"})
+		if user.HasRole(models.RoleAdmin) {
+			return problem.New(http.StatusBadRequest, problem.CodeRoleAlreadyAssigned, "User is already an admin")
 		}
 
 		// Promote the user to admin
-		user.IsAdmin = true
-		err = userRepo.Update(user)
+		err = roleRepo.Assign(user.Id, models.RoleAdmin)
 		if err != nil {
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to promote user"})
+			if err == repositories.ErrRoleAlreadyAssigned {
+				return problem.New(http.StatusBadRequest, problem.CodeRoleAlreadyAssigned, "User is already an admin")
+			}
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to promote user")
 		}
+		// The new rights apply to the user's next request
+		users.Forget(user.Id)
 
 		return c.JSON(http.StatusOK, map[string]string{"message": "User promoted to admin successfully"})
 	}
 }
+
+// GetUsers lists the users, optionally searching by username and
+// filtering by role
+func GetUsers(userRepo *repositories.UserRepository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		filter := repositories.UserFilter{
+			Search: c.QueryParam("q"),
+			Role:   c.QueryParam("role"),
+		}
+
+		limit := 10
+		if limitParam := c.QueryParam("limit"); limitParam != "" {
+			var err error
+			limit, err = strconv.Atoi(limitParam)
+			if err != nil || limit < 1 {
+				limit = 10
+			} else if limit > maxLimit {
+				limit = maxLimit
+			}
+		}
+
+		// Users are always paginated with cursors, and without one the
+		// first page is returned
+		cursor, _, err := cursorParam(c, repositories.UserSort)
+		if err != nil {
+			return problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid cursor")
+		}
+		userPage, err := userRepo.GetPage(filter, cursor, limit)
+		if err != nil {
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to get users")
+		}
+		response := pageResponse("users", userPage.Users, userPage.Next, userPage.Prev, limit)
+
+		// Counting is slow on large lists, so it's only done on request
+		if includeTotal(c) {
+			total, err := userRepo.GetTotalCount(filter)
+			if err != nil {
+				return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to get total count")
+			}
+			response["total"] = total
+		}
+
+		return c.JSON(http.StatusOK, response)
+	}
+}
+
+// GetUser returns the user in the username param along with all of
+// their sign ups
+func GetUser(userRepo *repositories.UserRepository, userEventRepo *repositories.UserEventRepository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user, err := getUserParam(c, userRepo)
+		if err != nil {
+			return err
+		}
+
+		signUps, err := userEventRepo.GetSignUps(user.Id)
+		if err != nil {
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to get sign ups")
+		}
+
+		return c.JSON(http.StatusOK, models.UserDetails{User: user, SignUps: signUps})
+	}
+}
+
+// DemoteAdmin takes the admin role away from the user. The last admin
+// can't be demoted
+func DemoteAdmin(userRepo *repositories.UserRepository, roleRepo *repositories.RoleRepository, users *repositories.UserCache) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user, err := getUserParam(c, userRepo)
+		if err != nil {
+			return err
+		}
+
+		if !user.HasRole(models.RoleAdmin) {
+			return problem.New(http.StatusBadRequest, problem.CodeRoleNotAssigned, "User is not an admin")
+		}
+
+		err = roleRepo.Remove(user.Id, models.RoleAdmin)
+		if err != nil {
+			switch err {
+			case repositories.ErrRoleNotAssigned:
+				return problem.New(http.StatusBadRequest, problem.CodeRoleNotAssigned, "User is not an admin")
+			case repositories.ErrLastAdmin:
+				return problem.New(http.StatusConflict, problem.CodeLastAdmin, "The last admin can't be demoted")
+			}
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to demote user")
+		}
+		users.Forget(user.Id)
+
+		return c.JSON(http.StatusOK, map[string]string{"message": "User demoted successfully"})
+	}
+}
+
+// SetUserSuspended suspends the user in the username param, or lifts
+// their suspension. Suspended users can't log in or use their tokens
+func SetUserSuspended(userRepo *repositories.UserRepository, users *repositories.UserCache, suspended bool) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user, err := getUserParam(c, userRepo)
+		if err != nil {
+			return err
+		}
+
+		// Admins would lock themselves out
+		if suspended && user.Id == c.Get("user_id") {
+			return problem.New(http.StatusBadRequest, problem.CodeCannotSuspendSelf, "You can't suspend yourself")
+		}
+
+		if err := userRepo.SetSuspended(user.Id, suspended); err != nil {
+			switch err {
+			case sql.ErrNoRows:
+				return problem.New(http.StatusNotFound, problem.CodeNotFound, "User not found")
+			case repositories.ErrLastAdmin:
+				return problem.New(http.StatusConflict, problem.CodeLastAdmin, "The last admin can't be suspended")
+			}
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to update user")
+		}
+		// The suspension applies to the user's next request
+		users.Forget(user.Id)
+
+		if suspended {
+			return c.JSON(http.StatusOK, map[string]string{"message": "User suspended successfully"})
+		}
+		return c.JSON(http.StatusOK, map[string]string{"message": "User unsuspended successfully"})
+	}
+}
+
+// ForcePasswordReset logs the user in the username param out and
+// keeps them from logging in until they choose a new password. The
+// reset token is emailed to the user, so the admin never sees it and
+// can't log in as them
+func ForcePasswordReset(userRepo *repositories.UserRepository, tokenRepo *repositories.TokenRepository, users *repositories.UserCache, m mailer.Mailer) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user, err := getUserParam(c, userRepo)
+		if err != nil {
+			return err
+		}
+
+		// Otherwise the user would be locked out with no way to get the
+		// token, and unverified emails could belong to someone else
+		if !user.EmailVerified() {
+			return problem.New(http.StatusConflict, problem.CodeEmailNotVerified, "The user has no verified email to send the reset token to")
+		}
+
+		token, expiresAt, err := userRepo.RequirePasswordReset(user.Id)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return problem.New(http.StatusNotFound, problem.CodeNotFound, "User not found")
+			}
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to force password reset")
+		}
+		users.Forget(user.Id)
+
+		if err := tokenRepo.RevokeUser(user.Id, ""); err != nil {
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to revoke the user's tokens")
+		}
+
+		logger := c.Logger()
+		go func() {
+			msg := mailer.Message{
+				To:      user.Email,
+				Subject: "Reset your password",
+				Body: fmt.Sprintf("An administrator asked you to choose a new password for your account %s. "+
+					"You can't log in until you do.\n\n"+
+					"To choose a new password, send this token to POST /password/reset before %s:\n\n%s\n",
+					user.Username, expiresAt.UTC().Format(time.RFC1123), token),
+			}
+			if err := m.Send(msg); err != nil {
+				logger.Errorf("Failed to send password reset email to user %d: %v", user.Id, err)
+			}
+		}()
+
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"expires_at": expiresAt,
+		})
+	}
+}
+
+// forgotPasswordMessage is the response to every password reset
+// request, so it doesn't tell which users exist
+const forgotPasswordMessage = "If the account exists and has a verified email, a password reset token was sent to it"
+
+// ForgotPassword emails a password reset token to the user, for when
+// they forgot their password
+func ForgotPassword(userRepo *repositories.UserRepository, m mailer.Mailer) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var input struct {
+			Username string `json:"username" validate:"required"`
+		}
+		if err := c.Bind(&input); err != nil {
+			return problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid request")
+		}
+
+		if err := c.Validate(input); err != nil {
+			return err
+		}
+
+		user, err := userRepo.Get(input.Username)
+		if err != nil && err != sql.ErrNoRows {
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to request password reset")
+		}
+		// Unknown users, users without a verified email and suspended
+		// users get the same response as everyone else. Unverified
+		// emails could belong to someone else
+		if err == sql.ErrNoRows || !user.EmailVerified() || user.IsSuspended() {
+			return c.JSON(http.StatusOK, map[string]string{"message": forgotPasswordMessage})
+		}
+
+		// Creating and sending the token takes long enough to tell which
+		// users exist, so it's done after responding
+		logger := c.Logger()
+		go func() {
+			token, expiresAt, err := userRepo.CreatePasswordResetToken(user.Id)
+			if err != nil {
+				logger.Errorf("Failed to create password reset token for user %d: %v", user.Id, err)
+				return
+			}
+			msg := mailer.Message{
+				To:      user.Email,
+				Subject: "Reset your password",
+				Body: fmt.Sprintf("Someone asked to reset the password of your account %s.\n\n"+
+					"To choose a new password, send this token to POST /password/reset before %s:\n\n%s\n\n"+
+					"If it wasn't you, you can ignore this email.\n",
+					user.Username, expiresAt.UTC().Format(time.RFC1123), token),
+			}
+			if err := m.Send(msg); err != nil {
+				logger.Errorf("Failed to send password reset email to user %d: %v", user.Id, err)
+			}
+		}()
+
+		return c.JSON(http.StatusOK, map[string]string{"message": forgotPasswordMessage})
+	}
+}
+
+// ResetPassword sets a new password with a password reset token, and
+// logs the user out of their previous sessions
+func ResetPassword(userRepo *repositories.UserRepository, tokenRepo *repositories.TokenRepository, users *repositories.UserCache) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var input struct {
+			Token    string `json:"token" validate:"required"`
+			Password string `json:"password" validate:"required,min=5"`
+		}
+		if err := c.Bind(&input); err != nil {
+			return problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid request")
+		}
+
+		if err := c.Validate(input); err != nil {
+			return err
+		}
+
+		var user models.User
+		if err := user.SetPassword(input.Password); err != nil {
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to set password")
+		}
+
+		userID, err := userRepo.ResetPassword(input.Token, user.Password)
+		if err != nil {
+			if err == repositories.ErrInvalidResetToken {
+				return problem.New(http.StatusBadRequest, problem.CodeInvalidResetToken, "Invalid or expired reset token")
+			}
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to reset password")
+		}
+		users.Forget(userID)
+
+		if err := tokenRepo.RevokeUser(userID, ""); err != nil {
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to revoke previous sessions")
+		}
+
+		return c.JSON(http.StatusOK, map[string]string{"message": "Password reset successfully"})
+	}
+}
+
+// GetLoginLockouts lists the users locked out after too many failed
+// logins
+func GetLoginLockouts(attemptRepo *repositories.LoginAttemptRepository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		lockouts, err := attemptRepo.GetLockouts()
+		if err != nil {
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to get lockouts")
+		}
+		return c.JSON(http.StatusOK, lockouts)
+	}
+}
+
+// ClearLoginLockout lets the user in the username param try to log in
+// again right away, forgetting their failed logins
+func ClearLoginLockout(attemptRepo *repositories.LoginAttemptRepository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if err := attemptRepo.Clear(c.Param("username")); err != nil {
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to clear lockout")
+		}
+		return c.JSON(http.StatusOK, map[string]string{"message": "Lockout cleared successfully"})
+	}
+}
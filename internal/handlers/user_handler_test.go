@@ -7,15 +7,36 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
 	"github.com/stretchr/testify/assert"
+	"github.com/xtommas/challenge-hetmo/internal/mailer"
+	"github.com/xtommas/challenge-hetmo/internal/problem"
 	"github.com/xtommas/challenge-hetmo/internal/repositories"
 	"github.com/xtommas/challenge-hetmo/internal/validator"
 	"golang.org/x/crypto/bcrypt"
 )
 
+// handle wraps a handler so the errors it returns are written as
+// problem details, like the server does
+func handle(h echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if err := h(c); err != nil {
+			problem.HTTPErrorHandler(err, c)
+		}
+		return nil
+	}
+}
+
+// newUserRows returns the mocked rows for a query that selects users
+func newUserRows() *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"id", "username", "password", "suspended_at", "password_reset_required",
+		"display_name", "email", "email_verified_at", "avatar_url", "locale", "timezone", "deleted_at", "two_factor_enabled", "roles", "permissions"})
+}
+
 func TestRegister(t *testing.T) {
 	// Setup
 	e := echo.New()
@@ -26,26 +47,89 @@ func TestRegister(t *testing.T) {
 		name           string
 		reqBody        string
 		expectedStatus int
+		expectEmailTo  string
 		mockBehavior   func(mock sqlmock.Sqlmock)
 	}{
 		{
 			name: "Successful registration",
 			reqBody: `{
 				"username": "newuser",
-				"password": "password123"
+				"password": "password123",
+				"email": "newuser@example.com"
 			}`,
-			expectedStatus: http.StatusCreated,
+			expectedStatus: http.StatusAccepted,
+			expectEmailTo:  "newuser@example.com",
 			mockBehavior: func(mock sqlmock.Sqlmock) {
 				mock.ExpectQuery("INSERT INTO users").
-					WithArgs("newuser", sqlmock.AnyArg(), false).
+					WithArgs("newuser", sqlmock.AnyArg(), "newuser@example.com", "{}").
 					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+				expectVerificationToken(mock, 1, "newuser@example.com")
+			},
+		},
+		{
+			name: "Email of another user",
+			reqBody: `{
+				"username": "newuser",
+				"password": "password123",
+				"email": "taken@example.com"
+			}`,
+			expectedStatus: http.StatusAccepted,
+			expectEmailTo:  "taken@example.com",
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("INSERT INTO users").
+					WithArgs("newuser", sqlmock.AnyArg(), "taken@example.com", "{}").
+					WillReturnError(&pq.Error{Code: "23505", Constraint: "users_email_key"})
+				mock.ExpectQuery("SELECT (.+) FROM users WHERE LOWER\\(email\\) = LOWER\\(\\$1\\)").
+					WithArgs("taken@example.com").
+					WillReturnRows(newUserRows().AddRow(2, "owner", "hashedpassword", nil, false, "", "taken@example.com", time.Now(), "", "", "UTC", nil, false, "{}", "{}"))
+			},
+		},
+		{
+			name: "Unverified email of another user",
+			reqBody: `{
+				"username": "newuser",
+				"password": "password123",
+				"email": "taken@example.com"
+			}`,
+			expectedStatus: http.StatusAccepted,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("INSERT INTO users").
+					WithArgs("newuser", sqlmock.AnyArg(), "taken@example.com", "{}").
+					WillReturnError(&pq.Error{Code: "23505", Constraint: "users_email_key"})
+				mock.ExpectQuery("SELECT (.+) FROM users WHERE LOWER\\(email\\) = LOWER\\(\\$1\\)").
+					WithArgs("taken@example.com").
+					WillReturnRows(newUserRows().AddRow(2, "owner", "hashedpassword", nil, false, "", "taken@example.com", nil, "", "", "UTC", nil, false, "{}", "{}"))
+			},
+		},
+		{
+			name: "Username of another user",
+			reqBody: `{
+				"username": "taken",
+				"password": "password123",
+				"email": "newuser@example.com"
+			}`,
+			expectedStatus: http.StatusConflict,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("INSERT INTO users").
+					WithArgs("taken", sqlmock.AnyArg(), "newuser@example.com", "{}").
+					WillReturnError(&pq.Error{Code: "23505", Constraint: "users_username_key"})
 			},
 		},
+		{
+			name: "Invalid input - missing email",
+			reqBody: `{
+				"username": "newuser",
+				"password": "password123"
+			}`,
+			expectedStatus: http.StatusBadRequest,
+			mockBehavior:   func(mock sqlmock.Sqlmock) {},
+		},
 		{
 			name: "Invalid input - short username",
 			reqBody: `{
 				"username": "nu",
-				"password": "password123"
+				"password": "password123",
+				"email": "nu@example.com"
 			}`,
 			expectedStatus: http.StatusBadRequest,
 			mockBehavior:   func(mock sqlmock.Sqlmock) {},
@@ -54,7 +138,8 @@ func TestRegister(t *testing.T) {
 			name: "Invalid input - short password",
 			reqBody: `{
 				"username": "newuser",
-				"password": "pass"
+				"password": "pass",
+				"email": "newuser@example.com"
 			}`,
 			expectedStatus: http.StatusBadRequest,
 			mockBehavior:   func(mock sqlmock.Sqlmock) {},
@@ -79,19 +164,40 @@ func TestRegister(t *testing.T) {
 			repo := &repositories.UserRepository{DB: db}
 
 			// Call the handler
-			handler := Register(repo)
-			err = handler(c)
+			mail := mailer.NewMemoryMailer()
+			handler := Register(repo, mail)
+			err = handle(handler)(c)
 
-			// Assertions
+			// Assertions. Taken emails get the same response as new
+			// ones
 			assert.NoError(t, err)
 			assert.Equal(t, tc.expectedStatus, rec.Code)
+			if tc.expectedStatus == http.StatusAccepted {
+				var response map[string]string
+				assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+				assert.Equal(t, registerMessage, response["message"])
+			}
 
-			// Ensure all expectations were met
-			assert.NoError(t, mock.ExpectationsWereMet())
+			// The emails are sent after responding
+			assert.Eventually(t, func() bool { return mock.ExpectationsWereMet() == nil }, time.Second, 10*time.Millisecond)
+			if tc.expectEmailTo != "" {
+				assert.Eventually(t, func() bool { return len(mail.Sent()) == 1 }, time.Second, 10*time.Millisecond)
+				assert.Equal(t, tc.expectEmailTo, mail.Sent()[0].To)
+			} else {
+				assert.Empty(t, mail.Sent())
+			}
 		})
 	}
 }
 
+// expectLoginNotBlocked mocks the check of the failed logins of the
+// username, finding no reason to wait
+func expectLoginNotBlocked(mock sqlmock.Sqlmock, username string) {
+	mock.ExpectQuery("SELECT MAX(.+) FROM login_attempts").
+		WithArgs("username", username, "ip", "192.0.2.1").
+		WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(nil))
+}
+
 func TestLogin(t *testing.T) {
 	// Setup
 	e := echo.New()
@@ -114,11 +220,57 @@ func TestLogin(t *testing.T) {
 			}`,
 			expectedStatus: http.StatusOK,
 			mockBehavior: func(mock sqlmock.Sqlmock) {
-				rows := sqlmock.NewRows([]string{"id", "username", "password", "is_admin"}).
-					AddRow(1, "existinguser", string(hashedPassword), false)
+				expectLoginNotBlocked(mock, "existinguser")
+				rows := newUserRows().
+					AddRow(1, "existinguser", string(hashedPassword), nil, false, "", "", nil, "", "", "UTC", nil, false, "{}", "{}")
+				mock.ExpectQuery("SELECT (.+) FROM users WHERE username = ?").
+					WithArgs("existinguser").
+					WillReturnRows(rows)
+				mock.ExpectExec("DELETE FROM login_attempts").
+					WithArgs("username", "existinguser").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				// A refresh token in a new family is issued along with the access token
+				mock.ExpectExec("INSERT INTO refresh_tokens").
+					WithArgs(1, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+			},
+		},
+		{
+			name: "Suspended account",
+			reqBody: `{
+				"username": "existinguser",
+				"password": "correctpassword"
+			}`,
+			expectedStatus: http.StatusForbidden,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				expectLoginNotBlocked(mock, "existinguser")
+				rows := newUserRows().
+					AddRow(1, "existinguser", string(hashedPassword), time.Now().Add(-time.Hour), false, "", "", nil, "", "", "UTC", nil, false, "{}", "{}")
 				mock.ExpectQuery("SELECT (.+) FROM users WHERE username = ?").
 					WithArgs("existinguser").
 					WillReturnRows(rows)
+				mock.ExpectExec("DELETE FROM login_attempts").
+					WithArgs("username", "existinguser").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+		},
+		{
+			name: "Password reset required",
+			reqBody: `{
+				"username": "existinguser",
+				"password": "correctpassword"
+			}`,
+			expectedStatus: http.StatusForbidden,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				expectLoginNotBlocked(mock, "existinguser")
+				rows := newUserRows().
+					AddRow(1, "existinguser", string(hashedPassword), nil, true, "", "", nil, "", "", "UTC", nil, false, "{}", "{}")
+				mock.ExpectQuery("SELECT (.+) FROM users WHERE username = ?").
+					WithArgs("existinguser").
+					WillReturnRows(rows)
+				mock.ExpectExec("DELETE FROM login_attempts").
+					WithArgs("username", "existinguser").
+					WillReturnResult(sqlmock.NewResult(0, 1))
 			},
 		},
 		{
@@ -129,9 +281,57 @@ func TestLogin(t *testing.T) {
 			}`,
 			expectedStatus: http.StatusUnauthorized,
 			mockBehavior: func(mock sqlmock.Sqlmock) {
+				expectLoginNotBlocked(mock, "nonexistentuser")
 				mock.ExpectQuery("SELECT (.+) FROM users WHERE username = ?").
 					WithArgs("nonexistentuser").
 					WillReturnError(sql.ErrNoRows)
+				mock.ExpectBegin()
+				mock.ExpectQuery("INSERT INTO login_attempts (.+) RETURNING failures").
+					WithArgs("username", "nonexistentuser", sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"failures"}).AddRow(1))
+				mock.ExpectQuery("INSERT INTO login_attempts (.+) RETURNING failures").
+					WithArgs("ip", "192.0.2.1", sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"failures"}).AddRow(1))
+				mock.ExpectCommit()
+			},
+		},
+		{
+			name: "Wrong password past the free failures",
+			reqBody: `{
+				"username": "existinguser",
+				"password": "wrongpassword"
+			}`,
+			expectedStatus: http.StatusUnauthorized,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				expectLoginNotBlocked(mock, "existinguser")
+				mock.ExpectQuery("SELECT (.+) FROM users WHERE username = ?").
+					WithArgs("existinguser").
+					WillReturnRows(newUserRows().AddRow(1, "existinguser", string(hashedPassword), nil, false, "", "", nil, "", "", "UTC", nil, false, "{}", "{}"))
+				mock.ExpectBegin()
+				mock.ExpectQuery("INSERT INTO login_attempts (.+) RETURNING failures").
+					WithArgs("username", "existinguser", sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"failures"}).AddRow(5))
+				// The fifth failure waits twice the base delay
+				mock.ExpectExec("UPDATE login_attempts SET blocked_until").
+					WithArgs("username", "existinguser", float64(2)).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectQuery("INSERT INTO login_attempts (.+) RETURNING failures").
+					WithArgs("ip", "192.0.2.1", sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"failures"}).AddRow(5))
+				mock.ExpectCommit()
+			},
+		},
+		{
+			name: "Locked out",
+			reqBody: `{
+				"username": "existinguser",
+				"password": "correctpassword"
+			}`,
+			expectedStatus: http.StatusTooManyRequests,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT MAX(.+) FROM login_attempts").
+					WithArgs("username", "existinguser", "ip", "192.0.2.1").
+					WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(time.Now().Add(10 * time.Minute)))
 			},
 		},
 	}
@@ -150,22 +350,29 @@ func TestLogin(t *testing.T) {
 
 			tc.mockBehavior(mock)
 
-			// Create repository with mock db
+			// Create repositories with mock db
 			repo := &repositories.UserRepository{DB: db}
+			tokenRepo := &repositories.TokenRepository{DB: db}
+			attemptRepo := &repositories.LoginAttemptRepository{DB: db}
 
 			// Call the handler
-			handler := Login(repo)
-			err = handler(c)
+			handler := Login(repo, tokenRepo, attemptRepo, &repositories.TwoFactorRepository{DB: db}, newTestKeys(t))
+			err = handle(handler)(c)
 
 			// Assertions
 			assert.NoError(t, err)
 			assert.Equal(t, tc.expectedStatus, rec.Code)
 
 			if tc.expectedStatus == http.StatusOK {
-				var response map[string]string
+				var response map[string]interface{}
 				err = json.Unmarshal(rec.Body.Bytes(), &response)
 				assert.NoError(t, err)
 				assert.Contains(t, response, "token")
+				assert.Contains(t, response, "refresh_token")
+				assert.Equal(t, float64(900), response["expires_in"])
+			}
+			if tc.expectedStatus == http.StatusTooManyRequests {
+				assert.NotEmpty(t, rec.Header().Get("Retry-After"))
 			}
 
 			// Ensure all expectations were met
@@ -190,14 +397,17 @@ func TestPromoteUserToAdmin(t *testing.T) {
 			username:       "regularuser",
 			expectedStatus: http.StatusOK,
 			mockBehavior: func(mock sqlmock.Sqlmock) {
-				rows := sqlmock.NewRows([]string{"id", "username", "password", "is_admin"}).
-					AddRow(1, "regularuser", "hashedpassword", false)
+				rows := newUserRows().
+					AddRow(1, "regularuser", "hashedpassword", nil, false, "", "", nil, "", "", "UTC", nil, false, "{}", "{}")
 				mock.ExpectQuery("SELECT (.+) FROM users WHERE username = ?").
 					WithArgs("regularuser").
 					WillReturnRows(rows)
-				mock.ExpectExec("UPDATE users SET").
-					WithArgs(true, 1).
-					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectQuery("SELECT id FROM roles WHERE name = ?").
+					WithArgs("admin").
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+				mock.ExpectExec("INSERT INTO user_roles").
+					WithArgs(1, 1).
+					WillReturnResult(sqlmock.NewResult(0, 1))
 			},
 		},
 		{
@@ -215,8 +425,8 @@ func TestPromoteUserToAdmin(t *testing.T) {
 			username:       "adminuser",
 			expectedStatus: http.StatusBadRequest,
 			mockBehavior: func(mock sqlmock.Sqlmock) {
-				rows := sqlmock.NewRows([]string{"id", "username", "password", "is_admin"}).
-					AddRow(2, "adminuser", "hashedpassword", true)
+				rows := newUserRows().
+					AddRow(2, "adminuser", "hashedpassword", nil, false, "", "", nil, "", "", "UTC", nil, false, "{admin}", "{users:manage}")
 				mock.ExpectQuery("SELECT (.+) FROM users WHERE username = ?").
 					WithArgs("adminuser").
 					WillReturnRows(rows)
@@ -239,25 +449,611 @@ func TestPromoteUserToAdmin(t *testing.T) {
 
 			tc.mockBehavior(mock)
 
-			// Create repository with mock db
+			// Create repositories with mock db
 			repo := &repositories.UserRepository{DB: db}
+			roleRepo := &repositories.RoleRepository{DB: db}
 
 			// Call the handler
-			handler := PromoteUserToAdmin(repo)
-			err = handler(c)
+			handler := PromoteUserToAdmin(repo, roleRepo, repositories.NewUserCache(repo, time.Minute))
+			err = handle(handler)(c)
 
 			// Assertions
 			assert.NoError(t, err)
 			assert.Equal(t, tc.expectedStatus, rec.Code)
 
-			var response map[string]string
+			var response map[string]interface{}
 			err = json.Unmarshal(rec.Body.Bytes(), &response)
 			assert.NoError(t, err)
 
 			if tc.expectedStatus == http.StatusOK {
 				assert.Equal(t, "User promoted to admin successfully", response["message"])
 			} else {
-				assert.Contains(t, response, "error")
+				assert.Contains(t, response, "detail")
+			}
+
+			// Ensure all expectations were met
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestGetUsers(t *testing.T) {
+	// Setup
+	e := echo.New()
+
+	cursor := (&repositories.Cursor{Sort: repositories.UserSort, Value: "bob", Id: 2}).Encode()
+
+	// Test cases
+	testCases := []struct {
+		name           string
+		query          string
+		expectedStatus int
+		expectedIds    []float64
+		expectNext     bool
+		expectPrev     bool
+		mockBehavior   func(mock sqlmock.Sqlmock)
+	}{
+		{
+			name:           "List users",
+			query:          "",
+			expectedStatus: http.StatusOK,
+			expectedIds:    []float64{1},
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT (.+) FROM users WHERE TRUE ORDER BY username ASC, id ASC LIMIT").
+					WithArgs(11).
+					WillReturnRows(newUserRows().AddRow(1, "user", "hashedpassword", nil, false, "", "", nil, "", "", "UTC", nil, false, "{}", "{}"))
+			},
+		},
+		{
+			name:           "Search users by username and role",
+			query:          "?q=ad_m&role=admin&limit=5&include_total=true",
+			expectedStatus: http.StatusOK,
+			expectedIds:    []float64{},
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT (.+) FROM users WHERE TRUE AND username ILIKE (.+) AND EXISTS (.+) ORDER BY username").
+					WithArgs("%ad\\_m%", "admin", 6).
+					WillReturnRows(newUserRows())
+				mock.ExpectQuery("SELECT COUNT(.+) FROM users WHERE TRUE AND username ILIKE (.+) AND EXISTS").
+					WithArgs("%ad\\_m%", "admin").
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+			},
+		},
+		{
+			name:           "Page after a cursor",
+			query:          "?limit=1&cursor=" + cursor,
+			expectedStatus: http.StatusOK,
+			expectedIds:    []float64{3},
+			expectNext:     true,
+			expectPrev:     true,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT (.+) FROM users WHERE TRUE AND \\(username, id\\) > (.+) ORDER BY username ASC, id ASC LIMIT").
+					WithArgs("bob", 2, 2).
+					WillReturnRows(newUserRows().
+						AddRow(3, "carol", "hashedpassword", nil, false, "", "", nil, "", "", "UTC", nil, false, "{}", "{}").
+						AddRow(4, "dave", "hashedpassword", nil, false, "", "", nil, "", "", "UTC", nil, false, "{}", "{}"))
+			},
+		},
+		{
+			name:           "Invalid cursor",
+			query:          "?cursor=invalid",
+			expectedStatus: http.StatusBadRequest,
+			mockBehavior:   func(mock sqlmock.Sqlmock) {},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/users"+tc.query, nil)
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+
+			// Mock database
+			db, mock, err := sqlmock.New()
+			assert.NoError(t, err)
+			defer db.Close()
+
+			tc.mockBehavior(mock)
+
+			// Call the handler
+			err = handle(GetUsers(&repositories.UserRepository{DB: db}))(c)
+
+			// Assertions
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedStatus, rec.Code)
+
+			if tc.expectedStatus == http.StatusOK {
+				var response map[string]interface{}
+				assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+				ids := []float64{}
+				for _, user := range response["users"].([]interface{}) {
+					ids = append(ids, user.(map[string]interface{})["id"].(float64))
+				}
+				assert.Equal(t, tc.expectedIds, ids)
+				assert.Equal(t, tc.expectNext, response["next_cursor"] != nil)
+				assert.Equal(t, tc.expectPrev, response["prev_cursor"] != nil)
+			}
+
+			// Ensure all expectations were met
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestDemoteAdmin(t *testing.T) {
+	// Setup
+	e := echo.New()
+
+	// Test cases
+	testCases := []struct {
+		name           string
+		expectedStatus int
+		mockBehavior   func(mock sqlmock.Sqlmock)
+	}{
+		{
+			name:           "Demote admin",
+			expectedStatus: http.StatusOK,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT (.+) FROM users WHERE username = ?").
+					WithArgs("adminuser").
+					WillReturnRows(newUserRows().AddRow(2, "adminuser", "hashedpassword", nil, false, "", "", nil, "", "", "UTC", nil, false, "{admin}", "{users:manage}"))
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT id FROM roles WHERE name = (.+) FOR UPDATE").
+					WithArgs("admin").
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+				mock.ExpectQuery("SELECT COUNT(.+) FROM user_roles").
+					WithArgs(1, 2).
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+				mock.ExpectExec("DELETE FROM user_roles").
+					WithArgs(2, 1).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+		},
+		{
+			name:           "Last admin",
+			expectedStatus: http.StatusConflict,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT (.+) FROM users WHERE username = ?").
+					WithArgs("adminuser").
+					WillReturnRows(newUserRows().AddRow(2, "adminuser", "hashedpassword", nil, false, "", "", nil, "", "", "UTC", nil, false, "{admin}", "{users:manage}"))
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT id FROM roles WHERE name = (.+) FOR UPDATE").
+					WithArgs("admin").
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+				mock.ExpectQuery("SELECT COUNT(.+) FROM user_roles").
+					WithArgs(1, 2).
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+				mock.ExpectRollback()
+			},
+		},
+		{
+			name:           "User is not an admin",
+			expectedStatus: http.StatusBadRequest,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT (.+) FROM users WHERE username = ?").
+					WithArgs("adminuser").
+					WillReturnRows(newUserRows().AddRow(2, "adminuser", "hashedpassword", nil, false, "", "", nil, "", "", "UTC", nil, false, "{}", "{}"))
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPatch, "/users/adminuser/demote", nil)
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+			c.SetParamNames("username")
+			c.SetParamValues("adminuser")
+
+			// Mock database
+			db, mock, err := sqlmock.New()
+			assert.NoError(t, err)
+			defer db.Close()
+
+			tc.mockBehavior(mock)
+
+			// Create repositories with mock db
+			userRepo := &repositories.UserRepository{DB: db}
+			roleRepo := &repositories.RoleRepository{DB: db}
+
+			// Call the handler
+			err = handle(DemoteAdmin(userRepo, roleRepo, repositories.NewUserCache(userRepo, time.Minute)))(c)
+
+			// Assertions
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedStatus, rec.Code)
+
+			// Ensure all expectations were met
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestSetUserSuspended(t *testing.T) {
+	// Setup
+	e := echo.New()
+
+	// Test cases
+	testCases := []struct {
+		name           string
+		suspended      bool
+		currentUser    int64
+		expectedStatus int
+		mockBehavior   func(mock sqlmock.Sqlmock)
+	}{
+		{
+			name:           "Suspend user",
+			suspended:      true,
+			currentUser:    2,
+			expectedStatus: http.StatusOK,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT COUNT(.+) FROM \\(SELECT id FROM roles WHERE name = (.+) FOR UPDATE\\)").
+					WithArgs("admin", 1).
+					WillReturnRows(sqlmock.NewRows([]string{"is_admin", "others"}).AddRow(false, 1))
+				mock.ExpectExec("UPDATE users SET suspended_at = COALESCE").
+					WithArgs(1).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+		},
+		{
+			name:           "Suspend the last admin",
+			suspended:      true,
+			currentUser:    2,
+			expectedStatus: http.StatusConflict,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT COUNT(.+) FROM \\(SELECT id FROM roles WHERE name = (.+) FOR UPDATE\\)").
+					WithArgs("admin", 1).
+					WillReturnRows(sqlmock.NewRows([]string{"is_admin", "others"}).AddRow(true, 0))
+				mock.ExpectRollback()
+			},
+		},
+		{
+			name:           "Unsuspend user",
+			suspended:      false,
+			currentUser:    2,
+			expectedStatus: http.StatusOK,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectExec("UPDATE users SET suspended_at = NULL").
+					WithArgs(1).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+		},
+		{
+			name:           "Suspend yourself",
+			suspended:      true,
+			currentUser:    1,
+			expectedStatus: http.StatusBadRequest,
+			mockBehavior:   func(mock sqlmock.Sqlmock) {},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/users/user/suspend", nil)
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+			c.SetParamNames("username")
+			c.SetParamValues("user")
+			c.Set("user_id", tc.currentUser)
+
+			// Mock database
+			db, mock, err := sqlmock.New()
+			assert.NoError(t, err)
+			defer db.Close()
+
+			mock.ExpectQuery("SELECT (.+) FROM users WHERE username = ?").
+				WithArgs("user").
+				WillReturnRows(newUserRows().AddRow(1, "user", "hashedpassword", nil, false, "", "", nil, "", "", "UTC", nil, false, "{}", "{}"))
+			tc.mockBehavior(mock)
+
+			// Call the handler
+			userRepo := &repositories.UserRepository{DB: db}
+			err = handle(SetUserSuspended(userRepo, repositories.NewUserCache(userRepo, time.Minute), tc.suspended))(c)
+
+			// Assertions
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedStatus, rec.Code)
+
+			// Ensure all expectations were met
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestForcePasswordReset(t *testing.T) {
+	// Setup
+	e := echo.New()
+
+	// Test cases
+	testCases := []struct {
+		name           string
+		emailVerified  bool
+		expectedStatus int
+		mockBehavior   func(mock sqlmock.Sqlmock)
+	}{
+		{
+			name:           "Force password reset",
+			emailVerified:  true,
+			expectedStatus: http.StatusOK,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectExec("UPDATE users SET password_reset_required = TRUE").
+					WithArgs(1).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("UPDATE password_reset_tokens SET used_at = NOW()").
+					WithArgs(1).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec("INSERT INTO password_reset_tokens").
+					WithArgs(1, sqlmock.AnyArg(), sqlmock.AnyArg(), true).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectCommit()
+				// The user is logged out everywhere
+				mock.ExpectBegin()
+				mock.ExpectExec("INSERT INTO revoked_access_tokens (.+) FROM refresh_tokens WHERE user_id = ?").
+					WithArgs(1, "").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("UPDATE refresh_tokens SET revoked_at = NOW\\(\\) WHERE user_id = ?").
+					WithArgs(1, "").
+					WillReturnResult(sqlmock.NewResult(0, 2))
+				mock.ExpectExec("UPDATE api_keys SET revoked_at = NOW\\(\\) WHERE user_id = ?").
+					WithArgs(1).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("UPDATE calendar_feed_tokens SET revoked_at = NOW\\(\\) WHERE user_id = ?").
+					WithArgs(1).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectCommit()
+			},
+		},
+		{
+			name:           "No verified email",
+			expectedStatus: http.StatusConflict,
+			mockBehavior:   func(mock sqlmock.Sqlmock) {},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/users/user/password-reset", nil)
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+			c.SetParamNames("username")
+			c.SetParamValues("user")
+
+			// Mock database
+			db, mock, err := sqlmock.New()
+			assert.NoError(t, err)
+			defer db.Close()
+
+			var emailVerifiedAt interface{}
+			if tc.emailVerified {
+				emailVerifiedAt = time.Now()
+			}
+			mock.ExpectQuery("SELECT (.+) FROM users WHERE username = ?").
+				WithArgs("user").
+				WillReturnRows(newUserRows().AddRow(1, "user", "hashedpassword", nil, false, "", "user@example.com", emailVerifiedAt, "", "", "UTC", nil, false, "{}", "{}"))
+			tc.mockBehavior(mock)
+
+			// Call the handler
+			userRepo := &repositories.UserRepository{DB: db}
+			tokenRepo := &repositories.TokenRepository{DB: db}
+			mail := mailer.NewMemoryMailer()
+			err = handle(ForcePasswordReset(userRepo, tokenRepo, repositories.NewUserCache(userRepo, time.Minute), mail))(c)
+
+			// Assertions
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedStatus, rec.Code)
+
+			if tc.expectedStatus == http.StatusOK {
+				// The admin only learns when the token expires
+				var response map[string]interface{}
+				assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+				assert.NotEmpty(t, response["expires_at"])
+				assert.NotContains(t, response, "reset_token")
+
+				assert.Eventually(t, func() bool { return len(mail.Sent()) == 1 }, time.Second, 10*time.Millisecond,
+					"the reset token wasn't emailed")
+				msg := mail.Sent()[0]
+				assert.Equal(t, "user@example.com", msg.To)
+				assert.Contains(t, msg.Body, "POST /password/reset")
+			} else {
+				assert.Empty(t, mail.Sent())
+			}
+
+			// Ensure all expectations were met
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestResetPassword(t *testing.T) {
+	// Setup
+	e := echo.New()
+	e.Validator = validator.NewCustomValidator()
+
+	// Test cases
+	testCases := []struct {
+		name           string
+		reqBody        string
+		expectedStatus int
+		mockBehavior   func(mock sqlmock.Sqlmock)
+	}{
+		{
+			name:           "Reset password",
+			reqBody:        `{"token": "reset", "password": "newpassword"}`,
+			expectedStatus: http.StatusOK,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("UPDATE password_reset_tokens SET used_at = NOW\\(\\) (.+) RETURNING user_id").
+					WithArgs(sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+				mock.ExpectExec("UPDATE users SET password = (.+), password_reset_required = FALSE").
+					WithArgs(sqlmock.AnyArg(), 1).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+				mock.ExpectBegin()
+				mock.ExpectExec("INSERT INTO revoked_access_tokens").
+					WithArgs(1, "").
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec("UPDATE refresh_tokens SET revoked_at = NOW\\(\\) WHERE user_id = ?").
+					WithArgs(1, "").
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec("UPDATE api_keys SET revoked_at = NOW\\(\\) WHERE user_id = ?").
+					WithArgs(1).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("UPDATE calendar_feed_tokens SET revoked_at = NOW\\(\\) WHERE user_id = ?").
+					WithArgs(1).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectCommit()
+			},
+		},
+		{
+			name:           "Invalid token",
+			reqBody:        `{"token": "reset", "password": "newpassword"}`,
+			expectedStatus: http.StatusBadRequest,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("UPDATE password_reset_tokens SET used_at = NOW\\(\\) (.+) RETURNING user_id").
+					WithArgs(sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}))
+				mock.ExpectRollback()
+			},
+		},
+		{
+			name:           "Password too short",
+			reqBody:        `{"token": "reset", "password": "new"}`,
+			expectedStatus: http.StatusBadRequest,
+			mockBehavior:   func(mock sqlmock.Sqlmock) {},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/password/reset", strings.NewReader(tc.reqBody))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+
+			// Mock database
+			db, mock, err := sqlmock.New()
+			assert.NoError(t, err)
+			defer db.Close()
+
+			tc.mockBehavior(mock)
+
+			// Call the handler
+			userRepo := &repositories.UserRepository{DB: db}
+			tokenRepo := &repositories.TokenRepository{DB: db}
+			err = handle(ResetPassword(userRepo, tokenRepo, repositories.NewUserCache(userRepo, time.Minute)))(c)
+
+			// Assertions
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedStatus, rec.Code)
+
+			// Ensure all expectations were met
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestForgotPassword(t *testing.T) {
+	// Setup
+	e := echo.New()
+	e.Validator = validator.NewCustomValidator()
+
+	// Test cases
+	testCases := []struct {
+		name         string
+		reqBody      string
+		expectEmail  bool
+		mockBehavior func(mock sqlmock.Sqlmock)
+	}{
+		{
+			name:        "Email the reset token",
+			reqBody:     `{"username": "user"}`,
+			expectEmail: true,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT (.+) FROM users WHERE username = ?").
+					WithArgs("user").
+					WillReturnRows(newUserRows().AddRow(1, "user", "hashedpassword", nil, false, "", "user@example.com", time.Now(), "", "", "UTC", nil, false, "{}", "{}"))
+				mock.ExpectBegin()
+				mock.ExpectExec("UPDATE password_reset_tokens SET used_at = NOW\\(\\) (.+) AND NOT forced").
+					WithArgs(1).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec("INSERT INTO password_reset_tokens").
+					WithArgs(1, sqlmock.AnyArg(), sqlmock.AnyArg(), false).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectCommit()
+			},
+		},
+		{
+			name:    "Unknown user",
+			reqBody: `{"username": "nonexistentuser"}`,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT (.+) FROM users WHERE username = ?").
+					WithArgs("nonexistentuser").
+					WillReturnError(sql.ErrNoRows)
+			},
+		},
+		{
+			name:    "Unverified email",
+			reqBody: `{"username": "user"}`,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT (.+) FROM users WHERE username = ?").
+					WithArgs("user").
+					WillReturnRows(newUserRows().AddRow(1, "user", "hashedpassword", nil, false, "", "user@example.com", nil, "", "", "UTC", nil, false, "{}", "{}"))
+			},
+		},
+		{
+			name:    "User without an email",
+			reqBody: `{"username": "user"}`,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT (.+) FROM users WHERE username = ?").
+					WithArgs("user").
+					WillReturnRows(newUserRows().AddRow(1, "user", "hashedpassword", nil, false, "", "", nil, "", "", "UTC", nil, false, "{}", "{}"))
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/password/forgot", strings.NewReader(tc.reqBody))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+
+			// Mock database
+			db, mock, err := sqlmock.New()
+			assert.NoError(t, err)
+			defer db.Close()
+
+			tc.mockBehavior(mock)
+
+			// Call the handler
+			mail := mailer.NewMemoryMailer()
+			err = handle(ForgotPassword(&repositories.UserRepository{DB: db}, mail))(c)
+
+			// Assertions. The response is the same whether or not
+			// the user exists
+			assert.NoError(t, err)
+			assert.Equal(t, http.StatusOK, rec.Code)
+
+			var response map[string]string
+			assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+			assert.Equal(t, forgotPasswordMessage, response["message"])
+
+			if tc.expectEmail {
+				assert.Eventually(t, func() bool { return len(mail.Sent()) == 1 }, time.Second, 10*time.Millisecond,
+					"the reset token wasn't emailed")
+				msg := mail.Sent()[0]
+				assert.Equal(t, "user@example.com", msg.To)
+				assert.Contains(t, msg.Body, "POST /password/reset")
+			} else {
+				assert.Empty(t, mail.Sent())
 			}
 
 			// Ensure all expectations were met
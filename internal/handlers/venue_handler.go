@@ -0,0 +1,195 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/xtommas/challenge-hetmo/internal/models"
+	"github.com/xtommas/challenge-hetmo/internal/problem"
+	"github.com/xtommas/challenge-hetmo/internal/repositories"
+)
+
+const (
+	// defaultRadiusKm is how far events are searched for around
+	// the near parameter when no radius_km is given
+	defaultRadiusKm = 10
+	// maxRadiusKm is the largest accepted radius_km
+	maxRadiusKm = 500
+)
+
+func GetVenues(venueRepo *repositories.VenueRepository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		venues, err := venueRepo.GetAll()
+		if err != nil {
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to get venues")
+		}
+		return c.JSON(http.StatusOK, venues)
+	}
+}
+
+func GetVenue(venueRepo *repositories.VenueRepository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid ID")
+		}
+		venue, err := venueRepo.Get(id)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return problem.New(http.StatusNotFound, problem.CodeNotFound, "Venue not found")
+			}
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to get venue")
+		}
+		return c.JSON(http.StatusOK, venue)
+	}
+}
+
+func CreateVenue(venueRepo *repositories.VenueRepository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		// Venues are in UTC unless told otherwise
+		venue := &models.Venue{Timezone: "UTC"}
+		if err := c.Bind(venue); err != nil {
+			return problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid request")
+		}
+
+		if err := c.Validate(venue); err != nil {
+			return err
+		}
+
+		err := venueRepo.Create(venue)
+		if err != nil {
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to create venue")
+		}
+		return c.JSON(http.StatusCreated, venue)
+	}
+}
+
+func UpdateVenue(venueRepo *repositories.VenueRepository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid ID")
+		}
+		venue, err := venueRepo.Get(id)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return problem.New(http.StatusNotFound, problem.CodeNotFound, "Venue not found")
+			}
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to get venue")
+		}
+
+		var input struct {
+			Name               *string  `json:"name"`
+			Address            *string  `json:"address"`
+			Latitude           *float64 `json:"latitude"`
+			Longitude          *float64 `json:"longitude"`
+			Capacity           *int     `json:"capacity"`
+			AccessibilityNotes *string  `json:"accessibility_notes"`
+			Timezone           *string  `json:"timezone"`
+		}
+		if err := c.Bind(&input); err != nil {
+			return problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid request")
+		}
+		if input.Name != nil {
+			venue.Name = *input.Name
+		}
+		if input.Address != nil {
+			venue.Address = *input.Address
+		}
+		if input.Latitude != nil {
+			venue.Latitude = input.Latitude
+		}
+		if input.Longitude != nil {
+			venue.Longitude = input.Longitude
+		}
+		if input.Capacity != nil {
+			// A capacity of 0 removes the seat limit
+			if *input.Capacity == 0 {
+				venue.Capacity = nil
+			} else {
+				venue.Capacity = input.Capacity
+			}
+		}
+		if input.AccessibilityNotes != nil {
+			venue.AccessibilityNotes = *input.AccessibilityNotes
+		}
+		if input.Timezone != nil {
+			venue.Timezone = *input.Timezone
+		}
+
+		if err := c.Validate(venue); err != nil {
+			return err
+		}
+
+		err = venueRepo.Update(venue)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return problem.New(http.StatusNotFound, problem.CodeNotFound, "Venue not found")
+			}
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to update venue")
+		}
+		return c.JSON(http.StatusOK, venue)
+	}
+}
+
+func DeleteVenue(venueRepo *repositories.VenueRepository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid ID")
+		}
+		err = venueRepo.Delete(id)
+		if err != nil {
+			switch err {
+			case sql.ErrNoRows:
+				return problem.New(http.StatusNotFound, problem.CodeNotFound, "Venue not found")
+			case repositories.ErrVenueInUse:
+				return problem.New(http.StatusConflict, problem.CodeVenueInUse, "The venue still has events")
+			}
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to delete venue")
+		}
+		return c.JSON(http.StatusOK, map[string]string{"message": "Venue deleted successfully"})
+	}
+}
+
+// nearParams reads the near and radius_km query parameters used to
+// search for events around a point. It returns why they are invalid,
+// or an empty message if they aren't
+func nearParams(c echo.Context) (*repositories.GeoPoint, float64, string) {
+	nearParam := c.QueryParam("near")
+	radiusParam := c.QueryParam("radius_km")
+	if nearParam == "" {
+		if radiusParam != "" {
+			return nil, 0, "radius_km can only be used along with near"
+		}
+		return nil, 0, ""
+	}
+
+	invalidNear := "Invalid near. Use latitude,longitude in degrees."
+	parts := strings.Split(nearParam, ",")
+	if len(parts) != 2 {
+		return nil, 0, invalidNear
+	}
+	lat, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	if err != nil || lat < -90 || lat > 90 {
+		return nil, 0, invalidNear
+	}
+	lng, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if err != nil || lng < -180 || lng > 180 {
+		return nil, 0, invalidNear
+	}
+
+	radiusKm := float64(defaultRadiusKm)
+	if radiusParam != "" {
+		radiusKm, err = strconv.ParseFloat(radiusParam, 64)
+		// The negated check also rejects NaN
+		if err != nil || !(radiusKm > 0 && radiusKm <= maxRadiusKm) {
+			return nil, 0, fmt.Sprintf("Invalid radius_km. Use a number greater than 0 and up to %d.", maxRadiusKm)
+		}
+	}
+	return &repositories.GeoPoint{Latitude: lat, Longitude: lng}, radiusKm, ""
+}
@@ -0,0 +1,230 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"github.com/xtommas/challenge-hetmo/internal/models"
+	"github.com/xtommas/challenge-hetmo/internal/repositories"
+	"github.com/xtommas/challenge-hetmo/internal/validator"
+)
+
+func newVenueRows() *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"id", "name", "address", "latitude", "longitude", "capacity", "accessibility_notes", "timezone"})
+}
+
+func TestCreateVenue(t *testing.T) {
+	e := echo.New()
+	e.Validator = validator.NewCustomValidator()
+
+	testCases := []struct {
+		name           string
+		reqBody        string
+		mockBehavior   func(mock sqlmock.Sqlmock)
+		expectedStatus int
+	}{
+		{
+			name:    "Create venue",
+			reqBody: `{"name": "Centro Cultural", "address": "Sarmiento 1551", "latitude": -34.6037, "longitude": -58.3816, "capacity": 40, "timezone": "America/Argentina/Buenos_Aires"}`,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("INSERT INTO venues").
+					WithArgs("Centro Cultural", "Sarmiento 1551", -34.6037, -58.3816, 40, "", "America/Argentina/Buenos_Aires").
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+			},
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:    "Venues are in UTC by default",
+			reqBody: `{"name": "Centro Cultural", "address": "Sarmiento 1551", "latitude": 0, "longitude": 0}`,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("INSERT INTO venues").
+					WithArgs("Centro Cultural", "Sarmiento 1551", 0.0, 0.0, nil, "", "UTC").
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+			},
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:           "Missing coordinates",
+			reqBody:        `{"name": "Centro Cultural", "address": "Sarmiento 1551"}`,
+			mockBehavior:   func(mock sqlmock.Sqlmock) {},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Latitude out of range",
+			reqBody:        `{"name": "Centro Cultural", "address": "Sarmiento 1551", "latitude": -134.6, "longitude": -58.3816}`,
+			mockBehavior:   func(mock sqlmock.Sqlmock) {},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Unknown timezone",
+			reqBody:        `{"name": "Centro Cultural", "address": "Sarmiento 1551", "latitude": -34.6037, "longitude": -58.3816, "timezone": "America/Atlantis"}`,
+			mockBehavior:   func(mock sqlmock.Sqlmock) {},
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/venues", strings.NewReader(tc.reqBody))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+
+			db, mock, err := sqlmock.New()
+			assert.NoError(t, err)
+			defer db.Close()
+			tc.mockBehavior(mock)
+
+			repo := &repositories.VenueRepository{DB: db}
+			err = handle(CreateVenue(repo))(c)
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedStatus, rec.Code)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestUpdateVenue(t *testing.T) {
+	e := echo.New()
+	e.Validator = validator.NewCustomValidator()
+
+	testCases := []struct {
+		name           string
+		venueID        string
+		reqBody        string
+		mockBehavior   func(mock sqlmock.Sqlmock)
+		expectedStatus int
+		expectedVenue  *models.Venue
+	}{
+		{
+			name:    "Update capacity only",
+			venueID: "1",
+			reqBody: `{"capacity": 0, "accessibility_notes": "Step-free entrance"}`,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT (.+) FROM venues WHERE id = ?").
+					WithArgs(1).
+					WillReturnRows(newVenueRows().AddRow(1, "Centro Cultural", "Sarmiento 1551", -34.6037, -58.3816, 40, "", "UTC"))
+				// A capacity of 0 removes the seat limit
+				mock.ExpectExec("UPDATE venues").
+					WithArgs("Centro Cultural", "Sarmiento 1551", -34.6037, -58.3816, nil, "Step-free entrance", "UTC", 1).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			expectedStatus: http.StatusOK,
+			expectedVenue:  &models.Venue{Id: 1, Name: "Centro Cultural", AccessibilityNotes: "Step-free entrance"},
+		},
+		{
+			name:    "Venue not found",
+			venueID: "2",
+			reqBody: `{"name": "Other"}`,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT (.+) FROM venues WHERE id = ?").
+					WithArgs(2).
+					WillReturnError(sql.ErrNoRows)
+			},
+			expectedStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPatch, "/venues/"+tc.venueID, strings.NewReader(tc.reqBody))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+			c.SetParamNames("id")
+			c.SetParamValues(tc.venueID)
+
+			db, mock, err := sqlmock.New()
+			assert.NoError(t, err)
+			defer db.Close()
+			tc.mockBehavior(mock)
+
+			repo := &repositories.VenueRepository{DB: db}
+			err = handle(UpdateVenue(repo))(c)
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedStatus, rec.Code)
+			if tc.expectedVenue != nil {
+				var venue models.Venue
+				assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &venue))
+				assert.Equal(t, tc.expectedVenue.Name, venue.Name)
+				assert.Equal(t, tc.expectedVenue.AccessibilityNotes, venue.AccessibilityNotes)
+				assert.Nil(t, venue.Capacity)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestDeleteVenue(t *testing.T) {
+	e := echo.New()
+
+	testCases := []struct {
+		name           string
+		venueID        string
+		mockBehavior   func(mock sqlmock.Sqlmock)
+		expectedStatus int
+	}{
+		{
+			name:    "Delete venue",
+			venueID: "1",
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec("DELETE FROM venues").
+					WithArgs(1).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:    "Venue with events",
+			venueID: "1",
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec("DELETE FROM venues").
+					WithArgs(1).
+					WillReturnError(&pq.Error{Code: "23503"})
+			},
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name:    "Venue not found",
+			venueID: "2",
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec("DELETE FROM venues").
+					WithArgs(2).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+			},
+			expectedStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodDelete, "/venues/"+tc.venueID, nil)
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+			c.SetParamNames("id")
+			c.SetParamValues(tc.venueID)
+
+			db, mock, err := sqlmock.New()
+			assert.NoError(t, err)
+			defer db.Close()
+			tc.mockBehavior(mock)
+
+			repo := &repositories.VenueRepository{DB: db}
+			err = handle(DeleteVenue(repo))(c)
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedStatus, rec.Code)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
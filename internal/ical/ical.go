@@ -0,0 +1,140 @@
+// Package ical renders events as RFC 5545 iCalendar data, so they can be
+// imported into (or subscribed to from) calendar applications
+package ical
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/xtommas/challenge-hetmo/internal/models"
+)
+
+// ContentType is the MIME type of iCalendar data
+const ContentType = "text/calendar; charset=utf-8"
+
+// uidDomain makes the UIDs globally unique. It must never change,
+// or calendar clients would see every event as a new one
+const uidDomain = "challenge-hetmo"
+
+const (
+	dateTimeFormat = "20060102T150405Z"
+	// Lines longer than this many octets must be folded
+	maxLineLength = 75
+)
+
+// Calendar is a VCALENDAR with one VEVENT per event
+type Calendar struct {
+	// Name is shown by calendar clients that support X-WR-CALNAME
+	Name   string
+	Events []models.Event
+}
+
+// Bytes renders the calendar
+func (cal *Calendar) Bytes() []byte {
+	var b bytes.Buffer
+	w := &writer{buf: &b}
+
+	w.line("BEGIN:VCALENDAR")
+	w.line("VERSION:2.0")
+	w.line("PRODID:-//Hetmo//Challenge Backend//EN")
+	w.line("CALSCALE:GREGORIAN")
+	w.line("METHOD:PUBLISH")
+	if cal.Name != "" {
+		w.line("X-WR-CALNAME:" + escape(cal.Name))
+	}
+	for _, event := range cal.Events {
+		writeEvent(w, event)
+	}
+	w.line("END:VCALENDAR")
+
+	return b.Bytes()
+}
+
+// UID returns the unique identifier of the event in iCalendar data
+func UID(event models.Event) string {
+	return fmt.Sprintf("event-%d@%s", event.Id, uidDomain)
+}
+
+func writeEvent(w *writer, event models.Event) {
+	w.line("BEGIN:VEVENT")
+	w.line("UID:" + UID(event))
+	w.line("DTSTAMP:" + formatTime(event.UpdatedAt))
+	w.line("LAST-MODIFIED:" + formatTime(event.UpdatedAt))
+	w.line("DTSTART:" + formatTime(event.DateAndTime))
+	w.line(fmt.Sprintf("SEQUENCE:%d", event.Sequence))
+	w.line("STATUS:" + status(event))
+	w.line("SUMMARY:" + escape(event.Title))
+	if event.ShortDescription != "" || event.LongDescription != "" {
+		w.line("DESCRIPTION:" + escape(description(event)))
+	}
+	if event.Location != "" {
+		w.line("LOCATION:" + escape(event.Location))
+	}
+	w.line("END:VEVENT")
+}
+
+// status maps the event lifecycle to the VEVENT statuses
+func status(event models.Event) string {
+	switch event.Status {
+	case models.EventDraft:
+		return "TENTATIVE"
+	case models.EventCancelled:
+		return "CANCELLED"
+	}
+	return "CONFIRMED"
+}
+
+func description(event models.Event) string {
+	parts := []string{}
+	for _, part := range []string{event.ShortDescription, event.LongDescription} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	if event.Organizer != "" {
+		parts = append(parts, "Organizer: "+event.Organizer)
+	}
+	return strings.Join(parts, "\n\n")
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(dateTimeFormat)
+}
+
+// escape escapes a TEXT value as described in RFC 5545, section 3.3.11
+func escape(s string) string {
+	return strings.NewReplacer(
+		`\`, `\\`,
+		`;`, `\;`,
+		`,`, `\,`,
+		"\r\n", `\n`,
+		"\n", `\n`,
+		"\r", `\n`,
+	).Replace(s)
+}
+
+// writer writes content lines, folding the ones that are too long
+type writer struct {
+	buf *bytes.Buffer
+}
+
+func (w *writer) line(s string) {
+	// Folded lines start with a space, which counts towards their length
+	limit := maxLineLength
+	for len(s) > limit {
+		// Don't split multi-byte characters
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(s[cut]) {
+			cut--
+		}
+		w.buf.WriteString(s[:cut])
+		w.buf.WriteString("\r\n ")
+		s = s[cut:]
+		limit = maxLineLength - 1
+	}
+	w.buf.WriteString(s)
+	w.buf.WriteString("\r\n")
+}
@@ -0,0 +1,32 @@
+package ical
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xtommas/challenge-hetmo/internal/models"
+)
+
+func TestCalendarFoldsLongLines(t *testing.T) {
+	cal := &Calendar{Events: []models.Event{{
+		Id:              1,
+		Title:           "Taller",
+		LongDescription: strings.Repeat("Programación en Go; ", 10),
+		DateAndTime:     time.Date(2099, 5, 1, 15, 0, 0, 0, time.UTC),
+	}}}
+
+	body := string(cal.Bytes())
+	for _, line := range strings.Split(strings.TrimSuffix(body, "\r\n"), "\r\n") {
+		assert.LessOrEqual(t, len(line), maxLineLength)
+	}
+
+	// Unfolding gives back the escaped description
+	unfolded := strings.ReplaceAll(body, "\r\n ", "")
+	assert.Contains(t, unfolded, "DESCRIPTION:"+strings.Repeat(`Programación en Go\; `, 10)+"\r\n")
+}
+
+func TestEscape(t *testing.T) {
+	assert.Equal(t, `a\\b\;c\,d\ne`, escape("a\\b;c,d\ne"))
+}
@@ -0,0 +1,209 @@
+// Package jwtkeys signs and verifies the access tokens with RS256 or
+// EdDSA keys, several of which can be valid at once so they can be
+// rotated without invalidating the tokens already issued
+package jwtkeys
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// minRSABits is the smallest RSA key accepted, as RFC 7518 requires
+const minRSABits = 2048
+
+var (
+	ErrNoSigningKey = errors.New("no private key to sign tokens with")
+	ErrUnknownKey   = errors.New("unknown key id")
+)
+
+// Key is a key that verifies tokens and, if its private part is
+// known, signs them
+type Key struct {
+	ID     string
+	Method jwt.SigningMethod
+
+	private crypto.Signer
+	public  crypto.PublicKey
+}
+
+// KeySet holds the keys that verify tokens, one of which signs the
+// new ones
+type KeySet struct {
+	signing *Key
+	keys    map[string]*Key
+}
+
+// Load reads the PEM keys of the directory, named after their key id,
+// such as 2024-06.pem. Private keys can sign tokens and public keys
+// only verify them, for keys being retired. The private key whose id
+// sorts last signs the new tokens
+func Load(dir string) (*KeySet, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	set := &KeySet{keys: make(map[string]*Key)}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		id := strings.TrimSuffix(filepath.Base(path), ".pem")
+		key, err := parseKey(id, data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+
+		set.keys[id] = key
+		if key.private != nil {
+			set.signing = key
+		}
+	}
+
+	if set.signing == nil {
+		return nil, ErrNoSigningKey
+	}
+	return set, nil
+}
+
+// Generate returns a set with a new Ed25519 key, for tests
+func Generate() (*KeySet, error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	key := &Key{ID: "generated", Method: jwt.SigningMethodEdDSA, private: private, public: public}
+	return &KeySet{signing: key, keys: map[string]*Key{key.ID: key}}, nil
+}
+
+// parseKey decodes a PEM private or public key
+func parseKey(id string, data []byte) (*Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM key found")
+	}
+
+	var parsed interface{}
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM type %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key := &Key{ID: id}
+	switch k := parsed.(type) {
+	case *rsa.PrivateKey:
+		key.private, key.public = k, &k.PublicKey
+	case ed25519.PrivateKey:
+		key.private, key.public = k, k.Public()
+	case *rsa.PublicKey, ed25519.PublicKey:
+		key.public = k
+	default:
+		return nil, fmt.Errorf("unsupported key type %T, use RSA or Ed25519", parsed)
+	}
+
+	if public, ok := key.public.(*rsa.PublicKey); ok {
+		if public.N.BitLen() < minRSABits {
+			return nil, fmt.Errorf("RSA keys need at least %d bits", minRSABits)
+		}
+		key.Method = jwt.SigningMethodRS256
+	} else {
+		key.Method = jwt.SigningMethodEdDSA
+	}
+	return key, nil
+}
+
+// Sign returns a token with the claims, signed with the signing key
+// and naming it in its kid header
+func (s *KeySet) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(s.signing.Method, claims)
+	token.Header["kid"] = s.signing.ID
+	return token.SignedString(s.signing.private)
+}
+
+// Parse verifies the token with the key named in its kid header and
+// fills the claims. Tokens are only accepted with the algorithm of
+// that key, so a public key can't be passed off as an HMAC secret
+func (s *KeySet) Parse(token string, claims jwt.Claims, options ...jwt.ParserOption) (*jwt.Token, error) {
+	options = append(options, jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg(), jwt.SigningMethodEdDSA.Alg()}))
+	return jwt.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
+		id, _ := token.Header["kid"].(string)
+		key, ok := s.keys[id]
+		if !ok {
+			return nil, ErrUnknownKey
+		}
+		if token.Method.Alg() != key.Method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method %s for key %s", token.Method.Alg(), id)
+		}
+		return key.public, nil
+	}, options...)
+}
+
+// JWK is a public key in the JSON Web Key format of RFC 7517
+type JWK struct {
+	KeyType   string `json:"kty"`
+	ID        string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	// RSA keys
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// Ed25519 keys
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+}
+
+// JWKS returns the public keys of the set, sorted by id, for other
+// services to verify the tokens
+func (s *KeySet) JWKS() []JWK {
+	ids := make([]string, 0, len(s.keys))
+	for id := range s.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	jwks := make([]JWK, 0, len(ids))
+	for _, id := range ids {
+		key := s.keys[id]
+		jwk := JWK{ID: id, Use: "sig", Algorithm: key.Method.Alg()}
+		switch public := key.public.(type) {
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.KeyType = "OKP"
+			jwk.Curve = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public)
+		}
+		jwks = append(jwks, jwk)
+	}
+	return jwks
+}
@@ -0,0 +1,163 @@
+package jwtkeys
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeKey writes a PEM key to the directory under the key id
+func writeKey(t *testing.T, dir, id, pemType string, der []byte) {
+	data := pem.EncodeToMemory(&pem.Block{Type: pemType, Bytes: der})
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, id+".pem"), data, 0600))
+}
+
+func writePrivateKey(t *testing.T, dir, id string, key interface{}) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.NoError(t, err)
+	writeKey(t, dir, id, "PRIVATE KEY", der)
+}
+
+func writePublicKey(t *testing.T, dir, id string, key interface{}) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	assert.NoError(t, err)
+	writeKey(t, dir, id, "PUBLIC KEY", der)
+}
+
+func validClaims() jwt.MapClaims {
+	return jwt.MapClaims{"user_id": 1, "exp": time.Now().Add(time.Minute).Unix()}
+}
+
+func TestRotation(t *testing.T) {
+	_, oldKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	newKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	// Tokens signed before the rotation
+	dir := t.TempDir()
+	writePrivateKey(t, dir, "2024-01", oldKey)
+	keys, err := Load(dir)
+	assert.NoError(t, err)
+	oldToken, err := keys.Sign(validClaims())
+	assert.NoError(t, err)
+
+	// The new key signs, and the old one only verifies
+	dir = t.TempDir()
+	writePublicKey(t, dir, "2024-01", oldKey.Public())
+	writePrivateKey(t, dir, "2024-06", newKey)
+	keys, err = Load(dir)
+	assert.NoError(t, err)
+
+	newToken, err := keys.Sign(validClaims())
+	assert.NoError(t, err)
+	token, err := keys.Parse(newToken, jwt.MapClaims{})
+	assert.NoError(t, err)
+	assert.Equal(t, "RS256", token.Method.Alg())
+	assert.Equal(t, "2024-06", token.Header["kid"])
+
+	token, err = keys.Parse(oldToken, jwt.MapClaims{})
+	assert.NoError(t, err)
+	assert.Equal(t, "EdDSA", token.Method.Alg())
+
+	jwks := keys.JWKS()
+	assert.Len(t, jwks, 2)
+	assert.Equal(t, JWK{KeyType: "OKP", ID: "2024-01", Use: "sig", Algorithm: "EdDSA", Curve: "Ed25519", X: jwks[0].X}, jwks[0])
+	assert.Equal(t, "RSA", jwks[1].KeyType)
+	assert.Equal(t, "AQAB", jwks[1].E)
+}
+
+func TestParseRejectsOtherAlgorithms(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	dir := t.TempDir()
+	writePrivateKey(t, dir, "main", key)
+	keys, err := Load(dir)
+	assert.NoError(t, err)
+
+	publicDER, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	assert.NoError(t, err)
+	publicPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER})
+
+	testCases := []struct {
+		name  string
+		token func() string
+	}{
+		{
+			// The public key is public, so it can't work as an HMAC secret
+			name: "HS256 signed with the public key",
+			token: func() string {
+				token := jwt.NewWithClaims(jwt.SigningMethodHS256, validClaims())
+				token.Header["kid"] = "main"
+				s, _ := token.SignedString(publicPEM)
+				return s
+			},
+		},
+		{
+			name: "Unsigned",
+			token: func() string {
+				token := jwt.NewWithClaims(jwt.SigningMethodNone, validClaims())
+				token.Header["kid"] = "main"
+				s, _ := token.SignedString(jwt.UnsafeAllowNoneSignatureType)
+				return s
+			},
+		},
+		{
+			name: "EdDSA with the id of an RSA key",
+			token: func() string {
+				_, other, _ := ed25519.GenerateKey(rand.Reader)
+				token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, validClaims())
+				token.Header["kid"] = "main"
+				s, _ := token.SignedString(other)
+				return s
+			},
+		},
+		{
+			name: "Unknown key id",
+			token: func() string {
+				token := jwt.NewWithClaims(jwt.SigningMethodRS256, validClaims())
+				token.Header["kid"] = "other"
+				s, _ := token.SignedString(key)
+				return s
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := keys.Parse(tc.token(), jwt.MapClaims{})
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	t.Run("Only public keys", func(t *testing.T) {
+		public, _, err := ed25519.GenerateKey(rand.Reader)
+		assert.NoError(t, err)
+		dir := t.TempDir()
+		writePublicKey(t, dir, "main", public)
+
+		_, err = Load(dir)
+		assert.ErrorIs(t, err, ErrNoSigningKey)
+	})
+
+	t.Run("Small RSA key", func(t *testing.T) {
+		key, err := rsa.GenerateKey(rand.Reader, 1024)
+		assert.NoError(t, err)
+		dir := t.TempDir()
+		writeKey(t, dir, "main", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key))
+
+		_, err = Load(dir)
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,28 @@
+package mailer
+
+import (
+	"io"
+	"sync"
+)
+
+// LogMailer writes the emails to a writer instead of sending them, for
+// local development and tests
+type LogMailer struct {
+	mu  sync.Mutex
+	out io.Writer
+	// Address the emails are sent from
+	from string
+}
+
+func NewLogMailer(out io.Writer, from string) *LogMailer {
+	return &LogMailer{out: out, from: from}
+}
+
+func (m *LogMailer) Send(msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// A blank line between emails tells them apart
+	_, err := m.out.Write(append(format(m.from, msg), "\r\n\r\n"...))
+	return err
+}
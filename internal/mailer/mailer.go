@@ -0,0 +1,41 @@
+// Package mailer sends the emails of the API, such as the ones with
+// password reset tokens
+package mailer
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Message is a plain text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers emails
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// format writes the message with its headers, ready to be sent. Line
+// breaks are dropped from the headers so they can't add new ones
+func format(from string, msg Message) []byte {
+	header := func(value string) string {
+		return strings.NewReplacer("\r", "", "\n", "").Replace(value)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", header(from))
+	fmt.Fprintf(&b, "To: %s\r\n", header(msg.To))
+	fmt.Fprintf(&b, "Subject: %s\r\n", header(msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("\r\n")
+	// Bodies use CRLF line endings like the headers
+	b.WriteString(strings.ReplaceAll(strings.ReplaceAll(msg.Body, "\r\n", "\n"), "\n", "\r\n"))
+	return []byte(b.String())
+}
@@ -0,0 +1,41 @@
+package mailer
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogMailer(t *testing.T) {
+	var out bytes.Buffer
+	m := NewLogMailer(&out, "noreply@example.com")
+
+	err := m.Send(Message{
+		To:      "ana@example.com",
+		Subject: "Reset\r\nBcc: eve@example.com",
+		Body:    "First line\nSecond line",
+	})
+	assert.NoError(t, err)
+
+	email := out.String()
+	assert.Contains(t, email, "From: noreply@example.com\r\n")
+	assert.Contains(t, email, "To: ana@example.com\r\n")
+	// Line breaks can't add headers
+	assert.Contains(t, email, "Subject: ResetBcc: eve@example.com\r\n")
+	assert.NotContains(t, email, "\r\nBcc:")
+	assert.True(t, strings.HasSuffix(email, "\r\n\r\nFirst line\r\nSecond line\r\n\r\n"))
+}
+
+func TestMemoryMailer(t *testing.T) {
+	m := NewMemoryMailer()
+
+	assert.NoError(t, m.Send(Message{To: "ana@example.com", Subject: "First"}))
+	assert.NoError(t, m.Send(Message{To: "bob@example.com", Subject: "Second"}))
+
+	sent := m.Sent()
+	assert.Len(t, sent, 2)
+	assert.Equal(t, "ana@example.com", sent[0].To)
+	assert.Equal(t, "Second", sent[1].Subject)
+}
@@ -0,0 +1,30 @@
+package mailer
+
+import "sync"
+
+// MemoryMailer keeps the emails instead of sending them, so tests can
+// check what was sent
+type MemoryMailer struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+func NewMemoryMailer() *MemoryMailer {
+	return &MemoryMailer{}
+}
+
+func (m *MemoryMailer) Send(msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.messages = append(m.messages, msg)
+	return nil
+}
+
+// Sent returns the emails sent so far, oldest first
+func (m *MemoryMailer) Sent() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]Message(nil), m.messages...)
+}
@@ -0,0 +1,26 @@
+package mailer
+
+import (
+	"net"
+	"net/smtp"
+)
+
+// SMTPMailer sends emails through an SMTP server
+type SMTPMailer struct {
+	Host string
+	Port string
+	// Username and Password are left empty when the server doesn't
+	// require authentication
+	Username string
+	Password string
+	// Address the emails are sent from
+	From string
+}
+
+func (m *SMTPMailer) Send(msg Message) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+	return smtp.SendMail(net.JoinHostPort(m.Host, m.Port), auth, m.From, []string{msg.To}, format(m.From, msg))
+}
@@ -1,55 +1,221 @@
 package middleware
 
 import (
+	"database/sql"
 	"net/http"
-	"os"
 	"strings"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/labstack/echo/v4"
+	"github.com/xtommas/challenge-hetmo/internal/jwtkeys"
+	"github.com/xtommas/challenge-hetmo/internal/models"
+	"github.com/xtommas/challenge-hetmo/internal/problem"
+	"github.com/xtommas/challenge-hetmo/internal/repositories"
 )
 
-func JWTMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
-	return func(c echo.Context) error {
-		authHeader := c.Request().Header.Get("Authorization")
-		token := strings.TrimPrefix(authHeader, "Bearer ")
-		if token == "" {
-			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Missing or invalid token"})
+// getActiveUser loads the user a request is made on behalf of,
+// turning away deleted and suspended users and those who have to
+// reset their password
+func getActiveUser(users *repositories.UserCache, userID int64) (*models.User, error) {
+	user, err := users.Get(userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, problem.New(http.StatusUnauthorized, problem.CodeInvalidToken, "User no longer exists")
 		}
+		return nil, problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to get user")
+	}
+	if user.IsDeleted() {
+		return nil, problem.New(http.StatusUnauthorized, problem.CodeInvalidToken, "User no longer exists")
+	}
+	if user.IsSuspended() {
+		return nil, problem.New(http.StatusForbidden, problem.CodeAccountSuspended, "Account suspended")
+	}
+	if user.PasswordResetRequired {
+		return nil, problem.New(http.StatusForbidden, problem.CodePasswordResetRequired, "Password reset required")
+	}
+	return user, nil
+}
+
+// JWTMiddleware authenticates requests with an access token, turning
+// away the tokens that were revoked before they expired. The
+// permissions of the user come from its current roles rather than
+// the token, so role changes and suspensions apply right away.
+// API keys are turned away, they can only be used on the routes that
+// use APIKeyMiddleware instead
+func JWTMiddleware(tokenRepo *repositories.TokenRepository, users *repositories.UserCache, keys *jwtkeys.KeySet) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if strings.HasPrefix(c.Request().Header.Get("Authorization"), "ApiKey ") {
+				return problem.New(http.StatusForbidden, problem.CodeSessionRequired, "API keys can't be used here, log in instead")
+			}
+			return authenticateToken(c, next, tokenRepo, users, keys)
+		}
+	}
+}
+
+// APIKeyMiddleware authenticates requests with an API key, in an
+// "ApiKey" header, or with an access token like JWTMiddleware. Every
+// route that uses it has to check the scopes of the keys with
+// RequireScope or RequirePermission
+func APIKeyMiddleware(tokenRepo *repositories.TokenRepository, users *repositories.UserCache, keys *jwtkeys.KeySet, apiKeyRepo *repositories.APIKeyRepository) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if apiKey, ok := strings.CutPrefix(c.Request().Header.Get("Authorization"), "ApiKey "); ok {
+				return authenticateAPIKey(c, next, apiKeyRepo, users, apiKey)
+			}
+			return authenticateToken(c, next, tokenRepo, users, keys)
+		}
+	}
+}
+
+// authenticateToken authenticates a request made with an access token
+func authenticateToken(c echo.Context, next echo.HandlerFunc, tokenRepo *repositories.TokenRepository, users *repositories.UserCache, keys *jwtkeys.KeySet) error {
+	token := strings.TrimPrefix(c.Request().Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		return problem.New(http.StatusUnauthorized, problem.CodeInvalidToken, "Missing or invalid token")
+	}
+
+	claims := jwt.MapClaims{}
+	_, err := keys.Parse(token, claims, jwt.WithExpirationRequired())
+
+	if err != nil {
+		return problem.New(http.StatusUnauthorized, problem.CodeInvalidToken, "Invalid token")
+	}
+
+	// JSON stores numbers as float64
+	userIDFloat, ok := claims["user_id"].(float64)
+	if !ok {
+		return problem.New(http.StatusUnauthorized, problem.CodeInvalidToken, "Invalid token claims")
+	}
+	userID := int64(userIDFloat)
 
-		claims := jwt.MapClaims{}
-		_, err := jwt.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
-			return []byte(os.Getenv("JWT_SECRET")), nil
-		})
+	// Tokens are told apart by their id, so they can be revoked
+	jti, ok := claims["jti"].(string)
+	if !ok || jti == "" {
+		return problem.New(http.StatusUnauthorized, problem.CodeInvalidToken, "Invalid token claims")
+	}
+	expiresAt, err := claims.GetExpirationTime()
+	if err != nil {
+		return problem.New(http.StatusUnauthorized, problem.CodeInvalidToken, "Invalid token claims")
+	}
+
+	revoked, err := tokenRepo.IsRevoked(jti)
+	if err != nil {
+		return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to check token")
+	}
+	if revoked {
+		return problem.New(http.StatusUnauthorized, problem.CodeTokenRevoked, "Token has been revoked")
+	}
 
-		if err != nil {
-			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid token"})
+	user, err := getActiveUser(users, userID)
+	if err != nil {
+		return err
+	}
+
+	c.Set("user_id", userID)
+	c.Set("permissions", user.Permissions)
+	c.Set("token_id", jti)
+	c.Set("token_expires_at", expiresAt.Time)
+	return next(c)
+}
+
+// authenticateAPIKey authenticates a request made with an API key. The
+// request has the permissions of the user that are also scopes of the
+// key
+func authenticateAPIKey(c echo.Context, next echo.HandlerFunc, apiKeyRepo *repositories.APIKeyRepository, users *repositories.UserCache, token string) error {
+	key, err := apiKeyRepo.Authenticate(token)
+	if err != nil {
+		if err == repositories.ErrInvalidAPIKey {
+			return problem.New(http.StatusUnauthorized, problem.CodeInvalidAPIKey, "Invalid API key")
 		}
+		return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to check API key")
+	}
 
-		// JSON stores numbers as float64
-		userIDFloat, ok := claims["user_id"].(float64)
-		if !ok {
-			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid token claims"})
+	user, err := getActiveUser(users, key.UserID)
+	if err != nil {
+		return err
+	}
+
+	c.Set("user_id", key.UserID)
+	c.Set("permissions", user.Permissions.Restrict(key.Scopes))
+	c.Set("api_key_scopes", key.Scopes)
+	return next(c)
+}
+
+// RequireScope turns away the requests made with an API key that
+// doesn't have the scope. Requests made with access tokens go through
+func RequireScope(scope string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			scopes, ok := c.Get("api_key_scopes").([]string)
+			if ok && !models.Permissions(scopes).Has(scope) {
+				return problem.New(http.StatusForbidden, problem.CodeAPIKeyScopeMissing, "API key lacks the "+scope+" scope")
+			}
+			return next(c)
 		}
-		userID := int64(userIDFloat)
+	}
+}
 
-		isAdmin, ok := claims["is_admin"].(bool)
-		if !ok {
-			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid token claims"})
+// RequirePermission turns away the users whose roles don't grant the
+// permission
+func RequirePermission(permission string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			permissions, _ := c.Get("permissions").(models.Permissions)
+			if !permissions.Has(permission) {
+				return problem.New(http.StatusForbidden, problem.CodeForbidden, "Access denied")
+			}
+			return next(c)
 		}
+	}
+}
 
-		c.Set("user_id", userID)
-		c.Set("is_admin", isAdmin)
-		return next(c)
+// RequireAdminTwoFactor turns away the admins that haven't enabled
+// two-factor authentication, except on the routes they need to
+// enable it. Allowed routes are given as the method and the path,
+// such as "GET /api/v1/me"
+func RequireAdminTwoFactor(users *repositories.UserCache, allowedRoutes ...string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			for _, route := range allowedRoutes {
+				if c.Request().Method+" "+c.Path() == route {
+					return next(c)
+				}
+			}
+
+			userID, _ := c.Get("user_id").(int64)
+			user, err := users.Get(userID)
+			if err != nil {
+				if err == sql.ErrNoRows {
+					return problem.New(http.StatusUnauthorized, problem.CodeInvalidToken, "User no longer exists")
+				}
+				return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to get user")
+			}
+			if user.HasRole(models.RoleAdmin) && !user.TwoFactorEnabled {
+				return problem.New(http.StatusForbidden, problem.CodeTwoFactorRequired, "Two-factor authentication required")
+			}
+			return next(c)
+		}
 	}
 }
 
-func AdminOnly(next echo.HandlerFunc) echo.HandlerFunc {
-	return func(c echo.Context) error {
-		isAdmin := c.Get("is_admin").(bool)
-		if !isAdmin {
-			return c.JSON(http.StatusForbidden, map[string]string{"error": "Access denied"})
+// RequireVerifiedEmail turns away the users that haven't verified
+// their email, so they can be reached about the events they sign up for
+func RequireVerifiedEmail(users *repositories.UserCache) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			userID, _ := c.Get("user_id").(int64)
+			user, err := users.Get(userID)
+			if err != nil {
+				if err == sql.ErrNoRows {
+					return problem.New(http.StatusUnauthorized, problem.CodeInvalidToken, "User no longer exists")
+				}
+				return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to get user")
+			}
+			if !user.EmailVerified() {
+				return problem.New(http.StatusForbidden, problem.CodeEmailNotVerified, "Verify your email first")
+			}
+			return next(c)
 		}
-		return next(c)
 	}
 }
@@ -0,0 +1,169 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/xtommas/challenge-hetmo/internal/jwtkeys"
+	"github.com/xtommas/challenge-hetmo/internal/models"
+	"github.com/xtommas/challenge-hetmo/internal/problem"
+	"github.com/xtommas/challenge-hetmo/internal/repositories"
+)
+
+// newUserRows returns the mocked rows for a query that selects users
+func newUserRows() *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"id", "username", "password", "suspended_at", "password_reset_required",
+		"display_name", "email", "email_verified_at", "avatar_url", "locale", "timezone", "deleted_at", "two_factor_enabled", "roles", "permissions"})
+}
+
+// expectAPIKey mocks the lookup of an API key with the scopes, made
+// by a user with every permission
+func expectAPIKey(mock sqlmock.Sqlmock, scopes string) {
+	mock.ExpectQuery("SELECT (.+) FROM api_keys").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "name", "prefix", "scopes", "created_at", "expires_at", "last_used_at"}).
+			AddRow(1, 1, "Script", "hetmo_abcdefghijkl", scopes, time.Now(), nil, time.Now()))
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE id = ?").
+		WithArgs(1).
+		WillReturnRows(newUserRows().AddRow(1, "user", "hashedpassword", nil, false, "", "", nil, "", "", "UTC", nil, false, "{admin}", "{events:create,users:manage}"))
+}
+
+func TestAPIKeyRoutes(t *testing.T) {
+	testCases := []struct {
+		name           string
+		path           string
+		scopes         string
+		expectedStatus int
+		expectedCode   string
+	}{
+		{
+			name:           "Route with the scope",
+			path:           "/api/v1/events",
+			scopes:         "{events:read}",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Key without the scope",
+			path:           "/api/v1/events",
+			scopes:         "{signups:manage}",
+			expectedStatus: http.StatusForbidden,
+			expectedCode:   problem.CodeAPIKeyScopeMissing,
+		},
+		{
+			name:           "Key without the permission",
+			path:           "/api/v1/users",
+			scopes:         "{events:read}",
+			expectedStatus: http.StatusForbidden,
+			expectedCode:   problem.CodeForbidden,
+		},
+		{
+			name:           "Route without API keys",
+			path:           "/api/v1/me",
+			expectedStatus: http.StatusForbidden,
+			expectedCode:   problem.CodeSessionRequired,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			assert.NoError(t, err)
+			defer db.Close()
+			if tc.scopes != "" {
+				expectAPIKey(mock, tc.scopes)
+			}
+
+			keys, err := jwtkeys.Generate()
+			assert.NoError(t, err)
+			tokenRepo := &repositories.TokenRepository{DB: db}
+			users := repositories.NewUserCache(&repositories.UserRepository{DB: db}, time.Minute)
+			ok := func(c echo.Context) error {
+				return c.NoContent(http.StatusOK)
+			}
+
+			// Routes are mounted like the API does
+			e := echo.New()
+			e.HTTPErrorHandler = problem.HTTPErrorHandler
+			r := e.Group("/api/v1", JWTMiddleware(tokenRepo, users, keys))
+			k := e.Group("/api/v1", APIKeyMiddleware(tokenRepo, users, keys, &repositories.APIKeyRepository{DB: db}))
+			k.GET("/events", ok, RequireScope(models.ScopeReadEvents))
+			k.GET("/users", ok, RequirePermission(models.PermissionManageUsers))
+			r.GET("/me", ok)
+
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			req.Header.Set("Authorization", "ApiKey hetmo_abcdefghijkl_secret")
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			assert.Equal(t, tc.expectedStatus, rec.Code)
+			if tc.expectedCode != "" {
+				var response problem.Problem
+				assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+				assert.Equal(t, tc.expectedCode, response.Code)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestRequireAdminTwoFactor(t *testing.T) {
+	testCases := []struct {
+		name           string
+		method         string
+		expectedStatus int
+	}{
+		{
+			name:           "Allowed route",
+			method:         http.MethodGet,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Other method of an allowed route",
+			method:         http.MethodDelete,
+			expectedStatus: http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			assert.NoError(t, err)
+			defer db.Close()
+			if tc.expectedStatus == http.StatusForbidden {
+				mock.ExpectQuery("SELECT (.+) FROM users WHERE id = ?").
+					WithArgs(1).
+					WillReturnRows(newUserRows().AddRow(1, "admin", "hashedpassword", nil, false, "", "", nil, "", "", "UTC", nil, false, "{admin}", "{users:manage}"))
+			}
+
+			users := repositories.NewUserCache(&repositories.UserRepository{DB: db}, time.Minute)
+			ok := func(c echo.Context) error {
+				return c.NoContent(http.StatusOK)
+			}
+			// An admin without two-factor authentication is logged in
+			logIn := func(next echo.HandlerFunc) echo.HandlerFunc {
+				return func(c echo.Context) error {
+					c.Set("user_id", int64(1))
+					return next(c)
+				}
+			}
+
+			e := echo.New()
+			e.HTTPErrorHandler = problem.HTTPErrorHandler
+			r := e.Group("/api/v1", logIn, RequireAdminTwoFactor(users, "GET /api/v1/me"))
+			r.GET("/me", ok)
+			r.DELETE("/me", ok)
+
+			req := httptest.NewRequest(tc.method, "/api/v1/me", nil)
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			assert.Equal(t, tc.expectedStatus, rec.Code)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
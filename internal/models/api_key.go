@@ -0,0 +1,47 @@
+package models
+
+import "time"
+
+// Scopes API keys can have besides the permissions of their user. The
+// routes that need neither a scope nor a permission, such as those
+// that manage the account, can't be used with API keys
+const (
+	// Read events, series, categories and venues
+	ScopeReadEvents = "events:read"
+	// Sign up for events and list the user's sign ups
+	ScopeManageSignUps = "signups:manage"
+)
+
+// APIKey lets scripts call the API on behalf of a user, limited to its
+// scopes. Only a hash of the key is stored, the prefix identifies it
+type APIKey struct {
+	Id         int64      `json:"id"`
+	UserID     int64      `json:"user_id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// AllowedScopes returns the scopes the user can give their API keys:
+// the basic ones and the permissions the user has
+func (u *User) AllowedScopes() []string {
+	return append([]string{ScopeReadEvents, ScopeManageSignUps}, u.Permissions...)
+}
+
+// Restrict returns the permissions that are also in the scopes, the
+// ones a request made with an API key has
+func (p Permissions) Restrict(scopes []string) Permissions {
+	restricted := Permissions{}
+	for _, permission := range p {
+		for _, scope := range scopes {
+			if permission == scope {
+				restricted = append(restricted, permission)
+				break
+			}
+		}
+	}
+	return restricted
+}
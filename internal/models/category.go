@@ -0,0 +1,38 @@
+package models
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Category is one of the admin-managed groups events belong to.
+// Events and filters refer to categories by their slug
+type Category struct {
+	Id   int64  `json:"id"`
+	Name string `json:"name" validate:"required,max=50"`
+	Slug string `json:"slug" validate:"required,max=50"`
+}
+
+var slugPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// IsSlug tells whether s is made of lowercase letters and digits,
+// with single hyphens between words
+func IsSlug(s string) bool {
+	return slugPattern.MatchString(s)
+}
+
+// NormalizeTags trims and lowercases the tags, dropping empty and
+// repeated ones, so "Go" and " go" are the same tag
+func NormalizeTags(tags []string) []string {
+	normalized := []string{}
+	seen := map[string]bool{}
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		normalized = append(normalized, tag)
+	}
+	return normalized
+}
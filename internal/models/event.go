@@ -1,14 +1,133 @@
 package models
 
-import "time"
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Event lifecycle states
+const (
+	EventDraft     = "draft"
+	EventPublished = "published"
+	EventCancelled = "cancelled"
+	EventCompleted = "completed"
+	EventArchived  = "archived"
+)
+
+var (
+	ErrInvalidTransition = errors.New("invalid status transition")
+	ErrEventHasSignUps   = errors.New("event has sign ups")
+	ErrEventNotFinished  = errors.New("event hasn't happened yet")
+)
+
+// eventTransitions lists the states an event can move to from each state
+var eventTransitions = map[string][]string{
+	EventDraft:     {EventPublished, EventCancelled, EventArchived},
+	EventPublished: {EventDraft, EventCancelled, EventCompleted},
+	EventCancelled: {EventArchived},
+	EventCompleted: {EventArchived},
+}
 
 type Event struct {
 	Id               int64     `json:"id"`
 	Title            string    `json:"title" validate:"required,min=3,max=100"`
 	LongDescription  string    `json:"long_description" validate:"required,min=10"`
 	ShortDescription string    `json:"short_description" validate:"required,max=200"`
-	DateAndTime      time.Time `json:"date_and_time" validate:"required,gt=now"`
+	DateAndTime      time.Time `json:"date_and_time" validate:"required"`
 	Organizer        string    `json:"organizer" validate:"required"`
 	Location         string    `json:"location" validate:"required"`
-	Status           string    `json:"status" validate:"required,oneof=draft published"`
+	Status           string    `json:"status" validate:"required,oneof=draft published cancelled completed archived"`
+	// IANA name of the time zone the event is shown in
+	Timezone string `json:"timezone" validate:"required,timezone"`
+	// A nil capacity means the event has no seat limit
+	Capacity        *int `json:"capacity" validate:"omitempty,min=1"`
+	WaitlistEnabled bool `json:"waitlist_enabled"`
+	// Slugs of the categories of the event
+	Categories []string `json:"categories" validate:"max=10,dive,required"`
+	Tags       []string `json:"tags" validate:"max=20,dive,min=1,max=30"`
+	// Set when the event takes place at one of the venues. Venue is
+	// only filled in when the event is read
+	VenueId *int64 `json:"venue_id"`
+	Venue   *Venue `json:"venue,omitempty"`
+	// Only set when filtering events near a location
+	DistanceKm *float64 `json:"distance_km,omitempty"`
+	// Set when the event is an occurrence of a recurring series
+	SeriesId *int64 `json:"series_id,omitempty"`
+	// The user that created the event, nil if they were deleted.
+	// Without the events:manage_any permission, users can only
+	// change the events they created
+	CreatedBy *int64 `json:"created_by"`
+	// Sequence counts the revisions of the event, so calendar
+	// clients know when to replace their copy
+	Sequence  int       `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Only set when the event was found through a text search
+	Search *SearchMatch `json:"search,omitempty"`
+}
+
+// MarshalJSON writes the date of the event both in UTC and in the
+// event's time zone
+func (e Event) MarshalJSON() ([]byte, error) {
+	// event has the fields of Event but not its methods, so it
+	// doesn't call MarshalJSON again
+	type event Event
+	local := e.DateAndTime
+	if loc, err := LoadTimezone(e.Timezone); err == nil {
+		local = local.In(loc)
+	}
+	return json.Marshal(struct {
+		event
+		DateAndTime      time.Time `json:"date_and_time"`
+		LocalDateAndTime time.Time `json:"local_date_and_time"`
+	}{event(e), e.DateAndTime.UTC(), local})
+}
+
+// SearchMatch tells how relevant an event is to a text search, with
+// the matched words wrapped in <mark> tags. The title and snippet are
+// HTML escaped, so they can be shown as HTML
+type SearchMatch struct {
+	Rank    float64 `json:"rank"`
+	Title   string  `json:"title"`
+	Snippet string  `json:"snippet"`
+}
+
+// CheckTransition returns an error if the event can't move to the
+// given status. hasSignUps tells whether users are signed up to it,
+// as events people signed up for can't go back to draft
+func (e *Event) CheckTransition(status string, hasSignUps bool) error {
+	allowed := false
+	for _, s := range eventTransitions[e.Status] {
+		if s == status {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return ErrInvalidTransition
+	}
+
+	if status == EventDraft && hasSignUps {
+		return ErrEventHasSignUps
+	}
+	if status == EventCompleted && e.DateAndTime.After(time.Now()) {
+		return ErrEventNotFinished
+	}
+
+	return nil
+}
+
+// IsEventStatus tells whether status is one of the event lifecycle states
+func IsEventStatus(status string) bool {
+	switch status {
+	case EventDraft, EventPublished, EventCancelled, EventCompleted, EventArchived:
+		return true
+	}
+	return false
+}
+
+// IsPublic tells whether users without admin rights can see the event
+func (e *Event) IsPublic() bool {
+	return e.Status == EventPublished || e.Status == EventCancelled || e.Status == EventCompleted
 }
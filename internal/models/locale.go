@@ -0,0 +1,19 @@
+package models
+
+import (
+	"errors"
+
+	"golang.org/x/text/language"
+)
+
+var ErrInvalidLocale = errors.New("invalid locale")
+
+// CanonicalLocale returns the BCP 47 language tag with the given name
+// in its canonical form, turning "es_ar" into "es-AR"
+func CanonicalLocale(name string) (string, error) {
+	tag, err := language.Parse(name)
+	if err != nil {
+		return "", ErrInvalidLocale
+	}
+	return tag.String(), nil
+}
@@ -0,0 +1,82 @@
+package models
+
+import (
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// LoginPolicy sets how failed logins slow down and lock out the next
+// attempts
+type LoginPolicy struct {
+	// Failures allowed before attempts have to wait
+	FreeFailures int
+	// The wait after the first failure past the free ones, which
+	// doubles with each further failure up to MaxDelay
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// Failures that lock out further attempts for LockoutDuration
+	LockoutFailures int
+	LockoutDuration time.Duration
+	// Failures older than this are forgotten
+	Window time.Duration
+}
+
+var (
+	// UsernameLoginPolicy applies to the attempts to log in as a user
+	UsernameLoginPolicy = LoginPolicy{
+		FreeFailures:    3,
+		BaseDelay:       time.Second,
+		MaxDelay:        time.Minute,
+		LockoutFailures: 10,
+		LockoutDuration: 15 * time.Minute,
+		Window:          15 * time.Minute,
+	}
+	// IPLoginPolicy applies to the attempts from an IP address, which
+	// may be shared by several users or try several usernames
+	IPLoginPolicy = LoginPolicy{
+		FreeFailures:    20,
+		BaseDelay:       time.Second,
+		MaxDelay:        5 * time.Minute,
+		LockoutFailures: 100,
+		LockoutDuration: time.Hour,
+		Window:          time.Hour,
+	}
+)
+
+// Delay returns how long attempts have to wait after the given number
+// of recent failures, and whether they are locked out
+func (p LoginPolicy) Delay(failures int) (time.Duration, bool) {
+	if failures >= p.LockoutFailures {
+		return p.LockoutDuration, true
+	}
+	if failures <= p.FreeFailures {
+		return 0, false
+	}
+	delay := p.BaseDelay
+	for i := p.FreeFailures + 1; i < failures && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return delay, false
+}
+
+// LoginLockout is a user locked out after too many failed logins
+type LoginLockout struct {
+	Username      string    `json:"username"`
+	Failures      int       `json:"failures"`
+	LastFailureAt time.Time `json:"last_failure_at"`
+	LockedUntil   time.Time `json:"locked_until"`
+}
+
+// dummyPassword is compared against when logging in as a user that
+// doesn't exist, so it takes as long as logging in as one that does
+var dummyPassword, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+// CheckDummyPassword takes as long as User.CheckPassword, and fails
+func CheckDummyPassword(password string) bool {
+	bcrypt.CompareHashAndPassword(dummyPassword, []byte(password))
+	return false
+}
@@ -0,0 +1,40 @@
+package models
+
+// Permissions granted by roles. Routes require one of them, and the
+// events:update and events:delete ones only cover the events the user
+// created unless they also have events:manage_any
+const (
+	PermissionViewDrafts       = "events:view_drafts"
+	PermissionCreateEvents     = "events:create"
+	PermissionUpdateEvents     = "events:update"
+	PermissionDeleteEvents     = "events:delete"
+	PermissionManageAnyEvent   = "events:manage_any"
+	PermissionCheckIn          = "signups:check_in"
+	PermissionManageCategories = "categories:manage"
+	PermissionManageVenues     = "venues:manage"
+	PermissionManageUsers      = "users:manage"
+)
+
+// RoleAdmin is the role with every permission
+const RoleAdmin = "admin"
+
+// Role is a named set of permissions assigned to users
+type Role struct {
+	Id          int64       `json:"id"`
+	Name        string      `json:"name"`
+	Description string      `json:"description"`
+	Permissions Permissions `json:"permissions"`
+}
+
+// Permissions is the set of permissions a user or role has
+type Permissions []string
+
+// Has tells whether the permission is in the set
+func (p Permissions) Has(permission string) bool {
+	for _, name := range p {
+		if name == permission {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,12 @@
+package models
+
+import "time"
+
+// EventSeries is a recurring event. Each occurrence is stored as an
+// event, so it can be edited, cancelled and signed up to on its own
+type EventSeries struct {
+	Id             int64     `json:"id"`
+	RecurrenceRule string    `json:"recurrence_rule"`
+	StartsAt       time.Time `json:"starts_at"`
+	Occurrences    []Event   `json:"occurrences"`
+}
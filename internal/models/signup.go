@@ -0,0 +1,59 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Possible states of a user's sign up to an event
+const (
+	SignUpConfirmed  = "confirmed"
+	SignUpWaitlisted = "waitlisted"
+	SignUpCancelled  = "cancelled"
+)
+
+// UserSignUp is a sign up of a user as listed for admins, along with
+// the event it's for
+type UserSignUp struct {
+	EventId     int64      `json:"event_id"`
+	Title       string     `json:"title"`
+	DateAndTime time.Time  `json:"date_and_time"`
+	Status      string     `json:"status"`
+	CreatedAt   time.Time  `json:"created_at"`
+	CancelledAt *time.Time `json:"cancelled_at,omitempty"`
+	CheckedInAt *time.Time `json:"checked_in_at,omitempty"`
+}
+
+// EventAvailability describes how full an event is, as seen
+// by the user requesting it
+type EventAvailability struct {
+	SeatsTaken int `json:"seats_taken"`
+	// nil when the event has no capacity limit
+	SeatsRemaining   *int   `json:"seats_remaining"`
+	WaitlistLength   int    `json:"waitlist_length"`
+	SignUpStatus     string `json:"signup_status,omitempty"`
+	WaitlistPosition *int   `json:"waitlist_position,omitempty"`
+}
+
+// EventDetails is the response for a single event
+type EventDetails struct {
+	*Event
+	EventAvailability
+}
+
+// MarshalJSON writes the fields of the event and its availability in
+// a single object. Otherwise the MarshalJSON of the embedded event
+// would leave the availability out
+func (d EventDetails) MarshalJSON() ([]byte, error) {
+	event, err := json.Marshal(d.Event)
+	if err != nil {
+		return nil, err
+	}
+	availability, err := json.Marshal(d.EventAvailability)
+	if err != nil {
+		return nil, err
+	}
+	// Join both objects, dropping the closing brace of the first
+	// and the opening brace of the second
+	return append(append(event[:len(event)-1], ','), availability[1:]...), nil
+}
@@ -0,0 +1,22 @@
+package models
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrInvalidTimezone = errors.New("invalid time zone")
+
+// LoadTimezone returns the time zone with the given IANA name, such
+// as "America/Argentina/Buenos_Aires"
+func LoadTimezone(name string) (*time.Location, error) {
+	// LoadLocation also accepts these, but they aren't IANA names
+	if name == "" || name == "Local" {
+		return nil, ErrInvalidTimezone
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, ErrInvalidTimezone
+	}
+	return loc, nil
+}
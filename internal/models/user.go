@@ -1,6 +1,8 @@
 package models
 
 import (
+	"time"
+
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -8,7 +10,57 @@ type User struct {
 	Id       int64  `json:"id"`
 	Username string `json:"username" validate:"required,min=3,max=50"`
 	Password string `json:"-" validate:"required,min=5"`
-	IsAdmin  bool   `json:"is_admin"`
+	// Names of the roles assigned to the user
+	Roles []string `json:"roles"`
+	// Permissions granted by the roles
+	Permissions Permissions `json:"permissions,omitempty"`
+	// Set while the account is suspended
+	SuspendedAt *time.Time `json:"suspended_at,omitempty"`
+	// Set when an admin forced a password reset, until the user
+	// chooses a new password
+	PasswordResetRequired bool `json:"password_reset_required"`
+	// Profile fields the user edits themselves
+	DisplayName string `json:"display_name"`
+	Email       string `json:"email"`
+	AvatarURL   string `json:"avatar_url"`
+	// Set once the user proved they own their email
+	EmailVerifiedAt *time.Time `json:"email_verified_at,omitempty"`
+	// BCP 47 language tag, such as "es-AR"
+	Locale string `json:"locale"`
+	// IANA name of the user's time zone
+	Timezone string `json:"timezone"`
+	// Set when the user deleted their account, which anonymises it
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	// Set when logging in takes a TOTP code besides the password
+	TwoFactorEnabled bool `json:"two_factor_enabled"`
+}
+
+// Profile holds the fields users edit themselves. They're validated
+// apart from the rest of the user, as users created through SSO have
+// no password and may have a shorter username
+type Profile struct {
+	DisplayName string `json:"display_name" validate:"max=100"`
+	Email       string `json:"email" validate:"omitempty,email,max=255"`
+	AvatarURL   string `json:"avatar_url" validate:"omitempty,web_url,max=2048"`
+	Locale      string `json:"locale" validate:"omitempty,locale"`
+	Timezone    string `json:"timezone" validate:"required,timezone"`
+}
+
+// Profile returns the fields of the user they edit themselves
+func (u *User) Profile() Profile {
+	return Profile{
+		DisplayName: u.DisplayName,
+		Email:       u.Email,
+		AvatarURL:   u.AvatarURL,
+		Locale:      u.Locale,
+		Timezone:    u.Timezone,
+	}
+}
+
+// UserDetails is the response for a single user in the admin API
+type UserDetails struct {
+	*User
+	SignUps []UserSignUp `json:"signups"`
 }
 
 func (u *User) SetPassword(password string) error {
@@ -21,6 +73,43 @@ func (u *User) SetPassword(password string) error {
 }
 
 func (u *User) CheckPassword(password string) bool {
+	// Deleted accounts have no password, but take as long to fail
+	if u.Password == "" {
+		return CheckDummyPassword(password)
+	}
 	err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password))
 	return err == nil
 }
+
+// HasPassword tells whether the user set a password. Users created
+// through SSO have none until they set one
+func (u *User) HasPassword() bool {
+	return u.Password != ""
+}
+
+// IsSuspended tells whether the user is kept from using the API
+func (u *User) IsSuspended() bool {
+	return u.SuspendedAt != nil
+}
+
+// IsDeleted tells whether the user deleted their account, which is
+// kept anonymised
+func (u *User) IsDeleted() bool {
+	return u.DeletedAt != nil
+}
+
+// EmailVerified tells whether the user has an email they proved they
+// own
+func (u *User) EmailVerified() bool {
+	return u.Email != "" && u.EmailVerifiedAt != nil
+}
+
+// HasRole tells whether the role is assigned to the user
+func (u *User) HasRole(role string) bool {
+	for _, name := range u.Roles {
+		if name == role {
+			return true
+		}
+	}
+	return false
+}
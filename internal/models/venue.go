@@ -0,0 +1,15 @@
+package models
+
+// Venue is a place where events happen
+type Venue struct {
+	Id        int64    `json:"id"`
+	Name      string   `json:"name" validate:"required,max=100"`
+	Address   string   `json:"address" validate:"required"`
+	Latitude  *float64 `json:"latitude" validate:"required,min=-90,max=90"`
+	Longitude *float64 `json:"longitude" validate:"required,min=-180,max=180"`
+	// A nil capacity means the venue has no seat limit
+	Capacity           *int   `json:"capacity" validate:"omitempty,min=1"`
+	AccessibilityNotes string `json:"accessibility_notes"`
+	// IANA name of the time zone the venue is in
+	Timezone string `json:"timezone" validate:"required,timezone"`
+}
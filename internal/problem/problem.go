@@ -0,0 +1,225 @@
+// Package problem describes the errors of the API as RFC 7807 problem
+// details. Every problem has a code that clients can rely on, unlike
+// its detail, which is meant for people and may change
+package problem
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ContentType is the media type of problem details
+const ContentType = "application/problem+json"
+
+// Codes of the problems. New codes can be added, but existing ones
+// keep their meaning
+const (
+	// Generic codes, for problems that clients don't need to tell apart
+	CodeInvalidRequest   = "invalid_request"
+	CodeValidationFailed = "validation_failed"
+	CodeUnauthorized     = "unauthorized"
+	CodeForbidden        = "forbidden"
+	CodeNotFound         = "not_found"
+	CodeMethodNotAllowed = "method_not_allowed"
+	CodeConflict         = "conflict"
+	CodeTooManyRequests  = "too_many_requests"
+	CodeInternal         = "internal_error"
+
+	// Authentication
+	CodeInvalidCredentials       = "invalid_credentials"
+	CodeInvalidToken             = "invalid_token"
+	CodeTokenRevoked             = "token_revoked"
+	CodeInvalidRefreshToken      = "invalid_refresh_token"
+	CodeRefreshTokenReused       = "refresh_token_reused"
+	CodeInvalidAPIKey            = "invalid_api_key"
+	CodeInvalidMFAToken          = "invalid_mfa_token"
+	CodeInvalidMFACode           = "invalid_mfa_code"
+	CodeIncorrectPassword        = "incorrect_password"
+	CodeInvalidResetToken        = "invalid_reset_token"
+	CodeInvalidVerificationToken = "invalid_verification_token"
+	CodeInvalidSSOState          = "invalid_sso_state"
+	CodeSSOLoginFailed           = "sso_login_failed"
+	CodeLoginThrottled           = "login_throttled"
+	CodeReauthenticationRequired = "reauthentication_required"
+
+	// Accounts
+	CodeAccountSuspended        = "account_suspended"
+	CodePasswordResetRequired   = "password_reset_required"
+	CodeTwoFactorRequired       = "two_factor_required"
+	CodeTwoFactorNotSetUp       = "two_factor_not_set_up"
+	CodeTwoFactorNotEnabled     = "two_factor_not_enabled"
+	CodeTwoFactorAlreadyEnabled = "two_factor_already_enabled"
+	CodeEmailTaken              = "email_taken"
+	CodeEmailMissing            = "email_missing"
+	CodeEmailNotVerified        = "email_not_verified"
+	CodeEmailAlreadyVerified    = "email_already_verified"
+	CodeSSOAccountLinked        = "sso_account_linked"
+	CodeAPIKeyScopeMissing      = "api_key_scope_missing"
+	CodeAPIKeyScopeNotAllowed   = "api_key_scope_not_allowed"
+	CodeSessionRequired         = "session_required"
+	CodeRoleAlreadyAssigned     = "role_already_assigned"
+	CodeRoleNotAssigned         = "role_not_assigned"
+	CodeLastAdmin               = "last_admin"
+	CodeCannotSuspendSelf       = "cannot_suspend_self"
+	CodeNotEventOwner           = "not_event_owner"
+	CodeInvalidStatusTransition = "invalid_status_transition"
+	CodeEventHasSignUps         = "event_has_sign_ups"
+	CodeEventNotHappened        = "event_not_happened"
+	CodeEditConflict            = "edit_conflict"
+	CodeAlreadySignedUp         = "already_signed_up"
+	CodeEventFull               = "event_full"
+	CodeCancellationClosed      = "cancellation_closed"
+	CodeNoUpcomingEvents        = "no_upcoming_events"
+	CodeInvalidRecurrenceRule   = "invalid_recurrence_rule"
+	CodeUnknownCategory         = "unknown_category"
+	CodeUnknownVenue            = "unknown_venue"
+	CodeCategoryExists          = "category_exists"
+	CodeVenueInUse              = "venue_in_use"
+)
+
+// FieldError describes a field of the request that failed validation
+type FieldError struct {
+	// Name of the field in the request body
+	Field string `json:"field"`
+	// Validation rule the field broke, such as "required" or "max"
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Problem is an error of the API, written to clients as problem
+// details by HTTPErrorHandler
+type Problem struct {
+	// The type is always "about:blank", clients tell problems apart by
+	// their code instead
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	// Path of the request that failed
+	Instance  string       `json:"instance,omitempty"`
+	Code      string       `json:"code"`
+	RequestID string       `json:"request_id,omitempty"`
+	Errors    []FieldError `json:"errors,omitempty"`
+}
+
+// New returns a problem with the HTTP status, the code and a detail
+// for people
+func New(status int, code, detail string) *Problem {
+	return &Problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+		Code:   code,
+	}
+}
+
+// Invalid returns a validation problem for a single field, for the
+// checks that the validator can't make
+func Invalid(field, code, message string) *Problem {
+	p := New(http.StatusBadRequest, CodeValidationFailed, "Some fields are invalid")
+	p.Errors = []FieldError{{Field: field, Code: code, Message: message}}
+	return p
+}
+
+func (p *Problem) Error() string {
+	if p.Detail == "" {
+		return p.Code
+	}
+	return p.Code + ": " + p.Detail
+}
+
+// statusCodes are the codes of the problems raised by Echo itself,
+// such as requests to unknown routes
+var statusCodes = map[int]string{
+	http.StatusBadRequest:            CodeInvalidRequest,
+	http.StatusUnauthorized:          CodeUnauthorized,
+	http.StatusForbidden:             CodeForbidden,
+	http.StatusNotFound:              CodeNotFound,
+	http.StatusMethodNotAllowed:      CodeMethodNotAllowed,
+	http.StatusConflict:              CodeConflict,
+	http.StatusRequestEntityTooLarge: CodeInvalidRequest,
+	http.StatusUnsupportedMediaType:  CodeInvalidRequest,
+	http.StatusTooManyRequests:       CodeTooManyRequests,
+}
+
+// fromError returns the problem to write for an error returned by a
+// handler or a middleware
+func fromError(err error, c echo.Context) *Problem {
+	var p *Problem
+	if errors.As(err, &p) {
+		copied := *p
+		return &copied
+	}
+
+	var he *echo.HTTPError
+	if errors.As(err, &he) {
+		code, ok := statusCodes[he.Code]
+		if !ok {
+			code = CodeInternal
+		}
+		p = New(he.Code, code, "")
+		if message, ok := he.Message.(string); ok && message != http.StatusText(he.Code) {
+			p.Detail = message
+		}
+		if he.Code >= http.StatusInternalServerError {
+			c.Logger().Error(err)
+		}
+		return p
+	}
+
+	// Errors that aren't problems are bugs, so their details stay in
+	// the logs
+	c.Logger().Error(err)
+	return New(http.StatusInternalServerError, CodeInternal, "An unexpected error occurred")
+}
+
+// RequestID gives every request an id, sent back in the X-Request-ID
+// header, so its errors can be found in the logs. Clients can send their
+// own id in the same header
+func RequestID() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			id := c.Request().Header.Get(echo.HeaderXRequestID)
+			if id == "" {
+				b := make([]byte, 16)
+				if _, err := rand.Read(b); err != nil {
+					return err
+				}
+				id = hex.EncodeToString(b)
+			}
+			c.Response().Header().Set(echo.HeaderXRequestID, id)
+			return next(c)
+		}
+	}
+}
+
+// HTTPErrorHandler writes the errors returned by the handlers and the
+// middlewares as problem details, along with the id of the request so
+// it can be found in the logs
+func HTTPErrorHandler(err error, c echo.Context) {
+	if c.Response().Committed {
+		return
+	}
+
+	p := fromError(err, c)
+	p.Instance = c.Request().URL.Path
+	p.RequestID = c.Response().Header().Get(echo.HeaderXRequestID)
+	if p.RequestID == "" {
+		p.RequestID = c.Request().Header.Get(echo.HeaderXRequestID)
+	}
+
+	c.Response().Header().Set(echo.HeaderContentType, ContentType)
+	if c.Request().Method == http.MethodHead {
+		err = c.NoContent(p.Status)
+	} else {
+		err = c.JSON(p.Status, p)
+	}
+	if err != nil {
+		c.Logger().Error(err)
+	}
+}
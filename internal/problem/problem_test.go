@@ -0,0 +1,132 @@
+package problem
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPErrorHandler(t *testing.T) {
+	testCases := []struct {
+		name           string
+		err            error
+		expectedStatus int
+		expectedCode   string
+		expectedDetail string
+	}{
+		{
+			name:           "Problem",
+			err:            New(http.StatusConflict, CodeEventFull, "Event is full"),
+			expectedStatus: http.StatusConflict,
+			expectedCode:   CodeEventFull,
+			expectedDetail: "Event is full",
+		},
+		{
+			name:           "Echo error",
+			err:            echo.ErrNotFound,
+			expectedStatus: http.StatusNotFound,
+			expectedCode:   CodeNotFound,
+		},
+		{
+			name:           "Echo error with a message",
+			err:            echo.NewHTTPError(http.StatusBadRequest, "Syntax error"),
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   CodeInvalidRequest,
+			expectedDetail: "Syntax error",
+		},
+		{
+			name:           "Other error",
+			err:            errors.New("pq: connection refused"),
+			expectedStatus: http.StatusInternalServerError,
+			expectedCode:   CodeInternal,
+			expectedDetail: "An unexpected error occurred",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			e := echo.New()
+			req := httptest.NewRequest(http.MethodGet, "/events/1", nil)
+			req.Header.Set(echo.HeaderXRequestID, "req-1")
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+
+			HTTPErrorHandler(tc.err, c)
+
+			assert.Equal(t, tc.expectedStatus, rec.Code)
+			assert.Equal(t, ContentType, rec.Header().Get(echo.HeaderContentType))
+
+			var p Problem
+			assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &p))
+			assert.Equal(t, "about:blank", p.Type)
+			assert.Equal(t, http.StatusText(tc.expectedStatus), p.Title)
+			assert.Equal(t, tc.expectedStatus, p.Status)
+			assert.Equal(t, tc.expectedCode, p.Code)
+			assert.Equal(t, tc.expectedDetail, p.Detail)
+			assert.Equal(t, "/events/1", p.Instance)
+			assert.Equal(t, "req-1", p.RequestID)
+		})
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	err := error(Invalid("expires_at", "gt", "must be in the future"))
+
+	var p *Problem
+	if assert.True(t, errors.As(err, &p)) {
+		assert.Equal(t, http.StatusBadRequest, p.Status)
+		assert.Equal(t, CodeValidationFailed, p.Code)
+		assert.Equal(t, []FieldError{{Field: "expires_at", Code: "gt", Message: "must be in the future"}}, p.Errors)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	testCases := []struct {
+		name     string
+		clientID string
+	}{
+		{
+			name:     "Generated id",
+			clientID: "",
+		},
+		{
+			name:     "Id sent by the client",
+			clientID: "req-1",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			e := echo.New()
+			e.HTTPErrorHandler = HTTPErrorHandler
+			e.Use(RequestID())
+			e.GET("/events/:id", func(c echo.Context) error {
+				return New(http.StatusNotFound, CodeNotFound, "Event not found")
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "/events/1", nil)
+			if tc.clientID != "" {
+				req.Header.Set(echo.HeaderXRequestID, tc.clientID)
+			}
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			id := rec.Header().Get(echo.HeaderXRequestID)
+			if tc.clientID != "" {
+				assert.Equal(t, tc.clientID, id)
+			} else {
+				assert.Len(t, id, 32)
+			}
+
+			// Errors repeat the id of their request
+			var p Problem
+			assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &p))
+			assert.Equal(t, id, p.RequestID)
+		})
+	}
+}
@@ -0,0 +1,238 @@
+// Package recurrence implements the subset of RFC 5545 recurrence
+// rules (RRULE) needed to schedule event series
+package recurrence
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxOccurrences caps how many occurrences a rule may generate, as
+// every occurrence is stored as an event
+const MaxOccurrences = 500
+
+// Supported frequencies
+const (
+	Daily   = "DAILY"
+	Weekly  = "WEEKLY"
+	Monthly = "MONTHLY"
+	Yearly  = "YEARLY"
+)
+
+var weekdays = map[string]time.Weekday{
+	"MO": time.Monday,
+	"TU": time.Tuesday,
+	"WE": time.Wednesday,
+	"TH": time.Thursday,
+	"FR": time.Friday,
+	"SA": time.Saturday,
+	"SU": time.Sunday,
+}
+
+var ErrUnbounded = errors.New("recurrence rule must have an UNTIL or COUNT")
+
+// Rule is a parsed recurrence rule such as "FREQ=WEEKLY;BYDAY=TU,TH;COUNT=10"
+type Rule struct {
+	Freq     string
+	Interval int
+	ByDay    []time.Weekday
+	Until    time.Time
+	Count    int
+}
+
+// Parse parses the FREQ, INTERVAL, BYDAY, UNTIL and COUNT parts of a
+// recurrence rule. BYDAY is only supported for daily and weekly rules
+func Parse(s string) (*Rule, error) {
+	rule := &Rule{Interval: 1}
+	s = strings.TrimPrefix(strings.TrimSpace(s), "RRULE:")
+	if s == "" {
+		return nil, errors.New("empty recurrence rule")
+	}
+
+	for _, part := range strings.Split(s, ";") {
+		name, value, ok := strings.Cut(part, "=")
+		if !ok || value == "" {
+			return nil, fmt.Errorf("invalid recurrence rule part %q", part)
+		}
+		switch strings.ToUpper(name) {
+		case "FREQ":
+			value = strings.ToUpper(value)
+			if value != Daily && value != Weekly && value != Monthly && value != Yearly {
+				return nil, fmt.Errorf("unsupported FREQ %q", value)
+			}
+			rule.Freq = value
+		case "INTERVAL":
+			interval, err := strconv.Atoi(value)
+			if err != nil || interval < 1 {
+				return nil, fmt.Errorf("invalid INTERVAL %q", value)
+			}
+			rule.Interval = interval
+		case "BYDAY":
+			for _, day := range strings.Split(strings.ToUpper(value), ",") {
+				weekday, ok := weekdays[day]
+				if !ok {
+					return nil, fmt.Errorf("unsupported BYDAY value %q", day)
+				}
+				rule.ByDay = append(rule.ByDay, weekday)
+			}
+		case "UNTIL":
+			until, err := parseUntil(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid UNTIL %q", value)
+			}
+			rule.Until = until
+		case "COUNT":
+			count, err := strconv.Atoi(value)
+			if err != nil || count < 1 {
+				return nil, fmt.Errorf("invalid COUNT %q", value)
+			}
+			rule.Count = count
+		default:
+			return nil, fmt.Errorf("unsupported recurrence rule part %q", name)
+		}
+	}
+
+	if rule.Freq == "" {
+		return nil, errors.New("recurrence rule must have a FREQ")
+	}
+	if len(rule.ByDay) > 0 && rule.Freq != Daily && rule.Freq != Weekly {
+		return nil, fmt.Errorf("BYDAY is not supported with FREQ=%s", rule.Freq)
+	}
+	if rule.Count > 0 && !rule.Until.IsZero() {
+		return nil, errors.New("recurrence rule can't have both UNTIL and COUNT")
+	}
+	if rule.Count == 0 && rule.Until.IsZero() {
+		return nil, ErrUnbounded
+	}
+
+	// Weekly rules visit the days in week order, starting on Monday
+	sort.Slice(rule.ByDay, func(i, j int) bool {
+		return mondayIndex(rule.ByDay[i]) < mondayIndex(rule.ByDay[j])
+	})
+
+	return rule, nil
+}
+
+// parseUntil accepts both the date and the UTC date-time forms of UNTIL
+func parseUntil(value string) (time.Time, error) {
+	if until, err := time.Parse("20060102T150405Z", value); err == nil {
+		return until, nil
+	}
+	until, err := time.Parse("20060102", value)
+	if err != nil {
+		return time.Time{}, err
+	}
+	// A date includes the whole day
+	return until.Add(24*time.Hour - time.Second), nil
+}
+
+func (r *Rule) String() string {
+	parts := []string{"FREQ=" + r.Freq}
+	if r.Interval > 1 {
+		parts = append(parts, "INTERVAL="+strconv.Itoa(r.Interval))
+	}
+	if len(r.ByDay) > 0 {
+		days := make([]string, len(r.ByDay))
+		for i, weekday := range r.ByDay {
+			for name, d := range weekdays {
+				if d == weekday {
+					days[i] = name
+				}
+			}
+		}
+		parts = append(parts, "BYDAY="+strings.Join(days, ","))
+	}
+	if !r.Until.IsZero() {
+		parts = append(parts, "UNTIL="+r.Until.UTC().Format("20060102T150405Z"))
+	}
+	if r.Count > 0 {
+		parts = append(parts, "COUNT="+strconv.Itoa(r.Count))
+	}
+	return strings.Join(parts, ";")
+}
+
+// Occurrences returns the start times of the occurrences generated from
+// dtstart, which is always the first one. Times are computed in the
+// location of dtstart, so a series keeps its wall clock time across DST
+// changes. It fails if the rule generates more than MaxOccurrences
+func (r *Rule) Occurrences(dtstart time.Time) ([]time.Time, error) {
+	occurrences := []time.Time{dtstart}
+
+	year, month, day := dtstart.Date()
+	hour, min, sec := dtstart.Clock()
+	at := func(y int, m time.Month, d int) time.Time {
+		return time.Date(y, m, d, hour, min, sec, dtstart.Nanosecond(), dtstart.Location())
+	}
+
+	// Each period is a day, week, month or year depending on FREQ, and
+	// the period of dtstart is 0. Rules whose BYDAY never matches are
+	// stopped by maxPeriods instead of looping forever
+	const maxPeriods = 100 * MaxOccurrences
+	for period := 0; period < maxPeriods; period++ {
+		var candidates []time.Time
+		switch r.Freq {
+		case Daily:
+			t := at(year, month, day+period*r.Interval)
+			if r.matchesDay(t) {
+				candidates = append(candidates, t)
+			}
+		case Weekly:
+			if len(r.ByDay) == 0 {
+				candidates = append(candidates, at(year, month, day+7*period*r.Interval))
+				break
+			}
+			weekStart := day - mondayIndex(dtstart.Weekday()) + 7*period*r.Interval
+			for _, weekday := range r.ByDay {
+				candidates = append(candidates, at(year, month, weekStart+mondayIndex(weekday)))
+			}
+		case Monthly:
+			// Months without the day of dtstart are skipped, as in RFC 5545
+			if t := at(year, month+time.Month(period*r.Interval), day); t.Day() == day {
+				candidates = append(candidates, t)
+			}
+		case Yearly:
+			if t := at(year+period*r.Interval, month, day); t.Day() == day {
+				candidates = append(candidates, t)
+			}
+		}
+
+		for _, t := range candidates {
+			// dtstart was already added, and counts even if it
+			// doesn't match BYDAY
+			if !t.After(dtstart) {
+				continue
+			}
+			if r.Count > 0 && len(occurrences) == r.Count || !r.Until.IsZero() && t.After(r.Until) {
+				return occurrences, nil
+			}
+			if len(occurrences) == MaxOccurrences {
+				return nil, fmt.Errorf("recurrence rule generates more than %d occurrences", MaxOccurrences)
+			}
+			occurrences = append(occurrences, t)
+		}
+	}
+
+	return occurrences, nil
+}
+
+// matchesDay tells whether t falls on one of the BYDAY days, if any
+func (r *Rule) matchesDay(t time.Time) bool {
+	if len(r.ByDay) == 0 {
+		return true
+	}
+	for _, weekday := range r.ByDay {
+		if t.Weekday() == weekday {
+			return true
+		}
+	}
+	return false
+}
+
+// mondayIndex returns the position of the weekday in a week starting on Monday
+func mondayIndex(weekday time.Weekday) int {
+	return (int(weekday) + 6) % 7
+}
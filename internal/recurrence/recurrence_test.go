@@ -0,0 +1,146 @@
+package recurrence
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	// Test cases
+	testCases := []struct {
+		name        string
+		rule        string
+		expected    string
+		expectError bool
+	}{
+		{
+			name:     "Weekly with days and count",
+			rule:     "FREQ=WEEKLY;BYDAY=TH,TU;COUNT=10",
+			expected: "FREQ=WEEKLY;BYDAY=TU,TH;COUNT=10",
+		},
+		{
+			name:     "RRULE prefix and until date",
+			rule:     "RRULE:FREQ=MONTHLY;INTERVAL=2;UNTIL=20991231",
+			expected: "FREQ=MONTHLY;INTERVAL=2;UNTIL=20991231T235959Z",
+		},
+		{
+			name:        "Missing FREQ",
+			rule:        "COUNT=3",
+			expectError: true,
+		},
+		{
+			name:        "Unbounded rule",
+			rule:        "FREQ=DAILY",
+			expectError: true,
+		},
+		{
+			name:        "BYDAY with monthly frequency",
+			rule:        "FREQ=MONTHLY;BYDAY=MO;COUNT=3",
+			expectError: true,
+		},
+		{
+			name:        "Unsupported part",
+			rule:        "FREQ=DAILY;BYHOUR=3;COUNT=3",
+			expectError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rule, err := Parse(tc.rule)
+			if tc.expectError {
+				assert.Error(t, err)
+				return
+			}
+			if assert.NoError(t, err) {
+				assert.Equal(t, tc.expected, rule.String())
+			}
+		})
+	}
+}
+
+func TestOccurrences(t *testing.T) {
+	// Tuesday
+	dtstart := time.Date(2099, time.January, 6, 19, 0, 0, 0, time.UTC)
+
+	date := func(month time.Month, day int) time.Time {
+		return time.Date(2099, month, day, 19, 0, 0, 0, time.UTC)
+	}
+
+	// Test cases
+	testCases := []struct {
+		name     string
+		rule     string
+		dtstart  time.Time
+		expected []time.Time
+	}{
+		{
+			name:     "Weekly",
+			rule:     "FREQ=WEEKLY;COUNT=3",
+			dtstart:  dtstart,
+			expected: []time.Time{date(1, 6), date(1, 13), date(1, 20)},
+		},
+		{
+			name:     "Weekly on several days",
+			rule:     "FREQ=WEEKLY;BYDAY=MO,TU,TH;COUNT=4",
+			dtstart:  dtstart,
+			expected: []time.Time{date(1, 6), date(1, 8), date(1, 12), date(1, 13)},
+		},
+		{
+			name:     "Every other week until a date",
+			rule:     "FREQ=WEEKLY;INTERVAL=2;UNTIL=20990203",
+			dtstart:  dtstart,
+			expected: []time.Time{date(1, 6), date(1, 20), date(2, 3)},
+		},
+		{
+			name:     "Weekdays only",
+			rule:     "FREQ=DAILY;BYDAY=MO,TU,WE,TH,FR;COUNT=5",
+			dtstart:  date(1, 8),
+			expected: []time.Time{date(1, 8), date(1, 9), date(1, 12), date(1, 13), date(1, 14)},
+		},
+		{
+			name:     "Monthly skips short months",
+			rule:     "FREQ=MONTHLY;COUNT=3",
+			dtstart:  date(1, 31),
+			expected: []time.Time{date(1, 31), date(3, 31), date(5, 31)},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rule, err := Parse(tc.rule)
+			assert.NoError(t, err)
+
+			occurrences, err := rule.Occurrences(tc.dtstart)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, occurrences)
+		})
+	}
+}
+
+func TestOccurrencesKeepsWallClockTime(t *testing.T) {
+	location, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("timezone database not available")
+	}
+
+	// Daylight saving time starts on March 8, 2099
+	dtstart := time.Date(2099, time.March, 3, 18, 30, 0, 0, location)
+	rule, err := Parse("FREQ=WEEKLY;COUNT=2")
+	assert.NoError(t, err)
+
+	occurrences, err := rule.Occurrences(dtstart)
+	assert.NoError(t, err)
+	assert.Equal(t, 18, occurrences[1].Hour())
+	assert.Equal(t, 7*24*time.Hour-time.Hour, occurrences[1].Sub(occurrences[0]))
+}
+
+func TestOccurrencesLimit(t *testing.T) {
+	rule, err := Parse("FREQ=DAILY;COUNT=1000")
+	assert.NoError(t, err)
+
+	_, err = rule.Occurrences(time.Date(2099, time.January, 1, 0, 0, 0, 0, time.UTC))
+	assert.Error(t, err)
+}
@@ -0,0 +1,139 @@
+package repositories
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/xtommas/challenge-hetmo/internal/models"
+)
+
+// ErrInvalidAPIKey is returned for API keys that are unknown, expired
+// or revoked
+var ErrInvalidAPIKey = errors.New("invalid api key")
+
+const (
+	// apiKeyPrefix starts every API key, so leaked keys are easy to
+	// find in code and logs
+	apiKeyPrefix = "hetmo_"
+	// lastUsedPrecision is how often the last use of a key is
+	// recorded, so keys used in a loop don't write on every request
+	lastUsedPrecision = time.Minute
+)
+
+const apiKeyColumns = `id, user_id, name, prefix, scopes, created_at, expires_at, last_used_at`
+
+// scanAPIKey reads a row selected with apiKeyColumns into key
+func scanAPIKey(s scanner, key *models.APIKey) error {
+	return s.Scan(&key.Id, &key.UserID, &key.Name, &key.Prefix, pq.Array(&key.Scopes),
+		&key.CreatedAt, &key.ExpiresAt, &key.LastUsedAt)
+}
+
+// APIKeyRepository stores the API keys of the users. Only a hash of
+// each key is stored
+type APIKeyRepository struct {
+	DB *sql.DB
+}
+
+// Create issues a new API key, filling in its id, prefix and creation
+// time. The key is returned only here
+func (r *APIKeyRepository) Create(key *models.APIKey) (string, error) {
+	id := make([]byte, 6)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	secret, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	key.Prefix = apiKeyPrefix + hex.EncodeToString(id)
+	token := key.Prefix + "_" + secret
+
+	query := `
+		INSERT INTO api_keys (user_id, name, prefix, key_hash, scopes, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at`
+	err = r.DB.QueryRow(query, key.UserID, key.Name, key.Prefix, hashToken(token), pq.Array(key.Scopes), key.ExpiresAt).
+		Scan(&key.Id, &key.CreatedAt)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// GetAll returns the API keys that weren't revoked, newest first. If
+// userID isn't zero, only the keys of that user are returned
+func (r *APIKeyRepository) GetAll(userID int64) ([]models.APIKey, error) {
+	query := `
+		SELECT ` + apiKeyColumns + ` FROM api_keys
+		WHERE revoked_at IS NULL AND ($1 = 0 OR user_id = $1)
+		ORDER BY created_at DESC, id DESC`
+	rows, err := r.DB.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []models.APIKey{}
+	for rows.Next() {
+		var key models.APIKey
+		if err := scanAPIKey(rows, &key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// Revoke revokes the API key. If userID isn't zero, only a key of that
+// user is revoked. It returns sql.ErrNoRows if there's no such key
+func (r *APIKeyRepository) Revoke(id, userID int64) error {
+	query := `
+		UPDATE api_keys SET revoked_at = NOW()
+		WHERE id = $1 AND ($2 = 0 OR user_id = $2) AND revoked_at IS NULL`
+	result, err := r.DB.Exec(query, id, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// Authenticate returns the API key, recording that it was used, or
+// ErrInvalidAPIKey if it can't be used
+func (r *APIKeyRepository) Authenticate(token string) (*models.APIKey, error) {
+	key := &models.APIKey{}
+	query := `
+		SELECT ` + apiKeyColumns + ` FROM api_keys
+		WHERE key_hash = $1 AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > NOW())`
+	if err := scanAPIKey(r.DB.QueryRow(query, hashToken(token)), key); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrInvalidAPIKey
+		}
+		return nil, err
+	}
+
+	if key.LastUsedAt == nil || time.Since(*key.LastUsedAt) >= lastUsedPrecision {
+		query = `UPDATE api_keys SET last_used_at = NOW() WHERE id = $1`
+		if _, err := r.DB.Exec(query, key.Id); err != nil {
+			return nil, err
+		}
+	}
+
+	return key, nil
+}
@@ -0,0 +1,95 @@
+package repositories
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+)
+
+// CalendarTokenRepository stores the tokens that give calendar clients
+// access to a user's feed. Only a hash of each token is stored
+type CalendarTokenRepository struct {
+	DB *sql.DB
+}
+
+// Create issues a new feed token for the user, revoking the previous one
+func (r *CalendarTokenRepository) Create(userID int64) (string, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := r.DB.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	query := `UPDATE calendar_feed_tokens SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL`
+	if _, err := tx.Exec(query, userID); err != nil {
+		return "", err
+	}
+
+	query = `INSERT INTO calendar_feed_tokens (user_id, token_hash) VALUES ($1, $2)`
+	if _, err := tx.Exec(query, userID, hashToken(token)); err != nil {
+		return "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// Revoke revokes the user's feed token. It returns sql.ErrNoRows if
+// the user didn't have one
+func (r *CalendarTokenRepository) Revoke(userID int64) error {
+	query := `UPDATE calendar_feed_tokens SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL`
+	result, err := r.DB.Exec(query, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// GetUserID returns the owner of a feed token that hasn't been revoked.
+// Tokens of suspended or deleted users don't work either
+func (r *CalendarTokenRepository) GetUserID(token string) (int64, error) {
+	query := `
+		SELECT t.user_id FROM calendar_feed_tokens t
+		JOIN users u ON u.id = t.user_id
+		WHERE t.token_hash = $1 AND t.revoked_at IS NULL
+			AND u.suspended_at IS NULL AND u.deleted_at IS NULL`
+	var userID int64
+	err := r.DB.QueryRow(query, hashToken(token)).Scan(&userID)
+	return userID, err
+}
+
+// newToken returns a random URL safe token
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken hashes a token for storage. Tokens are random, so
+// unlike passwords they don't need a slow hash
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,98 @@
+package repositories
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/xtommas/challenge-hetmo/internal/models"
+)
+
+var ErrCategoryExists = errors.New("category already exists")
+
+type CategoryRepository struct {
+	DB *sql.DB
+}
+
+// Create stores the category. It returns ErrCategoryExists if the
+// name or slug are already in use
+func (r *CategoryRepository) Create(category *models.Category) error {
+	query := `INSERT INTO categories (name, slug) VALUES ($1, $2) RETURNING id`
+	err := r.DB.QueryRow(query, category.Name, category.Slug).Scan(&category.Id)
+	if isUniqueViolation(err) {
+		return ErrCategoryExists
+	}
+	return err
+}
+
+func (r *CategoryRepository) GetAll() ([]models.Category, error) {
+	query := `SELECT id, name, slug FROM categories ORDER BY name, id`
+	rows, err := r.DB.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	categories := []models.Category{}
+	for rows.Next() {
+		var category models.Category
+		if err := rows.Scan(&category.Id, &category.Name, &category.Slug); err != nil {
+			return nil, err
+		}
+		categories = append(categories, category)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return categories, nil
+}
+
+func (r *CategoryRepository) Get(id int64) (*models.Category, error) {
+	query := `SELECT id, name, slug FROM categories WHERE id = $1`
+	category := &models.Category{}
+	err := r.DB.QueryRow(query, id).Scan(&category.Id, &category.Name, &category.Slug)
+	if err != nil {
+		return nil, err
+	}
+	return category, nil
+}
+
+// Update saves the name and slug of the category. Events keep
+// belonging to it, as they are linked by id
+func (r *CategoryRepository) Update(category *models.Category) error {
+	query := `UPDATE categories SET name = $1, slug = $2 WHERE id = $3`
+	result, err := r.DB.Exec(query, category.Name, category.Slug, category.Id)
+	if isUniqueViolation(err) {
+		return ErrCategoryExists
+	}
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Delete removes the category, taking it off the events it had
+func (r *CategoryRepository) Delete(id int64) error {
+	query := `DELETE FROM categories WHERE id = $1`
+	result, err := r.DB.Exec(query, id)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package repositories
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/xtommas/challenge-hetmo/internal/models"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Cursor marks a position in a sorted list of events or users, right
+// after (or before) the row it was taken from
+type Cursor struct {
+	Sort string `json:"sort"`
+	// Value is the text form of the sort key of the row
+	Value string `json:"value"`
+	Id    int64  `json:"id"`
+	// Before is set for cursors that point to the previous page
+	Before bool `json:"before,omitempty"`
+}
+
+// Encode returns the cursor as an opaque string for clients
+func (c *Cursor) Encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// DecodeCursor reads a cursor returned by Encode. The cursor must
+// have been taken from a list with the given sort
+func DecodeCursor(s, sort string) (*Cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	cursor := &Cursor{}
+	if err := json.Unmarshal(data, cursor); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	if cursor.Sort != sort {
+		return nil, ErrInvalidCursor
+	}
+	return cursor, nil
+}
+
+// EventPage is a page of events read with a cursor, along with the
+// cursors of its neighbouring pages. They are nil when there is
+// no such page
+type EventPage struct {
+	Events []models.Event
+	Next   *Cursor
+	Prev   *Cursor
+}
+
+// sortValue returns the column selected to build cursors from
+func sortValue(sort string) string {
+	s, _ := parseEventSort(sort)
+	return fmt.Sprintf("(%s)::text", s.expression)
+}
+
+// keysetClauses returns the condition, order and limit that read the
+// page of events at the cursor
+func keysetClauses(sort string, cursor *Cursor, args []interface{}, limit int) (string, []interface{}) {
+	s, direction := parseEventSort(sort)
+	return keyset(s.expression, s.sqlType, "e.id", direction, cursor, args, limit)
+}
+
+// keyset returns the condition, order and limit that read the page at
+// the cursor of a list sorted by the expression, of the given SQL
+// type, with ties broken by the id column. One row more than the limit
+// is read, to tell whether there are more rows after the page
+func keyset(expression, sqlType, id, direction string, cursor *Cursor, args []interface{}, limit int) (string, []interface{}) {
+	// Pages before the cursor are read in reverse order
+	if cursor != nil && cursor.Before {
+		if direction == "ASC" {
+			direction = "DESC"
+		} else {
+			direction = "ASC"
+		}
+	}
+
+	clauses := ""
+	if cursor != nil {
+		comparison := ">"
+		if direction == "DESC" {
+			comparison = "<"
+		}
+		args = append(args, cursor.Value, cursor.Id)
+		clauses += fmt.Sprintf(" AND (%s, %s) %s (CAST($%d AS %s), $%d)",
+			expression, id, comparison, len(args)-1, sqlType, len(args))
+	}
+
+	args = append(args, limit+1)
+	clauses += fmt.Sprintf(" ORDER BY %s %s, %s %s LIMIT $%d", expression, direction, id, direction, len(args))
+
+	return clauses, args
+}
+
+// newEventPage builds the page out of the rows read with the
+// clauses of keysetClauses and the sort values of each event
+func newEventPage(events []models.Event, values []string, sort string, cursor *Cursor, limit int) *EventPage {
+	more := len(events) > limit
+	if more {
+		events = events[:limit]
+		values = values[:limit]
+	}
+	ids := make([]int64, len(events))
+	for i := range events {
+		ids[i] = events[i].Id
+	}
+	if cursor != nil && cursor.Before {
+		for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+			events[i], events[j] = events[j], events[i]
+		}
+		reversePage(ids, values)
+	}
+
+	page := &EventPage{Events: events}
+	page.Next, page.Prev = pageCursors(ids, values, sort, cursor, more)
+	return page
+}
+
+// reversePage puts the ids and sort values of a page read backwards
+// in the order of the list
+func reversePage(ids []int64, values []string) {
+	for i, j := 0, len(ids)-1; i < j; i, j = i+1, j-1 {
+		ids[i], ids[j] = ids[j], ids[i]
+		values[i], values[j] = values[j], values[i]
+	}
+}
+
+// pageCursors returns the cursors of the pages next to the page read
+// at the cursor, given the ids and sort values of its rows in the order
+// of the list. more tells whether rows were left after the page in
+// the direction it was read
+func pageCursors(ids []int64, values []string, sort string, cursor *Cursor, more bool) (next, prev *Cursor) {
+	// An empty page can still go back to where the cursor came from
+	if len(ids) == 0 {
+		if cursor != nil {
+			back := *cursor
+			back.Before = !cursor.Before
+			if back.Before {
+				prev = &back
+			} else {
+				next = &back
+			}
+		}
+		return next, prev
+	}
+
+	first := &Cursor{Sort: sort, Value: values[0], Id: ids[0], Before: true}
+	last := &Cursor{Sort: sort, Value: values[len(values)-1], Id: ids[len(ids)-1]}
+	if cursor != nil && cursor.Before {
+		// We came from the page after this one
+		next = last
+		if more {
+			prev = first
+		}
+	} else {
+		if more {
+			next = last
+		}
+		if cursor != nil {
+			prev = first
+		}
+	}
+
+	return next, prev
+}
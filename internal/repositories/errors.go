@@ -0,0 +1,34 @@
+package repositories
+
+import (
+	"errors"
+
+	"github.com/lib/pq"
+)
+
+// isUniqueViolation tells whether err was caused by a unique constraint
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+// isForeignKeyViolation tells whether err was caused by a reference
+// to a row that doesn't exist, or by deleting a referenced row
+func isForeignKeyViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23503"
+}
+
+// isEmailViolation tells whether err was caused by an email another
+// user already has
+func isEmailViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505" && pqErr.Constraint == "users_email_key"
+}
+
+// isUsernameViolation tells whether err was caused by a username
+// another user already has
+func isUsernameViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505" && pqErr.Constraint == "users_username_key"
+}
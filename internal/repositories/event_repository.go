@@ -2,58 +2,271 @@ package repositories
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
 	"time"
 
+	"github.com/lib/pq"
 	"github.com/xtommas/challenge-hetmo/internal/models"
 )
 
+var (
+	ErrUnknownCategory = errors.New("unknown category")
+	ErrUnknownVenue    = errors.New("unknown venue")
+)
+
+// eventColumns are the columns read by scanEvent, qualified with
+// the "e" alias so they can also be used in joins
+const eventColumns = `e.id, e.title, e.long_description, e.short_description, e.date_and_time,
+	e.timezone, e.organizer, e.location, e.status, e.capacity, e.waitlist_enabled, e.series_id,
+	e.sequence, e.created_at, e.updated_at,
+	ARRAY(SELECT c.slug FROM event_categories ec JOIN categories c ON c.id = ec.category_id
+		WHERE ec.event_id = e.id ORDER BY c.slug),
+	ARRAY(SELECT t.name FROM event_tags et JOIN tags t ON t.id = et.tag_id
+		WHERE et.event_id = e.id ORDER BY t.name),
+	e.venue_id,
+	(SELECT row_to_json(venue) FROM (SELECT ` + venueColumns + ` FROM venues WHERE id = e.venue_id) venue),
+	e.created_by`
+
+// scanner is implemented by both *sql.Row and *sql.Rows
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// queryRower is implemented by both *sql.DB and *sql.Tx
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// scanEvent reads a row selected with eventColumns into event. Any
+// extra destinations are scanned from the columns that follow
+func scanEvent(s scanner, event *models.Event, extra ...interface{}) error {
+	var venue []byte
+	dest := []interface{}{
+		&event.Id,
+		&event.Title,
+		&event.LongDescription,
+		&event.ShortDescription,
+		&event.DateAndTime,
+		&event.Timezone,
+		&event.Organizer,
+		&event.Location,
+		&event.Status,
+		&event.Capacity,
+		&event.WaitlistEnabled,
+		&event.SeriesId,
+		&event.Sequence,
+		&event.CreatedAt,
+		&event.UpdatedAt,
+		pq.Array(&event.Categories),
+		pq.Array(&event.Tags),
+		&event.VenueId,
+		&venue,
+		&event.CreatedBy,
+	}
+	if err := s.Scan(append(dest, extra...)...); err != nil {
+		return err
+	}
+
+	// The venue is read as a JSON object
+	if venue != nil {
+		event.Venue = &models.Venue{}
+		return json.Unmarshal(venue, event.Venue)
+	}
+	return nil
+}
+
 type EventRepository struct {
 	DB *sql.DB
 }
 
 func (e *EventRepository) Create(event *models.Event) error {
-	// Make the title lowercase for case-insensitive filtering
-	event.Title = strings.ToLower(event.Title)
-	// Make these lowercase as well, in case we may want to
-	// filter them in the future using query params
-	event.Organizer = strings.ToLower(event.Organizer)
-	event.Location = strings.ToLower(event.Location)
+	tx, err := e.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := insertEvent(tx, event); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func insertEvent(tx *sql.Tx, event *models.Event) error {
 	query := `
-            INSERT INTO events (title, long_description, short_description, date_and_time, organizer, location, status) 
-            VALUES ($1, $2, $3, $4, $5, $6, $7) 
-            RETURNING id`
-	err := e.DB.QueryRow(query,
+            INSERT INTO events (title, long_description, short_description, date_and_time, timezone, organizer, location, status, capacity, waitlist_enabled, series_id, venue_id, created_by) 
+            VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13) 
+            RETURNING id, created_at, updated_at`
+	err := tx.QueryRow(query,
 		event.Title,
 		event.LongDescription,
 		event.ShortDescription,
 		event.DateAndTime,
+		event.Timezone,
 		event.Organizer,
 		event.Location,
-		event.Status).Scan(&event.Id)
+		event.Status,
+		event.Capacity,
+		event.WaitlistEnabled,
+		event.SeriesId,
+		event.VenueId,
+		event.CreatedBy).Scan(&event.Id, &event.CreatedAt, &event.UpdatedAt)
+	if isForeignKeyViolation(err) {
+		return ErrUnknownVenue
+	}
+	if err != nil {
+		return err
+	}
+
+	// New events have nothing to replace
+	if len(event.Categories) > 0 {
+		if err := addEventCategories(tx, event); err != nil {
+			return err
+		}
+	}
+	if len(event.Tags) > 0 {
+		if err := addEventTags(tx, event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setEventTaxonomy replaces the categories and tags of the event
+func setEventTaxonomy(tx *sql.Tx, event *models.Event) error {
+	if _, err := tx.Exec(`DELETE FROM event_categories WHERE event_id = $1`, event.Id); err != nil {
+		return err
+	}
+	if len(event.Categories) > 0 {
+		if err := addEventCategories(tx, event); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec(`DELETE FROM event_tags WHERE event_id = $1`, event.Id); err != nil {
+		return err
+	}
+	if len(event.Tags) > 0 {
+		if err := addEventTags(tx, event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addEventCategories links the event to its categories. It returns
+// ErrUnknownCategory if any of them doesn't exist
+func addEventCategories(tx *sql.Tx, event *models.Event) error {
+	query := `
+		INSERT INTO event_categories (event_id, category_id)
+		SELECT $1, id FROM categories WHERE slug = ANY($2)`
+	result, err := tx.Exec(query, event.Id, pq.Array(event.Categories))
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	unique := map[string]bool{}
+	for _, slug := range event.Categories {
+		unique[slug] = true
+	}
+	if int(rowsAffected) != len(unique) {
+		return ErrUnknownCategory
+	}
+	return nil
+}
+
+// addEventTags links the event to its tags, creating the ones
+// that weren't used before
+func addEventTags(tx *sql.Tx, event *models.Event) error {
+	query := `INSERT INTO tags (name) SELECT unnest($1::text[]) ON CONFLICT (name) DO NOTHING`
+	if _, err := tx.Exec(query, pq.Array(event.Tags)); err != nil {
+		return err
+	}
+	query = `
+		INSERT INTO event_tags (event_id, tag_id)
+		SELECT $1, id FROM tags WHERE name = ANY($2)`
+	_, err := tx.Exec(query, event.Id, pq.Array(event.Tags))
 	return err
 }
 
 func (e *EventRepository) Update(event *models.Event) error {
-	// Make the title, organizer and location lowercase for case-insensitive filtering
-	event.Title = strings.ToLower(event.Title)
-	event.Organizer = strings.ToLower(event.Organizer)
-	event.Location = strings.ToLower(event.Location)
+	tx, err := e.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := updateEvent(tx, event); err != nil {
+		return err
+	}
+	if event.Status == models.EventDraft {
+		if err := checkNoSignUps(tx, event.Id); err != nil {
+			return err
+		}
+	}
 
+	return tx.Commit()
+}
+
+func updateEvent(tx *sql.Tx, event *models.Event) error {
 	query := `
             UPDATE events 
-            SET title = $1, long_description = $2, short_description = $3, date_and_time = $4, organizer = $5, location = $6, status = $7 
-            WHERE id = $8`
-	result, err := e.DB.Exec(query,
+            SET title = $1, long_description = $2, short_description = $3, date_and_time = $4, timezone = $5, organizer = $6, location = $7, status = $8, capacity = $9,
+                waitlist_enabled = $10, venue_id = $11, sequence = sequence + 1, updated_at = NOW() 
+            WHERE id = $12
+            RETURNING sequence, updated_at`
+	err := tx.QueryRow(query,
 		event.Title,
 		event.LongDescription,
 		event.ShortDescription,
 		event.DateAndTime,
+		event.Timezone,
 		event.Organizer,
 		event.Location,
 		event.Status,
-		event.Id)
+		event.Capacity,
+		event.WaitlistEnabled,
+		event.VenueId,
+		event.Id).Scan(&event.Sequence, &event.UpdatedAt)
+	if isForeignKeyViolation(err) {
+		return ErrUnknownVenue
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := setEventTaxonomy(tx, event); err != nil {
+		return err
+	}
+
+	// The capacity may have been raised, so give the freed
+	// seats to the users that are waiting for them. The UPDATE
+	// above keeps the event row locked until we commit
+	return fillFromWaitlist(tx, event.Id)
+}
+
+// UpdateStatus moves the event from one status to another. It returns
+// sql.ErrNoRows if the event is no longer in the from status, so only
+// one of two concurrent transitions can succeed. Events with sign ups
+// can't go back to draft, which returns models.ErrEventHasSignUps
+func (e *EventRepository) UpdateStatus(id int64, from, to string) error {
+	tx, err := e.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		UPDATE events SET status = $3, sequence = sequence + 1, updated_at = NOW()
+		WHERE id = $1 AND status = $2`
+	result, err := tx.Exec(query, id, from, to)
 	if err != nil {
 		return err
 	}
@@ -64,23 +277,48 @@ func (e *EventRepository) Update(event *models.Event) error {
 	if rowsAffected == 0 {
 		return sql.ErrNoRows
 	}
+	if to == models.EventDraft {
+		if err := checkNoSignUps(tx, id); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// checkNoSignUps returns models.ErrEventHasSignUps if any user is signed
+// up to the event. It must run after the event row is locked, so the sign
+// ups that were waiting for the lock can't slip in once it's checked
+func checkNoSignUps(tx *sql.Tx, id int64) error {
+	exists, err := hasSignUps(tx, id)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return models.ErrEventHasSignUps
+	}
 	return nil
 }
 
+// HasSignUps tells whether any user is signed up to the event,
+// either with a seat or in the waitlist
+func (e *EventRepository) HasSignUps(id int64) (bool, error) {
+	return hasSignUps(e.DB, id)
+}
+
+// hasSignUps runs the query of HasSignUps, within a transaction or not
+func hasSignUps(q queryRower, id int64) (bool, error) {
+	query := `SELECT EXISTS (SELECT 1 FROM user_events WHERE event_id = $1 AND status <> 'cancelled')`
+	var exists bool
+	err := q.QueryRow(query, id).Scan(&exists)
+	return exists, err
+}
+
 func (e *EventRepository) Get(id int64) (*models.Event, error) {
-	query := `SELECT * FROM events WHERE id = $1`
+	query := `SELECT ` + eventColumns + ` FROM events e WHERE e.id = $1`
 	row := e.DB.QueryRow(query, id)
 	event := &models.Event{}
-	err := row.Scan(
-		&event.Id,
-		&event.Title,
-		&event.LongDescription,
-		&event.ShortDescription,
-		&event.DateAndTime,
-		&event.Organizer,
-		&event.Location,
-		&event.Status,
-	)
+	err := scanEvent(row, event)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, sql.ErrNoRows
@@ -90,43 +328,294 @@ func (e *EventRepository) Get(id int64) (*models.Event, error) {
 	return event, nil
 }
 
-func (e *EventRepository) GetAll(dateStart, dateEnd time.Time, status string, title string, limit, offset int) ([]models.Event, error) {
+// GetAvailability returns how many seats of the event are taken and,
+// if the given user signed up, the state of their sign up
+func (e *EventRepository) GetAvailability(event *models.Event, userID int64) (*models.EventAvailability, error) {
+	// Waitlisted users are served in the order they signed up, using
+	// the user id to break ties between simultaneous sign ups
+	query := `
+		SELECT
+			COUNT(*) FILTER (WHERE ue.status = 'confirmed'),
+			COUNT(*) FILTER (WHERE ue.status = 'waitlisted'),
+			COALESCE(MAX(me.status), ''),
+			COUNT(*) FILTER (WHERE me.status = 'waitlisted' AND ue.status = 'waitlisted'
+				AND (ue.created_at, ue.user_id) <= (me.created_at, me.user_id))
+		FROM user_events ue
+		LEFT JOIN user_events me ON me.event_id = ue.event_id AND me.user_id = $2
+		WHERE ue.event_id = $1`
+
+	availability := &models.EventAvailability{}
+	var position int
+	err := e.DB.QueryRow(query, event.Id, userID).Scan(
+		&availability.SeatsTaken,
+		&availability.WaitlistLength,
+		&availability.SignUpStatus,
+		&position,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if event.Capacity != nil {
+		remaining := *event.Capacity - availability.SeatsTaken
+		if remaining < 0 {
+			remaining = 0
+		}
+		availability.SeatsRemaining = &remaining
+	}
+	if availability.SignUpStatus == models.SignUpWaitlisted {
+		availability.WaitlistPosition = &position
+	}
+
+	return availability, nil
+}
+
+// EventFilter holds the conditions used to list events. Empty
+// fields don't filter anything
+type EventFilter struct {
+	DateStart time.Time
+	DateEnd   time.Time
+	Status    string
+	// Title, Organizer and Location match any part of the
+	// field, ignoring case
+	Title     string
+	Organizer string
+	Location  string
+	// Category is the slug of a category the events belong to
+	Category string
+	// Tags lists tags the events must have. Any of them is enough
+	// unless AllTags is set
+	Tags    []string
+	AllTags bool
+	// Query is searched for in the title, descriptions,
+	// organizer and location of the events
+	Query string
+	// Near keeps the events held at venues within RadiusKm
+	// kilometers of the point
+	Near     *GeoPoint
+	RadiusKm float64
+}
+
+// GeoPoint is a position given by its latitude and longitude
+// in degrees
+type GeoPoint struct {
+	Latitude  float64
+	Longitude float64
+}
+
+// kmPerDegree is the length of a degree of latitude, used to skip
+// the venues that are too far north or south of a point
+const kmPerDegree = 111.045
+
+// haversine returns the expression for the distance in kilometers
+// between the venue "nv" and the point in the given parameters
+func haversine(lat, lng int) string {
+	return fmt.Sprintf(`6371 * 2 * ASIN(LEAST(1, SQRT(
+		POWER(SIN(RADIANS(nv.latitude - $%[1]d) / 2), 2) +
+		COS(RADIANS($%[1]d)) * COS(RADIANS(nv.latitude)) *
+		POWER(SIN(RADIANS(nv.longitude - $%[2]d) / 2), 2))))`, lat, lng)
+}
+
+// searchConfig is the text search configuration used for the
+// search_vector column
+const searchConfig = "'simple'"
+
+// clauses returns the FROM and WHERE clauses that select the events
+// matching the filter, along with the arguments they use
+func (f EventFilter) clauses() (string, []interface{}) {
+	from := " FROM events e"
 	// Add a condition that's always true in the query
 	// so we can append other conditions based on the
-	// query parameters that are provided
-	query := `SELECT * FROM events WHERE 1=1`
-
-	// Cheack for query parameters
+	// fields that are set
+	where := " WHERE 1=1"
 	args := []interface{}{}
-	// Counter for positional placeholder in SQL query ($1, $2, ...)
-	argCounter := 1
 
-	// Add filtering conditions if query parameters are provided
-	if status != "" {
-		query += fmt.Sprintf(" AND status = $%d", argCounter)
-		args = append(args, status)
-		argCounter++
+	// The search query is parsed once and referenced as "query"
+	// by the conditions and the ranking
+	if f.Query != "" {
+		args = append(args, f.Query)
+		from += " CROSS JOIN websearch_to_tsquery(" + searchConfig + ", $1) query"
+		where += " AND e.search_vector @@ query"
+	}
+	// The distance to the venue is computed once and referenced
+	// as "distance.km" by the conditions and the ordering
+	if f.Near != nil {
+		args = append(args, f.Near.Latitude, f.Near.Longitude)
+		from += ` JOIN venues nv ON nv.id = e.venue_id
+			CROSS JOIN LATERAL (SELECT ` + haversine(len(args)-1, len(args)) + ` AS km) distance`
+		delta := f.RadiusKm / kmPerDegree
+		args = append(args, f.Near.Latitude-delta, f.Near.Latitude+delta, f.RadiusKm)
+		where += fmt.Sprintf(" AND nv.latitude BETWEEN $%d AND $%d AND distance.km <= $%d",
+			len(args)-2, len(args)-1, len(args))
+	}
+	if f.Status != "" {
+		args = append(args, f.Status)
+		where += fmt.Sprintf(" AND e.status = $%d", len(args))
+	}
+	if f.Title != "" {
+		args = append(args, "%"+escapeLike(f.Title)+"%")
+		where += fmt.Sprintf(" AND e.title ILIKE $%d", len(args))
+	}
+	if f.Organizer != "" {
+		args = append(args, "%"+escapeLike(f.Organizer)+"%")
+		where += fmt.Sprintf(" AND e.organizer ILIKE $%d", len(args))
+	}
+	if f.Location != "" {
+		args = append(args, "%"+escapeLike(f.Location)+"%")
+		where += fmt.Sprintf(" AND e.location ILIKE $%d", len(args))
+	}
+	if f.Category != "" {
+		args = append(args, f.Category)
+		where += fmt.Sprintf(` AND EXISTS (SELECT 1 FROM event_categories ec JOIN categories c ON c.id = ec.category_id
+			WHERE ec.event_id = e.id AND c.slug = $%d)`, len(args))
+	}
+	if len(f.Tags) > 0 {
+		args = append(args, pq.Array(f.Tags))
+		if f.AllTags {
+			// Count how many of the tags the event has
+			where += fmt.Sprintf(` AND (SELECT COUNT(*) FROM event_tags et JOIN tags t ON t.id = et.tag_id
+				WHERE et.event_id = e.id AND t.name = ANY($%d)) = %d`, len(args), len(f.Tags))
+		} else {
+			where += fmt.Sprintf(` AND EXISTS (SELECT 1 FROM event_tags et JOIN tags t ON t.id = et.tag_id
+				WHERE et.event_id = e.id AND t.name = ANY($%d))`, len(args))
+		}
+	}
+	if !f.DateStart.IsZero() {
+		args = append(args, f.DateStart)
+		where += fmt.Sprintf(" AND e.date_and_time >= $%d", len(args))
+	}
+	if !f.DateEnd.IsZero() {
+		args = append(args, f.DateEnd)
+		where += fmt.Sprintf(" AND e.date_and_time <= $%d", len(args))
+	}
+
+	return from + where, args
+}
+
+// likeEscaper escapes the wildcards of LIKE patterns, so they
+// are matched literally
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+func escapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
+
+// DefaultEventSort is the order events are listed in when no
+// other one is asked for
+const DefaultEventSort = "date_and_time"
+
+// RelevanceSort orders searches by how well the events match
+const RelevanceSort = "relevance"
+
+// DistanceSort orders events by how close their venue is to the
+// point they are searched near
+const DistanceSort = "distance"
+
+// eventSort is an expression events can be ordered by
+type eventSort struct {
+	expression string
+	// sqlType is the type of the expression, used to read back
+	// the values stored in cursors
+	sqlType string
+}
+
+// eventSorts maps the keys events can be sorted by to the
+// expressions they are ordered by
+var eventSorts = map[string]eventSort{
+	"date_and_time": {"e.date_and_time", "timestamptz"},
+	"title":         {"LOWER(e.title)", "text"},
+	"created_at":    {"e.created_at", "timestamptz"},
+	// Popular events are the ones with the most active sign ups
+	"popularity": {"(SELECT COUNT(*) FROM user_events p WHERE p.event_id = e.id AND p.status <> 'cancelled')", "bigint"},
+	// Only available when searching, see EventFilter.clauses
+	RelevanceSort: {"ts_rank(e.search_vector, query)", "real"},
+	// Only available when searching near a point
+	DistanceSort: {"distance.km", "double precision"},
+}
+
+// IsEventSort tells whether the events matching the filter can be
+// sorted by the given key, which may be prefixed with "-" for
+// descending order. Sorting by relevance is only possible when
+// searching, and by distance when searching near a point
+func IsEventSort(sort string, filter EventFilter) bool {
+	key := strings.TrimPrefix(sort, "-")
+	switch key {
+	case RelevanceSort:
+		return filter.Query != ""
+	case DistanceSort:
+		return filter.Near != nil
+	}
+	_, ok := eventSorts[key]
+	return ok
+}
+
+// parseEventSort returns the expression and direction of the sort
+// key, falling back to the default sort for unknown keys
+func parseEventSort(sort string) (eventSort, string) {
+	direction := "ASC"
+	if strings.HasPrefix(sort, "-") {
+		direction = "DESC"
+		sort = sort[1:]
+	}
+	s, ok := eventSorts[sort]
+	if !ok {
+		s = eventSorts[DefaultEventSort]
+	}
+	return s, direction
+}
+
+// eventOrder returns the ORDER BY clause for the sort key. The event
+// id breaks ties, so paginated results don't skip or repeat events
+func eventOrder(sort string) string {
+	s, direction := parseEventSort(sort)
+	return fmt.Sprintf(" ORDER BY %s %s, e.id %s", s.expression, direction, direction)
+}
+
+// escapeHTML returns the expression for the text with its HTML
+// special characters escaped. Highlights escape the text before adding
+// their <mark> tags, as they're meant to be shown as HTML
+func escapeHTML(text string) string {
+	return `replace(replace(replace(replace(` + text + `, '&', '&amp;'), '<', '&lt;'), '>', '&gt;'), '"', '&quot;')`
+}
+
+// columns returns the columns selected for the events matching the
+// filter. Searches also get their ranking and highlights, and
+// searches near a point the distance to the venue
+func (f EventFilter) columns() string {
+	columns := eventColumns
+	if f.Query != "" {
+		columns += `, ts_rank(e.search_vector, query),
+			ts_headline(` + searchConfig + `, ` + escapeHTML("e.title") + `, query, 'HighlightAll=true, StartSel=<mark>, StopSel=</mark>'),
+			ts_headline(` + searchConfig + `, ` + escapeHTML("e.short_description || ' ' || e.long_description") + `, query,
+				'StartSel=<mark>, StopSel=</mark>, MinWords=10, MaxWords=30, MaxFragments=2')`
 	}
-	if title != "" {
-		query += fmt.Sprintf(" AND title LIKE $%d", argCounter)
-		args = append(args, "%"+title+"%")
-		argCounter++
+	if f.Near != nil {
+		columns += ", distance.km"
 	}
-	if !dateStart.IsZero() {
-		query += fmt.Sprintf(" AND date_and_time >= $%d", argCounter)
-		args = append(args, dateStart)
-		argCounter++
+	return columns
+}
+
+// scan reads a row selected with the filter's columns. Any extra
+// destinations are scanned from the columns that follow
+func (f EventFilter) scan(s scanner, event *models.Event, extra ...interface{}) error {
+	if f.Near != nil {
+		extra = append([]interface{}{&event.DistanceKm}, extra...)
 	}
-	if !dateEnd.IsZero() {
-		query += fmt.Sprintf(" AND date_and_time <= $%d", argCounter)
-		args = append(args, dateEnd)
-		argCounter++
+	if f.Query != "" {
+		event.Search = &models.SearchMatch{}
+		extra = append([]interface{}{&event.Search.Rank, &event.Search.Title, &event.Search.Snippet}, extra...)
 	}
+	return scanEvent(s, event, extra...)
+}
+
+// GetAll returns a page of the events matching the filter
+func (e *EventRepository) GetAll(filter EventFilter, sort string, limit, offset int) ([]models.Event, error) {
+	clauses, args := filter.clauses()
+	query := `SELECT ` + filter.columns() + clauses + eventOrder(sort)
 
 	// Append LIMIT and OFFSET for pagination
-	query += fmt.Sprintf(" LIMIT $%d OFFSET $%d", argCounter, argCounter+1)
+	query += fmt.Sprintf(" LIMIT $%d OFFSET $%d", len(args)+1, len(args)+2)
 	args = append(args, limit, offset)
-	argCounter += 2
 
 	rows, err := e.DB.Query(query, args...)
 	if err != nil {
@@ -138,17 +627,7 @@ func (e *EventRepository) GetAll(dateStart, dateEnd time.Time, status string, ti
 	var events []models.Event
 	for rows.Next() {
 		var event models.Event
-		err := rows.Scan(
-			&event.Id,
-			&event.Title,
-			&event.LongDescription,
-			&event.ShortDescription,
-			&event.DateAndTime,
-			&event.Organizer,
-			&event.Location,
-			&event.Status,
-		)
-		if err != nil {
+		if err := filter.scan(rows, &event); err != nil {
 			return nil, err
 		}
 		events = append(events, event)
@@ -162,34 +641,44 @@ func (e *EventRepository) GetAll(dateStart, dateEnd time.Time, status string, ti
 	return events, nil
 }
 
-func (e *EventRepository) GetTotalCount(status string, title string, dateStart, dateEnd time.Time) (int, error) {
-	// Apply the same filtering conditions as in GetAll
-	query := `SELECT COUNT(*) FROM events WHERE 1=1`
-
-	args := []interface{}{}
-	argCounter := 1
+// GetPage returns the events matching the filter that come after
+// the cursor, or before it for cursors pointing backwards. A nil
+// cursor returns the first page
+func (e *EventRepository) GetPage(filter EventFilter, sort string, cursor *Cursor, limit int) (*EventPage, error) {
+	clauses, args := filter.clauses()
+	keyset, args := keysetClauses(sort, cursor, args, limit)
+	query := `SELECT ` + filter.columns() + `, ` + sortValue(sort) + clauses + keyset
 
-	// Add filtering conditions if query parameters are provided
-	if status != "" {
-		query += fmt.Sprintf(" AND status = $%d", argCounter)
-		args = append(args, status)
-		argCounter++
-	}
-	if title != "" {
-		query += fmt.Sprintf(" AND title LIKE $%d", argCounter)
-		args = append(args, "%"+title+"%")
-		argCounter++
+	rows, err := e.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
 	}
-	if !dateStart.IsZero() {
-		query += fmt.Sprintf(" AND date_and_time >= $%d", argCounter)
-		args = append(args, dateStart)
-		argCounter++
+	defer rows.Close()
+
+	var events []models.Event
+	var values []string
+	for rows.Next() {
+		var event models.Event
+		var value string
+		if err := filter.scan(rows, &event, &value); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+		values = append(values, value)
 	}
-	if !dateEnd.IsZero() {
-		query += fmt.Sprintf(" AND date_and_time <= $%d", argCounter)
-		args = append(args, dateEnd)
-		argCounter++
+
+	if err = rows.Err(); err != nil {
+		return nil, err
 	}
+
+	return newEventPage(events, values, sort, cursor, limit), nil
+}
+
+func (e *EventRepository) GetTotalCount(filter EventFilter) (int, error) {
+	// Apply the same filtering conditions as in GetAll
+	clauses, args := filter.clauses()
+	query := `SELECT COUNT(*)` + clauses
+
 	var count int
 	err := e.DB.QueryRow(query, args...).Scan(&count)
 	if err != nil {
@@ -198,6 +687,45 @@ func (e *EventRepository) GetTotalCount(status string, title string, dateStart,
 	return count, nil
 }
 
+// Suggest returns the titles that look the most like the filter's
+// search query, to be offered when the search finds nothing. The
+// rest of the filter still applies
+func (e *EventRepository) Suggest(filter EventFilter, limit int) ([]string, error) {
+	search := filter.Query
+	filter.Query = ""
+	clauses, args := filter.clauses()
+
+	// The <% operator compares the query with the most similar part
+	// of the title, and can use the trigram index
+	args = append(args, search)
+	n := len(args)
+	query := fmt.Sprintf(`SELECT e.title%s AND $%d <%% e.title
+		GROUP BY e.title
+		ORDER BY MAX(word_similarity($%d, e.title)) DESC, e.title
+		LIMIT $%d`, clauses, n, n, n+1)
+	args = append(args, limit)
+
+	rows, err := e.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	suggestions := []string{}
+	for rows.Next() {
+		var title string
+		if err := rows.Scan(&title); err != nil {
+			return nil, err
+		}
+		suggestions = append(suggestions, title)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return suggestions, nil
+}
+
 func (e *EventRepository) Delete(id int64) error {
 	query := `DELETE FROM events WHERE id = $1`
 	result, err := e.DB.Exec(query, id)
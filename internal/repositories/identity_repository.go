@@ -0,0 +1,176 @@
+package repositories
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+	"unicode/utf8"
+
+	"github.com/xtommas/challenge-hetmo/internal/models"
+)
+
+var (
+	// ErrInvalidSSOState is returned for SSO logins that are unknown,
+	// expired or already completed
+	ErrInvalidSSOState = errors.New("invalid sso state")
+	// ErrIdentityLinked is returned when the account at the provider
+	// already belongs to another user
+	ErrIdentityLinked = errors.New("identity linked to another user")
+)
+
+const (
+	// ssoStateTTL is how long users have to log in at the provider
+	ssoStateTTL = 10 * time.Minute
+	// maxUsernameAttempts is how many names a new SSO user tries
+	// before giving up
+	maxUsernameAttempts = 5
+)
+
+// SSOState is an SSO login waiting for the provider to send the user
+// back
+type SSOState struct {
+	Nonce        string
+	CodeVerifier string
+	// User to link the account at the provider to, zero for logins
+	UserID int64
+}
+
+// IdentityRepository stores the accounts of the users at the SSO
+// provider and the SSO logins in progress. Only a hash of each state
+// is stored
+type IdentityRepository struct {
+	DB *sql.DB
+}
+
+// CreateState stores a new SSO login and returns the state that
+// identifies it when the provider sends the user back
+func (r *IdentityRepository) CreateState(state SSOState) (string, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+
+	// Logins that were never completed are dropped along the way
+	query := `DELETE FROM sso_states WHERE expires_at <= NOW()`
+	if _, err := r.DB.Exec(query); err != nil {
+		return "", err
+	}
+
+	var userID sql.NullInt64
+	if state.UserID != 0 {
+		userID = sql.NullInt64{Int64: state.UserID, Valid: true}
+	}
+	query = `INSERT INTO sso_states (state_hash, nonce, code_verifier, user_id, expires_at) VALUES ($1, $2, $3, $4, $5)`
+	if _, err := r.DB.Exec(query, hashToken(token), state.Nonce, state.CodeVerifier, userID, time.Now().Add(ssoStateTTL)); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// UseState returns the SSO login identified by the state, which works
+// only once, or ErrInvalidSSOState if it can't be used
+func (r *IdentityRepository) UseState(token string) (*SSOState, error) {
+	state := &SSOState{}
+	var userID sql.NullInt64
+	query := `
+		DELETE FROM sso_states WHERE state_hash = $1 AND expires_at > NOW()
+		RETURNING nonce, code_verifier, user_id`
+	err := r.DB.QueryRow(query, hashToken(token)).Scan(&state.Nonce, &state.CodeVerifier, &userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrInvalidSSOState
+		}
+		return nil, err
+	}
+	state.UserID = userID.Int64
+	return state, nil
+}
+
+// GetUserID returns the user the account at the provider belongs to,
+// or sql.ErrNoRows if it doesn't belong to anyone yet
+func (r *IdentityRepository) GetUserID(issuer, subject string) (int64, error) {
+	var userID int64
+	query := `SELECT user_id FROM user_identities WHERE issuer = $1 AND subject = $2`
+	err := r.DB.QueryRow(query, issuer, subject).Scan(&userID)
+	return userID, err
+}
+
+// Link gives the account at the provider to the user. It returns
+// ErrIdentityLinked if it belongs to another user
+func (r *IdentityRepository) Link(userID int64, issuer, subject string) error {
+	// Linking the same account again changes nothing
+	query := `
+		INSERT INTO user_identities (user_id, issuer, subject) VALUES ($1, $2, $3)
+		ON CONFLICT (issuer, subject) DO UPDATE SET user_id = EXCLUDED.user_id
+		WHERE user_identities.user_id = EXCLUDED.user_id`
+	result, err := r.DB.Exec(query, userID, issuer, subject)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrIdentityLinked
+	}
+
+	return nil
+}
+
+// Provision creates a user for the account at the provider. If the
+// username is taken, a random suffix is added to it. The user has no
+// password, so it can only log in through the provider. Its email
+// counts as verified, as only verified emails are taken from the
+// provider, unless another user already has it
+func (r *IdentityRepository) Provision(user *models.User, issuer, subject string) error {
+	tx, err := r.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	username := user.Username
+	query := `
+		INSERT INTO users (username, password, display_name, email, email_verified_at)
+		SELECT $1, '', $2, e.email, CASE WHEN e.email <> '' THEN NOW() END
+		FROM (SELECT CASE WHEN EXISTS (SELECT 1 FROM users WHERE LOWER(email) = LOWER($3)) THEN '' ELSE $3 END AS email) e
+		ON CONFLICT (username) DO NOTHING
+		RETURNING id, email, email_verified_at`
+	for attempt := 1; ; attempt++ {
+		err = tx.QueryRow(query, username, user.DisplayName, user.Email).Scan(&user.Id, &user.Email, &user.EmailVerifiedAt)
+		if err == nil {
+			break
+		}
+		if err != sql.ErrNoRows || attempt == maxUsernameAttempts {
+			return err
+		}
+
+		suffix, err := newToken()
+		if err != nil {
+			return err
+		}
+		username = truncate(user.Username, 42) + "-" + suffix[:6]
+	}
+	user.Username = username
+
+	query = `INSERT INTO user_identities (user_id, issuer, subject) VALUES ($1, $2, $3)`
+	if _, err := tx.Exec(query, user.Id, issuer, subject); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// truncate cuts the string to at most n bytes, without splitting a
+// character
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
@@ -0,0 +1,121 @@
+package repositories
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/xtommas/challenge-hetmo/internal/models"
+)
+
+// Kinds of keys failed logins are tracked by
+const (
+	loginKeyUsername = "username"
+	loginKeyIP       = "ip"
+)
+
+// LoginAttemptRepository tracks the recent failed logins per username
+// and per IP address, following models.UsernameLoginPolicy and
+// models.IPLoginPolicy
+type LoginAttemptRepository struct {
+	DB *sql.DB
+}
+
+// BlockedUntil returns until when attempts to log in as the username
+// from the IP address have to wait, or the zero time if they don't
+func (r *LoginAttemptRepository) BlockedUntil(username, ip string) (time.Time, error) {
+	query := `
+		SELECT MAX(GREATEST(blocked_until, locked_until)) FROM login_attempts
+		WHERE (kind = $1 AND value = $2) OR (kind = $3 AND value = $4)`
+	var until sql.NullTime
+	err := r.DB.QueryRow(query, loginKeyUsername, username, loginKeyIP, ip).Scan(&until)
+	if err != nil || !until.Valid || !until.Time.After(time.Now()) {
+		return time.Time{}, err
+	}
+	return until.Time, nil
+}
+
+// RecordFailure counts a failed attempt to log in as the username from
+// the IP address, making the next attempts wait
+func (r *LoginAttemptRepository) RecordFailure(username, ip string) error {
+	tx, err := r.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := recordLoginFailure(tx, loginKeyUsername, username, models.UsernameLoginPolicy); err != nil {
+		return err
+	}
+	if err := recordLoginFailure(tx, loginKeyIP, ip, models.IPLoginPolicy); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// recordLoginFailure counts a failure for the key, forgetting the
+// failures outside of the policy window, and blocks the key for as
+// long as the policy says
+func recordLoginFailure(tx *sql.Tx, kind, value string, policy models.LoginPolicy) error {
+	var failures int
+	query := `
+		INSERT INTO login_attempts (kind, value, failures, last_failure_at) VALUES ($1, $2, 1, NOW())
+		ON CONFLICT (kind, value) DO UPDATE SET
+			failures = CASE WHEN login_attempts.last_failure_at < NOW() - make_interval(secs => $3)
+				THEN 1 ELSE login_attempts.failures + 1 END,
+			last_failure_at = NOW()
+		RETURNING failures`
+	if err := tx.QueryRow(query, kind, value, policy.Window.Seconds()).Scan(&failures); err != nil {
+		return err
+	}
+
+	delay, locked := policy.Delay(failures)
+	if delay == 0 {
+		return nil
+	}
+	query = `UPDATE login_attempts SET blocked_until = NOW() + make_interval(secs => $3) WHERE kind = $1 AND value = $2`
+	if locked {
+		query = `UPDATE login_attempts SET locked_until = NOW() + make_interval(secs => $3) WHERE kind = $1 AND value = $2`
+	}
+	_, err := tx.Exec(query, kind, value, delay.Seconds())
+	return err
+}
+
+// Clear forgets the failed attempts to log in as the username, after
+// a successful login or when an admin lifts the lockout. The failures
+// of the IP addresses are kept, so logging in to an account of their
+// own doesn't let attackers keep trying others
+func (r *LoginAttemptRepository) Clear(username string) error {
+	query := `DELETE FROM login_attempts WHERE kind = $1 AND value = $2`
+	_, err := r.DB.Exec(query, loginKeyUsername, username)
+	return err
+}
+
+// GetLockouts returns the usernames locked out after too many failed
+// logins, the latest failures first
+func (r *LoginAttemptRepository) GetLockouts() ([]models.LoginLockout, error) {
+	query := `
+		SELECT value, failures, last_failure_at, locked_until FROM login_attempts
+		WHERE kind = $1 AND locked_until > NOW()
+		ORDER BY last_failure_at DESC`
+	rows, err := r.DB.Query(query, loginKeyUsername)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lockouts := []models.LoginLockout{}
+	for rows.Next() {
+		var lockout models.LoginLockout
+		if err := rows.Scan(&lockout.Username, &lockout.Failures, &lockout.LastFailureAt, &lockout.LockedUntil); err != nil {
+			return nil, err
+		}
+		lockouts = append(lockouts, lockout)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return lockouts, nil
+}
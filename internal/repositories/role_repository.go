@@ -0,0 +1,129 @@
+package repositories
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/lib/pq"
+	"github.com/xtommas/challenge-hetmo/internal/models"
+)
+
+var (
+	ErrUnknownRole         = errors.New("unknown role")
+	ErrRoleAlreadyAssigned = errors.New("role already assigned to user")
+	ErrRoleNotAssigned     = errors.New("role not assigned to user")
+	// ErrLastAdmin is returned when removing the admin role would
+	// leave no one able to manage the users
+	ErrLastAdmin = errors.New("can't remove the last admin")
+)
+
+type RoleRepository struct {
+	DB *sql.DB
+}
+
+// GetAll returns the roles along with their permissions
+func (r *RoleRepository) GetAll() ([]models.Role, error) {
+	query := `
+		SELECT r.id, r.name, r.description,
+			ARRAY(SELECT rp.permission FROM role_permissions rp WHERE rp.role_id = r.id ORDER BY rp.permission)
+		FROM roles r ORDER BY r.name`
+	rows, err := r.DB.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []models.Role{}
+	for rows.Next() {
+		var role models.Role
+		if err := rows.Scan(&role.Id, &role.Name, &role.Description, pq.Array((*[]string)(&role.Permissions))); err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return roles, nil
+}
+
+// Assign gives the role to the user
+func (r *RoleRepository) Assign(userID int64, role string) error {
+	var roleID int64
+	query := `SELECT id FROM roles WHERE name = $1`
+	if err := r.DB.QueryRow(query, role).Scan(&roleID); err != nil {
+		if err == sql.ErrNoRows {
+			return ErrUnknownRole
+		}
+		return err
+	}
+
+	query = `INSERT INTO user_roles (user_id, role_id) VALUES ($1, $2) ON CONFLICT DO NOTHING`
+	result, err := r.DB.Exec(query, userID, roleID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRoleAlreadyAssigned
+	}
+
+	return nil
+}
+
+// Remove takes the role away from the user. The admin role can't be
+// removed from the last user that has it
+func (r *RoleRepository) Remove(userID int64, role string) error {
+	tx, err := r.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Lock the role so concurrent removals can't both
+	// see another admin left and remove the last two
+	var roleID int64
+	query := `SELECT id FROM roles WHERE name = $1 FOR UPDATE`
+	if err := tx.QueryRow(query, role).Scan(&roleID); err != nil {
+		if err == sql.ErrNoRows {
+			return ErrUnknownRole
+		}
+		return err
+	}
+
+	if role == models.RoleAdmin {
+		var others int
+		// Suspended admins can't log in to take over
+		query = `
+			SELECT COUNT(*) FROM user_roles ur JOIN users u ON u.id = ur.user_id
+			WHERE ur.role_id = $1 AND ur.user_id <> $2 AND u.suspended_at IS NULL AND u.deleted_at IS NULL`
+		if err := tx.QueryRow(query, roleID, userID).Scan(&others); err != nil {
+			return err
+		}
+		if others == 0 {
+			return ErrLastAdmin
+		}
+	}
+
+	query = `DELETE FROM user_roles WHERE user_id = $1 AND role_id = $2`
+	result, err := tx.Exec(query, userID, roleID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRoleNotAssigned
+	}
+
+	return tx.Commit()
+}
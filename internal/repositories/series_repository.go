@@ -0,0 +1,102 @@
+package repositories
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/xtommas/challenge-hetmo/internal/models"
+)
+
+type SeriesRepository struct {
+	DB *sql.DB
+}
+
+// Create stores the series and one event per start time, copying
+// every other field from the template event
+func (r *SeriesRepository) Create(series *models.EventSeries, template models.Event, starts []time.Time) error {
+	tx, err := r.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO event_series (recurrence_rule, starts_at) VALUES ($1, $2) RETURNING id`
+	if err := tx.QueryRow(query, series.RecurrenceRule, series.StartsAt).Scan(&series.Id); err != nil {
+		return err
+	}
+
+	series.Occurrences = make([]models.Event, 0, len(starts))
+	for _, start := range starts {
+		event := template
+		event.DateAndTime = start
+		event.SeriesId = &series.Id
+		if err := insertEvent(tx, &event); err != nil {
+			return err
+		}
+		series.Occurrences = append(series.Occurrences, event)
+	}
+
+	return tx.Commit()
+}
+
+// Get returns the series with its occurrences in chronological order
+func (r *SeriesRepository) Get(id int64) (*models.EventSeries, error) {
+	series := &models.EventSeries{}
+	query := `SELECT id, recurrence_rule, starts_at FROM event_series WHERE id = $1`
+	err := r.DB.QueryRow(query, id).Scan(&series.Id, &series.RecurrenceRule, &series.StartsAt)
+	if err != nil {
+		return nil, err
+	}
+
+	query = `SELECT ` + eventColumns + ` FROM events e WHERE e.series_id = $1 ORDER BY e.date_and_time, e.id`
+	rows, err := r.DB.Query(query, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var event models.Event
+		if err := scanEvent(rows, &event); err != nil {
+			return nil, err
+		}
+		series.Occurrences = append(series.Occurrences, event)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return series, nil
+}
+
+// UpdateOccurrences saves the given occurrences all at once
+func (r *SeriesRepository) UpdateOccurrences(events []models.Event) error {
+	tx, err := r.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for i := range events {
+		if err := updateEvent(tx, &events[i]); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// CancelOccurrences cancels the given occurrences of the series that
+// are still draft or published, and returns how many were cancelled
+func (r *SeriesRepository) CancelOccurrences(seriesID int64, eventIDs []int64) (int64, error) {
+	query := `
+		UPDATE events SET status = 'cancelled', sequence = sequence + 1, updated_at = NOW()
+		WHERE series_id = $1 AND id = ANY($2) AND status IN ('draft', 'published')`
+	result, err := r.DB.Exec(query, seriesID, pq.Array(eventIDs))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,254 @@
+package repositories
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var (
+	// ErrInvalidRefreshToken is returned for refresh tokens that are
+	// unknown, expired or revoked
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	// ErrRefreshTokenReused is returned when a refresh token is used
+	// twice, which revokes its whole family
+	ErrRefreshTokenReused = errors.New("refresh token reused")
+)
+
+// refreshTokenTTL is how long a refresh token can be used for
+const refreshTokenTTL = 30 * 24 * time.Hour
+
+// TokenRepository stores the refresh tokens that renew access tokens,
+// and the access tokens revoked before they expire. Only a hash of
+// each refresh token is stored
+type TokenRepository struct {
+	DB *sql.DB
+}
+
+// Create issues a refresh token for the user along with the access
+// token with the given id. The token joins the given family, or starts
+// a new one if it's empty. It returns ErrInvalidRefreshToken if the
+// family was revoked in the meantime
+func (r *TokenRepository) Create(userID int64, familyID, accessJTI string, accessExpiresAt time.Time) (string, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	if familyID == "" {
+		if familyID, err = newToken(); err != nil {
+			return "", err
+		}
+	}
+
+	query := `
+		INSERT INTO refresh_tokens (user_id, family_id, token_hash, access_jti, access_expires_at, expires_at)
+		SELECT $1::bigint, $2, $3, $4, $5::timestamptz, $6::timestamptz
+		WHERE NOT EXISTS (SELECT 1 FROM refresh_tokens WHERE family_id = $2 AND revoked_at IS NOT NULL)`
+	result, err := r.DB.Exec(query, userID, familyID, hashToken(token), accessJTI, accessExpiresAt, time.Now().Add(refreshTokenTTL))
+	if err != nil {
+		return "", err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return "", err
+	}
+	if rowsAffected == 0 {
+		return "", ErrInvalidRefreshToken
+	}
+
+	return token, nil
+}
+
+// Use marks the refresh token as used and returns its owner and
+// family, so a new token can replace it. Using a token a second time
+// revokes its family, as either the owner or a thief holds a copy
+func (r *TokenRepository) Use(token string) (int64, string, error) {
+	tx, err := r.DB.Begin()
+	if err != nil {
+		return 0, "", err
+	}
+	defer tx.Rollback()
+
+	var (
+		id, userID        int64
+		familyID          string
+		expiresAt         time.Time
+		usedAt, revokedAt sql.NullTime
+	)
+	query := `
+		SELECT id, user_id, family_id, expires_at, used_at, revoked_at
+		FROM refresh_tokens WHERE token_hash = $1
+		FOR UPDATE`
+	err = tx.QueryRow(query, hashToken(token)).Scan(&id, &userID, &familyID, &expiresAt, &usedAt, &revokedAt)
+	if err == sql.ErrNoRows {
+		return 0, "", ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return 0, "", err
+	}
+
+	if revokedAt.Valid || !expiresAt.After(time.Now()) {
+		return 0, "", ErrInvalidRefreshToken
+	}
+	if usedAt.Valid {
+		if err := revokeFamily(tx, familyID); err != nil {
+			return 0, "", err
+		}
+		if err := tx.Commit(); err != nil {
+			return 0, "", err
+		}
+		return 0, "", ErrRefreshTokenReused
+	}
+
+	query = `UPDATE refresh_tokens SET used_at = NOW() WHERE id = $1`
+	if _, err := tx.Exec(query, id); err != nil {
+		return 0, "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, "", err
+	}
+
+	return userID, familyID, nil
+}
+
+// Logout revokes the access token with the given id and, if one is
+// given, the family of the user's refresh token
+func (r *TokenRepository) Logout(userID int64, accessJTI string, accessExpiresAt time.Time, refreshToken string) error {
+	tx, err := r.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := revokeAccessToken(tx, accessJTI, accessExpiresAt); err != nil {
+		return err
+	}
+
+	if refreshToken != "" {
+		var familyID string
+		query := `SELECT family_id FROM refresh_tokens WHERE token_hash = $1 AND user_id = $2`
+		err := tx.QueryRow(query, hashToken(refreshToken), userID).Scan(&familyID)
+		// Unknown tokens have nothing to revoke
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if err == nil {
+			if err := revokeFamily(tx, familyID); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// RevokeUser revokes every refresh token of the user, along with the
+// access tokens issued with them, the user's API keys and calendar
+// feed token, logging the user out everywhere. If keepAccessJTI is
+// set, the session of that access token is kept
+func (r *TokenRepository) RevokeUser(userID int64, keepAccessJTI string) error {
+	tx, err := r.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := revokeUserTokens(tx, userID, keepAccessJTI); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// revokeUserTokens revokes the tokens, API keys and calendar feed
+// token of the user within the transaction, like RevokeUser
+func revokeUserTokens(tx *sql.Tx, userID int64, keepAccessJTI string) error {
+	// The access tokens go first, while the refresh tokens they were
+	// issued with still tell which sessions are active
+	query := `
+		INSERT INTO revoked_access_tokens (jti, expires_at)
+		SELECT access_jti, access_expires_at FROM refresh_tokens
+		WHERE user_id = $1 AND revoked_at IS NULL AND access_expires_at > NOW()
+			AND family_id NOT IN (SELECT family_id FROM refresh_tokens WHERE access_jti = $2)
+		ON CONFLICT (jti) DO NOTHING`
+	if _, err := tx.Exec(query, userID, keepAccessJTI); err != nil {
+		return err
+	}
+
+	query = `
+		UPDATE refresh_tokens SET revoked_at = NOW()
+		WHERE user_id = $1 AND revoked_at IS NULL
+			AND family_id NOT IN (SELECT family_id FROM refresh_tokens WHERE access_jti = $2)`
+	if _, err := tx.Exec(query, userID, keepAccessJTI); err != nil {
+		return err
+	}
+
+	// Otherwise whoever got hold of the account could keep using it
+	// through a key after the password is reset
+	query = `UPDATE api_keys SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL`
+	if _, err := tx.Exec(query, userID); err != nil {
+		return err
+	}
+
+	// The feed token in the URL is a credential as well
+	query = `UPDATE calendar_feed_tokens SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL`
+	_, err := tx.Exec(query, userID)
+	return err
+}
+
+// LoggedInAt returns when the session of the access token with the
+// given id logged in, that is, when the first refresh token of its
+// family was issued
+func (r *TokenRepository) LoggedInAt(accessJTI string) (time.Time, error) {
+	query := `
+		SELECT MIN(f.created_at) FROM refresh_tokens t
+		JOIN refresh_tokens f ON f.family_id = t.family_id
+		WHERE t.access_jti = $1`
+	var loggedInAt sql.NullTime
+	if err := r.DB.QueryRow(query, accessJTI).Scan(&loggedInAt); err != nil {
+		return time.Time{}, err
+	}
+	if !loggedInAt.Valid {
+		return time.Time{}, sql.ErrNoRows
+	}
+	return loggedInAt.Time, nil
+}
+
+// IsRevoked tells whether the access token with the given id was revoked
+func (r *TokenRepository) IsRevoked(accessJTI string) (bool, error) {
+	query := `SELECT EXISTS (SELECT 1 FROM revoked_access_tokens WHERE jti = $1)`
+	var revoked bool
+	err := r.DB.QueryRow(query, accessJTI).Scan(&revoked)
+	return revoked, err
+}
+
+// revokeAccessToken adds the access token to the revoked ones, and
+// forgets the revoked tokens that expired anyway
+func revokeAccessToken(tx *sql.Tx, jti string, expiresAt time.Time) error {
+	query := `DELETE FROM revoked_access_tokens WHERE expires_at <= NOW()`
+	if _, err := tx.Exec(query); err != nil {
+		return err
+	}
+
+	query = `INSERT INTO revoked_access_tokens (jti, expires_at) VALUES ($1, $2) ON CONFLICT (jti) DO NOTHING`
+	_, err := tx.Exec(query, jti, expiresAt)
+	return err
+}
+
+// revokeFamily revokes every refresh token of the family, along with
+// the access tokens issued with them that didn't expire yet
+func revokeFamily(tx *sql.Tx, familyID string) error {
+	query := `UPDATE refresh_tokens SET revoked_at = NOW() WHERE family_id = $1 AND revoked_at IS NULL`
+	if _, err := tx.Exec(query, familyID); err != nil {
+		return err
+	}
+
+	query = `
+		INSERT INTO revoked_access_tokens (jti, expires_at)
+		SELECT access_jti, access_expires_at FROM refresh_tokens
+		WHERE family_id = $1 AND access_expires_at > NOW()
+		ON CONFLICT (jti) DO NOTHING`
+	_, err := tx.Exec(query, familyID)
+	return err
+}
@@ -0,0 +1,239 @@
+package repositories
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	ErrTwoFactorEnabled = errors.New("two-factor authentication already enabled")
+	// ErrInvalidChallenge is returned for MFA challenges that are
+	// unknown, expired, used or failed too many times
+	ErrInvalidChallenge = errors.New("invalid mfa challenge")
+)
+
+const (
+	// mfaChallengeTTL is how long users have to send their second
+	// factor after their password
+	mfaChallengeTTL = 5 * time.Minute
+	// maxChallengeAttempts is how many wrong codes a challenge takes
+	// before the user has to send their password again
+	maxChallengeAttempts = 5
+	recoveryCodeCount    = 10
+)
+
+// TwoFactorRepository stores the TOTP secrets and recovery codes of
+// the users with two-factor authentication, and the logins waiting
+// for their second factor
+type TwoFactorRepository struct {
+	DB *sql.DB
+}
+
+// Setup stores a new secret for the user, replacing one that was set
+// up but never enabled
+func (r *TwoFactorRepository) Setup(userID int64, secret string) error {
+	query := `
+		INSERT INTO user_totp (user_id, secret) VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET secret = EXCLUDED.secret
+		WHERE user_totp.enabled_at IS NULL`
+	result, err := r.DB.Exec(query, userID, secret)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrTwoFactorEnabled
+	}
+
+	return nil
+}
+
+// Get returns the secret of the user and whether two-factor
+// authentication is enabled. It returns sql.ErrNoRows if the user
+// never set it up
+func (r *TwoFactorRepository) Get(userID int64) (string, bool, error) {
+	var secret string
+	var enabled bool
+	query := `SELECT secret, enabled_at IS NOT NULL FROM user_totp WHERE user_id = $1`
+	err := r.DB.QueryRow(query, userID).Scan(&secret, &enabled)
+	return secret, enabled, err
+}
+
+// Enable turns on two-factor authentication for the user, who proved
+// their app works with a code of the given period, and returns their
+// recovery codes. Only hashes of the codes are kept
+func (r *TwoFactorRepository) Enable(userID, step int64) ([]string, error) {
+	tx, err := r.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `UPDATE user_totp SET enabled_at = NOW(), last_used_step = $2 WHERE user_id = $1 AND enabled_at IS NULL`
+	result, err := tx.Exec(query, userID, step)
+	if err != nil {
+		return nil, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if rowsAffected == 0 {
+		return nil, ErrTwoFactorEnabled
+	}
+
+	query = `DELETE FROM recovery_codes WHERE user_id = $1`
+	if _, err := tx.Exec(query, userID); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		if codes[i], err = newRecoveryCode(); err != nil {
+			return nil, err
+		}
+		query = `INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2)`
+		if _, err := tx.Exec(query, userID, hashToken(normalizeRecoveryCode(codes[i]))); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// UseStep records that the user logged in with a code of the given
+// period. It returns false if a code of that period or a later one was
+// already used, so each code works only once
+func (r *TwoFactorRepository) UseStep(userID, step int64) (bool, error) {
+	query := `
+		UPDATE user_totp SET last_used_step = $2
+		WHERE user_id = $1 AND enabled_at IS NOT NULL AND (last_used_step IS NULL OR last_used_step < $2)`
+	result, err := r.DB.Exec(query, userID, step)
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	return rowsAffected > 0, err
+}
+
+// UseRecoveryCode spends one of the user's recovery codes, returning
+// false if it isn't one of them or it was already used
+func (r *TwoFactorRepository) UseRecoveryCode(userID int64, code string) (bool, error) {
+	query := `UPDATE recovery_codes SET used_at = NOW() WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL`
+	result, err := r.DB.Exec(query, userID, hashToken(normalizeRecoveryCode(code)))
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	return rowsAffected > 0, err
+}
+
+// Disable turns off two-factor authentication for the user, forgetting
+// their secret and recovery codes
+func (r *TwoFactorRepository) Disable(userID int64) error {
+	tx, err := r.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, query := range []string{
+		`DELETE FROM user_totp WHERE user_id = $1`,
+		`DELETE FROM recovery_codes WHERE user_id = $1`,
+		`DELETE FROM mfa_challenges WHERE user_id = $1`,
+	} {
+		if _, err := tx.Exec(query, userID); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// CreateChallenge returns a token for the user to send along with
+// their second factor, once their password was checked
+func (r *TwoFactorRepository) CreateChallenge(userID int64) (string, time.Time, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	expiresAt := time.Now().Add(mfaChallengeTTL)
+
+	query := `INSERT INTO mfa_challenges (user_id, token_hash, expires_at) VALUES ($1, $2, $3)`
+	if _, err := r.DB.Exec(query, userID, hashToken(token), expiresAt); err != nil {
+		return "", time.Time{}, err
+	}
+	return token, expiresAt, nil
+}
+
+// CheckChallenge returns the user the challenge token was issued to,
+// or ErrInvalidChallenge if it can't be used
+func (r *TwoFactorRepository) CheckChallenge(token string) (int64, error) {
+	var userID int64
+	query := `
+		SELECT user_id FROM mfa_challenges
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > NOW() AND attempts < $2`
+	err := r.DB.QueryRow(query, hashToken(token), maxChallengeAttempts).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, ErrInvalidChallenge
+	}
+	return userID, err
+}
+
+// FailChallenge counts a wrong code sent with the challenge token
+func (r *TwoFactorRepository) FailChallenge(token string) error {
+	query := `UPDATE mfa_challenges SET attempts = attempts + 1 WHERE token_hash = $1`
+	_, err := r.DB.Exec(query, hashToken(token))
+	return err
+}
+
+// UseChallenge marks the challenge token as used, returning
+// ErrInvalidChallenge if it can't be used anymore
+func (r *TwoFactorRepository) UseChallenge(token string) error {
+	query := `
+		UPDATE mfa_challenges SET used_at = NOW()
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > NOW() AND attempts < $2`
+	result, err := r.DB.Exec(query, hashToken(token), maxChallengeAttempts)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrInvalidChallenge
+	}
+
+	return nil
+}
+
+// newRecoveryCode returns a random recovery code split in groups, such
+// as "abcd-efgh-ijkl-mnop"
+func newRecoveryCode() (string, error) {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	code := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+	return code[0:4] + "-" + code[4:8] + "-" + code[8:12] + "-" + code[12:16], nil
+}
+
+// normalizeRecoveryCode drops what users may add or change when
+// typing a recovery code
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
@@ -0,0 +1,87 @@
+package repositories
+
+import (
+	"sync"
+	"time"
+
+	"github.com/xtommas/challenge-hetmo/internal/models"
+)
+
+// UserCache keeps the users read by id for a short time, so checking
+// who makes each request doesn't always hit the database. Changes
+// made elsewhere show up once the entries expire
+type UserCache struct {
+	repo *UserRepository
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	entries map[int64]userCacheEntry
+	// misses counts the reads from the database, to know when to
+	// drop the expired entries
+	misses int
+	// forgotten counts the calls to Forget, so users read before one
+	// of them aren't cached after it
+	forgotten int
+}
+
+type userCacheEntry struct {
+	user      models.User
+	expiresAt time.Time
+}
+
+// NewUserCache returns a cache that keeps users for the given time
+func NewUserCache(repo *UserRepository, ttl time.Duration) *UserCache {
+	return &UserCache{repo: repo, ttl: ttl, entries: map[int64]userCacheEntry{}}
+}
+
+// Get returns the user with the given id, reading it from the
+// database when it isn't cached or its entry expired
+func (c *UserCache) Get(id int64) (*models.User, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[id]
+	forgotten := c.forgotten
+	c.mu.Unlock()
+	if ok && time.Now().Before(entry.expiresAt) {
+		// Callers get a copy they are free to change
+		user := entry.user
+		return &user, nil
+	}
+
+	user, err := c.repo.GetByID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	// Drop the expired entries now and then so the map doesn't
+	// keep every user that ever made a request
+	c.misses++
+	if c.misses%256 == 0 {
+		c.removeExpired()
+	}
+	if c.forgotten == forgotten {
+		c.entries[id] = userCacheEntry{user: *user, expiresAt: time.Now().Add(c.ttl)}
+	}
+	c.mu.Unlock()
+
+	return user, nil
+}
+
+// Forget removes the user from the cache, so changes to it apply to
+// the next request
+func (c *UserCache) Forget(id int64) {
+	c.mu.Lock()
+	delete(c.entries, id)
+	c.forgotten++
+	c.mu.Unlock()
+}
+
+// removeExpired deletes the expired entries. The lock must be held
+func (c *UserCache) removeExpired() {
+	now := time.Now()
+	for id, entry := range c.entries {
+		if !now.Before(entry.expiresAt) {
+			delete(c.entries, id)
+		}
+	}
+}
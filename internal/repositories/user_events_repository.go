@@ -8,22 +8,122 @@ import (
 	"github.com/xtommas/challenge-hetmo/internal/models"
 )
 
+var (
+	ErrSignUpNotAllowed = errors.New("can't sign up to event")
+	ErrAlreadySignedUp  = errors.New("already signed up to event")
+	ErrEventFull        = errors.New("event is full")
+	ErrSignUpNotFound   = errors.New("not signed up to event")
+	// ErrCancellationClosed is returned when the event is too close
+	// (or already happened) for the sign up to be cancelled
+	ErrCancellationClosed = errors.New("cancellations are closed for this event")
+)
+
 type UserEventRepository struct {
 	DB *sql.DB
 }
 
-func (r *UserEventRepository) CreateSignUp(userID, eventID int64) error {
-	// Ensure the event is published and the date is in the future
-	// 'WHERE EXISTS' makes the insert only occur if the conditions are met
+// CreateSignUp signs the user up to the event and returns the status of
+// the sign up. Once the event is full, new sign ups go to the waitlist,
+// or are refused if the event doesn't have one
+func (r *UserEventRepository) CreateSignUp(userID, eventID int64) (string, error) {
+	tx, err := r.DB.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	// Ensure the event is published and the date is in the future.
+	// 'FOR UPDATE' locks the event row until the transaction ends, so
+	// concurrent sign ups to the same event see each other's seats
+	var capacity sql.NullInt64
+	var waitlistEnabled bool
 	query := `
-		INSERT INTO user_events (user_id, event_id)
-		SELECT $1, $2
-		WHERE EXISTS (
-			SELECT 1 FROM events
-			WHERE id = $2 AND status = 'published' AND date_and_time > $3
-		)`
+		SELECT capacity, waitlist_enabled FROM events
+		WHERE id = $1 AND status = 'published' AND date_and_time > $2
+		FOR UPDATE`
+	err = tx.QueryRow(query, eventID, time.Now()).Scan(&capacity, &waitlistEnabled)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", ErrSignUpNotAllowed
+		}
+		return "", err
+	}
+
+	status := models.SignUpConfirmed
+	if capacity.Valid {
+		var taken int64
+		query = `SELECT COUNT(*) FROM user_events WHERE event_id = $1 AND status = 'confirmed'`
+		if err := tx.QueryRow(query, eventID).Scan(&taken); err != nil {
+			return "", err
+		}
+		if taken >= capacity.Int64 {
+			if !waitlistEnabled {
+				return "", ErrEventFull
+			}
+			status = models.SignUpWaitlisted
+		}
+	}
 
-	result, err := r.DB.Exec(query, userID, eventID, time.Now())
+	// Users that cancelled can sign up again, but they
+	// go to the back of the waitlist
+	query = `
+		INSERT INTO user_events (user_id, event_id, status)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id, event_id) DO UPDATE
+		SET status = EXCLUDED.status, created_at = NOW(), cancelled_at = NULL, cancellation_reason = NULL
+		WHERE user_events.status = 'cancelled'`
+	result, err := tx.Exec(query, userID, eventID, status)
+	if err != nil {
+		return "", err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return "", err
+	}
+
+	if rowsAffected == 0 {
+		return "", ErrAlreadySignedUp
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+
+	return status, nil
+}
+
+// CancelSignUp cancels the user's sign up to the event, keeping a record
+// of when and why it happened. Sign ups can't be cancelled once the event
+// is less than cutoff away. If the user had a seat, it's given to the
+// first user in the waitlist
+func (r *UserEventRepository) CancelSignUp(userID, eventID int64, reason string, cutoff time.Duration) error {
+	tx, err := r.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Lock the event so the freed seat can't be taken
+	// by a concurrent sign up before we promote someone
+	var dateAndTime time.Time
+	query := `SELECT date_and_time FROM events WHERE id = $1 FOR UPDATE`
+	if err := tx.QueryRow(query, eventID).Scan(&dateAndTime); err != nil {
+		if err == sql.ErrNoRows {
+			return ErrSignUpNotFound
+		}
+		return err
+	}
+
+	if time.Until(dateAndTime) < cutoff {
+		return ErrCancellationClosed
+	}
+
+	query = `
+		UPDATE user_events
+		SET status = 'cancelled', cancelled_at = NOW(), cancellation_reason = $3
+		WHERE user_id = $1 AND event_id = $2 AND status <> 'cancelled'`
+	result, err := tx.Exec(query, userID, eventID, sql.NullString{String: reason, Valid: reason != ""})
 	if err != nil {
 		return err
 	}
@@ -34,27 +134,63 @@ func (r *UserEventRepository) CreateSignUp(userID, eventID int64) error {
 	}
 
 	if rowsAffected == 0 {
-		return errors.New("can't sign up to event")
+		return ErrSignUpNotFound
 	}
 
-	return nil
+	if err := fillFromWaitlist(tx, eventID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
-func (r *UserEventRepository) GetTotalCount(userID int64, filter string) (int, error) {
+// fillFromWaitlist confirms the earliest waitlisted sign ups of the
+// event until it's full again. Callers must hold a lock on the event
+// row so concurrent calls can't hand out the same seat twice
+func fillFromWaitlist(tx *sql.Tx, eventID int64) error {
+	// LIMIT NULL means no limit, which is what we want
+	// when the event has no capacity
 	query := `
-			SELECT COUNT(*) FROM events e
-			JOIN user_events ue ON e.id = ue.event_id
-			WHERE ue.user_id = $1
-			`
-	args := []interface{}{userID}
+		UPDATE user_events SET status = 'confirmed'
+		WHERE event_id = $1 AND user_id IN (
+			SELECT user_id FROM user_events
+			WHERE event_id = $1 AND status = 'waitlisted'
+			ORDER BY created_at, user_id
+			LIMIT (
+				SELECT CASE WHEN e.capacity IS NULL THEN NULL
+					ELSE GREATEST(e.capacity - COUNT(ue.user_id), 0) END
+				FROM events e
+				LEFT JOIN user_events ue ON ue.event_id = e.id AND ue.status = 'confirmed'
+				WHERE e.id = $1
+				GROUP BY e.id
+			)
+		)`
+	_, err := tx.Exec(query, eventID)
+	return err
+}
+
+// userEventsClauses returns the FROM and WHERE clauses that select
+// the events the user is signed up to, along with their arguments
+func userEventsClauses(userID int64, filter string) (string, []interface{}) {
+	clauses := `
+              FROM events e
+              JOIN user_events ue ON e.id = ue.event_id
+              WHERE ue.user_id = $1 AND ue.status <> 'cancelled'`
 
 	// Apply filter
 	if filter == "upcoming" {
-		query += ` AND e.date_and_time > NOW()`
+		clauses += ` AND e.date_and_time > NOW()`
 	} else if filter == "past" {
-		query += ` AND e.date_and_time <= NOW()`
+		clauses += ` AND e.date_and_time <= NOW()`
 	}
 
+	return clauses, []interface{}{userID}
+}
+
+func (r *UserEventRepository) GetTotalCount(userID int64, filter string) (int, error) {
+	clauses, args := userEventsClauses(userID, filter)
+	query := `SELECT COUNT(*)` + clauses
+
 	var count int
 	if err := r.DB.QueryRow(query, args...).Scan(&count); err != nil {
 		return 0, err
@@ -63,20 +199,40 @@ func (r *UserEventRepository) GetTotalCount(userID int64, filter string) (int, e
 	return count, nil
 }
 
-func (r *UserEventRepository) GetAll(userID int64, filter string, limit, offset int) ([]models.Event, error) {
-	query := `SELECT e.id, e.title, e.long_description, e.short_description, e.date_and_time, e.organizer, e.location, e.status
-              FROM events e
-              JOIN user_events ue ON e.id = ue.event_id
-              WHERE ue.user_id = $1`
+func (r *UserEventRepository) GetAll(userID int64, filter, sort string, limit, offset int) ([]models.Event, error) {
+	clauses, args := userEventsClauses(userID, filter)
+	query := `SELECT ` + eventColumns + clauses + eventOrder(sort) + ` LIMIT $2 OFFSET $3`
+	args = append(args, limit, offset)
 
-	if filter == "upcoming" {
-		query += ` AND e.date_and_time > NOW()`
-	} else if filter == "past" {
-		query += ` AND e.date_and_time <= NOW()`
+	rows, err := r.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []models.Event
+	for rows.Next() {
+		var event models.Event
+		if err := scanEvent(rows, &event); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
 	}
 
-	query += ` LIMIT $2 OFFSET $3`
-	args := []interface{}{userID, limit, offset}
+	return events, nil
+}
+
+// GetPage returns the events the user is signed up to that come
+// after the cursor, or before it for cursors pointing backwards. A
+// nil cursor returns the first page
+func (r *UserEventRepository) GetPage(userID int64, filter, sort string, cursor *Cursor, limit int) (*EventPage, error) {
+	clauses, args := userEventsClauses(userID, filter)
+	keyset, args := keysetClauses(sort, cursor, args, limit)
+	query := `SELECT ` + eventColumns + `, ` + sortValue(sort) + clauses + keyset
 
 	rows, err := r.DB.Query(query, args...)
 	if err != nil {
@@ -85,27 +241,69 @@ func (r *UserEventRepository) GetAll(userID int64, filter string, limit, offset
 	defer rows.Close()
 
 	var events []models.Event
+	var values []string
 	for rows.Next() {
 		var event models.Event
-		err := rows.Scan(
-			&event.Id,
-			&event.Title,
-			&event.LongDescription,
-			&event.ShortDescription,
-			&event.DateAndTime,
-			&event.Organizer,
-			&event.Location,
-			&event.Status,
-		)
-		if err != nil {
+		var value string
+		if err := scanEvent(rows, &event, &value); err != nil {
 			return nil, err
 		}
 		events = append(events, event)
+		values = append(values, value)
 	}
 
 	if err = rows.Err(); err != nil {
 		return nil, err
 	}
 
-	return events, nil
+	return newEventPage(events, values, sort, cursor, limit), nil
+}
+
+// CheckIn marks the user as present at the event. Only users with a
+// seat can be checked in, and checking them in again keeps the time
+// of the first check in
+func (r *UserEventRepository) CheckIn(userID, eventID int64) (time.Time, error) {
+	query := `
+		UPDATE user_events SET checked_in_at = COALESCE(checked_in_at, NOW())
+		WHERE user_id = $1 AND event_id = $2 AND status = 'confirmed'
+		RETURNING checked_in_at`
+	var checkedInAt time.Time
+	err := r.DB.QueryRow(query, userID, eventID).Scan(&checkedInAt)
+	if err == sql.ErrNoRows {
+		return time.Time{}, ErrSignUpNotFound
+	}
+	return checkedInAt, err
+}
+
+// GetSignUps returns every sign up of the user, cancelled ones
+// included, with the most recent events first
+func (r *UserEventRepository) GetSignUps(userID int64) ([]models.UserSignUp, error) {
+	query := `
+		SELECT e.id, e.title, e.date_and_time, ue.status, ue.created_at, ue.cancelled_at, ue.checked_in_at
+		FROM user_events ue
+		JOIN events e ON e.id = ue.event_id
+		WHERE ue.user_id = $1
+		ORDER BY e.date_and_time DESC, e.id`
+	rows, err := r.DB.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	signUps := []models.UserSignUp{}
+	for rows.Next() {
+		var signUp models.UserSignUp
+		err := rows.Scan(&signUp.EventId, &signUp.Title, &signUp.DateAndTime, &signUp.Status,
+			&signUp.CreatedAt, &signUp.CancelledAt, &signUp.CheckedInAt)
+		if err != nil {
+			return nil, err
+		}
+		signUps = append(signUps, signUp)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return signUps, nil
 }
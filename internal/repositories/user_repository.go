@@ -2,23 +2,112 @@ package repositories
 
 import (
 	"database/sql"
+	"errors"
+	"fmt"
+	"time"
 
+	"github.com/lib/pq"
 	"github.com/xtommas/challenge-hetmo/internal/models"
 )
 
+// userColumns are the columns read by scanUser, along with the roles
+// of the user and the permissions they grant
+const userColumns = `id, username, password, suspended_at, password_reset_required,
+	display_name, email, email_verified_at, avatar_url, locale, timezone, deleted_at,
+	EXISTS (SELECT 1 FROM user_totp t WHERE t.user_id = users.id AND t.enabled_at IS NOT NULL),
+	ARRAY(SELECT r.name FROM user_roles ur JOIN roles r ON r.id = ur.role_id
+		WHERE ur.user_id = users.id ORDER BY r.name),
+	ARRAY(SELECT DISTINCT rp.permission FROM user_roles ur JOIN role_permissions rp ON rp.role_id = ur.role_id
+		WHERE ur.user_id = users.id ORDER BY rp.permission)`
+
+func scanUser(s scanner, user *models.User) error {
+	return s.Scan(&user.Id, &user.Username, &user.Password, &user.SuspendedAt, &user.PasswordResetRequired,
+		&user.DisplayName, &user.Email, &user.EmailVerifiedAt, &user.AvatarURL, &user.Locale, &user.Timezone, &user.DeletedAt, &user.TwoFactorEnabled,
+		pq.Array(&user.Roles), pq.Array((*[]string)(&user.Permissions)))
+}
+
+// ErrInvalidResetToken is returned for password reset tokens that are
+// unknown, expired or already used
+var ErrInvalidResetToken = errors.New("invalid password reset token")
+
+// ErrEmailTaken is returned when another user has the email
+var ErrEmailTaken = errors.New("email already in use")
+
+// ErrUsernameTaken is returned when another user has the username
+var ErrUsernameTaken = errors.New("username already in use")
+
+// ErrInvalidVerificationToken is returned for email verification
+// tokens that are unknown, expired, already used or sent to an email
+// the user no longer has
+var ErrInvalidVerificationToken = errors.New("invalid email verification token")
+
+// emailVerificationTTL is how long email verification tokens can be
+// used for
+const emailVerificationTTL = 24 * time.Hour
+
+// How long password reset tokens can be used for. Tokens sent by email
+// for forgotten passwords are shorter lived, as mailboxes leak more
+// easily than the channel admins use to hand over their tokens
+const (
+	forcedPasswordResetTTL    = 24 * time.Hour
+	forgottenPasswordResetTTL = time.Hour
+)
+
+// UserFilter narrows down the users listed to admins
+type UserFilter struct {
+	// Part of the username, matched ignoring case
+	Search string
+	// Name of a role the users must have
+	Role string
+}
+
+// clauses returns the FROM and WHERE clauses that select the users
+// matching the filter, along with their arguments
+func (f UserFilter) clauses() (string, []interface{}) {
+	clauses := ` FROM users WHERE TRUE`
+	var args []interface{}
+	if f.Search != "" {
+		args = append(args, "%"+escapeLike(f.Search)+"%")
+		clauses += fmt.Sprintf(" AND username ILIKE $%d", len(args))
+	}
+	if f.Role != "" {
+		args = append(args, f.Role)
+		clauses += fmt.Sprintf(` AND EXISTS (SELECT 1 FROM user_roles ur JOIN roles r ON r.id = ur.role_id
+			WHERE ur.user_id = users.id AND r.name = $%d)`, len(args))
+	}
+	return clauses, args
+}
+
 type UserRepository struct {
 	DB *sql.DB
 }
 
+// Create stores the user along with its roles. It returns
+// ErrUsernameTaken or ErrEmailTaken if another user has the username
+// or the email
 func (r *UserRepository) Create(user *models.User) error {
-	query := `INSERT INTO users (username, password, is_admin) VALUES ($1, $2, $3) RETURNING id`
-	return r.DB.QueryRow(query, user.Username, user.Password, user.IsAdmin).Scan(&user.Id)
+	query := `
+		WITH new_user AS (
+			INSERT INTO users (username, password, email) VALUES ($1, $2, $3) RETURNING id
+		), granted AS (
+			INSERT INTO user_roles (user_id, role_id)
+			SELECT new_user.id, roles.id FROM new_user, roles WHERE roles.name = ANY($4)
+		)
+		SELECT id FROM new_user`
+	err := r.DB.QueryRow(query, user.Username, user.Password, user.Email, pq.Array(user.Roles)).Scan(&user.Id)
+	if isUsernameViolation(err) {
+		return ErrUsernameTaken
+	}
+	if isEmailViolation(err) {
+		return ErrEmailTaken
+	}
+	return err
 }
 
 func (r *UserRepository) Get(username string) (*models.User, error) {
-	query := `SELECT id, username, password, is_admin FROM users WHERE username = $1`
+	query := `SELECT ` + userColumns + ` FROM users WHERE username = $1`
 	user := &models.User{}
-	err := r.DB.QueryRow(query, username).Scan(&user.Id, &user.Username, &user.Password, &user.IsAdmin)
+	err := scanUser(r.DB.QueryRow(query, username), user)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, err
@@ -28,9 +117,116 @@ func (r *UserRepository) Get(username string) (*models.User, error) {
 	return user, nil
 }
 
-func (r *UserRepository) Update(user *models.User) error {
-	query := `UPDATE users SET is_admin = $1 WHERE id = $2`
-	result, err := r.DB.Exec(query, user.IsAdmin, user.Id)
+// GetByID returns the user with the given id
+func (r *UserRepository) GetByID(id int64) (*models.User, error) {
+	query := `SELECT ` + userColumns + ` FROM users WHERE id = $1`
+	user := &models.User{}
+	err := scanUser(r.DB.QueryRow(query, id), user)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// GetByEmail returns the user with the given email, ignoring case
+func (r *UserRepository) GetByEmail(email string) (*models.User, error) {
+	query := `SELECT ` + userColumns + ` FROM users WHERE LOWER(email) = LOWER($1) AND email <> ''`
+	user := &models.User{}
+	err := scanUser(r.DB.QueryRow(query, email), user)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// UserSort is the only order users are listed in, which their
+// cursors are made for
+const UserSort = "username"
+
+// UserPage is a page of users read with a cursor, along with the
+// cursors of its neighbouring pages. They are nil when there is
+// no such page
+type UserPage struct {
+	Users []models.User
+	Next  *Cursor
+	Prev  *Cursor
+}
+
+// GetPage returns the users matching the filter that come after the
+// cursor, or before it for cursors pointing backwards, sorted by
+// username. A nil cursor returns the first page
+func (r *UserRepository) GetPage(filter UserFilter, cursor *Cursor, limit int) (*UserPage, error) {
+	clauses, args := filter.clauses()
+	keyset, args := keyset("username", "text", "id", "ASC", cursor, args, limit)
+	query := `SELECT ` + userColumns + clauses + keyset
+
+	rows, err := r.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []models.User{}
+	for rows.Next() {
+		var user models.User
+		if err := scanUser(rows, &user); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	more := len(users) > limit
+	if more {
+		users = users[:limit]
+	}
+	ids := make([]int64, len(users))
+	values := make([]string, len(users))
+	for i := range users {
+		ids[i] = users[i].Id
+		values[i] = users[i].Username
+	}
+	if cursor != nil && cursor.Before {
+		for i, j := 0, len(users)-1; i < j; i, j = i+1, j-1 {
+			users[i], users[j] = users[j], users[i]
+		}
+		reversePage(ids, values)
+	}
+
+	page := &UserPage{Users: users}
+	page.Next, page.Prev = pageCursors(ids, values, UserSort, cursor, more)
+	return page, nil
+}
+
+func (r *UserRepository) GetTotalCount(filter UserFilter) (int, error) {
+	clauses, args := filter.clauses()
+	var count int
+	err := r.DB.QueryRow(`SELECT COUNT(*)`+clauses, args...).Scan(&count)
+	return count, err
+}
+
+// SetSuspended suspends the user or lifts their suspension. It returns
+// ErrLastAdmin for the last admin that isn't suspended, as no one
+// would be left to lift the suspension
+func (r *UserRepository) SetSuspended(id int64, suspended bool) error {
+	tx, err := r.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `UPDATE users SET suspended_at = NULL WHERE id = $1`
+	if suspended {
+		if err := checkNotLastAdmin(tx, id); err != nil {
+			return err
+		}
+		// Suspending twice keeps the time of the first suspension
+		query = `UPDATE users SET suspended_at = COALESCE(suspended_at, NOW()) WHERE id = $1`
+	}
+	result, err := tx.Exec(query, id)
 	if err != nil {
 		return err
 	}
@@ -39,10 +235,385 @@ func (r *UserRepository) Update(user *models.User) error {
 	if err != nil {
 		return err
 	}
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return tx.Commit()
+}
+
+// checkNotLastAdmin returns ErrLastAdmin if the user is an admin and
+// no other admin is left that can log in. It locks the admin role like
+// RoleRepository.Remove does, so the last two admins can't both be
+// taken away at once
+func checkNotLastAdmin(tx *sql.Tx, id int64) error {
+	var isAdmin bool
+	var otherAdmins int
+	query := `
+		SELECT COUNT(*) FILTER (WHERE ur.user_id = $2) > 0,
+			COUNT(*) FILTER (WHERE ur.user_id <> $2 AND u.suspended_at IS NULL AND u.deleted_at IS NULL)
+		FROM (SELECT id FROM roles WHERE name = $1 FOR UPDATE) r
+		LEFT JOIN user_roles ur ON ur.role_id = r.id
+		LEFT JOIN users u ON u.id = ur.user_id`
+	if err := tx.QueryRow(query, models.RoleAdmin, id).Scan(&isAdmin, &otherAdmins); err != nil {
+		return err
+	}
+	if isAdmin && otherAdmins == 0 {
+		return ErrLastAdmin
+	}
+	return nil
+}
 
+// RequirePasswordReset keeps the user from logging in until they
+// choose a new password, and returns the token they can do it with.
+// Previous tokens of the user stop working
+func (r *UserRepository) RequirePasswordReset(id int64) (string, time.Time, error) {
+	tx, err := r.DB.Begin()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer tx.Rollback()
+
+	query := `UPDATE users SET password_reset_required = TRUE WHERE id = $1`
+	result, err := tx.Exec(query, id)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if rowsAffected == 0 {
+		return "", time.Time{}, sql.ErrNoRows
+	}
+
+	token, expiresAt, err := createPasswordResetToken(tx, id, true)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", time.Time{}, err
+	}
+
+	return token, expiresAt, nil
+}
+
+// CreatePasswordResetToken returns a token the user can choose a new
+// password with, for users who forgot theirs. Unlike
+// RequirePasswordReset, the user can still log in with their current
+// password. Previous tokens of the user stop working, except the ones
+// RequirePasswordReset gave, which the user may still be waiting for
+func (r *UserRepository) CreatePasswordResetToken(id int64) (string, time.Time, error) {
+	tx, err := r.DB.Begin()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer tx.Rollback()
+
+	token, expiresAt, err := createPasswordResetToken(tx, id, false)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", time.Time{}, err
+	}
+
+	return token, expiresAt, nil
+}
+
+// createPasswordResetToken stores a new password reset token of the
+// user and makes the previous ones unusable. Tokens that weren't forced
+// by an admin leave the forced ones alone, so a user can't drop the
+// token an admin sent them by asking for another one
+func createPasswordResetToken(tx *sql.Tx, userID int64, forced bool) (string, time.Time, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	ttl := forgottenPasswordResetTTL
+	if forced {
+		ttl = forcedPasswordResetTTL
+	}
+	expiresAt := time.Now().Add(ttl)
+
+	query := `UPDATE password_reset_tokens SET used_at = NOW() WHERE user_id = $1 AND used_at IS NULL`
+	if !forced {
+		query += ` AND NOT forced`
+	}
+	if _, err := tx.Exec(query, userID); err != nil {
+		return "", time.Time{}, err
+	}
+
+	query = `INSERT INTO password_reset_tokens (user_id, token_hash, expires_at, forced) VALUES ($1, $2, $3, $4)`
+	if _, err := tx.Exec(query, userID, hashToken(token), expiresAt, forced); err != nil {
+		return "", time.Time{}, err
+	}
+
+	return token, expiresAt, nil
+}
+
+// ResetPassword sets the password hash of the owner of the reset
+// token, which can't be used again, and returns the owner's id
+func (r *UserRepository) ResetPassword(token, password string) (int64, error) {
+	tx, err := r.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var userID int64
+	query := `
+		UPDATE password_reset_tokens SET used_at = NOW()
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > NOW()
+		RETURNING user_id`
+	err = tx.QueryRow(query, hashToken(token)).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, ErrInvalidResetToken
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	query = `UPDATE users SET password = $1, password_reset_required = FALSE WHERE id = $2`
+	if _, err := tx.Exec(query, password, userID); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return userID, nil
+}
+
+// CreateEmailVerificationToken returns a token that verifies the
+// email of the user, to be sent to that email. Previous tokens of the
+// user stop working
+func (r *UserRepository) CreateEmailVerificationToken(id int64, email string) (string, time.Time, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	expiresAt := time.Now().Add(emailVerificationTTL)
+
+	tx, err := r.DB.Begin()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer tx.Rollback()
+
+	query := `UPDATE email_verification_tokens SET used_at = NOW() WHERE user_id = $1 AND used_at IS NULL`
+	if _, err := tx.Exec(query, id); err != nil {
+		return "", time.Time{}, err
+	}
+
+	query = `INSERT INTO email_verification_tokens (user_id, email, token_hash, expires_at) VALUES ($1, $2, $3, $4)`
+	if _, err := tx.Exec(query, id, email, hashToken(token), expiresAt); err != nil {
+		return "", time.Time{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", time.Time{}, err
+	}
+
+	return token, expiresAt, nil
+}
+
+// VerifyEmail marks the email the token was sent to as verified, as
+// long as its owner still has it, and returns the owner's id. The
+// token can't be used again
+func (r *UserRepository) VerifyEmail(token string) (int64, error) {
+	tx, err := r.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var userID int64
+	var email string
+	query := `
+		UPDATE email_verification_tokens SET used_at = NOW()
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > NOW()
+		RETURNING user_id, email`
+	err = tx.QueryRow(query, hashToken(token)).Scan(&userID, &email)
+	if err == sql.ErrNoRows {
+		return 0, ErrInvalidVerificationToken
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	query = `
+		UPDATE users SET email_verified_at = COALESCE(email_verified_at, NOW())
+		WHERE id = $1 AND LOWER(email) = LOWER($2) AND deleted_at IS NULL`
+	result, err := tx.Exec(query, userID, email)
+	if err != nil {
+		return 0, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if rowsAffected == 0 {
+		return 0, ErrInvalidVerificationToken
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return userID, nil
+}
+
+// UpdateProfile saves the profile fields of the user. Changing the
+// email makes it unverified. It returns ErrEmailTaken if another user
+// has the email
+func (r *UserRepository) UpdateProfile(user *models.User) error {
+	query := `
+		UPDATE users SET display_name = $1, email = $2, avatar_url = $3, locale = $4, timezone = $5,
+			email_verified_at = CASE WHEN LOWER(email) = LOWER($2) THEN email_verified_at END
+		WHERE id = $6 AND deleted_at IS NULL`
+	result, err := r.DB.Exec(query, user.DisplayName, user.Email, user.AvatarURL, user.Locale, user.Timezone, user.Id)
+	if isEmailViolation(err) {
+		return ErrEmailTaken
+	}
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// SetPassword replaces the password hash of the user
+func (r *UserRepository) SetPassword(id int64, password string) error {
+	query := `UPDATE users SET password = $1 WHERE id = $2 AND deleted_at IS NULL`
+	result, err := r.DB.Exec(query, password, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
 	if rowsAffected == 0 {
 		return sql.ErrNoRows
 	}
 
 	return nil
 }
+
+// Anonymise deletes the account of the user while keeping its row, so
+// the past sign ups of the user still count towards attendance. The
+// user loses their name, profile, password and roles, is logged out
+// everywhere and gives up their seats at upcoming events. The last
+// admin can't be anonymised
+func (r *UserRepository) Anonymise(id int64) error {
+	// A random name frees the old one and can't be guessed to log in
+	suffix, err := newToken()
+	if err != nil {
+		return err
+	}
+
+	tx, err := r.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := checkNotLastAdmin(tx, id); err != nil {
+		return err
+	}
+
+	// Lock the upcoming events the user has a seat or a spot in the
+	// waitlist for, so their seats go to the waitlist
+	query := `
+		SELECT e.id FROM events e
+		JOIN user_events ue ON ue.event_id = e.id
+		WHERE ue.user_id = $1 AND ue.status <> 'cancelled' AND e.date_and_time > NOW()
+		ORDER BY e.id
+		FOR UPDATE OF e`
+	rows, err := tx.Query(query, id)
+	if err != nil {
+		return err
+	}
+	var eventIDs []int64
+	for rows.Next() {
+		var eventID int64
+		if err := rows.Scan(&eventID); err != nil {
+			rows.Close()
+			return err
+		}
+		eventIDs = append(eventIDs, eventID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if len(eventIDs) > 0 {
+		query = `
+			UPDATE user_events
+			SET status = 'cancelled', cancelled_at = NOW(), cancellation_reason = 'Account deleted'
+			WHERE user_id = $1 AND event_id = ANY($2)`
+		if _, err := tx.Exec(query, id, pq.Array(eventIDs)); err != nil {
+			return err
+		}
+		for _, eventID := range eventIDs {
+			if err := fillFromWaitlist(tx, eventID); err != nil {
+				return err
+			}
+		}
+	}
+
+	// The sessions end along with the account, so they can't outlive it
+	if err := revokeUserTokens(tx, id, ""); err != nil {
+		return err
+	}
+
+	for _, query := range []string{
+		`DELETE FROM user_roles WHERE user_id = $1`,
+		`DELETE FROM calendar_feed_tokens WHERE user_id = $1`,
+		`DELETE FROM password_reset_tokens WHERE user_id = $1`,
+		`DELETE FROM email_verification_tokens WHERE user_id = $1`,
+		`DELETE FROM user_totp WHERE user_id = $1`,
+		`DELETE FROM recovery_codes WHERE user_id = $1`,
+		`DELETE FROM user_identities WHERE user_id = $1`,
+		`DELETE FROM sso_states WHERE user_id = $1`,
+		`DELETE FROM api_keys WHERE user_id = $1`,
+	} {
+		if _, err := tx.Exec(query, id); err != nil {
+			return err
+		}
+	}
+
+	// An empty hash never matches a password
+	query = `
+		UPDATE users SET username = $2, password = '', suspended_at = NULL, password_reset_required = FALSE,
+			display_name = '', email = '', email_verified_at = NULL, avatar_url = '', locale = '', timezone = 'UTC', deleted_at = NOW()
+		WHERE id = $1 AND deleted_at IS NULL`
+	result, err := tx.Exec(query, id, "deleted-"+suffix[:16])
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return tx.Commit()
+}
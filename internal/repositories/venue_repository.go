@@ -0,0 +1,127 @@
+package repositories
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/xtommas/challenge-hetmo/internal/models"
+)
+
+var ErrVenueInUse = errors.New("venue has events")
+
+// venueColumns are the columns read by scanVenue
+const venueColumns = `id, name, address, latitude, longitude, capacity, accessibility_notes, timezone`
+
+func scanVenue(s scanner, venue *models.Venue) error {
+	return s.Scan(
+		&venue.Id,
+		&venue.Name,
+		&venue.Address,
+		&venue.Latitude,
+		&venue.Longitude,
+		&venue.Capacity,
+		&venue.AccessibilityNotes,
+		&venue.Timezone,
+	)
+}
+
+type VenueRepository struct {
+	DB *sql.DB
+}
+
+func (r *VenueRepository) Create(venue *models.Venue) error {
+	query := `
+		INSERT INTO venues (name, address, latitude, longitude, capacity, accessibility_notes, timezone)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id`
+	return r.DB.QueryRow(query,
+		venue.Name,
+		venue.Address,
+		venue.Latitude,
+		venue.Longitude,
+		venue.Capacity,
+		venue.AccessibilityNotes,
+		venue.Timezone).Scan(&venue.Id)
+}
+
+func (r *VenueRepository) GetAll() ([]models.Venue, error) {
+	query := `SELECT ` + venueColumns + ` FROM venues ORDER BY name, id`
+	rows, err := r.DB.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	venues := []models.Venue{}
+	for rows.Next() {
+		var venue models.Venue
+		if err := scanVenue(rows, &venue); err != nil {
+			return nil, err
+		}
+		venues = append(venues, venue)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return venues, nil
+}
+
+func (r *VenueRepository) Get(id int64) (*models.Venue, error) {
+	query := `SELECT ` + venueColumns + ` FROM venues WHERE id = $1`
+	venue := &models.Venue{}
+	if err := scanVenue(r.DB.QueryRow(query, id), venue); err != nil {
+		return nil, err
+	}
+	return venue, nil
+}
+
+func (r *VenueRepository) Update(venue *models.Venue) error {
+	query := `
+		UPDATE venues
+		SET name = $1, address = $2, latitude = $3, longitude = $4, capacity = $5, accessibility_notes = $6, timezone = $7
+		WHERE id = $8`
+	result, err := r.DB.Exec(query,
+		venue.Name,
+		venue.Address,
+		venue.Latitude,
+		venue.Longitude,
+		venue.Capacity,
+		venue.AccessibilityNotes,
+		venue.Timezone,
+		venue.Id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Delete removes the venue. It returns ErrVenueInUse if any event
+// takes place there
+func (r *VenueRepository) Delete(id int64) error {
+	query := `DELETE FROM venues WHERE id = $1`
+	result, err := r.DB.Exec(query, id)
+	if isForeignKeyViolation(err) {
+		return ErrVenueInUse
+	}
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
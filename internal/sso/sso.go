@@ -0,0 +1,163 @@
+// Package sso logs users in with an OpenID Connect provider, using the
+// authorization code flow with PKCE
+package sso
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// ErrNonceMismatch is returned for ID tokens that weren't issued for
+// the login being completed
+var ErrNonceMismatch = errors.New("id token nonce doesn't match")
+
+// Config holds the settings of the provider
+type Config struct {
+	// URL the provider identifies itself with, where its discovery
+	// document is
+	IssuerURL    string
+	ClientID     string
+	ClientSecret string
+	// URL of the callback endpoint of the API
+	RedirectURL string
+	// Claim of the ID token that lists the groups of the user,
+	// "groups" by default
+	GroupsClaim string
+	// Group whose members are admins. When empty, the roles of the
+	// users are managed only in the API
+	AdminGroup string
+}
+
+// Identity is what the provider tells about the user that logged in
+type Identity struct {
+	Issuer  string
+	Subject string
+	// Name the user goes by at the provider, to name new users
+	Username      string
+	Name          string
+	Email         string
+	EmailVerified bool
+	Groups        []string
+}
+
+// InGroup tells whether the user is a member of the group
+func (i *Identity) InGroup(group string) bool {
+	for _, g := range i.Groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+// Provider logs users in with an OpenID Connect provider
+type Provider struct {
+	config   Config
+	oauth2   oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+// NewProvider discovers the endpoints and keys of the provider
+func NewProvider(ctx context.Context, config Config) (*Provider, error) {
+	provider, err := oidc.NewProvider(ctx, config.IssuerURL)
+	if err != nil {
+		return nil, err
+	}
+	if config.GroupsClaim == "" {
+		config.GroupsClaim = "groups"
+	}
+
+	return &Provider{
+		config: config,
+		oauth2: oauth2.Config{
+			ClientID:     config.ClientID,
+			ClientSecret: config.ClientSecret,
+			RedirectURL:  config.RedirectURL,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       []string{oidc.ScopeOpenID, "profile", "email"},
+		},
+		verifier: provider.Verifier(&oidc.Config{ClientID: config.ClientID}),
+	}, nil
+}
+
+// AdminGroup returns the group whose members are admins, if any
+func (p *Provider) AdminGroup() string {
+	return p.config.AdminGroup
+}
+
+// AuthCodeURL returns the URL of the provider where the user logs in.
+// The provider sends the user back to the callback with the state,
+// and the nonce ends up in the ID token. Only the challenge derived
+// from the verifier is sent, the verifier proves later that the code
+// is redeemed by whoever started the login
+func (p *Provider) AuthCodeURL(state, nonce, verifier string) string {
+	return p.oauth2.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier))
+}
+
+// Exchange redeems the code the provider sent to the callback and
+// returns the identity of the user in the verified ID token
+func (p *Provider) Exchange(ctx context.Context, code, verifier, nonce string) (*Identity, error) {
+	token, err := p.oauth2.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return nil, err
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, errors.New("no id token in the token response")
+	}
+	idToken, err := p.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(idToken.Nonce), []byte(nonce)) != 1 {
+		return nil, ErrNonceMismatch
+	}
+
+	var claims struct {
+		PreferredUsername string `json:"preferred_username"`
+		Name              string `json:"name"`
+		Email             string `json:"email"`
+		// Some providers send it as a string
+		EmailVerified interface{} `json:"email_verified"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, err
+	}
+	var rawClaims map[string]interface{}
+	if err := idToken.Claims(&rawClaims); err != nil {
+		return nil, err
+	}
+
+	return &Identity{
+		Issuer:        idToken.Issuer,
+		Subject:       idToken.Subject,
+		Username:      claims.PreferredUsername,
+		Name:          claims.Name,
+		Email:         claims.Email,
+		EmailVerified: claims.EmailVerified == true || claims.EmailVerified == "true",
+		Groups:        groups(rawClaims[p.config.GroupsClaim]),
+	}, nil
+}
+
+// groups reads the groups claim, which providers send as a list or as
+// a single string
+func groups(claim interface{}) []string {
+	switch v := claim.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var groups []string
+		for _, g := range v {
+			if s, ok := g.(string); ok {
+				groups = append(groups, s)
+			}
+		}
+		return groups
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package sso
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xtommas/challenge-hetmo/internal/sso/ssotest"
+	"golang.org/x/oauth2"
+)
+
+func newTestProvider(t *testing.T, server *ssotest.Server) *Provider {
+	provider, err := NewProvider(context.Background(), Config{
+		IssuerURL:    server.URL,
+		ClientID:     ssotest.ClientID,
+		ClientSecret: ssotest.ClientSecret,
+		RedirectURL:  "http://localhost:8080/sso/callback",
+		GroupsClaim:  "roles",
+		AdminGroup:   "event-admins",
+	})
+	assert.NoError(t, err)
+	return provider
+}
+
+func TestExchange(t *testing.T) {
+	server := ssotest.NewServer()
+	defer server.Close()
+	server.SetClaims(map[string]interface{}{
+		"sub":                "user-1",
+		"preferred_username": "jdoe",
+		"email":              "jdoe@example.com",
+		"email_verified":     "true",
+		"roles":              []string{"staff", "event-admins"},
+	})
+	provider := newTestProvider(t, server)
+
+	testCases := []struct {
+		name          string
+		exchangeWith  func(verifier, nonce string) (string, string)
+		expectedError bool
+	}{
+		{
+			name:         "Valid login",
+			exchangeWith: func(verifier, nonce string) (string, string) { return verifier, nonce },
+		},
+		{
+			// Someone who stole the code doesn't know the verifier
+			name:          "Wrong code verifier",
+			exchangeWith:  func(verifier, nonce string) (string, string) { return oauth2.GenerateVerifier(), nonce },
+			expectedError: true,
+		},
+		{
+			name:          "ID token of another login",
+			exchangeWith:  func(verifier, nonce string) (string, string) { return verifier, "other-nonce" },
+			expectedError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			verifier := oauth2.GenerateVerifier()
+			query, err := server.Authorize(provider.AuthCodeURL("state", "nonce", verifier))
+			assert.NoError(t, err)
+			assert.Equal(t, "state", query.Get("state"))
+
+			verifier, nonce := tc.exchangeWith(verifier, "nonce")
+			identity, err := provider.Exchange(context.Background(), query.Get("code"), verifier, nonce)
+			if tc.expectedError {
+				assert.Error(t, err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, server.URL, identity.Issuer)
+			assert.Equal(t, "user-1", identity.Subject)
+			assert.Equal(t, "jdoe", identity.Username)
+			assert.True(t, identity.EmailVerified)
+			assert.True(t, identity.InGroup(provider.AdminGroup()))
+		})
+	}
+}
+
+func TestGroups(t *testing.T) {
+	assert.Equal(t, []string{"admins"}, groups("admins"))
+	assert.Equal(t, []string{"a", "b"}, groups([]interface{}{"a", 1, "b"}))
+	assert.Nil(t, groups(nil))
+}
@@ -0,0 +1,108 @@
+// Package totp implements the time-based one-time passwords of
+// RFC 6238, as generated by authenticator apps
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Codes have Digits digits and change every Period, the defaults that
+// every authenticator app supports
+const (
+	Digits = 6
+	Period = 30 * time.Second
+)
+
+// skew is how many periods before and after the current one are still
+// accepted, since the clocks of phones drift
+const skew = 1
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewSecret returns a random secret, encoded in base32 as
+// authenticator apps expect it
+func NewSecret() (string, error) {
+	// RFC 4226 recommends 160 bits
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return encoding.EncodeToString(b), nil
+}
+
+// Step returns the number of the period the time falls in
+func Step(t time.Time) int64 {
+	return t.Unix() / int64(Period/time.Second)
+}
+
+// Code returns the code of the secret for the given period, as
+// defined by the HOTP algorithm of RFC 4226
+func Code(secret string, step int64) (string, error) {
+	key, err := encoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < Digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", Digits, value%mod), nil
+}
+
+// Validate checks the code against the secret at the given time,
+// returning the period it belongs to. Callers should refuse codes of
+// periods that were already used, so codes can't be replayed
+func Validate(secret, code string, t time.Time) (int64, bool) {
+	if len(code) != Digits {
+		return 0, false
+	}
+	current := Step(t)
+	for step := current - skew; step <= current+skew; step++ {
+		expected, err := Code(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// URI returns the otpauth:// URI that authenticator apps read from QR
+// codes to add the secret
+func URI(issuer, account, secret string) string {
+	u := url.URL{
+		Scheme: "otpauth",
+		Host:   "totp",
+		Path:   "/" + issuer + ":" + account,
+	}
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(Digits))
+	query.Set("period", fmt.Sprint(int(Period/time.Second)))
+	u.RawQuery = query.Encode()
+	return u.String()
+}
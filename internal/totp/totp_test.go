@@ -0,0 +1,72 @@
+package totp
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// rfcSecret is the SHA-1 secret of the test vectors of RFC 6238
+var rfcSecret = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+
+func TestCode(t *testing.T) {
+	// The RFC lists 8 digit codes, these are their last 6 digits
+	testCases := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, tc := range testCases {
+		code, err := Code(rfcSecret, Step(time.Unix(tc.unix, 0)))
+		assert.NoError(t, err)
+		assert.Equal(t, tc.code, code, "time %d", tc.unix)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+
+	step, ok := Validate(rfcSecret, "050471", now)
+	assert.True(t, ok)
+	assert.Equal(t, Step(now), step)
+
+	// Codes of the previous period are still accepted
+	step, ok = Validate(rfcSecret, "050471", now.Add(Period))
+	assert.True(t, ok)
+	assert.Equal(t, Step(now), step)
+
+	// But not older ones
+	_, ok = Validate(rfcSecret, "050471", now.Add(2*Period))
+	assert.False(t, ok)
+
+	_, ok = Validate(rfcSecret, "000000", now)
+	assert.False(t, ok)
+	_, ok = Validate(rfcSecret, "50471", now)
+	assert.False(t, ok)
+}
+
+func TestNewSecret(t *testing.T) {
+	secret, err := NewSecret()
+	assert.NoError(t, err)
+	assert.Len(t, secret, 32)
+
+	_, err = Code(secret, 1)
+	assert.NoError(t, err)
+}
+
+func TestURI(t *testing.T) {
+	uri := URI("Eventos", "ana", "JBSWY3DPEHPK3PXP")
+	assert.True(t, strings.HasPrefix(uri, "otpauth://totp/Eventos:ana?"))
+	assert.Contains(t, uri, "secret=JBSWY3DPEHPK3PXP")
+	assert.Contains(t, uri, "issuer=Eventos")
+}
@@ -1,17 +1,125 @@
 package validator
 
 import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+
 	"github.com/go-playground/validator"
+	"github.com/xtommas/challenge-hetmo/internal/models"
+	"github.com/xtommas/challenge-hetmo/internal/problem"
 )
 
 type CustomValidator struct {
 	validator *validator.Validate
 }
 
+// Validate checks the struct, returning a problem that lists the
+// fields that failed validation
 func (cv *CustomValidator) Validate(i interface{}) error {
-	return cv.validator.Struct(i)
+	err := cv.validator.Struct(i)
+	var fieldErrors validator.ValidationErrors
+	if !errors.As(err, &fieldErrors) {
+		return err
+	}
+
+	p := problem.New(http.StatusBadRequest, problem.CodeValidationFailed, "Some fields are invalid")
+	for _, fe := range fieldErrors {
+		p.Errors = append(p.Errors, problem.FieldError{
+			Field:   fieldName(fe),
+			Code:    fe.Tag(),
+			Message: message(fe),
+		})
+	}
+	return p
 }
 
 func NewCustomValidator() *CustomValidator {
-	return &CustomValidator{validator: validator.New()}
+	v := validator.New()
+	v.RegisterValidation("timezone", isTimezone)
+	v.RegisterValidation("locale", isLocale)
+	v.RegisterValidation("web_url", isWebURL)
+	// Fields are named as in the request body
+	v.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
+	return &CustomValidator{validator: v}
+}
+
+// fieldName returns the path of the field in the request body, such as
+// "tags[2]", leaving out the name of the struct
+func fieldName(fe validator.FieldError) string {
+	_, name, found := strings.Cut(fe.Namespace(), ".")
+	if !found {
+		return fe.Field()
+	}
+	return name
+}
+
+// message describes the rule the field broke for people
+func message(fe validator.FieldError) string {
+	switch fe.Tag() {
+	case "required":
+		return "is required"
+	case "min", "max":
+		bound := "at least"
+		if fe.Tag() == "max" {
+			bound = "at most"
+		}
+		switch fe.Kind() {
+		case reflect.String:
+			return fmt.Sprintf("must be %s %s characters long", bound, fe.Param())
+		case reflect.Slice, reflect.Map, reflect.Array:
+			return fmt.Sprintf("must have %s %s items", bound, fe.Param())
+		}
+		return fmt.Sprintf("must be %s %s", bound, fe.Param())
+	case "gt":
+		if fe.Type() == reflect.TypeOf(time.Time{}) {
+			return "must be in the future"
+		}
+		return fmt.Sprintf("must be greater than %s", fe.Param())
+	case "oneof":
+		return "must be one of " + strings.Join(strings.Fields(fe.Param()), ", ")
+	case "email":
+		return "must be an email address"
+	case "web_url":
+		return "must be an http or https URL"
+	case "timezone":
+		return "must be an IANA time zone, such as America/Argentina/Buenos_Aires"
+	case "locale":
+		return "must be a BCP 47 language tag, such as es-AR"
+	}
+	return "is invalid"
+}
+
+// isTimezone checks that the field is the IANA name of a time zone,
+// such as "America/Argentina/Buenos_Aires"
+func isTimezone(fl validator.FieldLevel) bool {
+	_, err := models.LoadTimezone(fl.Field().String())
+	return err == nil
+}
+
+// isLocale checks that the field is a BCP 47 language tag, such as
+// "es-AR"
+func isLocale(fl validator.FieldLevel) bool {
+	_, err := models.CanonicalLocale(fl.Field().String())
+	return err == nil
+}
+
+// isWebURL checks that the field is an absolute http or https URL, so
+// clients can safely link to it
+func isWebURL(fl validator.FieldLevel) bool {
+	u, err := url.Parse(fl.Field().String())
+	if err != nil {
+		return false
+	}
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
 }
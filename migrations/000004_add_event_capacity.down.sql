@@ -0,0 +1,9 @@
+DROP INDEX IF EXISTS user_events_event_status_idx;
+
+ALTER TABLE user_events
+    DROP COLUMN IF EXISTS created_at,
+    DROP COLUMN IF EXISTS status;
+
+ALTER TABLE events
+    DROP COLUMN IF EXISTS waitlist_enabled,
+    DROP COLUMN IF EXISTS capacity;
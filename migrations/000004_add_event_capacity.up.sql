@@ -0,0 +1,9 @@
+ALTER TABLE events
+    ADD COLUMN IF NOT EXISTS capacity INTEGER CHECK (capacity > 0),
+    ADD COLUMN IF NOT EXISTS waitlist_enabled BOOLEAN NOT NULL DEFAULT TRUE;
+
+ALTER TABLE user_events
+    ADD COLUMN IF NOT EXISTS status VARCHAR(20) NOT NULL DEFAULT 'confirmed',
+    ADD COLUMN IF NOT EXISTS created_at TIMESTAMP NOT NULL DEFAULT NOW();
+
+CREATE INDEX IF NOT EXISTS user_events_event_status_idx ON user_events (event_id, status, created_at);
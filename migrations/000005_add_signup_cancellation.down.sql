@@ -0,0 +1,5 @@
+DELETE FROM user_events WHERE status = 'cancelled';
+
+ALTER TABLE user_events
+    DROP COLUMN IF EXISTS cancellation_reason,
+    DROP COLUMN IF EXISTS cancelled_at;
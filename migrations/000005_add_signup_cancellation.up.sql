@@ -0,0 +1,3 @@
+ALTER TABLE user_events
+    ADD COLUMN IF NOT EXISTS cancelled_at TIMESTAMP,
+    ADD COLUMN IF NOT EXISTS cancellation_reason TEXT;
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS events_series_id_idx;
+
+ALTER TABLE events DROP COLUMN IF EXISTS series_id;
+
+DROP TABLE IF EXISTS event_series;
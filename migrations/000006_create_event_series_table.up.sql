@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS event_series (
+    id BIGSERIAL PRIMARY KEY,
+    recurrence_rule VARCHAR(255) NOT NULL,
+    starts_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+ALTER TABLE events
+    ADD COLUMN IF NOT EXISTS series_id BIGINT REFERENCES event_series(id) ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS events_series_id_idx ON events (series_id, date_and_time);
@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS calendar_feed_tokens;
+
+ALTER TABLE events
+    DROP COLUMN IF EXISTS updated_at,
+    DROP COLUMN IF EXISTS sequence;
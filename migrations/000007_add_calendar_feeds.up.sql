@@ -0,0 +1,13 @@
+ALTER TABLE events
+    ADD COLUMN IF NOT EXISTS sequence INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP NOT NULL DEFAULT NOW();
+
+CREATE TABLE IF NOT EXISTS calendar_feed_tokens (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users(id),
+    token_hash VARCHAR(64) UNIQUE NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    revoked_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS calendar_feed_tokens_user_id_idx ON calendar_feed_tokens (user_id);
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS events_title_trgm_idx;
+DROP INDEX IF EXISTS events_search_vector_idx;
+
+ALTER TABLE events DROP COLUMN IF EXISTS search_vector;
@@ -0,0 +1,15 @@
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+-- The 'simple' configuration doesn't stem words, as events are
+-- written in more than one language
+ALTER TABLE events
+    ADD COLUMN IF NOT EXISTS search_vector TSVECTOR GENERATED ALWAYS AS (
+        setweight(to_tsvector('simple', coalesce(title, '')), 'A') ||
+        setweight(to_tsvector('simple', coalesce(short_description, '')), 'B') ||
+        setweight(to_tsvector('simple', coalesce(organizer, '')), 'B') ||
+        setweight(to_tsvector('simple', coalesce(location, '')), 'B') ||
+        setweight(to_tsvector('simple', coalesce(long_description, '')), 'C')
+    ) STORED;
+
+CREATE INDEX IF NOT EXISTS events_search_vector_idx ON events USING GIN (search_vector);
+CREATE INDEX IF NOT EXISTS events_title_trgm_idx ON events USING GIN (title gin_trgm_ops);
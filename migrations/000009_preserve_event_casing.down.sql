@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS events_location_trgm_idx;
+DROP INDEX IF EXISTS events_organizer_trgm_idx;
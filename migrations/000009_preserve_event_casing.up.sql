@@ -0,0 +1,4 @@
+-- Events are no longer lowercased before being saved. The casing of
+-- the existing rows can't be recovered, so they stay as they are
+CREATE INDEX IF NOT EXISTS events_organizer_trgm_idx ON events USING GIN (organizer gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS events_location_trgm_idx ON events USING GIN (location gin_trgm_ops);
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS events_created_at_id_idx;
+DROP INDEX IF EXISTS events_title_id_idx;
+DROP INDEX IF EXISTS events_date_and_time_id_idx;
+
+ALTER TABLE events DROP COLUMN IF EXISTS created_at;
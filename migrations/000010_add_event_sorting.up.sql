@@ -0,0 +1,7 @@
+-- Existing events get the migration time, their ids keep them in order
+ALTER TABLE events ADD COLUMN IF NOT EXISTS created_at TIMESTAMP NOT NULL DEFAULT NOW();
+
+-- The id is the tiebreaker of every sort
+CREATE INDEX IF NOT EXISTS events_date_and_time_id_idx ON events (date_and_time, id);
+CREATE INDEX IF NOT EXISTS events_title_id_idx ON events (LOWER(title), id);
+CREATE INDEX IF NOT EXISTS events_created_at_id_idx ON events (created_at, id);
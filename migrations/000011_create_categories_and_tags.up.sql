@@ -0,0 +1,26 @@
+CREATE TABLE IF NOT EXISTS categories (
+    id BIGSERIAL PRIMARY KEY,
+    name VARCHAR(50) UNIQUE NOT NULL,
+    slug VARCHAR(50) UNIQUE NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS tags (
+    id BIGSERIAL PRIMARY KEY,
+    name VARCHAR(30) UNIQUE NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS event_categories (
+    event_id BIGINT NOT NULL REFERENCES events(id) ON DELETE CASCADE,
+    category_id BIGINT NOT NULL REFERENCES categories(id) ON DELETE CASCADE,
+    PRIMARY KEY (event_id, category_id)
+);
+
+CREATE TABLE IF NOT EXISTS event_tags (
+    event_id BIGINT NOT NULL REFERENCES events(id) ON DELETE CASCADE,
+    tag_id BIGINT NOT NULL REFERENCES tags(id) ON DELETE CASCADE,
+    PRIMARY KEY (event_id, tag_id)
+);
+
+CREATE INDEX IF NOT EXISTS event_categories_category_id_idx ON event_categories (category_id);
+CREATE INDEX IF NOT EXISTS event_tags_tag_id_idx ON event_tags (tag_id);
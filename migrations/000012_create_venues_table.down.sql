@@ -0,0 +1,3 @@
+ALTER TABLE events DROP COLUMN IF EXISTS venue_id;
+
+DROP TABLE IF EXISTS venues;
@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS venues (
+    id BIGSERIAL PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,
+    address TEXT NOT NULL,
+    latitude DOUBLE PRECISION NOT NULL CHECK (latitude BETWEEN -90 AND 90),
+    longitude DOUBLE PRECISION NOT NULL CHECK (longitude BETWEEN -180 AND 180),
+    capacity INTEGER CHECK (capacity > 0),
+    accessibility_notes TEXT NOT NULL DEFAULT '',
+    timezone VARCHAR(64) NOT NULL DEFAULT 'UTC',
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+-- Used to narrow down the venues before computing distances
+CREATE INDEX IF NOT EXISTS venues_latitude_idx ON venues (latitude);
+
+-- Venues with events can't be deleted
+ALTER TABLE events ADD COLUMN IF NOT EXISTS venue_id BIGINT REFERENCES venues(id);
+
+CREATE INDEX IF NOT EXISTS events_venue_id_idx ON events (venue_id);
@@ -0,0 +1,9 @@
+ALTER TABLE events DROP COLUMN IF EXISTS timezone;
+
+ALTER TABLE event_series
+    ALTER COLUMN starts_at TYPE TIMESTAMP USING starts_at AT TIME ZONE 'UTC';
+
+ALTER TABLE events
+    ALTER COLUMN date_and_time TYPE TIMESTAMP USING date_and_time AT TIME ZONE 'UTC',
+    ALTER COLUMN created_at TYPE TIMESTAMP USING created_at AT TIME ZONE 'UTC',
+    ALTER COLUMN updated_at TYPE TIMESTAMP USING updated_at AT TIME ZONE 'UTC';
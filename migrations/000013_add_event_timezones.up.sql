@@ -0,0 +1,14 @@
+-- Existing times were written as UTC, so they keep the same instant
+ALTER TABLE events
+    ALTER COLUMN date_and_time TYPE TIMESTAMPTZ USING date_and_time AT TIME ZONE 'UTC',
+    ALTER COLUMN created_at TYPE TIMESTAMPTZ USING created_at AT TIME ZONE 'UTC',
+    ALTER COLUMN updated_at TYPE TIMESTAMPTZ USING updated_at AT TIME ZONE 'UTC';
+
+ALTER TABLE event_series
+    ALTER COLUMN starts_at TYPE TIMESTAMPTZ USING starts_at AT TIME ZONE 'UTC';
+
+-- IANA name of the time zone the event is shown in
+ALTER TABLE events ADD COLUMN IF NOT EXISTS timezone VARCHAR(64) NOT NULL DEFAULT 'UTC';
+
+-- Events held at a venue take its time zone
+UPDATE events e SET timezone = v.timezone FROM venues v WHERE v.id = e.venue_id;
@@ -0,0 +1,26 @@
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users(id),
+    -- Tokens that replaced each other share a family, which is
+    -- revoked as a whole when an already used token shows up again
+    family_id VARCHAR(64) NOT NULL,
+    token_hash VARCHAR(64) UNIQUE NOT NULL,
+    -- The access token issued along with the refresh token, so it
+    -- can be revoked with its family
+    access_jti VARCHAR(64) NOT NULL,
+    access_expires_at TIMESTAMPTZ NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    used_at TIMESTAMPTZ,
+    revoked_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS refresh_tokens_family_id_idx ON refresh_tokens (family_id);
+CREATE INDEX IF NOT EXISTS refresh_tokens_user_id_idx ON refresh_tokens (user_id);
+
+-- Access tokens revoked before they expire. Rows are only needed
+-- until then
+CREATE TABLE IF NOT EXISTS revoked_access_tokens (
+    jti VARCHAR(64) PRIMARY KEY,
+    expires_at TIMESTAMPTZ NOT NULL
+);
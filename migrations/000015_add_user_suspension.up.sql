@@ -0,0 +1,2 @@
+-- Suspended users can't log in or use their tokens
+ALTER TABLE users ADD COLUMN IF NOT EXISTS suspended_at TIMESTAMPTZ;
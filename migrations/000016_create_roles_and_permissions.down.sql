@@ -0,0 +1,13 @@
+ALTER TABLE user_events DROP COLUMN IF EXISTS checked_in_at;
+
+ALTER TABLE events DROP COLUMN IF EXISTS created_by;
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS is_admin BOOLEAN NOT NULL DEFAULT FALSE;
+
+UPDATE users SET is_admin = TRUE
+WHERE id IN (SELECT ur.user_id FROM user_roles ur JOIN roles r ON r.id = ur.role_id WHERE r.name = 'admin');
+
+DROP TABLE IF EXISTS user_roles;
+DROP TABLE IF EXISTS role_permissions;
+DROP TABLE IF EXISTS roles;
+DROP TABLE IF EXISTS permissions;
@@ -0,0 +1,67 @@
+CREATE TABLE IF NOT EXISTS permissions (
+    name VARCHAR(64) PRIMARY KEY,
+    description TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS roles (
+    id BIGSERIAL PRIMARY KEY,
+    name VARCHAR(50) UNIQUE NOT NULL,
+    description TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS role_permissions (
+    role_id BIGINT REFERENCES roles(id) ON DELETE CASCADE,
+    permission VARCHAR(64) REFERENCES permissions(name) ON DELETE CASCADE,
+    PRIMARY KEY (role_id, permission)
+);
+
+CREATE TABLE IF NOT EXISTS user_roles (
+    user_id BIGINT REFERENCES users(id) ON DELETE CASCADE,
+    role_id BIGINT REFERENCES roles(id) ON DELETE CASCADE,
+    PRIMARY KEY (user_id, role_id)
+);
+
+INSERT INTO permissions (name, description) VALUES
+    ('events:view_drafts', 'See draft and archived events'),
+    ('events:create', 'Create events and series'),
+    ('events:update', 'Edit and change the status of own events'),
+    ('events:delete', 'Delete own events'),
+    ('events:manage_any', 'Edit, change the status of and delete events created by others'),
+    ('signups:check_in', 'Mark the attendance of signed up users'),
+    ('categories:manage', 'Create, edit and delete categories'),
+    ('venues:manage', 'Create, edit and delete venues'),
+    ('users:manage', 'Assign roles to users')
+ON CONFLICT (name) DO NOTHING;
+
+INSERT INTO roles (name, description) VALUES
+    ('admin', 'Full access'),
+    ('organizer', 'Manages the events they create'),
+    ('staff', 'Checks in attendees'),
+    ('viewer', 'Sees draft events')
+ON CONFLICT (name) DO NOTHING;
+
+INSERT INTO role_permissions (role_id, permission)
+SELECT r.id, p.name FROM roles r, permissions p WHERE r.name = 'admin'
+UNION ALL
+SELECT r.id, p.name FROM roles r, permissions p
+WHERE r.name = 'organizer' AND p.name IN ('events:view_drafts', 'events:create', 'events:update', 'events:delete')
+UNION ALL
+SELECT r.id, 'signups:check_in' FROM roles r WHERE r.name = 'staff'
+UNION ALL
+SELECT r.id, 'events:view_drafts' FROM roles r WHERE r.name = 'viewer'
+ON CONFLICT DO NOTHING;
+
+-- Admins keep their rights through the admin role
+INSERT INTO user_roles (user_id, role_id)
+SELECT u.id, r.id FROM users u, roles r WHERE u.is_admin AND r.name = 'admin'
+ON CONFLICT DO NOTHING;
+
+ALTER TABLE users DROP COLUMN IF EXISTS is_admin;
+
+-- Organizers can only manage the events they created. Events created
+-- before this have no creator, so only admins can manage them
+ALTER TABLE events ADD COLUMN IF NOT EXISTS created_by BIGINT REFERENCES users(id) ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS events_created_by_idx ON events (created_by);
+
+ALTER TABLE user_events ADD COLUMN IF NOT EXISTS checked_in_at TIMESTAMPTZ;
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS password_reset_tokens;
+
+ALTER TABLE users DROP COLUMN IF EXISTS password_reset_required;
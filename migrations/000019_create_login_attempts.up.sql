@@ -0,0 +1,13 @@
+-- Recent failed logins per username and per IP address, which slow
+-- down and then lock out further attempts
+CREATE TABLE IF NOT EXISTS login_attempts (
+    kind VARCHAR(10) NOT NULL,
+    value TEXT NOT NULL,
+    failures INT NOT NULL,
+    last_failure_at TIMESTAMPTZ NOT NULL,
+    -- Set while attempts have to wait, growing with each failure
+    blocked_until TIMESTAMPTZ,
+    -- Set while attempts are locked out after too many failures
+    locked_until TIMESTAMPTZ,
+    PRIMARY KEY (kind, value)
+);
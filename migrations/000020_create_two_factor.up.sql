@@ -0,0 +1,31 @@
+-- TOTP secrets of the users that set up two-factor authentication.
+-- It's only enabled once the user proves their app generates codes
+CREATE TABLE IF NOT EXISTS user_totp (
+    user_id BIGINT PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    secret VARCHAR(64) NOT NULL,
+    enabled_at TIMESTAMPTZ,
+    -- Period of the last code used, so codes can't be replayed
+    last_used_step BIGINT
+);
+
+-- Single use codes to log in without the authenticator app. Only a
+-- hash of each code is stored
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    code_hash VARCHAR(64) NOT NULL,
+    used_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS recovery_codes_user_id_idx ON recovery_codes (user_id);
+
+-- Logins of users with two-factor authentication wait here for the
+-- second factor after the password was checked
+CREATE TABLE IF NOT EXISTS mfa_challenges (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    token_hash VARCHAR(64) UNIQUE NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    attempts INT NOT NULL DEFAULT 0,
+    used_at TIMESTAMPTZ
+);
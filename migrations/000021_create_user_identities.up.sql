@@ -0,0 +1,22 @@
+-- Accounts of the users at the SSO provider, by the issuer and the
+-- subject of their ID tokens
+CREATE TABLE IF NOT EXISTS user_identities (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    issuer TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (issuer, subject)
+);
+
+CREATE INDEX IF NOT EXISTS user_identities_user_id_idx ON user_identities (user_id);
+
+-- SSO logins waiting for the provider to send the user back. Logins
+-- that link an account to the current user keep its id
+CREATE TABLE IF NOT EXISTS sso_states (
+    state_hash VARCHAR(64) PRIMARY KEY,
+    nonce VARCHAR(64) NOT NULL,
+    code_verifier VARCHAR(128) NOT NULL,
+    user_id BIGINT REFERENCES users(id) ON DELETE CASCADE,
+    expires_at TIMESTAMPTZ NOT NULL
+);
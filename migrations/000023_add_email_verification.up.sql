@@ -0,0 +1,38 @@
+-- Emails were free text until now, so accounts may share one. They're
+-- reported rather than dropped, to be sorted out before migrating again
+DO $$
+DECLARE
+    conflicts TEXT;
+BEGIN
+    SELECT string_agg(email || ' (' || usernames || ')', ', ') INTO conflicts
+    FROM (
+        SELECT LOWER(email) AS email, string_agg(username, ', ' ORDER BY id) AS usernames
+        FROM users WHERE email <> ''
+        GROUP BY LOWER(email) HAVING COUNT(*) > 1
+    ) duplicated;
+    IF conflicts IS NOT NULL THEN
+        RAISE EXCEPTION 'Users share emails, give them different ones before migrating: %', conflicts;
+    END IF;
+END $$;
+
+-- Set once the user proved they own their email, and cleared when it
+-- changes
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified_at TIMESTAMPTZ;
+
+-- Emails belong to a single user, ignoring case. Users without an
+-- email have an empty one
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_key ON users (LOWER(email)) WHERE email <> '';
+
+-- Tokens emailed to users to verify their email. The email is kept
+-- so tokens sent before a change can't verify the new email
+CREATE TABLE IF NOT EXISTS email_verification_tokens (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    email VARCHAR(255) NOT NULL,
+    token_hash VARCHAR(64) NOT NULL UNIQUE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS email_verification_tokens_user_id_idx ON email_verification_tokens (user_id);
@@ -0,0 +1 @@
+ALTER TABLE password_reset_tokens DROP COLUMN IF EXISTS forced;
@@ -0,0 +1,3 @@
+-- Tokens given when an admin requires a password reset. Users asking
+-- for a new token because they forgot their password don't void them
+ALTER TABLE password_reset_tokens ADD COLUMN IF NOT EXISTS forced BOOLEAN NOT NULL DEFAULT FALSE;